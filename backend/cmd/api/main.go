@@ -4,6 +4,7 @@ import (
 	"backend/src/api"
 	"backend/src/services"
 	"bufio"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
@@ -36,6 +38,12 @@ import (
 // @securityDefinitions.basic  BasicAuth
 
 func main() {
+	// dnsmasq runs this binary as its dhcp-script, see supervisord.conf
+	if services.IsDHCPScript(os.Getenv) {
+		runDHCPScript(os.Args[1:])
+		return
+	}
+
 	// Get configuration from environment variables
 	namespace := os.Getenv("POD_NAMESPACE")
 	if namespace == "" {
@@ -52,10 +60,18 @@ func main() {
 		apiPort = "8081"
 	}
 
+	// ExternalDNS doesn't send credentials, so its webhook provider is served
+	// on a port of its own, outside of basic auth. 0 disables it.
+	webhookPort := os.Getenv("EXTERNAL_DNS_WEBHOOK_PORT")
+	if webhookPort == "" {
+		webhookPort = "8888"
+	}
+
 	fmt.Printf("INFO: Starting application in namespace: %s\n", namespace)
 	fmt.Printf("INFO: Starting application version: %s\n", api.Version)
 	fmt.Printf("INFO: Web server listening on port: %s\n", webPort)
 	fmt.Printf("INFO: API server listening on port: %s\n", apiPort)
+	fmt.Printf("INFO: ExternalDNS webhook listening on port: %s\n", webhookPort)
 
 	// Create a new Kubernetes clientset.
 	config, err := clientcmd.BuildConfigFromFlags("", "")
@@ -72,7 +88,52 @@ func main() {
 	dhcpService := services.NewDHCPService(clientset, namespace, configService)
 	statusService := services.NewStatusService()
 	supervisorService := services.NewSupervisorService()
-	server := api.NewServer(configService, dhcpService, statusService, supervisorService)
+	if supervisorService.Available() {
+		configService.SetSupervisor(supervisorService)
+		dhcpService.SetSupervisor(supervisorService)
+	}
+	blocklistService := services.NewBlocklistService(clientset, namespace, nil)
+	if supervisorService.Available() {
+		blocklistService.SetSupervisor(supervisorService)
+	}
+	configService.SetBlocklistService(blocklistService)
+	historyService := services.NewHistoryService(clientset, namespace, configService, dhcpService)
+	eventService := services.NewEventService()
+	deviceService := services.NewDeviceService(clientset, namespace, dhcpService, eventService)
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	// Publish DNS records for annotated Services, Ingresses and HTTPRoutes
+	var autoDNSService *services.AutoDNSService
+	if os.Getenv("AUTO_DNS_ENABLED") == "true" {
+		autoDNSService = services.NewAutoDNSService(clientset, dynamicClient)
+		if supervisorService.Available() {
+			autoDNSService.SetSupervisor(supervisorService)
+		}
+	}
+	// Elect the replica serving DHCP and owning writes when several run
+	var clusterService *services.ClusterService
+	if os.Getenv("CLUSTER_ENABLED") == "true" {
+		clusterService = services.NewClusterService(clientset, namespace, configService, dhcpService)
+	}
+	server := api.NewServer(configService, dhcpService, statusService, supervisorService, blocklistService, historyService, eventService, deviceService, autoDNSService, clusterService)
+
+	// Reconcile DNSRecord and DHCPReservation resources, see chart/crds
+	if os.Getenv("CRD_CONTROLLER_ENABLED") == "true" {
+		controller := services.NewCRDController(dynamicClient, namespace, configService, dhcpService)
+		if supervisorService.Available() {
+			controller.SetSupervisor(supervisorService)
+		}
+		if clusterService != nil {
+			clusterService.OnLeading(controller.Start)
+		} else {
+			go controller.Start(context.Background())
+		}
+	}
+	if clusterService != nil {
+		go clusterService.Run(context.Background())
+	}
 
 	// --- Server Setup ---
 	router := gin.New()
@@ -157,6 +218,8 @@ func main() {
 
 				// Auth success
 				c.Set(gin.AuthUserKey, user)
+				// Record the user as author of configuration changes
+				c.Request = c.Request.WithContext(services.WithAuthor(c.Request.Context(), user))
 				c.Next()
 			})
 		}
@@ -166,22 +229,79 @@ func main() {
 
 	// API Routes
 	v1 := router.Group("/api/v1")
+	v1.Use(server.RequireLeader())
 	{
 		v1.GET("/config", server.GetConfig)
 		v1.GET("/config/tags", server.GetTags)
-		v1.PUT("/config", server.UpdateConfig)
-		v1.POST("/dns/entries", server.AddDNSEntry)
+		v1.GET("/config/options", server.GetConfigOptions)
+		v1.PATCH("/config/options", server.RequireIfMatch(configService.ConfigETag), server.PatchConfigOptions)
+		v1.PUT("/config", server.RequireIfMatch(configService.ConfigETag), server.UpdateConfig)
+		v1.POST("/dns/entries", server.RequireIfMatch(configService.DNSEntriesETag), server.AddDNSEntry)
 		v1.GET("/dns/entries", server.GetDNSEntries)
-		v1.DELETE("/dns/entries", server.DeleteDNSEntry)
-		v1.PUT("/dns/entries", server.UpdateDNSEntry)
+		v1.DELETE("/dns/entries", server.RequireIfMatch(configService.DNSEntriesETag), server.DeleteDNSEntry)
+		v1.PUT("/dns/entries", server.RequireIfMatch(configService.DNSEntriesETag), server.UpdateDNSEntry)
+		v1.GET("/dns/entries/:id", server.GetDNSEntry)
+		v1.PUT("/dns/entries/:id", server.RequireIfMatch(configService.DNSEntriesETag), server.UpdateDNSEntryByID)
+		v1.DELETE("/dns/entries/:id", server.RequireIfMatch(configService.DNSEntriesETag), server.DeleteDNSEntryByID)
+		v1.GET("/dns/published", server.GetPublishedRecords)
+		v1.GET("/dns/forwarders", server.GetForwarders)
+		v1.POST("/dns/forwarders", server.RequireIfMatch(configService.ForwardersETag), server.AddForwarder)
+		v1.PUT("/dns/forwarders", server.RequireIfMatch(configService.ForwardersETag), server.UpdateForwarder)
+		v1.DELETE("/dns/forwarders", server.RequireIfMatch(configService.ForwardersETag), server.DeleteForwarder)
+		v1.GET("/dns/blocklists", server.GetBlocklists)
+		v1.POST("/dns/blocklists", server.AddBlocklist)
+		v1.POST("/dns/blocklists/refresh", server.RefreshBlocklists)
+		v1.GET("/dns/blocklists/allowlist", server.GetAllowlist)
+		v1.PUT("/dns/blocklists/allowlist", server.UpdateAllowlist)
+		v1.PUT("/dns/blocklists/mode", server.UpdateBlocklistMode)
+		v1.PUT("/dns/blocklists/:name", server.UpdateBlocklist)
+		v1.DELETE("/dns/blocklists/:name", server.DeleteBlocklist)
+		v1.POST("/dns/blocklists/:name/refresh", server.RefreshBlocklists)
 		v1.GET("/dhcp/leases", server.GetLeases)
 		v1.PUT("/dhcp/leases", server.UpdateLease)
 		v1.DELETE("/dhcp/leases", server.DeleteLease)
+		v1.GET("/dhcp/events", server.GetLeaseEvents)
+		v1.GET("/dhcp/events/stream", server.StreamLeaseEvents)
+		v1.GET("/dhcp/devices", server.GetDevices)
+		v1.GET("/dhcp/devices/:mac", server.GetDevice)
+		v1.PATCH("/dhcp/devices/:mac", server.UpdateDevice)
+		v1.DELETE("/dhcp/devices/:mac", server.DeleteDevice)
+		v1.POST("/dhcp/devices/:mac/reservation", server.PromoteDevice)
+		v1.GET("/history", server.GetHistory)
+		v1.GET("/history/:rev", server.GetRevision)
+		v1.POST("/history/:rev/restore", server.RestoreRevision)
 		v1.GET("/dhcp/reservations", server.GetReservations)
-		v1.POST("/dhcp/reservations", server.AddReservation)
-		v1.PUT("/dhcp/reservations", server.UpdateReservation)
-		v1.DELETE("/dhcp/reservations", server.DeleteReservation)
+		v1.POST("/dhcp/reservations", server.RequireIfMatch(dhcpService.ReservationsETag), server.AddReservation)
+		v1.PUT("/dhcp/reservations", server.RequireIfMatch(dhcpService.ReservationsETag), server.UpdateReservation)
+		v1.DELETE("/dhcp/reservations", server.RequireIfMatch(dhcpService.ReservationsETag), server.DeleteReservation)
+		v1.GET("/dhcp/reservations/:id", server.GetReservation)
+		v1.PUT("/dhcp/reservations/:id", server.RequireIfMatch(dhcpService.ReservationsETag), server.UpdateReservationByID)
+		v1.DELETE("/dhcp/reservations/:id", server.RequireIfMatch(dhcpService.ReservationsETag), server.DeleteReservationByID)
+		v1.GET("/dhcp/validate", server.ValidateReservations)
+		v1.GET("/dhcp/ranges", server.GetRanges)
+		v1.POST("/dhcp/ranges", server.RequireIfMatch(dhcpService.RangesETag), server.AddRange)
+		v1.GET("/dhcp/ranges/:id", server.GetRange)
+		v1.PUT("/dhcp/ranges/:id", server.RequireIfMatch(dhcpService.RangesETag), server.UpdateRange)
+		v1.DELETE("/dhcp/ranges/:id", server.RequireIfMatch(dhcpService.RangesETag), server.DeleteRange)
+		v1.GET("/dhcp/options", server.GetDHCPOptions)
+		v1.GET("/dhcp/options/catalogue", server.GetDHCPOptionCatalogue)
+		v1.POST("/dhcp/options", server.RequireIfMatch(dhcpService.DHCPOptionsETag), server.AddDHCPOption)
+		v1.GET("/dhcp/options/:id", server.GetDHCPOption)
+		v1.PUT("/dhcp/options/:id", server.RequireIfMatch(dhcpService.DHCPOptionsETag), server.UpdateDHCPOption)
+		v1.DELETE("/dhcp/options/:id", server.RequireIfMatch(dhcpService.DHCPOptionsETag), server.DeleteDHCPOption)
+		v1.GET("/dhcp/tags", server.GetDHCPTags)
+		v1.POST("/dhcp/tags", server.CreateDHCPTag)
+		v1.GET("/dhcp/tags/:name", server.GetDHCPTag)
+		v1.PUT("/dhcp/tags/:name", server.UpdateDHCPTag)
+		v1.DELETE("/dhcp/tags/:name", server.DeleteDHCPTag)
+		v1.GET("/pxe", server.GetPXE)
+		v1.PUT("/pxe", server.RequireIfMatch(dhcpService.PXEETag), server.UpdatePXESettings)
+		v1.POST("/pxe/profiles", server.RequireIfMatch(dhcpService.PXEETag), server.AddPXEProfile)
+		v1.GET("/pxe/profiles/:id", server.GetPXEProfile)
+		v1.PUT("/pxe/profiles/:id", server.RequireIfMatch(dhcpService.PXEETag), server.UpdatePXEProfile)
+		v1.DELETE("/pxe/profiles/:id", server.RequireIfMatch(dhcpService.PXEETag), server.DeletePXEProfile)
 		v1.GET("/status", server.GetStatus)
+		v1.GET("/cluster", server.GetCluster)
 		v1.POST("/supervisor/:service/start", server.StartSupervisorService)
 		v1.POST("/supervisor/:service/stop", server.StopSupervisorService)
 		v1.POST("/supervisor/:service/restart", server.RestartSupervisorService)
@@ -211,6 +331,25 @@ func main() {
 		c.String(http.StatusOK, `window.env = { API_URL: "" };`)
 	})
 
+	if webhookPort != "0" {
+		webhook := gin.New()
+		webhook.Use(gin.Recovery())
+		webhook.Use(gin.Logger())
+		externalDNS := webhook.Group("/api/v1/externaldns")
+		externalDNS.Use(server.RequireLeader())
+		{
+			externalDNS.GET("", server.NegotiateExternalDNS)
+			externalDNS.GET("/records", server.GetExternalDNSRecords)
+			externalDNS.POST("/records", server.ApplyExternalDNSChanges)
+			externalDNS.POST("/adjustendpoints", server.AdjustExternalDNSEndpoints)
+		}
+		go func() {
+			if err := webhook.Run(":" + webhookPort); err != nil {
+				panic(fmt.Sprintf("ExternalDNS webhook server failed: %v", err))
+			}
+		}()
+	}
+
 	// Run server
 	if err := router.Run(":" + webPort); err != nil {
 		panic(fmt.Sprintf("Server failed: %v", err))
@@ -238,3 +377,16 @@ func loadBasicAuthUsers(path string) (gin.Accounts, error) {
 	}
 	return accounts, scanner.Err()
 }
+
+// runDHCPScript forwards a lease event from dnsmasq to the API. Other actions
+// are ignored and errors are only logged: dnsmasq waits for the script and a
+// failure must not affect it.
+func runDHCPScript(args []string) {
+	event, ok := services.LeaseEventFromScript(args, os.Getenv)
+	if !ok {
+		return
+	}
+	if err := services.SendLeaseEvent(services.NewEventService().SocketPath(), event); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN: Failed to forward lease event: %v\n", err)
+	}
+}
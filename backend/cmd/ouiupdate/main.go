@@ -0,0 +1,97 @@
+package main
+
+import (
+	"backend/src/services"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ieeeRegistries are the MA-L (OUI), MA-M and MA-S assignments of the IEEE
+// registry, downloaded when no registry file is given
+var ieeeRegistries = []string{
+	"https://standards-oui.ieee.org/oui/oui.csv",
+	"https://standards-oui.ieee.org/oui28/mam.csv",
+	"https://standards-oui.ieee.org/oui36/oui36.csv",
+}
+
+// ouiupdate rebuilds the embedded vendor database from the IEEE registry, or
+// from local copies or URLs of its files (oui.txt, oui.csv, mam.csv or
+// oui36.csv). Run it from the backend directory, or set the output with -o:
+//
+//	go run ./cmd/ouiupdate
+//	go run ./cmd/ouiupdate -o src/services/oui.txt oui.csv mam.csv oui36.csv
+func main() {
+	output := flag.String("o", "src/services/oui.txt", "database to write")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: ouiupdate [-o oui.txt] [registry file or URL]...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	registries := flag.Args()
+	if len(registries) == 0 {
+		registries = ieeeRegistries
+	}
+
+	db := make(map[string]string)
+	var sources []string
+	for _, registry := range registries {
+		entries, err := readRegistry(registry)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", registry, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Found %d assignments in %s\n", len(entries), registry)
+		for prefix, vendor := range entries {
+			db[prefix] = vendor
+		}
+		sources = append(sources, path.Base(registry))
+	}
+	if len(db) == 0 {
+		fmt.Println("Error: no assignments found")
+		os.Exit(1)
+	}
+
+	header := "# MAC address prefixes (OUI, MA-M and MA-S assignments) and their vendors.\n" +
+		"# Generated by cmd/ouiupdate from " + strings.Join(sources, ", ") + ".\n"
+	if err := os.WriteFile(*output, []byte(header+services.FormatOUI(db)), 0644); err != nil {
+		fmt.Printf("Error writing %s: %v\n", *output, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully wrote %d assignments to %s\n", len(db), *output)
+}
+
+func readRegistry(registry string) (map[string]string, error) {
+	if !strings.HasPrefix(registry, "http://") && !strings.HasPrefix(registry, "https://") {
+		file, err := os.Open(registry)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return services.ParseOUI(file)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, registry, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Identify the tool to the registry server
+	req.Header.Set("User-Agent", "dnsmasq-k8s-ouiupdate")
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return services.ParseOUI(resp.Body)
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"backend/src/services"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
@@ -31,7 +34,9 @@ func TestGetConfig(t *testing.T) {
 	dhcpService := services.NewDHCPService(clientset, "default", configService)
 	statusService := services.NewStatusService()
 	supervisorService := services.NewSupervisorService()
-	server := NewServer(configService, dhcpService, statusService, supervisorService)
+	blocklistService := services.NewBlocklistService(clientset, "default", nil)
+	historyService := services.NewHistoryService(clientset, "default", configService, dhcpService)
+	server := NewServer(configService, dhcpService, statusService, supervisorService, blocklistService, historyService, nil, nil, nil, nil)
 
 	r := gin.Default()
 	r.GET("/config", server.GetConfig)
@@ -57,7 +62,9 @@ func TestUpdateConfig(t *testing.T) {
 	dhcpService := services.NewDHCPService(clientset, "default", configService)
 	statusService := services.NewStatusService()
 	supervisorService := services.NewSupervisorService()
-	server := NewServer(configService, dhcpService, statusService, supervisorService)
+	blocklistService := services.NewBlocklistService(clientset, "default", nil)
+	historyService := services.NewHistoryService(clientset, "default", configService, dhcpService)
+	server := NewServer(configService, dhcpService, statusService, supervisorService, blocklistService, historyService, nil, nil, nil, nil)
 
 	r := gin.Default()
 	r.PUT("/config", server.UpdateConfig)
@@ -69,6 +76,55 @@ func TestUpdateConfig(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
+func TestUpdateConfig_IfMatch(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "dnsmasq.conf")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	_, err = tmpFile.WriteString("domain-needed\n")
+	assert.NoError(t, err)
+
+	os.Setenv("DNSMASQ_CONFIG_FILE", tmpFile.Name())
+	defer os.Unsetenv("DNSMASQ_CONFIG_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	configService := services.NewConfigService(clientset, "default")
+	dhcpService := services.NewDHCPService(clientset, "default", configService)
+	statusService := services.NewStatusService()
+	supervisorService := services.NewSupervisorService()
+	blocklistService := services.NewBlocklistService(clientset, "default", nil)
+	historyService := services.NewHistoryService(clientset, "default", configService, dhcpService)
+	server := NewServer(configService, dhcpService, statusService, supervisorService, blocklistService, historyService, nil, nil, nil, nil)
+
+	r := gin.Default()
+	r.GET("/config", server.GetConfig)
+	r.PUT("/config", server.RequireIfMatch(configService.ConfigETag), server.UpdateConfig)
+
+	put := func(ifMatch string) int {
+		req, _ := http.NewRequest("PUT", "/config", strings.NewReader(`{"config": "bogus-priv\n"}`))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	req, _ := http.NewRequest("GET", "/config", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	assert.Equal(t, http.StatusPreconditionRequired, put(""))
+	assert.Equal(t, http.StatusPreconditionFailed, put(`"stale"`))
+	assert.Equal(t, http.StatusOK, put(etag))
+	// The file changed, so the old ETag no longer matches
+	assert.Equal(t, http.StatusPreconditionFailed, put(etag))
+	assert.Equal(t, http.StatusOK, put("*"))
+}
+
 func TestGetLeases(t *testing.T) {
 	leaseFile, err := ioutil.TempFile("", "leases")
 	assert.NoError(t, err)
@@ -90,7 +146,9 @@ func TestGetLeases(t *testing.T) {
 	dhcpService := services.NewDHCPService(clientset, "default", configService)
 	statusService := services.NewStatusService()
 	supervisorService := services.NewSupervisorService()
-	server := NewServer(configService, dhcpService, statusService, supervisorService)
+	blocklistService := services.NewBlocklistService(clientset, "default", nil)
+	historyService := services.NewHistoryService(clientset, "default", configService, dhcpService)
+	server := NewServer(configService, dhcpService, statusService, supervisorService, blocklistService, historyService, nil, nil, nil, nil)
 
 	r := gin.Default()
 	r.GET("/dhcp/leases", server.GetLeases)
@@ -108,7 +166,9 @@ func TestGetNavbar(t *testing.T) {
 	dhcpService := services.NewDHCPService(clientset, "default", configService)
 	statusService := services.NewStatusService()
 	supervisorService := services.NewSupervisorService()
-	server := NewServer(configService, dhcpService, statusService, supervisorService)
+	blocklistService := services.NewBlocklistService(clientset, "default", nil)
+	historyService := services.NewHistoryService(clientset, "default", configService, dhcpService)
+	server := NewServer(configService, dhcpService, statusService, supervisorService, blocklistService, historyService, nil, nil, nil, nil)
 
 	r := gin.Default()
 	r.GET("/navbar", server.GetNavbar)
@@ -121,3 +181,87 @@ func TestGetNavbar(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "Home")
 	assert.Contains(t, w.Body.String(), "Config")
 }
+
+func TestGetPublishedRecords(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "default", Annotations: map[string]string{
+			services.HostnameAnnotation: "myapp.home.lan",
+		}},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+			Ingress: []corev1.LoadBalancerIngress{{IP: "192.168.1.240"}},
+		}},
+	})
+	server := &Server{autoDNSService: services.NewAutoDNSService(clientset, nil)}
+
+	r := gin.Default()
+	r.GET("/dns/published", server.GetPublishedRecords)
+
+	req, _ := http.NewRequest("GET", "/dns/published", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Enabled bool                       `json:"enabled"`
+		Records []services.PublishedRecord `json:"records"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.True(t, body.Enabled)
+	assert.Equal(t, []services.PublishedRecord{
+		{Source: "service/default/myapp", Hostname: "myapp.home.lan", Targets: []string{"192.168.1.240"}},
+	}, body.Records)
+}
+
+func TestAdjustExternalDNSEndpoints(t *testing.T) {
+	server := &Server{}
+
+	r := gin.Default()
+	r.POST("/externaldns/adjustendpoints", server.AdjustExternalDNSEndpoints)
+
+	body := `[{"dnsName":"web.home.lan","targets":["192.168.1.240"],"recordType":"A","recordTTL":300},` +
+		`{"dnsName":"_sip._tcp.home.lan","targets":["10 5 5060 sip.home.lan"],"recordType":"SRV"}]`
+	req, _ := http.NewRequest("POST", "/externaldns/adjustendpoints", strings.NewReader(body))
+	req.Header.Set("Content-Type", services.ExternalDNSMediaType)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, services.ExternalDNSMediaType, w.Header().Get("Content-Type"))
+	var endpoints []services.ExternalDNSEndpoint
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &endpoints))
+	assert.Equal(t, []services.ExternalDNSEndpoint{
+		{DNSName: "web.home.lan", Targets: []string{"192.168.1.240"}, RecordType: "A"},
+	}, endpoints)
+}
+
+func TestRequireLeader(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	// Not elected yet, so a follower
+	server := &Server{clusterService: services.NewClusterService(clientset, "default", nil, nil)}
+
+	r := gin.Default()
+	r.Use(server.RequireLeader())
+	r.GET("/cluster", server.GetCluster)
+	r.POST("/dns/entries", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req, _ := http.NewRequest("GET", "/cluster", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var info services.ClusterInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.True(t, info.Enabled)
+	assert.Equal(t, services.RoleFollower, info.Role)
+
+	req, _ = http.NewRequest("POST", "/dns/entries", strings.NewReader(`{}`))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// Without clustering changes are accepted
+	server.clusterService = nil
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetPublishedRecords returns the DNS records published for Kubernetes objects
+// @Summary      Get published DNS records
+// @Description  Returns the records published for the Services, Ingresses and HTTPRoutes annotated with dnsmasq-k8s.io/hostname, and whether publishing is enabled
+// @Tags         dns
+// @Produce      json
+// @Success      200  {object}  map[string]interface{}
+// @Failure      500  {object}  map[string]string
+// @Router       /dns/published [get]
+func (s *Server) GetPublishedRecords(c *gin.Context) {
+	if s.autoDNSService == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false, "records": []interface{}{}})
+		return
+	}
+	records, err := s.autoDNSService.GetPublishedRecords(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "records": records})
+}
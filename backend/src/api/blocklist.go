@@ -0,0 +1,232 @@
+package api
+
+import (
+	"backend/src/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BlocklistRequest struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Content string `json:"content"`
+	// Enabled defaults to true when omitted
+	Enabled *bool `json:"enabled"`
+}
+
+type AllowlistRequest struct {
+	Domains []string `json:"domains"`
+}
+
+type BlocklistModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+func (r BlocklistRequest) toBlocklist() services.Blocklist {
+	enabled := true
+	if r.Enabled != nil {
+		enabled = *r.Enabled
+	}
+	return services.Blocklist{Name: r.Name, URL: r.URL, Content: r.Content, Enabled: enabled}
+}
+
+// GetBlocklists returns the configured blocklists with their stats
+// @Summary      Get blocklists
+// @Description  Returns blocklist sources, allowlist, blocking mode and per-list stats
+// @Tags         blocklists
+// @Produce      json
+// @Success      200  {object}  services.BlocklistSummary
+// @Failure      500  {object}  map[string]string
+// @Router       /dns/blocklists [get]
+func (s *Server) GetBlocklists(c *gin.Context) {
+	summary, err := s.blocklistService.GetSummary(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// AddBlocklist adds a blocklist source
+// @Summary      Add blocklist
+// @Description  Adds a blocklist downloaded from a URL or imported from inline hosts/domain-list content
+// @Tags         blocklists
+// @Accept       json
+// @Produce      json
+// @Param        blocklist  body      BlocklistRequest  true  "Blocklist"
+// @Success      200        {object}  map[string]string
+// @Failure      400        {object}  map[string]string
+// @Failure      409        {object}  map[string]string
+// @Failure      500        {object}  map[string]string
+// @Router       /dns/blocklists [post]
+func (s *Server) AddBlocklist(c *gin.Context) {
+	var json BlocklistRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	list := json.toBlocklist()
+	if err := services.ValidateBlocklist(list); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.blocklistService.AddBlocklist(c.Request.Context(), list); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// UpdateBlocklist updates a blocklist source
+// @Summary      Update blocklist
+// @Description  Updates, renames or toggles a blocklist
+// @Tags         blocklists
+// @Accept       json
+// @Produce      json
+// @Param        name       path      string            true  "Blocklist Name"
+// @Param        blocklist  body      BlocklistRequest  true  "Blocklist"
+// @Success      200        {object}  map[string]string
+// @Failure      400        {object}  map[string]string
+// @Failure      404        {object}  map[string]string
+// @Failure      409        {object}  map[string]string
+// @Failure      500        {object}  map[string]string
+// @Router       /dns/blocklists/{name} [put]
+func (s *Server) UpdateBlocklist(c *gin.Context) {
+	var json BlocklistRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	list := json.toBlocklist()
+	if list.Name == "" {
+		list.Name = c.Param("name")
+	}
+	if err := services.ValidateBlocklist(list); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.blocklistService.UpdateBlocklist(c.Request.Context(), c.Param("name"), list); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// DeleteBlocklist deletes a blocklist source
+// @Summary      Delete blocklist
+// @Description  Deletes a blocklist and re-renders the blocked domains
+// @Tags         blocklists
+// @Produce      json
+// @Param        name  path      string  true  "Blocklist Name"
+// @Success      200   {object}  map[string]string
+// @Failure      404   {object}  map[string]string
+// @Failure      500   {object}  map[string]string
+// @Router       /dns/blocklists/{name} [delete]
+func (s *Server) DeleteBlocklist(c *gin.Context) {
+	if err := s.blocklistService.DeleteBlocklist(c.Request.Context(), c.Param("name")); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// RefreshBlocklists downloads blocklists again
+// @Summary      Refresh blocklists
+// @Description  Downloads all blocklists again, or only the one named in the path
+// @Tags         blocklists
+// @Produce      json
+// @Param        name  path      string  false  "Blocklist Name"
+// @Success      200   {object}  services.BlocklistSummary
+// @Failure      404   {object}  map[string]string
+// @Failure      500   {object}  map[string]string
+// @Router       /dns/blocklists/refresh [post]
+// @Router       /dns/blocklists/{name}/refresh [post]
+func (s *Server) RefreshBlocklists(c *gin.Context) {
+	var names []string
+	if name := c.Param("name"); name != "" {
+		names = append(names, name)
+	}
+
+	if err := s.blocklistService.Refresh(c.Request.Context(), names...); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	summary, err := s.blocklistService.GetSummary(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// GetAllowlist returns the allowlisted domains
+// @Summary      Get allowlist
+// @Description  Returns domains that are never blocked
+// @Tags         blocklists
+// @Produce      json
+// @Success      200  {object}  AllowlistRequest
+// @Failure      500  {object}  map[string]string
+// @Router       /dns/blocklists/allowlist [get]
+func (s *Server) GetAllowlist(c *gin.Context) {
+	config, err := s.blocklistService.GetConfig(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"domains": config.Allowlist})
+}
+
+// UpdateAllowlist replaces the allowlist
+// @Summary      Update allowlist
+// @Description  Replaces the domains that are never blocked
+// @Tags         blocklists
+// @Accept       json
+// @Produce      json
+// @Param        allowlist  body      AllowlistRequest  true  "Allowlist"
+// @Success      200        {object}  map[string]string
+// @Failure      400        {object}  map[string]string
+// @Failure      500        {object}  map[string]string
+// @Router       /dns/blocklists/allowlist [put]
+func (s *Server) UpdateAllowlist(c *gin.Context) {
+	var json AllowlistRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.blocklistService.SetAllowlist(c.Request.Context(), json.Domains); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// UpdateBlocklistMode sets how blocked domains are answered
+// @Summary      Update blocklist mode
+// @Description  "address" answers 0.0.0.0, "local" answers NXDOMAIN
+// @Tags         blocklists
+// @Accept       json
+// @Produce      json
+// @Param        mode  body      BlocklistModeRequest  true  "Mode"
+// @Success      200   {object}  map[string]string
+// @Failure      400   {object}  map[string]string
+// @Router       /dns/blocklists/mode [put]
+func (s *Server) UpdateBlocklistMode(c *gin.Context) {
+	var json BlocklistModeRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.blocklistService.SetMode(c.Request.Context(), json.Mode); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
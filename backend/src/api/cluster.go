@@ -0,0 +1,40 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetCluster returns the role of the replica answering
+// @Summary      Get cluster status
+// @Description  Returns whether leader election is enabled, the role of the replica answering and the current leader. Only the leader serves DHCP and accepts changes.
+// @Tags         status
+// @Produce      json
+// @Success      200  {object}  services.ClusterInfo
+// @Router       /cluster [get]
+func (s *Server) GetCluster(c *gin.Context) {
+	c.JSON(http.StatusOK, s.clusterService.GetInfo())
+}
+
+// RequireLeader rejects changes on followers with 503. Followers serve the
+// configuration read-only, as synced from the leader's ConfigMaps.
+func (s *Server) RequireLeader() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if s.clusterService.Follower() {
+			info := s.clusterService.GetInfo()
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error":  fmt.Sprintf("this replica is a read-only follower, changes go to the leader %s", info.Leader),
+				"leader": info.Leader,
+			})
+			return
+		}
+		c.Next()
+	}
+}
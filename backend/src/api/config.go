@@ -2,7 +2,8 @@ package api
 
 import (
 	"backend/src/services"
-	"net"
+	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -17,6 +18,12 @@ type AddDNSEntryRequest struct {
 	Domain  string `json:"domain"`
 	Value   string `json:"value"`
 	Comment string `json:"comment"`
+	PTR     bool   `json:"ptr"`
+	// SRV and MX fields
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target"`
 }
 
 type UpdateDNSEntryRequest struct {
@@ -30,9 +37,13 @@ type UpdateDNSEntryRequest struct {
 // @Tags         config
 // @Produce      text/plain
 // @Success      200  {string}  string
+// @Header       200  {string}  ETag  "Version of the configuration, send it back in If-Match"
 // @Failure      500  {object}  map[string]string
 // @Router       /config [get]
 func (s *Server) GetConfig(c *gin.Context) {
+	if !setETag(c, s.configService.ConfigETag) {
+		return
+	}
 	config, err := s.configService.GetConfig(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -66,10 +77,13 @@ func (s *Server) GetTags(c *gin.Context) {
 // @Tags         config
 // @Accept       json
 // @Produce      json
-// @Param        config  body      UpdateConfigRequest  true  "Configuration"
-// @Success      200     {object}  map[string]string
-// @Failure      400     {object}  map[string]string
-// @Failure      500     {object}  map[string]string
+// @Param        config    body      UpdateConfigRequest  true  "Configuration"
+// @Param        If-Match  header    string               true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
 // @Router       /config [put]
 func (s *Server) UpdateConfig(c *gin.Context) {
 	var json UpdateConfigRequest
@@ -81,7 +95,7 @@ func (s *Server) UpdateConfig(c *gin.Context) {
 
 	err := s.configService.UpdateConfig(c.Request.Context(), json.Config)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -90,14 +104,17 @@ func (s *Server) UpdateConfig(c *gin.Context) {
 
 // AddDNSEntry adds a new DNS entry
 // @Summary      Add DNS entry
-// @Description  Adds a new DNS entry (A, CNAME, or TXT)
+// @Description  Adds a new DNS entry (A, AAAA, CNAME, TXT, PTR, SRV, or MX). A and AAAA entries can request a matching PTR record.
 // @Tags         dns
 // @Accept       json
 // @Produce      json
-// @Param        entry  body      AddDNSEntryRequest  true  "DNS Entry"
-// @Success      200    {object}  map[string]string
-// @Failure      400    {object}  map[string]string
-// @Failure      500    {object}  map[string]string
+// @Param        entry     body      AddDNSEntryRequest  true  "DNS Entry"
+// @Param        If-Match  header    string              true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
 // @Router       /dns/entries [post]
 func (s *Server) AddDNSEntry(c *gin.Context) {
 	var json AddDNSEntryRequest
@@ -107,36 +124,25 @@ func (s *Server) AddDNSEntry(c *gin.Context) {
 		return
 	}
 
-	// Validate record type - only support A, CNAME, TXT
-	validTypes := map[string]bool{
-		"address": true,
-		"cname":   true,
-		"txt":     true,
+	entry := services.DNSEntry{
+		Type:     json.Type,
+		Domain:   json.Domain,
+		Value:    json.Value,
+		Comment:  json.Comment,
+		PTR:      json.PTR,
+		Priority: json.Priority,
+		Weight:   json.Weight,
+		Port:     json.Port,
+		Target:   json.Target,
 	}
-	if !validTypes[json.Type] {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported DNS record type. Only A, CNAME, and TXT records are supported."})
+	if err := services.ValidateDNSEntry(entry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Validate IP address for A records
-	if json.Type == "address" {
-		if net.ParseIP(json.Value) == nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid IP address"})
-			return
-		}
-	}
-
-	// Validate domain name for CNAME records
-	if json.Type == "cname" {
-		if json.Value == "" || len(json.Value) > 253 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid domain name for CNAME record"})
-			return
-		}
-	}
-
-	err := s.configService.AddDNSEntry(c.Request.Context(), json.Type, json.Domain, json.Value, json.Comment)
+	err := s.configService.CreateDNSEntry(c.Request.Context(), entry)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -149,9 +155,13 @@ func (s *Server) AddDNSEntry(c *gin.Context) {
 // @Tags         dns
 // @Produce      json
 // @Success      200  {array}   services.DNSEntry
+// @Header       200  {string}  ETag  "Version of the entries, send it back in If-Match"
 // @Failure      500  {object}  map[string]string
 // @Router       /dns/entries [get]
 func (s *Server) GetDNSEntries(c *gin.Context) {
+	if !setETag(c, s.configService.DNSEntriesETag) {
+		return
+	}
 	entries, err := s.configService.GetDNSEntries(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -167,10 +177,15 @@ func (s *Server) GetDNSEntries(c *gin.Context) {
 // @Tags         dns
 // @Accept       json
 // @Produce      json
-// @Param        entry  body      services.DNSEntry  true  "DNS Entry"
-// @Success      200    {object}  map[string]string
-// @Failure      400    {object}  map[string]string
-// @Failure      500    {object}  map[string]string
+// @Param        entry     body      services.DNSEntry  true  "DNS Entry"
+// @Param        If-Match  header    string             true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      409       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
 // @Router       /dns/entries [delete]
 func (s *Server) DeleteDNSEntry(c *gin.Context) {
 	var json services.DNSEntry
@@ -181,7 +196,7 @@ func (s *Server) DeleteDNSEntry(c *gin.Context) {
 
 	err := s.configService.DeleteDNSEntry(c.Request.Context(), json)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -194,10 +209,15 @@ func (s *Server) DeleteDNSEntry(c *gin.Context) {
 // @Tags         dns
 // @Accept       json
 // @Produce      json
-// @Param        entry  body      UpdateDNSEntryRequest  true  "DNS Entry Update"
-// @Success      200    {object}  map[string]string
-// @Failure      400    {object}  map[string]string
-// @Failure      500    {object}  map[string]string
+// @Param        entry     body      UpdateDNSEntryRequest  true  "DNS Entry Update"
+// @Param        If-Match  header    string                 true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      409       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
 // @Router       /dns/entries [put]
 func (s *Server) UpdateDNSEntry(c *gin.Context) {
 	var json UpdateDNSEntryRequest
@@ -207,10 +227,182 @@ func (s *Server) UpdateDNSEntry(c *gin.Context) {
 	}
 
 	err := s.configService.UpdateDNSEntry(c.Request.Context(), json.Old, json.New)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// GetDNSEntry returns a single DNS entry
+// @Summary      Get DNS entry
+// @Description  Returns the DNS entry with the given ID
+// @Tags         dns
+// @Produce      json
+// @Param        id   path      string  true  "Entry ID"
+// @Success      200  {object}  services.DNSEntry
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /dns/entries/{id} [get]
+func (s *Server) GetDNSEntry(c *gin.Context) {
+	entry, err := s.configService.GetDNSEntry(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// UpdateDNSEntryByID replaces a DNS entry
+// @Summary      Update DNS entry by ID
+// @Description  Replaces the DNS entry with the given ID and returns its new ID
+// @Tags         dns
+// @Accept       json
+// @Produce      json
+// @Param        id        path      string             true  "Entry ID"
+// @Param        entry     body      services.DNSEntry  true  "DNS Entry"
+// @Param        If-Match  header    string             true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      409       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /dns/entries/{id} [put]
+func (s *Server) UpdateDNSEntryByID(c *gin.Context) {
+	var json services.DNSEntry
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateDNSEntry(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.configService.UpdateDNSEntryByID(c.Request.Context(), c.Param("id"), json)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id})
+}
+
+// DeleteDNSEntryByID deletes a DNS entry
+// @Summary      Delete DNS entry by ID
+// @Description  Deletes the DNS entry with the given ID
+// @Tags         dns
+// @Produce      json
+// @Param        id        path      string  true  "Entry ID"
+// @Param        If-Match  header    string  true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      409       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /dns/entries/{id} [delete]
+func (s *Server) DeleteDNSEntryByID(c *gin.Context) {
+	if err := s.configService.DeleteDNSEntryByID(c.Request.Context(), c.Param("id")); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// GetConfigOptions returns dnsmasq.conf as structured options
+// @Summary      Get configuration options
+// @Description  Returns the options, flags and includes of dnsmasq.conf in file order
+// @Tags         config
+// @Produce      json
+// @Success      200  {object}  services.ConfigOptions
+// @Header       200  {string}  ETag  "Version of the configuration, send it back in If-Match"
+// @Failure      500  {object}  map[string]string
+// @Router       /config/options [get]
+func (s *Server) GetConfigOptions(c *gin.Context) {
+	if !setETag(c, s.configService.ConfigETag) {
+		return
+	}
+	options, err := s.configService.GetConfigOptions(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.JSON(http.StatusOK, options)
+}
+
+// PatchConfigOptions changes options in dnsmasq.conf
+// @Summary      Patch configuration options
+// @Description  Applies a JSON merge patch keyed by option name: a string or number sets a single value, an array sets a repeated option, true sets a flag, and false or null removes the option. Other lines are left untouched.
+// @Tags         config
+// @Accept       json
+// @Produce      json
+// @Param        options   body      map[string]interface{}  true  "Option changes"
+// @Param        If-Match  header    string                  true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /config/options [patch]
+func (s *Server) PatchConfigOptions(c *gin.Context) {
+	var patch map[string]interface{}
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	changes := make(map[string]services.OptionChange, len(patch))
+	for key, value := range patch {
+		change, err := optionChange(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %v", key, err)})
+			return
+		}
+		changes[key] = change
+	}
+
+	if err := s.configService.UpdateConfigOptions(c.Request.Context(), changes); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
+
+// optionChange converts a merge patch value to an option change.
+func optionChange(value interface{}) (services.OptionChange, error) {
+	switch v := value.(type) {
+	case nil:
+		return services.OptionChange{Remove: true}, nil
+	case bool:
+		return services.OptionChange{Flag: v, Remove: !v}, nil
+	case string:
+		return services.OptionChange{Values: []string{v}}, nil
+	case json.Number:
+		return services.OptionChange{Values: []string{v.String()}}, nil
+	case []interface{}:
+		change := services.OptionChange{Values: []string{}, Remove: len(v) == 0}
+		for _, item := range v {
+			switch item := item.(type) {
+			case string:
+				change.Values = append(change.Values, item)
+			case json.Number:
+				change.Values = append(change.Values, item.String())
+			default:
+				return services.OptionChange{}, fmt.Errorf("array values must be strings or numbers")
+			}
+		}
+		return change, nil
+	}
+	return services.OptionChange{}, fmt.Errorf("unsupported value type")
+}
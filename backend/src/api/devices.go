@@ -0,0 +1,145 @@
+package api
+
+import (
+	"backend/src/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PromoteDeviceRequest overrides the defaults of a reservation made from a
+// device. Empty fields default to the last IP address and hostname seen.
+type PromoteDeviceRequest struct {
+	IPAddress string `json:"ip_address"`
+	Hostname  string `json:"hostname"`
+	Tag       string `json:"tag"`
+	Comment   string `json:"comment"`
+}
+
+// GetDevices returns the device inventory
+// @Summary      Get devices
+// @Description  Returns every client seen in the DHCP leases, most recently seen first
+// @Tags         dhcp
+// @Produce      json
+// @Param        q    query     string  false  "Search MAC address, IP addresses, hostnames, vendor, name and notes"
+// @Success      200  {object}  map[string][]services.Device
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/devices [get]
+func (s *Server) GetDevices(c *gin.Context) {
+	devices, err := s.deviceService.GetDevices(c.Request.Context(), c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"devices": devices})
+}
+
+// GetDevice returns a single device
+// @Summary      Get device
+// @Description  Returns the device with the given MAC address
+// @Tags         dhcp
+// @Produce      json
+// @Param        mac  path      string  true  "MAC address"
+// @Success      200  {object}  services.Device
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/devices/{mac} [get]
+func (s *Server) GetDevice(c *gin.Context) {
+	device, err := s.deviceService.GetDevice(c.Request.Context(), c.Param("mac"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
+
+// UpdateDevice sets the name and notes of a device
+// @Summary      Update device
+// @Description  Sets the friendly name and notes of a device. Omitted fields are left unchanged.
+// @Tags         dhcp
+// @Accept       json
+// @Produce      json
+// @Param        mac     path      string                 true  "MAC address"
+// @Param        device  body      services.DeviceUpdate  true  "Name and notes"
+// @Success      200     {object}  services.Device
+// @Failure      400     {object}  map[string]string
+// @Failure      404     {object}  map[string]string
+// @Failure      500     {object}  map[string]string
+// @Router       /dhcp/devices/{mac} [patch]
+func (s *Server) UpdateDevice(c *gin.Context) {
+	var update services.DeviceUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	device, err := s.deviceService.UpdateDevice(c.Request.Context(), c.Param("mac"), update)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
+
+// DeleteDevice removes a device from the inventory
+// @Summary      Delete device
+// @Description  Removes a device from the inventory. It is added again when it shows up in the leases.
+// @Tags         dhcp
+// @Produce      json
+// @Param        mac  path      string  true  "MAC address"
+// @Success      200  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/devices/{mac} [delete]
+func (s *Server) DeleteDevice(c *gin.Context) {
+	if err := s.deviceService.DeleteDevice(c.Request.Context(), c.Param("mac")); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// PromoteDevice adds a reservation for a device
+// @Summary      Promote device to reservation
+// @Description  Reserves the last IP address and hostname seen for a device, unless given in the body, and returns the reservation's ID and validation warnings. Reservations with validation errors are rejected with 409.
+// @Tags         dhcp
+// @Accept       json
+// @Produce      json
+// @Param        mac          path      string                true   "MAC address"
+// @Param        reservation  body      PromoteDeviceRequest  false  "Reservation fields"
+// @Success      200          {object}  map[string]string
+// @Failure      400          {object}  map[string]string
+// @Failure      404          {object}  map[string]string
+// @Failure      409          {object}  map[string]string
+// @Failure      500          {object}  map[string]string
+// @Router       /dhcp/devices/{mac}/reservation [post]
+func (s *Server) PromoteDevice(c *gin.Context) {
+	var req PromoteDeviceRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	res, err := s.deviceService.DeviceReservation(c.Request.Context(), c.Param("mac"), services.DHCPReservation{
+		IPAddress: req.IPAddress,
+		Hostname:  req.Hostname,
+		Tag:       req.Tag,
+		Comment:   req.Comment,
+	})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.ValidateReservation(res); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.dhcpService.AddReservation(c.Request.Context(), res)
+	if err != nil {
+		reservationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id, "warnings": s.reservationWarnings(c, id)})
+}
@@ -2,23 +2,26 @@ package api
 
 import (
 	"backend/src/services"
-	"net"
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
 type AddReservationRequest struct {
-	MACAddress string `json:"mac_address"`
-	IPAddress  string `json:"ip_address"`
-	Hostname   string `json:"hostname"`
-	Tag        string `json:"tag"`
-	Comment    string `json:"comment"`
+	MACAddress  string `json:"mac_address"`
+	ClientID    string `json:"client_id"`
+	IPAddress   string `json:"ip_address"`
+	IPv6Address string `json:"ipv6_address"`
+	Hostname    string `json:"hostname"`
+	Tag         string `json:"tag"`
+	Comment     string `json:"comment"`
 }
 
 type UpdateReservationRequest struct {
-	Old services.DHCPReservation `json:"old"`
-	New services.DHCPReservation `json:"new"`
+	Old services.DHCPReservation   `json:"old"`
+	New services.ReservationUpdate `json:"new"`
 }
 
 type UpdateLeaseRequest struct {
@@ -50,9 +53,13 @@ func (s *Server) GetLeases(c *gin.Context) {
 // @Tags         dhcp
 // @Produce      json
 // @Success      200  {object}  map[string][]services.DHCPReservation
+// @Header       200  {string}  ETag  "Version of the reservations, send it back in If-Match"
 // @Failure      500  {object}  map[string]string
 // @Router       /dhcp/reservations [get]
 func (s *Server) GetReservations(c *gin.Context) {
+	if !setETag(c, s.dhcpService.ReservationsETag) {
+		return
+	}
 	reservations, err := s.dhcpService.GetReservations(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -63,13 +70,17 @@ func (s *Server) GetReservations(c *gin.Context) {
 
 // AddReservation adds a new DHCP reservation
 // @Summary      Add DHCP reservation
-// @Description  Adds a new DHCP reservation
+// @Description  Adds a new DHCP reservation and returns its ID and validation warnings. Clients are matched by MAC address, client ID (a DUID for DHCPv6) or both. Reservations with validation errors, such as a duplicate IP or MAC address, are rejected with 409.
 // @Tags         dhcp
 // @Accept       json
 // @Produce      json
 // @Param        reservation  body      AddReservationRequest  true  "DHCP Reservation"
+// @Param        If-Match     header    string                 true  "ETag from the last GET"
 // @Success      200          {object}  map[string]string
 // @Failure      400          {object}  map[string]string
+// @Failure      409          {object}  map[string]string
+// @Failure      412          {object}  map[string]string
+// @Failure      428          {object}  map[string]string
 // @Failure      500          {object}  map[string]string
 // @Router       /dhcp/reservations [post]
 func (s *Server) AddReservation(c *gin.Context) {
@@ -80,23 +91,27 @@ func (s *Server) AddReservation(c *gin.Context) {
 		return
 	}
 
-	if _, err := net.ParseMAC(json.MACAddress); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid MAC address"})
-		return
+	res := services.DHCPReservation{
+		MACAddress:  json.MACAddress,
+		ClientID:    json.ClientID,
+		IPAddress:   json.IPAddress,
+		IPv6Address: json.IPv6Address,
+		Hostname:    json.Hostname,
+		Tag:         json.Tag,
+		Comment:     json.Comment,
 	}
-
-	if net.ParseIP(json.IPAddress) == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid IP address"})
+	if err := services.ValidateReservation(res); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	err := s.dhcpService.AddReservation(c.Request.Context(), json.MACAddress, json.IPAddress, json.Hostname, json.Tag, json.Comment)
+	id, err := s.dhcpService.AddReservation(c.Request.Context(), res)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		reservationError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id, "warnings": s.reservationWarnings(c, id)})
 }
 
 // UpdateReservation updates a DHCP reservation
@@ -106,8 +121,12 @@ func (s *Server) AddReservation(c *gin.Context) {
 // @Accept       json
 // @Produce      json
 // @Param        reservation  body      UpdateReservationRequest  true  "DHCP Reservation Update"
+// @Param        If-Match     header    string                    true  "ETag from the last GET"
 // @Success      200          {object}  map[string]string
 // @Failure      400          {object}  map[string]string
+// @Failure      409          {object}  map[string]string
+// @Failure      412          {object}  map[string]string
+// @Failure      428          {object}  map[string]string
 // @Failure      500          {object}  map[string]string
 // @Router       /dhcp/reservations [put]
 func (s *Server) UpdateReservation(c *gin.Context) {
@@ -117,7 +136,7 @@ func (s *Server) UpdateReservation(c *gin.Context) {
 		return
 	}
 	if err := s.dhcpService.UpdateReservation(c.Request.Context(), json.Old, json.New); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		reservationError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
@@ -130,8 +149,13 @@ func (s *Server) UpdateReservation(c *gin.Context) {
 // @Accept       json
 // @Produce      json
 // @Param        reservation  body      services.DHCPReservation  true  "DHCP Reservation"
+// @Param        If-Match     header    string                    true  "ETag from the last GET"
 // @Success      200          {object}  map[string]string
 // @Failure      400          {object}  map[string]string
+// @Failure      404          {object}  map[string]string
+// @Failure      409          {object}  map[string]string
+// @Failure      412          {object}  map[string]string
+// @Failure      428          {object}  map[string]string
 // @Failure      500          {object}  map[string]string
 // @Router       /dhcp/reservations [delete]
 func (s *Server) DeleteReservation(c *gin.Context) {
@@ -141,21 +165,139 @@ func (s *Server) DeleteReservation(c *gin.Context) {
 		return
 	}
 	if err := s.dhcpService.DeleteReservation(c.Request.Context(), json); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// GetReservation returns a single DHCP reservation
+// @Summary      Get DHCP reservation
+// @Description  Returns the DHCP reservation with the given ID
+// @Tags         dhcp
+// @Produce      json
+// @Param        id   path      string  true  "Reservation ID"
+// @Success      200  {object}  services.DHCPReservation
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/reservations/{id} [get]
+func (s *Server) GetReservation(c *gin.Context) {
+	res, err := s.dhcpService.GetReservation(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// UpdateReservationByID replaces a DHCP reservation
+// @Summary      Update DHCP reservation by ID
+// @Description  Replaces the DHCP reservation with the given ID and returns its new ID and validation warnings. Reservations with validation errors are rejected with 409.
+// @Tags         dhcp
+// @Accept       json
+// @Produce      json
+// @Param        id           path      string                    true  "Reservation ID"
+// @Param        reservation  body      services.DHCPReservation  true  "DHCP Reservation"
+// @Param        If-Match     header    string                    true  "ETag from the last GET"
+// @Success      200          {object}  map[string]string
+// @Failure      400          {object}  map[string]string
+// @Failure      404          {object}  map[string]string
+// @Failure      409          {object}  map[string]string
+// @Failure      412          {object}  map[string]string
+// @Failure      428          {object}  map[string]string
+// @Failure      500          {object}  map[string]string
+// @Router       /dhcp/reservations/{id} [put]
+func (s *Server) UpdateReservationByID(c *gin.Context) {
+	var json services.DHCPReservation
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateReservation(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.dhcpService.UpdateReservationByID(c.Request.Context(), c.Param("id"), json)
+	if err != nil {
+		reservationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id, "warnings": s.reservationWarnings(c, id)})
+}
+
+// ValidateReservations checks the DHCP reservations
+// @Summary      Validate DHCP reservations
+// @Description  Checks the reservations for duplicate IP addresses, MAC addresses and hostnames, addresses outside the DHCP ranges, addresses leased to other clients and hostnames with conflicting A/AAAA records in custom.conf. Duplicate IP and MAC addresses are errors, the rest are warnings.
+// @Tags         dhcp
+// @Produce      json
+// @Success      200  {object}  services.ValidationReport
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/validate [get]
+func (s *Server) ValidateReservations(c *gin.Context) {
+	report, err := s.dhcpService.ValidateReservations(c.Request.Context())
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	c.JSON(http.StatusOK, report)
+}
+
+// reservationError writes the response for a failed reservation write. Writes
+// rejected by validation get 409 with the errors and warnings found.
+func reservationError(c *gin.Context, err error) {
+	var validationErr *services.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "errors": validationErr.Report.Errors, "warnings": validationErr.Report.Warnings})
+		return
+	}
+	c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+}
+
+// reservationWarnings returns the validation warnings of a reservation that
+// was just written.
+func (s *Server) reservationWarnings(c *gin.Context, id string) []services.ValidationIssue {
+	report, err := s.dhcpService.ValidateReservations(c.Request.Context())
+	if err != nil {
+		fmt.Printf("WARN: Failed to validate reservations: %v\n", err)
+		return []services.ValidationIssue{}
+	}
+	return report.For(id).Warnings
+}
+
+// DeleteReservationByID deletes a DHCP reservation
+// @Summary      Delete DHCP reservation by ID
+// @Description  Deletes the DHCP reservation with the given ID
+// @Tags         dhcp
+// @Produce      json
+// @Param        id        path      string  true  "Reservation ID"
+// @Param        If-Match  header    string  true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      409       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /dhcp/reservations/{id} [delete]
+func (s *Server) DeleteReservationByID(c *gin.Context) {
+	if err := s.dhcpService.DeleteReservationByID(c.Request.Context(), c.Param("id")); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 // UpdateLease updates a DHCP lease
 // @Summary      Update DHCP lease
-// @Description  Updates a DHCP lease
+// @Description  Updates a DHCP lease. dnsmasq is stopped while the lease file is edited and started again, then the lease file is re-read: verified tells whether the change took effect.
 // @Tags         dhcp
 // @Accept       json
 // @Produce      json
 // @Param        lease  body      UpdateLeaseRequest  true  "DHCP Lease Update"
 // @Success      200    {object}  map[string]string
 // @Failure      400    {object}  map[string]string
+// @Failure      404    {object}  map[string]string
 // @Failure      500    {object}  map[string]string
 // @Router       /dhcp/leases [put]
 func (s *Server) UpdateLease(c *gin.Context) {
@@ -164,22 +306,24 @@ func (s *Server) UpdateLease(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := s.dhcpService.UpdateLease(c.Request.Context(), json.Old, json.New); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	change, err := s.dhcpService.UpdateLease(c.Request.Context(), json.Old, json.New)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "method": change.Method, "verified": change.Verified})
 }
 
 // DeleteLease deletes a DHCP lease
 // @Summary      Delete DHCP lease
-// @Description  Deletes a DHCP lease
+// @Description  Releases a DHCP lease. dnsmasq is stopped while the lease is removed from the lease file and started again, then the lease file is re-read: verified tells whether the release took effect.
 // @Tags         dhcp
 // @Accept       json
 // @Produce      json
 // @Param        lease  body      services.DHCPLease  true  "DHCP Lease"
 // @Success      200    {object}  map[string]string
 // @Failure      400    {object}  map[string]string
+// @Failure      404    {object}  map[string]string
 // @Failure      500    {object}  map[string]string
 // @Router       /dhcp/leases [delete]
 func (s *Server) DeleteLease(c *gin.Context) {
@@ -188,9 +332,10 @@ func (s *Server) DeleteLease(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := s.dhcpService.DeleteLease(c.Request.Context(), json); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	change, err := s.dhcpService.DeleteLease(c.Request.Context(), json)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "method": change.Method, "verified": change.Verified})
 }
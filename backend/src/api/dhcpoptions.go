@@ -0,0 +1,151 @@
+package api
+
+import (
+	"backend/src/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetDHCPOptions returns all managed DHCP options
+// @Summary      Get DHCP options
+// @Description  Returns the dhcp-option entries of the managed DHCP options file with their scope
+// @Tags         dhcp
+// @Produce      json
+// @Success      200  {object}  map[string][]services.DHCPOption
+// @Header       200  {string}  ETag  "Version of the options, send it back in If-Match"
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/options [get]
+func (s *Server) GetDHCPOptions(c *gin.Context) {
+	if !setETag(c, s.dhcpService.DHCPOptionsETag) {
+		return
+	}
+	options, err := s.dhcpService.GetDHCPOptions(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"options": options})
+}
+
+// GetDHCPOptionCatalogue returns the supported DHCP options
+// @Summary      Get DHCP option catalogue
+// @Description  Returns the DHCPv4 and DHCPv6 options that can be set, with their number and value type
+// @Tags         dhcp
+// @Produce      json
+// @Success      200  {object}  map[string][]services.DHCPOptionDef
+// @Router       /dhcp/options/catalogue [get]
+func (s *Server) GetDHCPOptionCatalogue(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"options": services.DHCPOptionCatalogue()})
+}
+
+// GetDHCPOption returns a single DHCP option
+// @Summary      Get DHCP option
+// @Description  Returns the DHCP option with the given ID
+// @Tags         dhcp
+// @Produce      json
+// @Param        id   path      string  true  "Option ID"
+// @Success      200  {object}  services.DHCPOption
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/options/{id} [get]
+func (s *Server) GetDHCPOption(c *gin.Context) {
+	opt, err := s.dhcpService.GetDHCPOption(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, opt)
+}
+
+// AddDHCPOption adds a new DHCP option
+// @Summary      Add DHCP option
+// @Description  Adds a global, tag or range scoped option and returns its ID. Values are validated against the catalogue.
+// @Tags         dhcp
+// @Accept       json
+// @Produce      json
+// @Param        option    body      services.DHCPOption  true  "DHCP Option"
+// @Param        If-Match  header    string               true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /dhcp/options [post]
+func (s *Server) AddDHCPOption(c *gin.Context) {
+	var json services.DHCPOption
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateDHCPOption(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.dhcpService.AddDHCPOption(c.Request.Context(), json)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id})
+}
+
+// UpdateDHCPOption replaces a DHCP option
+// @Summary      Update DHCP option
+// @Description  Replaces the DHCP option with the given ID and returns its new ID
+// @Tags         dhcp
+// @Accept       json
+// @Produce      json
+// @Param        id        path      string               true  "Option ID"
+// @Param        option    body      services.DHCPOption  true  "DHCP Option"
+// @Param        If-Match  header    string               true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /dhcp/options/{id} [put]
+func (s *Server) UpdateDHCPOption(c *gin.Context) {
+	var json services.DHCPOption
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateDHCPOption(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.dhcpService.UpdateDHCPOption(c.Request.Context(), c.Param("id"), json)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id})
+}
+
+// DeleteDHCPOption deletes a DHCP option
+// @Summary      Delete DHCP option
+// @Description  Deletes the DHCP option with the given ID
+// @Tags         dhcp
+// @Produce      json
+// @Param        id        path      string  true  "Option ID"
+// @Param        If-Match  header    string  true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /dhcp/options/{id} [delete]
+func (s *Server) DeleteDHCPOption(c *gin.Context) {
+	if err := s.dhcpService.DeleteDHCPOption(c.Request.Context(), c.Param("id")); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
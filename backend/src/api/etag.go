@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// etagFunc returns the current ETag of a resource.
+type etagFunc func(ctx context.Context) (string, error)
+
+// setETag adds the current ETag of a resource to the response.
+func setETag(c *gin.Context, etag etagFunc) bool {
+	tag, err := etag(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	c.Header("ETag", tag)
+	return true
+}
+
+// RequireIfMatch guards a mutating route with optimistic concurrency. The
+// request must carry an If-Match header matching the resource's current ETag
+// (or "*"), otherwise it is rejected with 428 when the header is missing and
+// 412 when it is stale. Guarded writes are serialized so the check and the
+// write cannot interleave with another API call.
+func (s *Server) RequireIfMatch(etag etagFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ifMatch := c.GetHeader("If-Match")
+		if ifMatch == "" {
+			c.AbortWithStatusJSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required"})
+			return
+		}
+
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+
+		current, err := etag(c.Request.Context())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !etagMatches(ifMatch, current) {
+			c.Header("ETag", current)
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "resource has been modified, reload and retry"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// etagMatches reports whether an If-Match header value matches etag.
+func etagMatches(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventKeepalive is the interval of comments sent on idle event streams
+const eventKeepalive = 30 * time.Second
+
+// GetLeaseEvents returns the latest lease events
+// @Summary      Get lease events
+// @Description  Returns the latest add, old and del lease events reported by dnsmasq, oldest first
+// @Tags         dhcp
+// @Produce      json
+// @Param        since  query     int  false  "Only return events with a greater ID"
+// @Param        limit  query     int  false  "Maximum number of events"
+// @Success      200    {object}  map[string][]services.LeaseEvent
+// @Failure      400    {object}  map[string]string
+// @Router       /dhcp/events [get]
+func (s *Server) GetLeaseEvents(c *gin.Context) {
+	since, err := strconv.ParseUint(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil || limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": s.eventService.GetEvents(since, limit)})
+}
+
+// StreamLeaseEvents streams lease events as server-sent events
+// @Summary      Stream lease events
+// @Description  Streams lease events as server-sent events named lease. Events after since, or after the Last-Event-ID header of a reconnecting client, are replayed first.
+// @Tags         dhcp
+// @Produce      text/event-stream
+// @Param        since  query     int  false  "Replay events with a greater ID"
+// @Success      200    {object}  services.LeaseEvent
+// @Failure      400    {object}  map[string]string
+// @Router       /dhcp/events/stream [get]
+func (s *Server) StreamLeaseEvents(c *gin.Context) {
+	since := c.Query("since")
+	if since == "" {
+		since = c.GetHeader("Last-Event-ID")
+	}
+	last, err := strconv.ParseUint(since, 10, 64)
+	if since != "" && err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since"})
+		return
+	}
+
+	// Subscribe before reading the history so no event is missed in between
+	events, cancel := s.eventService.Subscribe()
+	defer cancel()
+	var replay []byte
+	if since != "" {
+		for _, event := range s.eventService.GetEvents(last, 0) {
+			data, _ := json.Marshal(event)
+			replay = fmt.Appendf(replay, "id: %d\nevent: lease\ndata: %s\n\n", event.ID, data)
+			last = event.ID
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Write(replay)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event := <-events:
+			if event.ID <= last {
+				// Already replayed
+				return true
+			}
+			last = event.ID
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: lease\ndata: %s\n\n", event.ID, data)
+		}
+		return true
+	})
+}
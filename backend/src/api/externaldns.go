@@ -0,0 +1,91 @@
+package api
+
+import (
+	"backend/src/services"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// externalDNSJSON writes a response in the media type of the ExternalDNS
+// webhook protocol, which ExternalDNS checks on every response
+func externalDNSJSON(c *gin.Context, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Vary", "Content-Type")
+	c.Data(status, services.ExternalDNSMediaType, data)
+}
+
+// NegotiateExternalDNS starts the ExternalDNS webhook protocol
+// @Summary      Negotiate with ExternalDNS
+// @Description  Returns the domain filter of the ExternalDNS webhook provider, from EXTERNAL_DNS_DOMAIN_FILTER and EXTERNAL_DNS_EXCLUDE_DOMAINS. The provider is served without basic auth on EXTERNAL_DNS_WEBHOOK_PORT (8888), not on the port of the rest of the API.
+// @Tags         externaldns
+// @Produce      json
+// @Success      200  {object}  services.ExternalDNSDomainFilter
+// @Router       /externaldns [get]
+func (s *Server) NegotiateExternalDNS(c *gin.Context) {
+	externalDNSJSON(c, http.StatusOK, s.configService.ExternalDNSDomainFilter())
+}
+
+// GetExternalDNSRecords returns the records owned by ExternalDNS
+// @Summary      Get ExternalDNS records
+// @Description  Returns the custom DNS entries marked as owned by ExternalDNS, as webhook endpoints
+// @Tags         externaldns
+// @Produce      json
+// @Success      200  {array}   services.ExternalDNSEndpoint
+// @Failure      500  {object}  map[string]string
+// @Router       /externaldns/records [get]
+func (s *Server) GetExternalDNSRecords(c *gin.Context) {
+	endpoints, err := s.configService.GetExternalDNSEndpoints(c.Request.Context())
+	if err != nil {
+		externalDNSJSON(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	externalDNSJSON(c, http.StatusOK, endpoints)
+}
+
+// ApplyExternalDNSChanges applies the changes planned by ExternalDNS
+// @Summary      Apply ExternalDNS changes
+// @Description  Creates, updates and deletes custom DNS entries owned by ExternalDNS. Entries added through the rest of the API are never changed.
+// @Tags         externaldns
+// @Accept       json
+// @Param        changes  body      services.ExternalDNSChanges  true  "Changes"
+// @Success      204
+// @Failure      400      {object}  map[string]string
+// @Failure      500      {object}  map[string]string
+// @Router       /externaldns/records [post]
+func (s *Server) ApplyExternalDNSChanges(c *gin.Context) {
+	var changes services.ExternalDNSChanges
+	if err := c.ShouldBindJSON(&changes); err != nil {
+		externalDNSJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.configService.ApplyExternalDNSChanges(c.Request.Context(), changes); err != nil {
+		externalDNSJSON(c, errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// AdjustExternalDNSEndpoints filters the endpoints planned by ExternalDNS
+// @Summary      Adjust ExternalDNS endpoints
+// @Description  Drops the endpoints that cannot be stored as custom DNS entries and clears the TTL and provider specific properties, which are not kept
+// @Tags         externaldns
+// @Accept       json
+// @Produce      json
+// @Param        endpoints  body      []services.ExternalDNSEndpoint  true  "Endpoints"
+// @Success      200        {array}   services.ExternalDNSEndpoint
+// @Failure      400        {object}  map[string]string
+// @Router       /externaldns/adjustendpoints [post]
+func (s *Server) AdjustExternalDNSEndpoints(c *gin.Context) {
+	var endpoints []services.ExternalDNSEndpoint
+	if err := c.ShouldBindJSON(&endpoints); err != nil {
+		externalDNSJSON(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	externalDNSJSON(c, http.StatusOK, services.AdjustExternalDNSEndpoints(endpoints))
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"backend/src/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type UpdateForwarderRequest struct {
+	Old services.Forwarder `json:"old"`
+	New services.Forwarder `json:"new"`
+}
+
+// GetForwarders returns all upstream forwarders
+// @Summary      Get DNS forwarders
+// @Description  Returns global upstream servers, conditional forwarders, rev-server and local entries
+// @Tags         dns
+// @Produce      json
+// @Success      200  {object}  map[string][]services.Forwarder
+// @Header       200  {string}  ETag  "Version of the forwarders, send it back in If-Match"
+// @Failure      500  {object}  map[string]string
+// @Router       /dns/forwarders [get]
+func (s *Server) GetForwarders(c *gin.Context) {
+	if !setETag(c, s.configService.ForwardersETag) {
+		return
+	}
+	forwarders, err := s.configService.GetForwarders(c.Request.Context())
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"forwarders": forwarders})
+}
+
+// AddForwarder adds a new upstream forwarder
+// @Summary      Add DNS forwarder
+// @Description  Adds a server, rev-server or local entry
+// @Tags         dns
+// @Accept       json
+// @Produce      json
+// @Param        forwarder  body      services.Forwarder  true  "Forwarder"
+// @Param        If-Match   header    string              true  "ETag from the last GET"
+// @Success      200        {object}  map[string]string
+// @Failure      400        {object}  map[string]string
+// @Failure      412        {object}  map[string]string
+// @Failure      428        {object}  map[string]string
+// @Failure      500        {object}  map[string]string
+// @Router       /dns/forwarders [post]
+func (s *Server) AddForwarder(c *gin.Context) {
+	var json services.Forwarder
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateForwarder(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.configService.AddForwarder(c.Request.Context(), json); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// UpdateForwarder updates an upstream forwarder
+// @Summary      Update DNS forwarder
+// @Description  Updates a server, rev-server or local entry
+// @Tags         dns
+// @Accept       json
+// @Produce      json
+// @Param        forwarder  body      UpdateForwarderRequest  true  "Forwarder Update"
+// @Param        If-Match   header    string                  true  "ETag from the last GET"
+// @Success      200        {object}  map[string]string
+// @Failure      400        {object}  map[string]string
+// @Failure      404        {object}  map[string]string
+// @Failure      412        {object}  map[string]string
+// @Failure      428        {object}  map[string]string
+// @Failure      500        {object}  map[string]string
+// @Router       /dns/forwarders [put]
+func (s *Server) UpdateForwarder(c *gin.Context) {
+	var json UpdateForwarderRequest
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateForwarder(json.New); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.configService.UpdateForwarder(c.Request.Context(), json.Old, json.New); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// DeleteForwarder deletes an upstream forwarder
+// @Summary      Delete DNS forwarder
+// @Description  Deletes a server, rev-server or local entry
+// @Tags         dns
+// @Accept       json
+// @Produce      json
+// @Param        forwarder  body      services.Forwarder  true  "Forwarder"
+// @Param        If-Match   header    string              true  "ETag from the last GET"
+// @Success      200        {object}  map[string]string
+// @Failure      400        {object}  map[string]string
+// @Failure      404        {object}  map[string]string
+// @Failure      412        {object}  map[string]string
+// @Failure      428        {object}  map[string]string
+// @Failure      500        {object}  map[string]string
+// @Router       /dns/forwarders [delete]
+func (s *Server) DeleteForwarder(c *gin.Context) {
+	var json services.Forwarder
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.configService.DeleteForwarder(c.Request.Context(), json); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
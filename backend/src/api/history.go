@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetHistory returns the revision history
+// @Summary      Get revision history
+// @Description  Returns revisions of dnsmasq.conf, custom.conf and the DHCP reservations, ranges and options files, newest first
+// @Tags         history
+// @Produce      json
+// @Param        file  query     string  false  "Only return revisions of this file"
+// @Success      200   {object}  map[string][]services.Revision
+// @Failure      500   {object}  map[string]string
+// @Router       /history [get]
+func (s *Server) GetHistory(c *gin.Context) {
+	revisions, err := s.historyService.GetHistory(c.Request.Context(), c.Query("file"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions})
+}
+
+// GetRevision returns a single revision
+// @Summary      Get revision
+// @Description  Returns a revision including the file content
+// @Tags         history
+// @Produce      json
+// @Param        rev  path      int  true  "Revision"
+// @Success      200  {object}  services.Revision
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /history/{rev} [get]
+func (s *Server) GetRevision(c *gin.Context) {
+	rev, err := strconv.Atoi(c.Param("rev"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+
+	revision, err := s.historyService.GetRevision(c.Request.Context(), rev)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, revision)
+}
+
+// RestoreRevision rolls a file back to a revision
+// @Summary      Restore revision
+// @Description  Writes the content of a revision back to its file, recorded as a new revision
+// @Tags         history
+// @Produce      json
+// @Param        rev  path      int  true  "Revision"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /history/{rev}/restore [post]
+func (s *Server) RestoreRevision(c *gin.Context) {
+	rev, err := strconv.Atoi(c.Param("rev"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	revision, err := s.historyService.Restore(c.Request.Context(), rev)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// Restoring content identical to the current file records nothing
+	if revision == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "rev": revision.Rev})
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"backend/src/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetPXE returns the network boot configuration
+// @Summary      Get PXE configuration
+// @Description  Returns the TFTP settings, the boot profiles and the architectures profiles can target
+// @Tags         pxe
+// @Produce      json
+// @Success      200  {object}  services.PXEConfig
+// @Header       200  {string}  ETag  "Version of the PXE configuration, send it back in If-Match"
+// @Failure      500  {object}  map[string]string
+// @Router       /pxe [get]
+func (s *Server) GetPXE(c *gin.Context) {
+	if !setETag(c, s.dhcpService.PXEETag) {
+		return
+	}
+	config, err := s.dhcpService.GetPXE(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tftp_enabled":  config.TFTPEnabled,
+		"tftp_root":     config.TFTPRoot,
+		"profiles":      config.Profiles,
+		"extra":         config.Extra,
+		"architectures": services.PXEArchitectures(),
+	})
+}
+
+// UpdatePXESettings changes the TFTP settings
+// @Summary      Update TFTP settings
+// @Description  Enables or disables the built-in TFTP server and sets its root. The boot files of the profiles it serves must exist in the root.
+// @Tags         pxe
+// @Accept       json
+// @Produce      json
+// @Param        settings  body      services.PXESettings  true  "TFTP settings"
+// @Param        If-Match  header    string                true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /pxe [put]
+func (s *Server) UpdatePXESettings(c *gin.Context) {
+	var json services.PXESettings
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidatePXESettings(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.dhcpService.UpdatePXESettings(c.Request.Context(), json); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// GetPXEProfile returns a single boot profile
+// @Summary      Get PXE profile
+// @Description  Returns the boot profile with the given ID
+// @Tags         pxe
+// @Produce      json
+// @Param        id   path      string  true  "Profile ID"
+// @Success      200  {object}  services.PXEProfile
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /pxe/profiles/{id} [get]
+func (s *Server) GetPXEProfile(c *gin.Context) {
+	profile, err := s.dhcpService.GetPXEProfile(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// AddPXEProfile adds a boot profile
+// @Summary      Add PXE profile
+// @Description  Adds a boot file or PXE menu entry for an architecture and/or tags and returns its ID
+// @Tags         pxe
+// @Accept       json
+// @Produce      json
+// @Param        profile   body      services.PXEProfile  true  "PXE profile"
+// @Param        If-Match  header    string               true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /pxe/profiles [post]
+func (s *Server) AddPXEProfile(c *gin.Context) {
+	var json services.PXEProfile
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidatePXEProfile(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.dhcpService.AddPXEProfile(c.Request.Context(), json)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id})
+}
+
+// UpdatePXEProfile replaces a boot profile
+// @Summary      Update PXE profile
+// @Description  Replaces the boot profile with the given ID and returns its new ID
+// @Tags         pxe
+// @Accept       json
+// @Produce      json
+// @Param        id        path      string               true  "Profile ID"
+// @Param        profile   body      services.PXEProfile  true  "PXE profile"
+// @Param        If-Match  header    string               true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /pxe/profiles/{id} [put]
+func (s *Server) UpdatePXEProfile(c *gin.Context) {
+	var json services.PXEProfile
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidatePXEProfile(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.dhcpService.UpdatePXEProfile(c.Request.Context(), c.Param("id"), json)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id})
+}
+
+// DeletePXEProfile deletes a boot profile
+// @Summary      Delete PXE profile
+// @Description  Deletes the boot profile with the given ID
+// @Tags         pxe
+// @Produce      json
+// @Param        id        path      string  true  "Profile ID"
+// @Param        If-Match  header    string  true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /pxe/profiles/{id} [delete]
+func (s *Server) DeletePXEProfile(c *gin.Context) {
+	if err := s.dhcpService.DeletePXEProfile(c.Request.Context(), c.Param("id")); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
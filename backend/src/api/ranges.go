@@ -0,0 +1,141 @@
+package api
+
+import (
+	"backend/src/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetRanges returns all DHCP ranges
+// @Summary      Get DHCP ranges
+// @Description  Returns the IPv4 and IPv6 dhcp-range entries of the managed ranges file
+// @Tags         dhcp
+// @Produce      json
+// @Success      200  {object}  map[string][]services.DHCPRange
+// @Header       200  {string}  ETag  "Version of the ranges, send it back in If-Match"
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/ranges [get]
+func (s *Server) GetRanges(c *gin.Context) {
+	if !setETag(c, s.dhcpService.RangesETag) {
+		return
+	}
+	ranges, err := s.dhcpService.GetRanges(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ranges": ranges})
+}
+
+// GetRange returns a single DHCP range
+// @Summary      Get DHCP range
+// @Description  Returns the DHCP range with the given ID
+// @Tags         dhcp
+// @Produce      json
+// @Param        id   path      string  true  "Range ID"
+// @Success      200  {object}  services.DHCPRange
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/ranges/{id} [get]
+func (s *Server) GetRange(c *gin.Context) {
+	r, err := s.dhcpService.GetRange(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// AddRange adds a new DHCP range
+// @Summary      Add DHCP range
+// @Description  Adds an IPv4 or IPv6 range and returns its ID. Ranges may not overlap.
+// @Tags         dhcp
+// @Accept       json
+// @Produce      json
+// @Param        range     body      services.DHCPRange  true  "DHCP Range"
+// @Param        If-Match  header    string              true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      409       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /dhcp/ranges [post]
+func (s *Server) AddRange(c *gin.Context) {
+	var json services.DHCPRange
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateRange(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.dhcpService.AddRange(c.Request.Context(), json)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id})
+}
+
+// UpdateRange replaces a DHCP range
+// @Summary      Update DHCP range
+// @Description  Replaces the DHCP range with the given ID and returns its new ID
+// @Tags         dhcp
+// @Accept       json
+// @Produce      json
+// @Param        id        path      string              true  "Range ID"
+// @Param        range     body      services.DHCPRange  true  "DHCP Range"
+// @Param        If-Match  header    string              true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      400       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      409       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /dhcp/ranges/{id} [put]
+func (s *Server) UpdateRange(c *gin.Context) {
+	var json services.DHCPRange
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateRange(json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := s.dhcpService.UpdateRange(c.Request.Context(), c.Param("id"), json)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "id": id})
+}
+
+// DeleteRange deletes a DHCP range
+// @Summary      Delete DHCP range
+// @Description  Deletes the DHCP range with the given ID
+// @Tags         dhcp
+// @Produce      json
+// @Param        id        path      string  true  "Range ID"
+// @Param        If-Match  header    string  true  "ETag from the last GET"
+// @Success      200       {object}  map[string]string
+// @Failure      404       {object}  map[string]string
+// @Failure      412       {object}  map[string]string
+// @Failure      428       {object}  map[string]string
+// @Failure      500       {object}  map[string]string
+// @Router       /dhcp/ranges/{id} [delete]
+func (s *Server) DeleteRange(c *gin.Context) {
+	if err := s.dhcpService.DeleteRange(c.Request.Context(), c.Param("id")); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
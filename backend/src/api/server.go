@@ -3,6 +3,9 @@ package api
 import (
 	"backend/src/services"
 	"context"
+	"errors"
+	"net/http"
+	"sync"
 )
 
 type Server struct {
@@ -10,21 +13,81 @@ type Server struct {
 	dhcpService       *services.DHCPService
 	statusService     *services.StatusService
 	supervisorService *services.SupervisorService
+	blocklistService  *services.BlocklistService
+	historyService    *services.HistoryService
+	eventService      *services.EventService
+	deviceService     *services.DeviceService
+	autoDNSService    *services.AutoDNSService
+	clusterService    *services.ClusterService
+
+	// writeMu serializes writes guarded by RequireIfMatch, restores and tag
+	// renames
+	writeMu sync.Mutex
 }
 
-func NewServer(configService *services.ConfigService, dhcpService *services.DHCPService, statusService *services.StatusService, supervisorService *services.SupervisorService) *Server {
+func NewServer(configService *services.ConfigService, dhcpService *services.DHCPService, statusService *services.StatusService, supervisorService *services.SupervisorService, blocklistService *services.BlocklistService, historyService *services.HistoryService, eventService *services.EventService, deviceService *services.DeviceService, autoDNSService *services.AutoDNSService, clusterService *services.ClusterService) *Server {
 	server := &Server{
 		configService:     configService,
 		dhcpService:       dhcpService,
 		statusService:     statusService,
 		supervisorService: supervisorService,
+		blocklistService:  blocklistService,
+		historyService:    historyService,
+		eventService:      eventService,
+		deviceService:     deviceService,
+		autoDNSService:    autoDNSService,
+		clusterService:    clusterService,
+	}
+
+	// Only the leader syncs the managed files to their ConfigMaps. Without
+	// clustering this replica always leads.
+	leading := []func(context.Context){
+		configService.StartConfigSync,
+		configService.StartCustomDNSSync,
+		configService.StartForwardersSync,
+		configService.StartExternalDNSSync,
+		dhcpService.StartReservationsSync,
+		dhcpService.StartRangesSync,
+		dhcpService.StartDHCPOptionsSync,
+		dhcpService.StartPXESync,
+	}
+	if deviceService != nil {
+		leading = append(leading, deviceService.StartDeviceSync)
+	}
+	if clusterService == nil {
+		go dhcpService.StartLeaseSync(context.Background())
+		for _, start := range leading {
+			go start(context.Background())
+		}
+	} else {
+		// The leader syncs leases as part of TakeOverDHCP
+		for _, start := range leading {
+			clusterService.OnLeading(start)
+		}
 	}
 
-	go dhcpService.StartLeaseSync(context.Background())
-	go configService.StartConfigSync(context.Background())
-	go configService.StartCustomDNSSync(context.Background())
 	go configService.StartConfigMapWatch(context.Background())
-	go dhcpService.StartReservationsSync(context.Background())
+	go blocklistService.StartBlocklistSync(context.Background())
+	if eventService != nil {
+		go eventService.StartListener(context.Background())
+	}
+	if autoDNSService != nil {
+		go autoDNSService.Start(context.Background())
+	}
 
 	return server
 }
+
+// errorStatus maps a service error to an HTTP status code.
+func errorStatus(err error) int {
+	if errors.Is(err, services.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, services.ErrConflict) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, services.ErrInvalid) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"backend/src/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetDHCPTags returns all DHCP tags with their usage
+// @Summary      Get DHCP tags
+// @Description  Returns defined tags and tags used in the configuration, with the reservations, ranges, options and dnsmasq.conf lines using them
+// @Tags         dhcp
+// @Produce      json
+// @Success      200  {object}  map[string][]services.Tag
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/tags [get]
+func (s *Server) GetDHCPTags(c *gin.Context) {
+	tags, err := s.dhcpService.GetTags(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
+
+// GetDHCPTag returns a single DHCP tag
+// @Summary      Get DHCP tag
+// @Description  Returns the tag with the given name and its usage
+// @Tags         dhcp
+// @Produce      json
+// @Param        name  path      string  true  "Tag name"
+// @Success      200   {object}  services.Tag
+// @Failure      404   {object}  map[string]string
+// @Failure      500   {object}  map[string]string
+// @Router       /dhcp/tags/{name} [get]
+func (s *Server) GetDHCPTag(c *gin.Context) {
+	tag, err := s.dhcpService.GetTag(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tag)
+}
+
+// CreateDHCPTag defines a new DHCP tag
+// @Summary      Create DHCP tag
+// @Description  Defines a tag so it can be used by reservations, ranges and options
+// @Tags         dhcp
+// @Accept       json
+// @Produce      json
+// @Param        tag  body      services.Tag  true  "Tag"
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object}  map[string]string
+// @Failure      409  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /dhcp/tags [post]
+func (s *Server) CreateDHCPTag(c *gin.Context) {
+	var json services.Tag
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateTagName(json.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.dhcpService.CreateTag(c.Request.Context(), json); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// UpdateDHCPTag renames a DHCP tag or updates its description
+// @Summary      Update DHCP tag
+// @Description  Updates the description of a tag. When the name changes, the tag is renamed in reservations.conf, the ranges and options files and dnsmasq.conf.
+// @Tags         dhcp
+// @Accept       json
+// @Produce      json
+// @Param        name  path      string        true  "Tag name"
+// @Param        tag   body      services.Tag  true  "Tag"
+// @Success      200   {object}  map[string]string
+// @Failure      400   {object}  map[string]string
+// @Failure      404   {object}  map[string]string
+// @Failure      409   {object}  map[string]string
+// @Failure      500   {object}  map[string]string
+// @Router       /dhcp/tags/{name} [put]
+func (s *Server) UpdateDHCPTag(c *gin.Context) {
+	var json services.Tag
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.ValidateTagName(json.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if err := s.dhcpService.UpdateTag(c.Request.Context(), c.Param("name"), json); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// DeleteDHCPTag deletes a DHCP tag
+// @Summary      Delete DHCP tag
+// @Description  Deletes a tag definition. Tags still used by a reservation, range, option or dnsmasq.conf line are rejected with 409.
+// @Tags         dhcp
+// @Produce      json
+// @Param        name  path      string  true  "Tag name"
+// @Success      200   {object}  map[string]string
+// @Failure      404   {object}  map[string]string
+// @Failure      409   {object}  map[string]string
+// @Failure      500   {object}  map[string]string
+// @Router       /dhcp/tags/{name} [delete]
+func (s *Server) DeleteDHCPTag(c *gin.Context) {
+	if err := s.dhcpService.DeleteTag(c.Request.Context(), c.Param("name")); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,346 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations of the Services, Ingresses and HTTPRoutes published in DNS
+const (
+	// HostnameAnnotation lists the hostnames to publish, comma separated
+	HostnameAnnotation = "dnsmasq-k8s.io/hostname"
+	// TargetAnnotation overrides the addresses the hostnames resolve to, IP
+	// addresses
+	TargetAnnotation = "dnsmasq-k8s.io/target"
+)
+
+// autoDNSHeader is the first line of the generated hosts file
+const autoDNSHeader = "# Generated by dnsmasq-k8s from annotated Services, Ingresses and HTTPRoutes, do not edit"
+
+var (
+	httpRoutesResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+	gatewaysResource   = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gateways"}
+)
+
+// PublishedRecord is a DNS record published for a Kubernetes object.
+type PublishedRecord struct {
+	// Source is the object, as <kind>/<namespace>/<name>
+	Source   string `json:"source"`
+	Hostname string `json:"hostname"`
+	// Targets are the IP addresses the hostname resolves to
+	Targets []string `json:"targets"`
+}
+
+// AutoDNSService publishes DNS records for the Services, Ingresses and
+// HTTPRoutes annotated with HostnameAnnotation. The records are written to a
+// hosts file dnsmasq reads with addn-hosts, rewritten from the cluster state
+// on every change, so records of deleted objects go away with them. Every
+// replica keeps its own file, dnsmasq reloads it on SIGHUP without a restart.
+//
+// Load balancers known by a hostname only, such as AWS ELBs, are not
+// published: a hosts file has no CNAMEs, and dnsmasq only answers a cname=
+// whose target it knows itself.
+type AutoDNSService struct {
+	clientset kubernetes.Interface
+	// dynamicClient reads HTTPRoutes and Gateways, which the clientset does
+	// not know. HTTPRoutes are not published without it.
+	dynamicClient dynamic.Interface
+	// namespace limits the objects published, all namespaces when empty
+	namespace   string
+	autoDNSFile string
+	// supervisor signals dnsmasq to reload the file, see SetSupervisor
+	supervisor ServiceSignaler
+	resync     time.Duration
+}
+
+func NewAutoDNSService(clientset kubernetes.Interface, dynamicClient dynamic.Interface) *AutoDNSService {
+	// dnsmasq reads the hosts files of /etc/dnsmasq-hosts, see
+	// supervisord.conf
+	autoDNSFile := os.Getenv("DNSMASQ_AUTO_DNS_FILE")
+	if autoDNSFile == "" {
+		autoDNSFile = "/etc/dnsmasq-hosts/auto-dns.hosts"
+	}
+	return &AutoDNSService{
+		clientset:     clientset,
+		dynamicClient: dynamicClient,
+		namespace:     os.Getenv("AUTO_DNS_NAMESPACE"),
+		autoDNSFile:   autoDNSFile,
+		resync:        5 * time.Minute,
+	}
+}
+
+// SetSupervisor makes changes to the published records send SIGHUP to
+// dnsmasq, which then reads its hosts files again.
+func (s *AutoDNSService) SetSupervisor(supervisor ServiceSignaler) {
+	s.supervisor = supervisor
+}
+
+// Start publishes the records, then again whenever an object changes, until
+// ctx is done.
+func (s *AutoDNSService) Start(ctx context.Context) {
+	where := "all namespaces"
+	if s.namespace != "" {
+		where = "namespace " + s.namespace
+	}
+	fmt.Printf("INFO: Publishing DNS records for annotated objects in %s to %s\n", where, s.autoDNSFile)
+	for {
+		if err := s.Sync(ctx); err != nil {
+			fmt.Printf("WARN: failed to publish DNS records: %v\n", err)
+		}
+		s.waitForChange(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (s *AutoDNSService) waitForChange(ctx context.Context) {
+	watches := []func(context.Context) (watch.Interface, error){
+		func(ctx context.Context) (watch.Interface, error) {
+			return s.clientset.CoreV1().Services(s.namespace).Watch(ctx, metav1.ListOptions{})
+		},
+		func(ctx context.Context) (watch.Interface, error) {
+			return s.clientset.NetworkingV1().Ingresses(s.namespace).Watch(ctx, metav1.ListOptions{})
+		},
+	}
+	if s.dynamicClient != nil {
+		for _, gvr := range []schema.GroupVersionResource{httpRoutesResource, gatewaysResource} {
+			watches = append(watches, func(ctx context.Context) (watch.Interface, error) {
+				return s.dynamicClient.Resource(gvr).Namespace(s.namespace).Watch(ctx, metav1.ListOptions{})
+			})
+		}
+	}
+	waitForWatches(ctx, s.resync, watches...)
+}
+
+// GetPublishedRecords returns the records published for the annotated
+// objects, sorted by source.
+func (s *AutoDNSService) GetPublishedRecords(ctx context.Context) ([]PublishedRecord, error) {
+	records := []PublishedRecord{}
+
+	services, err := s.clientset.CoreV1().Services(s.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %v", err)
+	}
+	for _, svc := range services.Items {
+		var targets []string
+		if svc.Spec.Type == corev1.ServiceTypeLoadBalancer {
+			for _, ingress := range svc.Status.LoadBalancer.Ingress {
+				targets = append(targets, ingress.IP, ingress.Hostname)
+			}
+		}
+		targets = append(targets, svc.Spec.ExternalIPs...)
+		records = append(records, publishedRecords("service", svc.ObjectMeta, targets)...)
+	}
+
+	ingresses, err := s.clientset.NetworkingV1().Ingresses(s.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ingresses: %v", err)
+	}
+	for _, ing := range ingresses.Items {
+		var targets []string
+		for _, ingress := range ing.Status.LoadBalancer.Ingress {
+			targets = append(targets, ingress.IP, ingress.Hostname)
+		}
+		records = append(records, publishedRecords("ingress", ing.ObjectMeta, targets)...)
+	}
+
+	if s.dynamicClient != nil {
+		routes, err := s.httpRouteRecords(ctx)
+		if err != nil {
+			// Without the Gateway API CRDs there are no routes to publish
+			fmt.Printf("WARN: skipping HTTPRoutes: %v\n", err)
+		}
+		records = append(records, routes...)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Source < records[j].Source })
+	return records, nil
+}
+
+// httpRouteRecords returns the records of annotated HTTPRoutes, which resolve
+// to the addresses of their parent Gateways.
+func (s *AutoDNSService) httpRouteRecords(ctx context.Context) ([]PublishedRecord, error) {
+	routes, err := s.dynamicClient.Resource(httpRoutesResource).Namespace(s.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list httproutes: %v", err)
+	}
+
+	var records []PublishedRecord
+	gateways := map[string][]string{}
+	for _, route := range routes.Items {
+		meta := metav1.ObjectMeta{Name: route.GetName(), Namespace: route.GetNamespace(), Annotations: route.GetAnnotations()}
+		if meta.Annotations[HostnameAnnotation] == "" {
+			continue
+		}
+		var targets []string
+		parents, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+		for _, parent := range parents {
+			ref, ok := parent.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if kind, _ := ref["kind"].(string); kind != "" && kind != "Gateway" {
+				continue
+			}
+			name, _ := ref["name"].(string)
+			namespace, _ := ref["namespace"].(string)
+			if namespace == "" {
+				namespace = route.GetNamespace()
+			}
+			key := namespace + "/" + name
+			if _, ok := gateways[key]; !ok {
+				gateways[key] = s.gatewayAddresses(ctx, namespace, name)
+			}
+			targets = append(targets, gateways[key]...)
+		}
+		records = append(records, publishedRecords("httproute", meta, targets)...)
+	}
+	return records, nil
+}
+
+func (s *AutoDNSService) gatewayAddresses(ctx context.Context, namespace, name string) []string {
+	gateway, err := s.dynamicClient.Resource(gatewaysResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		fmt.Printf("WARN: failed to get gateway %s/%s: %v\n", namespace, name, err)
+		return nil
+	}
+	var addresses []string
+	list, _, _ := unstructured.NestedSlice(gateway.Object, "status", "addresses")
+	for _, item := range list {
+		if address, ok := item.(map[string]interface{}); ok {
+			if value, ok := address["value"].(string); ok {
+				addresses = append(addresses, value)
+			}
+		}
+	}
+	return addresses
+}
+
+// publishedRecords returns a record per hostname of an annotated object.
+// TargetAnnotation replaces the object's own addresses. Invalid hostnames are
+// skipped, as are targets that are not IP addresses.
+func publishedRecords(kind string, meta metav1.ObjectMeta, targets []string) []PublishedRecord {
+	hostnames := splitAnnotation(meta.Annotations[HostnameAnnotation])
+	if len(hostnames) == 0 {
+		return nil
+	}
+	source := kind + "/" + meta.Namespace + "/" + meta.Name
+	if override := splitAnnotation(meta.Annotations[TargetAnnotation]); len(override) > 0 {
+		targets = override
+	}
+
+	var addresses, names []string
+	for _, target := range targets {
+		switch {
+		case target == "":
+		case net.ParseIP(target) != nil:
+			if !slices.Contains(addresses, target) {
+				addresses = append(addresses, target)
+			}
+		default:
+			names = append(names, target)
+		}
+	}
+	if len(addresses) == 0 {
+		if len(names) > 0 {
+			fmt.Printf("WARN: %s only has hostname targets (%s), not publishing %s\n", source, strings.Join(names, ", "), strings.Join(hostnames, ", "))
+		} else {
+			fmt.Printf("INFO: %s has no address yet, not publishing %s\n", source, strings.Join(hostnames, ", "))
+		}
+		return nil
+	}
+
+	var records []PublishedRecord
+	for _, hostname := range hostnames {
+		if !validHostname(hostname) {
+			fmt.Printf("WARN: %s has an invalid hostname: %q\n", source, hostname)
+			continue
+		}
+		records = append(records, PublishedRecord{Source: source, Hostname: strings.TrimSuffix(hostname, "."), Targets: addresses})
+	}
+	return records
+}
+
+func splitAnnotation(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func validHostname(hostname string) bool {
+	hostname = strings.TrimSuffix(hostname, ".")
+	return len(hostname) <= 253 && reDomain.MatchString(strings.ToLower(hostname))
+}
+
+// formatAutoDNS renders the generated hosts file. A hostname published by
+// several objects gets the addresses of all of them.
+func formatAutoDNS(records []PublishedRecord) string {
+	lines := []string{autoDNSHeader}
+	seen := map[string]bool{}
+	for _, record := range records {
+		for _, target := range record.Targets {
+			line := target + " " + record.Hostname
+			if seen[line] {
+				continue
+			}
+			seen[line] = true
+			lines = append(lines, line+" # "+record.Source)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Sync rewrites the generated file from the annotated objects, and signals
+// dnsmasq to reload it when it changed.
+func (s *AutoDNSService) Sync(ctx context.Context) error {
+	records, err := s.GetPublishedRecords(ctx)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockFile(s.autoDNSFile)
+	defer unlock()
+
+	content, err := readFile(s.autoDNSFile)
+	if err != nil {
+		return err
+	}
+	newContent := formatAutoDNS(records)
+	if newContent == string(content) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.autoDNSFile), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.autoDNSFile, []byte(newContent)); err != nil {
+		return err
+	}
+	fmt.Printf("INFO: Published %d DNS record(s) to %s\n", len(records), s.autoDNSFile)
+
+	if s.supervisor != nil {
+		if err := s.supervisor.SignalService(dnsmasqProgram, "HUP"); err != nil {
+			return fmt.Errorf("failed to reload dnsmasq: %v", err)
+		}
+	}
+	return nil
+}
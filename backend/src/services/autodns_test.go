@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPublishedRecords(t *testing.T) {
+	meta := metav1.ObjectMeta{Name: "web", Namespace: "apps", Annotations: map[string]string{
+		HostnameAnnotation: "web.home.lan, www.home.lan., bad_host!",
+	}}
+	records := publishedRecords("service", meta, []string{"", "lb.example.com", "192.168.1.240", "192.168.1.240"})
+	assert.Equal(t, []PublishedRecord{
+		{Source: "service/apps/web", Hostname: "web.home.lan", Targets: []string{"192.168.1.240"}},
+		{Source: "service/apps/web", Hostname: "www.home.lan", Targets: []string{"192.168.1.240"}},
+	}, records)
+
+	assert.Equal(t, "# Generated by dnsmasq-k8s from annotated Services, Ingresses and HTTPRoutes, do not edit\n"+
+		"192.168.1.240 web.home.lan # service/apps/web\n"+
+		"192.168.1.240 www.home.lan # service/apps/web\n", formatAutoDNS(records))
+
+	// Hostname targets can't be published
+	assert.Empty(t, publishedRecords("ingress", meta, []string{"lb.example.com."}))
+
+	// The target annotation replaces the object's addresses
+	meta.Annotations[TargetAnnotation] = "10.0.0.1,fd00::1"
+	records = publishedRecords("service", meta, []string{"192.168.1.240"})
+	assert.Equal(t, []string{"10.0.0.1", "fd00::1"}, records[0].Targets)
+
+	// Nothing is published before the object has an address
+	delete(meta.Annotations, TargetAnnotation)
+	assert.Empty(t, publishedRecords("service", meta, nil))
+	assert.Empty(t, publishedRecords("service", metav1.ObjectMeta{Name: "plain"}, []string{"192.168.1.240"}))
+}
+
+func TestAutoDNSService(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "autodns")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	autoDNSFile := filepath.Join(tmpDir, "hosts", "auto-dns.hosts")
+	os.Setenv("DNSMASQ_AUTO_DNS_FILE", autoDNSFile)
+	defer os.Unsetenv("DNSMASQ_AUTO_DNS_FILE")
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "default", Annotations: map[string]string{HostnameAnnotation: "myapp.home.lan"}},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+			Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "192.168.1.240"}},
+			}},
+		},
+		// Not annotated
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+			Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "192.168.1.241"}},
+			}},
+		},
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: "blog", Namespace: "web", Annotations: map[string]string{HostnameAnnotation: "blog.home.lan"}},
+			Status: networkingv1.IngressStatus{LoadBalancer: networkingv1.IngressLoadBalancerStatus{
+				Ingress: []networkingv1.IngressLoadBalancerIngress{{IP: "192.168.1.250"}},
+			}},
+		},
+	)
+	gateway := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "Gateway",
+		"metadata":   map[string]interface{}{"name": "public", "namespace": "gateways"},
+		"status": map[string]interface{}{"addresses": []interface{}{
+			map[string]interface{}{"type": "IPAddress", "value": "192.168.1.251"},
+		}},
+	}}
+	route := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "HTTPRoute",
+		"metadata": map[string]interface{}{"name": "shop", "namespace": "web", "annotations": map[string]interface{}{
+			HostnameAnnotation: "shop.home.lan",
+		}},
+		"spec": map[string]interface{}{"parentRefs": []interface{}{
+			map[string]interface{}{"name": "public", "namespace": "gateways"},
+		}},
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			httpRoutesResource: "HTTPRouteList",
+			gatewaysResource:   "GatewayList",
+		}, route)
+	// The fake client would guess "gatewaies" as the resource of Gateways
+	assert.NoError(t, dynamicClient.Tracker().Create(gatewaysResource, gateway, "gateways"))
+
+	autoDNSService := NewAutoDNSService(clientset, dynamicClient)
+	supervisor := &fakeSupervisor{}
+	autoDNSService.SetSupervisor(supervisor)
+	ctx := context.Background()
+
+	assert.NoError(t, autoDNSService.Sync(ctx))
+	content, err := os.ReadFile(autoDNSFile)
+	assert.NoError(t, err)
+	assert.Equal(t, autoDNSHeader+"\n"+
+		"192.168.1.251 shop.home.lan # httproute/web/shop\n"+
+		"192.168.1.250 blog.home.lan # ingress/web/blog\n"+
+		"192.168.1.240 myapp.home.lan # service/default/myapp\n", string(content))
+	assert.Equal(t, []string{"signal HUP dnsmasq"}, supervisor.calls)
+
+	// dnsmasq is only signaled when the records change
+	assert.NoError(t, autoDNSService.Sync(ctx))
+	assert.Len(t, supervisor.calls, 1)
+
+	// Records of deleted objects are removed
+	assert.NoError(t, clientset.CoreV1().Services("default").Delete(ctx, "myapp", metav1.DeleteOptions{}))
+	assert.NoError(t, dynamicClient.Resource(httpRoutesResource).Namespace("web").Delete(ctx, "shop", metav1.DeleteOptions{}))
+	assert.NoError(t, autoDNSService.Sync(ctx))
+	content, err = os.ReadFile(autoDNSFile)
+	assert.NoError(t, err)
+	assert.Equal(t, autoDNSHeader+"\n192.168.1.250 blog.home.lan # ingress/web/blog\n", string(content))
+	assert.Equal(t, []string{"signal HUP dnsmasq", "signal HUP dnsmasq"}, supervisor.calls)
+}
@@ -0,0 +1,710 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	blocklistConfigMap = "dnsmasq-blocklists"
+	blocklistConfigKey = "blocklists.json"
+	// BlocklistContentPrefix names the ConfigMap holding the source of an
+	// imported list, followed by the name of the list
+	BlocklistContentPrefix = "dnsmasq-blocklist-"
+	blocklistContentKey    = "blocklist.txt"
+	// maxBlocklistSize caps a single downloaded list
+	maxBlocklistSize = 64 << 20
+	// maxImportedBlocklistSize keeps an imported list within the 1 MiB limit
+	// of its ConfigMap
+	maxImportedBlocklistSize = 1000 * 1024
+)
+
+// BlocklistFetcher retrieves the raw content of a remote blocklist.
+type BlocklistFetcher interface {
+	Fetch(ctx context.Context, url string) (io.ReadCloser, error)
+}
+
+// HTTPBlocklistFetcher downloads blocklists over HTTP(S).
+type HTTPBlocklistFetcher struct {
+	Client *http.Client
+}
+
+func (f *HTTPBlocklistFetcher) Fetch(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Blocklist is a source of blocked domains, either downloaded from URL or
+// imported as inline Content (hosts or plain domain-list format). Imported
+// content is stored in a ConfigMap of its own, named after the list, and is
+// never part of the configuration.
+type Blocklist struct {
+	Name    string `json:"name"`
+	URL     string `json:"url,omitempty"`
+	Content string `json:"content,omitempty"`
+	Enabled bool   `json:"enabled"`
+}
+
+// BlocklistConfig is the source of truth stored in the dnsmasq-blocklists ConfigMap.
+type BlocklistConfig struct {
+	Lists     []Blocklist `json:"lists"`
+	Allowlist []string    `json:"allowlist"`
+	// Mode is "address" (answer 0.0.0.0) or "local" (answer NXDOMAIN)
+	Mode string `json:"mode"`
+}
+
+// BlocklistStats reports the result of the last refresh of a list.
+type BlocklistStats struct {
+	Name        string    `json:"name"`
+	Domains     int       `json:"domains"`
+	LastRefresh time.Time `json:"last_refresh"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// BlocklistSummary is returned by the API: the configuration with per-list stats.
+type BlocklistSummary struct {
+	BlocklistConfig
+	Stats        []BlocklistStats `json:"stats"`
+	TotalBlocked int              `json:"total_blocked"`
+}
+
+type BlocklistService struct {
+	clientset     kubernetes.Interface
+	namespace     string
+	blocklistFile string
+	fetcher       BlocklistFetcher
+
+	// configMu serializes the changes to the configuration
+	configMu     sync.Mutex
+	applyMu      sync.Mutex
+	mu           sync.Mutex
+	cache        map[string][]string
+	stats        map[string]BlocklistStats
+	totalBlocked int
+	// sources holds the URL each cached list was loaded from
+	sources map[string]string
+	// supervisor restarts dnsmasq when the blocklist file changes, see
+	// SetSupervisor
+	supervisor ServiceController
+}
+
+// NewBlocklistService creates the service. A nil fetcher downloads lists over HTTP.
+func NewBlocklistService(clientset kubernetes.Interface, namespace string, fetcher BlocklistFetcher) *BlocklistService {
+	blocklistFile := os.Getenv("DNSMASQ_BLOCKLIST_FILE")
+	if blocklistFile == "" {
+		blocklistFile = "/etc/dnsmasq.d/blocklist.conf"
+	}
+	if fetcher == nil {
+		fetcher = &HTTPBlocklistFetcher{Client: &http.Client{Timeout: 2 * time.Minute}}
+	}
+	return &BlocklistService{
+		clientset:     clientset,
+		namespace:     namespace,
+		blocklistFile: blocklistFile,
+		fetcher:       fetcher,
+		cache:         make(map[string][]string),
+		stats:         make(map[string]BlocklistStats),
+		sources:       make(map[string]string),
+	}
+}
+
+// SetSupervisor makes changes to the blocklist file restart dnsmasq, which
+// only reads /etc/dnsmasq.d when it starts.
+func (s *BlocklistService) SetSupervisor(supervisor ServiceController) {
+	s.supervisor = supervisor
+}
+
+func (s *BlocklistService) GetConfig(ctx context.Context) (*BlocklistConfig, error) {
+	config := &BlocklistConfig{Lists: []Blocklist{}, Allowlist: []string{}, Mode: "address"}
+
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, blocklistConfigMap, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+
+	if content, ok := configMap.Data[blocklistConfigKey]; ok && content != "" {
+		if err := json.Unmarshal([]byte(content), config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", blocklistConfigKey, err)
+		}
+	}
+	if config.Mode == "" {
+		config.Mode = "address"
+	}
+	return config, nil
+}
+
+// saveConfig stores the content of the imported lists in their own
+// ConfigMaps, then the configuration without it.
+func (s *BlocklistService) saveConfig(ctx context.Context, config *BlocklistConfig) error {
+	stored := *config
+	stored.Lists = make([]Blocklist, len(config.Lists))
+	for i, list := range config.Lists {
+		if list.Content != "" {
+			if err := UpdateConfigMapWithRetry(ctx, s.clientset, s.namespace, BlocklistContentPrefix+list.Name, blocklistContentKey, list.Content); err != nil {
+				return err
+			}
+			list.Content = ""
+		}
+		stored.Lists[i] = list
+	}
+
+	content, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return UpdateConfigMapWithRetry(ctx, s.clientset, s.namespace, blocklistConfigMap, blocklistConfigKey, string(content))
+}
+
+// importedContent returns the content of an imported list.
+func (s *BlocklistService) importedContent(ctx context.Context, name string) (string, error) {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, BlocklistContentPrefix+name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return configMap.Data[blocklistContentKey], nil
+}
+
+// deleteImportedContent removes the ConfigMap holding the content of a list.
+func (s *BlocklistService) deleteImportedContent(ctx context.Context, name string) error {
+	err := s.clientset.CoreV1().ConfigMaps(s.namespace).Delete(ctx, BlocklistContentPrefix+name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *BlocklistService) GetSummary(ctx context.Context) (*BlocklistSummary, error) {
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := &BlocklistSummary{BlocklistConfig: *config, Stats: []BlocklistStats{}, TotalBlocked: s.totalBlocked}
+	for _, list := range summary.Lists {
+		if stats, ok := s.stats[list.Name]; ok {
+			summary.Stats = append(summary.Stats, stats)
+		} else {
+			summary.Stats = append(summary.Stats, BlocklistStats{Name: list.Name})
+		}
+	}
+	return summary, nil
+}
+
+func (s *BlocklistService) AddBlocklist(ctx context.Context, list Blocklist) error {
+	if err := ValidateBlocklist(list); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+	for _, existing := range config.Lists {
+		if existing.Name == list.Name {
+			return fmt.Errorf("%w: blocklist %s already exists", ErrConflict, list.Name)
+		}
+	}
+	config.Lists = append(config.Lists, list)
+
+	if err := s.saveConfig(ctx, config); err != nil {
+		return err
+	}
+	return s.apply(ctx, config, list.Name)
+}
+
+func (s *BlocklistService) UpdateBlocklist(ctx context.Context, name string, list Blocklist) error {
+	if err := ValidateBlocklist(list); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	if list.Name != name {
+		for _, existing := range config.Lists {
+			if existing.Name == list.Name {
+				return fmt.Errorf("%w: blocklist %s already exists", ErrConflict, list.Name)
+			}
+		}
+	}
+
+	found := false
+	imported := false
+	for i, existing := range config.Lists {
+		if existing.Name == name {
+			imported = existing.URL == ""
+			// Keep imported content when the client only toggles or renames the list
+			if imported && list.URL == "" && list.Content == "" {
+				// Older versions stored the content in the configuration
+				list.Content = existing.Content
+				if list.Content == "" && list.Name != name {
+					if list.Content, err = s.importedContent(ctx, name); err != nil {
+						return err
+					}
+				}
+			}
+			config.Lists[i] = list
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("blocklist %w", ErrNotFound)
+	}
+
+	s.mu.Lock()
+	delete(s.cache, name)
+	delete(s.stats, name)
+	s.mu.Unlock()
+
+	if err := s.saveConfig(ctx, config); err != nil {
+		return err
+	}
+	if imported && (list.Name != name || list.URL != "") {
+		if err := s.deleteImportedContent(ctx, name); err != nil {
+			fmt.Printf("WARN: failed to delete the content of blocklist %s: %v\n", name, err)
+		}
+	}
+	return s.apply(ctx, config, list.Name)
+}
+
+func (s *BlocklistService) DeleteBlocklist(ctx context.Context, name string) error {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	lists := []Blocklist{}
+	for _, existing := range config.Lists {
+		if existing.Name != name {
+			lists = append(lists, existing)
+		}
+	}
+	if len(lists) == len(config.Lists) {
+		return fmt.Errorf("blocklist %w", ErrNotFound)
+	}
+	config.Lists = lists
+
+	s.mu.Lock()
+	delete(s.cache, name)
+	delete(s.stats, name)
+	s.mu.Unlock()
+
+	if err := s.saveConfig(ctx, config); err != nil {
+		return err
+	}
+	if err := s.deleteImportedContent(ctx, name); err != nil {
+		fmt.Printf("WARN: failed to delete the content of blocklist %s: %v\n", name, err)
+	}
+	return s.apply(ctx, config)
+}
+
+// SetAllowlist replaces the allowlist and re-renders the blocklist file.
+func (s *BlocklistService) SetAllowlist(ctx context.Context, domains []string) error {
+	allowlist := []string{}
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if !isValidDomain(domain) {
+			return fmt.Errorf("%w: invalid domain: %s", ErrInvalid, domain)
+		}
+		allowlist = append(allowlist, domain)
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+	config.Allowlist = allowlist
+
+	if err := s.saveConfig(ctx, config); err != nil {
+		return err
+	}
+	return s.apply(ctx, config)
+}
+
+// SetMode switches between address (0.0.0.0) and local (NXDOMAIN) blocking.
+func (s *BlocklistService) SetMode(ctx context.Context, mode string) error {
+	if mode != "address" && mode != "local" {
+		return fmt.Errorf("%w: unsupported blocklist mode: %s. Only 'address' and 'local' are supported", ErrInvalid, mode)
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+	config.Mode = mode
+
+	if err := s.saveConfig(ctx, config); err != nil {
+		return err
+	}
+	return s.apply(ctx, config)
+}
+
+// Refresh downloads the given lists again (all lists when none are given)
+// and re-renders the blocklist file.
+func (s *BlocklistService) Refresh(ctx context.Context, names ...string) error {
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, list := range config.Lists {
+		known[list.Name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("blocklist %w", ErrNotFound)
+		}
+	}
+
+	if len(names) == 0 {
+		for _, list := range config.Lists {
+			names = append(names, list.Name)
+		}
+	}
+	return s.apply(ctx, config, names...)
+}
+
+// Resync re-renders the blocklist file after the dnsmasq-blocklists ConfigMap
+// changed, possibly on another replica. Cached lists are reused unless their
+// URL changed; changes to imported content are picked up by Refresh.
+func (s *BlocklistService) Resync(ctx context.Context) error {
+	config, err := s.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	var changed []string
+	s.mu.Lock()
+	for _, list := range config.Lists {
+		if url, ok := s.sources[list.Name]; ok && url != list.URL {
+			changed = append(changed, list.Name)
+		}
+	}
+	s.mu.Unlock()
+	return s.apply(ctx, config, changed...)
+}
+
+// apply loads the lists in reload (and any list not cached yet), then writes
+// the merged, deduplicated result to the blocklist file and restarts dnsmasq
+// when it changed.
+func (s *BlocklistService) apply(ctx context.Context, config *BlocklistConfig, reload ...string) error {
+	// Serialize renders; mu only guards the cache and stats so readers are
+	// not blocked while lists are downloading.
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	toReload := make(map[string]bool)
+	for _, name := range reload {
+		toReload[name] = true
+	}
+
+	for _, list := range config.Lists {
+		s.mu.Lock()
+		previous, cached := s.cache[list.Name]
+		s.mu.Unlock()
+		if cached && !toReload[list.Name] {
+			continue
+		}
+
+		domains, stats := s.load(ctx, list, previous)
+		s.mu.Lock()
+		s.cache[list.Name] = domains
+		s.stats[list.Name] = stats
+		s.sources[list.Name] = list.URL
+		s.mu.Unlock()
+	}
+
+	blocked := make(map[string]bool)
+	s.mu.Lock()
+	for _, list := range config.Lists {
+		if !list.Enabled {
+			continue
+		}
+		for _, domain := range s.cache[list.Name] {
+			blocked[domain] = true
+		}
+	}
+	s.mu.Unlock()
+
+	content, total := renderBlocklist(blocked, config.Allowlist, config.Mode)
+
+	s.mu.Lock()
+	s.totalBlocked = total
+	s.mu.Unlock()
+
+	changed, err := s.writeBlocklist(content)
+	if err != nil {
+		return err
+	}
+	if changed && s.supervisor != nil {
+		return restartDnsmasq(s.supervisor)
+	}
+	return nil
+}
+
+// writeBlocklist writes content to the blocklist file and reports whether it
+// changed. A missing file is created even when content is empty.
+func (s *BlocklistService) writeBlocklist(content string) (bool, error) {
+	unlock := lockFile(s.blocklistFile)
+	defer unlock()
+
+	old, err := os.ReadFile(s.blocklistFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	changed := content != string(old)
+	if err == nil && !changed {
+		return false, nil
+	}
+	if err := writeFileAtomic(s.blocklistFile, []byte(content)); err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+// load fetches or parses a single list. Errors are reported through the stats
+// so one broken source doesn't block the others; on fetch errors the previous
+// copy of the list keeps being served.
+func (s *BlocklistService) load(ctx context.Context, list Blocklist, previous []string) ([]string, BlocklistStats) {
+	stats := BlocklistStats{Name: list.Name, LastRefresh: time.Now()}
+
+	var reader io.Reader
+	if list.URL != "" {
+		body, err := s.fetcher.Fetch(ctx, list.URL)
+		if err != nil {
+			stats.Error = err.Error()
+			stats.Domains = len(previous)
+			return previous, stats
+		}
+		defer body.Close()
+		reader = io.LimitReader(body, maxBlocklistSize)
+	} else {
+		content := list.Content
+		if content == "" {
+			var err error
+			if content, err = s.importedContent(ctx, list.Name); err != nil {
+				stats.Error = err.Error()
+				stats.Domains = len(previous)
+				return previous, stats
+			}
+		}
+		reader = strings.NewReader(content)
+	}
+
+	domains, err := ParseBlocklist(reader)
+	if err != nil {
+		stats.Error = err.Error()
+	}
+	stats.Domains = len(domains)
+	return domains, stats
+}
+
+// StartBlocklistSync renders the blocklist file from the ConfigMap on startup
+// and refreshes remote lists periodically (BLOCKLIST_REFRESH_INTERVAL, default 24h).
+func (s *BlocklistService) StartBlocklistSync(ctx context.Context) {
+	interval := 24 * time.Hour
+	if value := os.Getenv("BLOCKLIST_REFRESH_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			interval = parsed
+		} else {
+			fmt.Printf("WARN: invalid BLOCKLIST_REFRESH_INTERVAL %q, using %s\n", value, interval)
+		}
+	}
+
+	fmt.Printf("INFO: Starting blocklist sync for %s\n", s.blocklistFile)
+	if err := s.Refresh(ctx); err != nil {
+		fmt.Printf("ERROR: failed to render blocklist: %v\n", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Refresh(ctx); err != nil {
+				fmt.Printf("ERROR: failed to refresh blocklists: %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ValidateBlocklist checks a blocklist definition.
+func ValidateBlocklist(list Blocklist) error {
+	// The name of an imported list is part of the name of its ConfigMap
+	if !reBlocklistName.MatchString(list.Name) {
+		return fmt.Errorf("invalid blocklist name: %q, use lowercase letters, digits and dashes", list.Name)
+	}
+	if reservedBlocklistNames[list.Name] {
+		return fmt.Errorf("blocklist name %q is reserved", list.Name)
+	}
+	if list.URL != "" && list.Content != "" {
+		return fmt.Errorf("a blocklist takes either a url or imported content, not both")
+	}
+	if len(list.Content) > maxImportedBlocklistSize {
+		return fmt.Errorf("imported blocklists are limited to %d KiB, serve larger lists from a url", maxImportedBlocklistSize/1024)
+	}
+	if list.URL != "" && !strings.HasPrefix(list.URL, "http://") && !strings.HasPrefix(list.URL, "https://") {
+		return fmt.Errorf("blocklist url must be http or https: %s", list.URL)
+	}
+	return nil
+}
+
+var reBlocklistName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// reservedBlocklistNames clash with the routes under /dns/blocklists
+var reservedBlocklistNames = map[string]bool{"mode": true, "allowlist": true, "refresh": true}
+
+var reDomain = regexp.MustCompile(`^([a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?\.)*[a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?$`)
+
+func isValidDomain(domain string) bool {
+	return len(domain) <= 253 && reDomain.MatchString(domain) && net.ParseIP(domain) == nil
+}
+
+// ParseBlocklist reads hosts-format ("0.0.0.0 ads.example.com") and plain
+// domain-list files, returning the unique valid domains it contains.
+func ParseBlocklist(r io.Reader) ([]string, error) {
+	seen := make(map[string]bool)
+	var domains []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexAny(line, "#!"); idx != -1 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// hosts format: IP followed by one or more names, otherwise one domain per line
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		} else if len(fields) > 1 {
+			continue
+		}
+		for _, domain := range fields {
+			domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+			if domain == "localhost.localdomain" || !strings.Contains(domain, ".") {
+				continue
+			}
+			if !isValidDomain(domain) || seen[domain] {
+				continue
+			}
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// renderBlocklist writes one directive per blocked domain, skipping domains
+// already covered by a blocked parent. Allowlisted domains are removed, and
+// allowlisted subdomains of a blocked domain are sent upstream with server=/domain/#.
+func renderBlocklist(blocked map[string]bool, allowlist []string, mode string) (string, int) {
+	allowed := make(map[string]bool)
+	for _, domain := range allowlist {
+		allowed[domain] = true
+		delete(blocked, domain)
+	}
+
+	var domains []string
+	for domain := range blocked {
+		if !hasBlockedParent(domain, blocked) {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+
+	var b strings.Builder
+	b.WriteString("# Generated by dnsmasq-k8s from the dnsmasq-blocklists ConfigMap, do not edit.\n")
+	for _, domain := range domains {
+		if mode == "local" {
+			fmt.Fprintf(&b, "local=/%s/\n", domain)
+		} else {
+			fmt.Fprintf(&b, "address=/%s/0.0.0.0\n", domain)
+		}
+	}
+
+	var exceptions []string
+	for domain := range allowed {
+		if hasBlockedParent(domain, blocked) {
+			exceptions = append(exceptions, domain)
+		}
+	}
+	sort.Strings(exceptions)
+	for _, domain := range exceptions {
+		fmt.Fprintf(&b, "server=/%s/#\n", domain)
+	}
+
+	return b.String(), len(domains)
+}
+
+func hasBlockedParent(domain string, blocked map[string]bool) bool {
+	for idx := strings.Index(domain, "."); idx != -1; idx = strings.Index(domain, ".") {
+		domain = domain[idx+1:]
+		if blocked[domain] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeFetcher serves blocklists from memory so tests run offline.
+type fakeFetcher map[string]string
+
+func (f fakeFetcher) Fetch(ctx context.Context, url string) (io.ReadCloser, error) {
+	content, ok := f[url]
+	if !ok {
+		return nil, fmt.Errorf("not found: %s", url)
+	}
+	return io.NopCloser(strings.NewReader(content)), nil
+}
+
+func TestParseBlocklist(t *testing.T) {
+	content := `# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com
+0.0.0.0 ADS.example.com # duplicate, different case
+# domain list format
+malware.example.net
+not a domain!
+192.168.1.1
+`
+	domains, err := ParseBlocklist(strings.NewReader(content))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ads.example.com", "tracker.example.com", "malware.example.net"}, domains)
+}
+
+func TestBlocklistService(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "blocklist-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	blocklistFile := filepath.Join(tmpDir, "blocklist.conf")
+	os.Setenv("DNSMASQ_BLOCKLIST_FILE", blocklistFile)
+	defer os.Unsetenv("DNSMASQ_BLOCKLIST_FILE")
+
+	fetcher := fakeFetcher{
+		"https://lists.example/ads.txt": "0.0.0.0 example.com\n0.0.0.0 ads.example.com\n0.0.0.0 cdn.example.com\n",
+	}
+	clientset := fake.NewSimpleClientset()
+	service := NewBlocklistService(clientset, "default", fetcher)
+	supervisor := &fakeSupervisor{}
+	service.SetSupervisor(supervisor)
+	ctx := context.Background()
+
+	assert.Error(t, service.AddBlocklist(ctx, Blocklist{Name: "bad", URL: "ftp://lists.example/x"}))
+
+	assert.NoError(t, service.AddBlocklist(ctx, Blocklist{Name: "ads", URL: "https://lists.example/ads.txt", Enabled: true}))
+	assert.NoError(t, service.AddBlocklist(ctx, Blocklist{Name: "local", Content: "malware.test\nexample.com\n", Enabled: true}))
+	assert.NoError(t, service.AddBlocklist(ctx, Blocklist{Name: "broken", URL: "https://lists.example/missing.txt", Enabled: true}))
+	assert.ErrorIs(t, service.AddBlocklist(ctx, Blocklist{Name: "ads", Content: "x.test"}), ErrConflict)
+	assert.ErrorIs(t, service.AddBlocklist(ctx, Blocklist{Name: "My List", Content: "x.test"}), ErrInvalid)
+	assert.ErrorIs(t, service.AddBlocklist(ctx, Blocklist{Name: "refresh", Content: "x.test"}), ErrInvalid)
+
+	content, err := os.ReadFile(blocklistFile)
+	assert.NoError(t, err)
+	// Subdomains of a blocked domain are redundant and duplicates are merged
+	assert.Contains(t, string(content), "address=/example.com/0.0.0.0\n")
+	assert.NotContains(t, string(content), "ads.example.com")
+	assert.Contains(t, string(content), "address=/malware.test/0.0.0.0\n")
+
+	// dnsmasq restarts when the file changes, not when a refresh leaves it as is
+	restarts := len(supervisor.called())
+	assert.NotZero(t, restarts)
+	assert.NoError(t, service.Refresh(ctx, "ads"))
+	assert.Len(t, supervisor.called(), restarts)
+	assert.ErrorIs(t, service.Refresh(ctx, "unknown"), ErrNotFound)
+
+	summary, err := service.GetSummary(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.TotalBlocked)
+	assert.Len(t, summary.Stats, 3)
+	assert.Equal(t, 3, summary.Stats[0].Domains)
+	assert.Equal(t, 2, summary.Stats[1].Domains)
+	assert.NotEmpty(t, summary.Stats[2].Error)
+	assert.Empty(t, summary.Lists[1].Content)
+
+	// Allowlisted subdomains of a blocked domain are sent upstream
+	assert.NoError(t, service.SetAllowlist(ctx, []string{"cdn.example.com", "malware.test"}))
+	assert.NoError(t, service.SetMode(ctx, "local"))
+	content, err = os.ReadFile(blocklistFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "local=/example.com/\n")
+	assert.Contains(t, string(content), "server=/cdn.example.com/#\n")
+	assert.NotContains(t, string(content), "malware.test")
+
+	// Disabling a list removes its domains without downloading it again
+	delete(fetcher, "https://lists.example/ads.txt")
+	assert.NoError(t, service.UpdateBlocklist(ctx, "local", Blocklist{Name: "local", Enabled: false}))
+	content, err = os.ReadFile(blocklistFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "local=/example.com/\n")
+
+	assert.NoError(t, service.DeleteBlocklist(ctx, "ads"))
+	assert.ErrorIs(t, service.DeleteBlocklist(ctx, "ads"), ErrNotFound)
+	assert.ErrorIs(t, service.UpdateBlocklist(ctx, "ads", Blocklist{Name: "ads"}), ErrNotFound)
+	content, err = os.ReadFile(blocklistFile)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "example.com/")
+
+	// Sources are persisted in the ConfigMap, imported content in one of its own
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, "dnsmasq-blocklists", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, cm.Data["blocklists.json"], "lists.example/ads.txt")
+	assert.NotContains(t, cm.Data["blocklists.json"], `"content"`)
+	cm, err = clientset.CoreV1().ConfigMaps("default").Get(ctx, "dnsmasq-blocklist-local", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "malware.test\nexample.com\n", cm.Data["blocklist.txt"])
+
+	// Renaming an imported list moves its content, and a new service loads it
+	assert.NoError(t, service.UpdateBlocklist(ctx, "local", Blocklist{Name: "imported", Enabled: true}))
+	_, err = clientset.CoreV1().ConfigMaps("default").Get(ctx, "dnsmasq-blocklist-local", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	assert.NoError(t, NewBlocklistService(clientset, "default", fetcher).Refresh(ctx))
+	content, err = os.ReadFile(blocklistFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "local=/example.com/\n")
+
+	assert.NoError(t, service.DeleteBlocklist(ctx, "imported"))
+	_, err = clientset.CoreV1().ConfigMaps("default").Get(ctx, "dnsmasq-blocklist-imported", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func TestBlocklistService_InlineContent(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "blocklist-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	blocklistFile := filepath.Join(tmpDir, "blocklist.conf")
+	os.Setenv("DNSMASQ_BLOCKLIST_FILE", blocklistFile)
+	defer os.Unsetenv("DNSMASQ_BLOCKLIST_FILE")
+
+	// Content stored in the configuration by older versions is moved out on the next change
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "dnsmasq-blocklists", Namespace: "default"},
+		Data:       map[string]string{"blocklists.json": `{"lists":[{"name":"local","content":"malware.test\n","enabled":true}],"mode":"address"}`},
+	})
+	service := NewBlocklistService(clientset, "default", fakeFetcher{})
+	ctx := context.Background()
+
+	assert.NoError(t, service.Refresh(ctx))
+	assert.NoError(t, service.UpdateBlocklist(ctx, "local", Blocklist{Name: "local", Enabled: true}))
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, "dnsmasq-blocklists", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, cm.Data["blocklists.json"], "malware.test")
+	cm, err = clientset.CoreV1().ConfigMaps("default").Get(ctx, "dnsmasq-blocklist-local", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "malware.test\n", cm.Data["blocklist.txt"])
+
+	content, err := os.ReadFile(blocklistFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "address=/malware.test/0.0.0.0\n")
+}
+
+func TestBlocklistService_ConfigMapWatch(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "blocklist-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	fetcher := fakeFetcher{
+		"https://lists.example/ads.txt":   "ads.example.com\n",
+		"https://lists.example/track.txt": "tracker.example.com\n",
+	}
+	clientset := fake.NewSimpleClientset()
+	watching := make(chan struct{})
+	clientset.PrependWatchReactor("configmaps", func(k8stesting.Action) (bool, watch.Interface, error) {
+		close(watching)
+		return false, nil, nil
+	})
+
+	// Changes made on one replica are rendered by the watch of another
+	os.Setenv("DNSMASQ_BLOCKLIST_FILE", filepath.Join(tmpDir, "leader.conf"))
+	leader := NewBlocklistService(clientset, "default", fetcher)
+	blocklistFile := filepath.Join(tmpDir, "follower.conf")
+	os.Setenv("DNSMASQ_BLOCKLIST_FILE", blocklistFile)
+	defer os.Unsetenv("DNSMASQ_BLOCKLIST_FILE")
+	follower := NewBlocklistService(clientset, "default", fetcher)
+	configService := NewConfigService(clientset, "default")
+	configService.SetBlocklistService(follower)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go configService.StartConfigMapWatch(ctx)
+	<-watching
+
+	rendered := func(domain string) func() bool {
+		return func() bool {
+			content, _ := os.ReadFile(blocklistFile)
+			return strings.Contains(string(content), "address=/"+domain+"/0.0.0.0\n")
+		}
+	}
+	assert.NoError(t, leader.AddBlocklist(ctx, Blocklist{Name: "ads", URL: "https://lists.example/ads.txt", Enabled: true}))
+	assert.NoError(t, leader.AddBlocklist(ctx, Blocklist{Name: "local", Content: "malware.test\n", Enabled: true}))
+	assert.Eventually(t, rendered("ads.example.com"), time.Second, 10*time.Millisecond)
+	assert.Eventually(t, rendered("malware.test"), time.Second, 10*time.Millisecond)
+
+	// Lists whose URL changed are downloaded again
+	assert.NoError(t, leader.UpdateBlocklist(ctx, "ads", Blocklist{Name: "ads", URL: "https://lists.example/track.txt", Enabled: true}))
+	assert.Eventually(t, rendered("tracker.example.com"), time.Second, 10*time.Millisecond)
+
+	// Imported content is read from its ConfigMap again
+	assert.NoError(t, leader.UpdateBlocklist(ctx, "local", Blocklist{Name: "local", Content: "phishing.test\n", Enabled: true}))
+	assert.Eventually(t, rendered("phishing.test"), time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// RoleLabel is set on the pod of every replica to its role, so the Service
+// of the web UI and DHCP can select the leader.
+const RoleLabel = "dnsmasq-k8s.io/role"
+
+// Replica roles
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// followerRanges replaces the ranges file of followers, so their dnsmasq
+// serves DNS only. Turning DHCP off on every interface also covers the
+// ranges set in dnsmasq.conf, which followers share with the leader.
+const followerRanges = "# DHCP is served by the leader replica, see /api/v1/cluster\nno-dhcp-interface=*\n"
+
+// ClusterInfo describes the replica answering and the current leader.
+type ClusterInfo struct {
+	Enabled  bool   `json:"enabled"`
+	Identity string `json:"identity,omitempty"`
+	Role     string `json:"role"`
+	Leader   string `json:"leader,omitempty"`
+}
+
+// ClusterService elects the replica serving DHCP and owning writes when
+// several replicas run, with a coordination.k8s.io Lease. The leader runs
+// the functions registered with OnLeading, which sync the managed files to
+// their ConfigMaps. Followers serve DNS from the files the ConfigMap watch
+// keeps up to date, and their dnsmasq has no DHCP range.
+type ClusterService struct {
+	clientset kubernetes.Interface
+	namespace string
+	identity  string
+	// podName is the pod labeled with RoleLabel, none when empty
+	podName   string
+	leaseName string
+	dhcp      *DHCPService
+
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	leader atomic.Bool
+	holder atomic.Value
+
+	// mu orders the start of the leading functions with the end of a term
+	mu      sync.Mutex
+	leading []func(context.Context)
+	running sync.WaitGroup
+}
+
+// NewClusterService attaches the cluster to configService, whose ConfigMap
+// watch follows the role of this replica.
+func NewClusterService(clientset kubernetes.Interface, namespace string, configService *ConfigService, dhcpService *DHCPService) *ClusterService {
+	podName := os.Getenv("POD_NAME")
+	identity := podName
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	leaseName := os.Getenv("CLUSTER_LEASE_NAME")
+	if leaseName == "" {
+		leaseName = "dnsmasq-k8s-leader"
+	}
+	leaseDuration := 15 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("CLUSTER_LEASE_DURATION")); err == nil && v > 0 {
+		leaseDuration = v
+	}
+	s := &ClusterService{
+		clientset:     clientset,
+		namespace:     namespace,
+		identity:      identity,
+		podName:       podName,
+		leaseName:     leaseName,
+		dhcp:          dhcpService,
+		leaseDuration: leaseDuration,
+		renewDeadline: leaseDuration * 2 / 3,
+		retryPeriod:   leaseDuration / 7,
+	}
+	s.holder.Store("")
+	if configService != nil {
+		configService.cluster = s
+	}
+	return s
+}
+
+// OnLeading registers fn to run while this replica is the leader. fn runs in
+// its own goroutine and must return once ctx is done.
+func (s *ClusterService) OnLeading(fn func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leading = append(s.leading, fn)
+}
+
+// Follower reports whether this replica is a follower. It is false when
+// clustering is disabled, so it is safe to call on a nil receiver.
+func (s *ClusterService) Follower() bool {
+	return s != nil && !s.leader.Load()
+}
+
+func (s *ClusterService) GetInfo() ClusterInfo {
+	if s == nil {
+		return ClusterInfo{Role: RoleLeader}
+	}
+	info := ClusterInfo{Enabled: true, Identity: s.identity, Role: RoleFollower, Leader: s.holder.Load().(string)}
+	if s.leader.Load() {
+		info.Role = RoleLeader
+	}
+	return info
+}
+
+// Run takes part in leader elections until ctx is done. The replica starts
+// as a follower, and becomes one again whenever it loses the lease.
+func (s *ClusterService) Run(ctx context.Context) {
+	s.follow(ctx)
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: s.leaseName, Namespace: s.namespace},
+		Client:     s.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: s.identity},
+	}
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   s.leaseDuration,
+			RenewDeadline:   s.renewDeadline,
+			RetryPeriod:     s.retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            s.leaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: s.lead,
+				OnStoppedLeading: func() {},
+				OnNewLeader: func(identity string) {
+					s.holder.Store(identity)
+					fmt.Printf("INFO: %s is the leader\n", identity)
+				},
+			},
+		})
+		if err != nil {
+			fmt.Printf("ERROR: failed to create leader elector: %v\n", err)
+			return
+		}
+		elector.Run(ctx)
+
+		// Run cancels the context of the term before it returns, so lead
+		// either started the leading functions already or never will
+		s.mu.Lock()
+		wasLeader := s.leader.Swap(false)
+		s.mu.Unlock()
+		s.running.Wait()
+		if wasLeader && ctx.Err() == nil {
+			fmt.Println("INFO: Lost leadership, switching to follower")
+			s.follow(ctx)
+		}
+	}
+}
+
+// lead starts the term of this replica as leader: DHCP is taken over and
+// the leading functions run until ctx is done.
+func (s *ClusterService) lead(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	fmt.Printf("INFO: %s became the leader\n", s.identity)
+	s.leader.Store(true)
+	s.holder.Store(s.identity)
+	s.setRole(ctx, RoleLeader)
+
+	leading := s.leading
+	if s.dhcp != nil {
+		leading = append([]func(context.Context){s.dhcp.TakeOverDHCP}, leading...)
+	}
+	s.running.Add(len(leading))
+	for _, fn := range leading {
+		go func(fn func(context.Context)) {
+			defer s.running.Done()
+			fn(ctx)
+		}(fn)
+	}
+}
+
+func (s *ClusterService) follow(ctx context.Context) {
+	s.setRole(ctx, RoleFollower)
+	if s.dhcp != nil {
+		if err := s.dhcp.StandByDHCP(ctx); err != nil {
+			fmt.Printf("ERROR: failed to stop serving DHCP: %v\n", err)
+		}
+	}
+}
+
+// setRole labels the pod of this replica with its role.
+func (s *ClusterService) setRole(ctx context.Context, role string) {
+	if s.podName == "" {
+		return
+	}
+	patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, RoleLabel, role)
+	_, err := s.clientset.CoreV1().Pods(s.namespace).Patch(ctx, s.podName, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		fmt.Printf("WARN: failed to label pod %s as %s: %v\n", s.podName, role, err)
+	}
+}
+
+// TakeOverDHCP makes this replica the DHCP server: the ranges and the
+// leases handed out by the previous leader are restored from their
+// ConfigMaps while dnsmasq is stopped, so dnsmasq loads them when it starts.
+// The lease file is then synced to its ConfigMap until ctx is done.
+func (s *DHCPService) TakeOverDHCP(ctx context.Context) {
+	if s.supervisor != nil {
+		if err := s.supervisor.StopService(dnsmasqProgram); err != nil {
+			fmt.Printf("ERROR: failed to stop dnsmasq: %v\n", err)
+		}
+	}
+	if err := s.RestoreLeasesFromConfigMap(ctx); err != nil {
+		fmt.Printf("WARN: failed to restore leases from ConfigMap: %v\n", err)
+	}
+	if err := s.RestoreRangesFromConfigMap(ctx); err != nil {
+		fmt.Printf("WARN: failed to restore ranges from ConfigMap: %v\n", err)
+	}
+	if content, err := readFile(s.rangesFile); err == nil && string(content) == followerRanges {
+		// No ranges were ever synced
+		if err := writeFile(s.rangesFile, nil); err != nil {
+			fmt.Printf("ERROR: failed to clear ranges file: %v\n", err)
+		}
+	}
+	if s.supervisor != nil {
+		if err := s.supervisor.StartService(dnsmasqProgram); err != nil {
+			fmt.Printf("ERROR: failed to start dnsmasq: %v\n", err)
+		}
+	}
+
+	// The leases were just restored, restoring them again would overwrite
+	// the ones dnsmasq handed out since
+	startFileSync(ctx, s.leaseFile, "lease", nil, s.SyncLeasesToConfigMap)
+}
+
+// StandByDHCP removes the DHCP ranges of a follower and restarts dnsmasq
+// when they changed. The ranges file is not synced on followers, the ranges
+// are restored from their ConfigMap by TakeOverDHCP.
+func (s *DHCPService) StandByDHCP(ctx context.Context) error {
+	unlock := lockFile(s.rangesFile)
+	defer unlock()
+
+	content, err := readFile(s.rangesFile)
+	if err != nil {
+		return err
+	}
+	if string(content) == followerRanges {
+		return nil
+	}
+	if err := writeFileAtomic(s.rangesFile, []byte(followerRanges)); err != nil {
+		return err
+	}
+	if s.supervisor != nil {
+		return restartDnsmasq(s.supervisor)
+	}
+	return nil
+}
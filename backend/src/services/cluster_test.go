@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestClusterService(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "cluster")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	leaseFile := filepath.Join(tmpDir, "dnsmasq.leases")
+	rangesFile := filepath.Join(tmpDir, "ranges.conf")
+	assert.NoError(t, os.WriteFile(rangesFile, []byte("dhcp-range=192.168.1.100,192.168.1.200,12h\n"), 0644))
+	os.Setenv("DHCP_LEASE_FILE", leaseFile)
+	defer os.Unsetenv("DHCP_LEASE_FILE")
+	os.Setenv("DHCP_RANGES_FILE", rangesFile)
+	defer os.Unsetenv("DHCP_RANGES_FILE")
+	// Ranges may be set in dnsmasq.conf as well
+	configFile := filepath.Join(tmpDir, "dnsmasq.conf")
+	config := "conf-dir=" + tmpDir + ",*.conf\ndhcp-range=192.168.1.10,192.168.1.49,12h\n"
+	assert.NoError(t, os.WriteFile(configFile, []byte(config), 0644))
+	os.Setenv("DNSMASQ_CONFIG_FILE", configFile)
+	defer os.Unsetenv("DNSMASQ_CONFIG_FILE")
+	os.Setenv("POD_NAME", "dnsmasq-k8s-1")
+	defer os.Unsetenv("POD_NAME")
+	os.Setenv("CLUSTER_LEASE_DURATION", "1s")
+	defer os.Unsetenv("CLUSTER_LEASE_DURATION")
+
+	leases := "1700000000 aa:bb:cc:dd:ee:ff 192.168.1.150 laptop 01:aa:bb:cc:dd:ee:ff\n"
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "dnsmasq-k8s-1", Namespace: "default"}},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "dnsmasq-leases", Namespace: "default"},
+			Data:       map[string]string{"dnsmasq.leases": leases},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "dnsmasq-ranges", Namespace: "default"},
+			Data:       map[string]string{"ranges.conf": "dhcp-range=192.168.1.50,192.168.1.99,12h\n"},
+		},
+	)
+	configService := NewConfigService(clientset, "default")
+	dhcpService := NewDHCPService(clientset, "default", configService)
+	supervisor := &fakeSupervisor{}
+	dhcpService.SetSupervisor(supervisor)
+	cluster := NewClusterService(clientset, "default", configService, dhcpService)
+
+	// Without clustering every replica leads
+	var disabled *ClusterService
+	assert.False(t, disabled.Follower())
+	assert.Equal(t, RoleLeader, disabled.GetInfo().Role)
+
+	// Followers have no DHCP range, and DHCP is off for the ones in
+	// dnsmasq.conf
+	assert.True(t, cluster.Follower())
+	assert.NoError(t, dhcpService.StandByDHCP(context.Background()))
+	content, err := os.ReadFile(rangesFile)
+	assert.NoError(t, err)
+	assert.Equal(t, followerRanges, string(content))
+	assert.Equal(t, []string{"*"}, ParseConf(followerRanges).Get("no-dhcp-interface"))
+	content, err = os.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, config, string(content))
+	assert.Equal(t, []string{"stop dnsmasq", "start dnsmasq"}, supervisor.calls)
+
+	leading := make(chan struct{})
+	cluster.OnLeading(func(ctx context.Context) {
+		close(leading)
+		<-ctx.Done()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		cluster.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-leading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the only replica did not become the leader")
+	}
+	assert.False(t, cluster.Follower())
+	assert.Equal(t, ClusterInfo{Enabled: true, Identity: "dnsmasq-k8s-1", Role: RoleLeader, Leader: "dnsmasq-k8s-1"}, cluster.GetInfo())
+	pod, err := clientset.CoreV1().Pods("default").Get(ctx, "dnsmasq-k8s-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, RoleLeader, pod.Labels[RoleLabel])
+
+	// The leader serves the ranges and leases of the previous leader
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(leaseFile)
+		return string(content) == leases
+	}, 5*time.Second, 50*time.Millisecond)
+	content, err = os.ReadFile(rangesFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "dhcp-range=192.168.1.50,192.168.1.99,12h\n", string(content))
+
+	cancel()
+	<-done
+	assert.True(t, cluster.Follower())
+	assert.Equal(t, []string{"stop dnsmasq", "start dnsmasq", "stop dnsmasq", "start dnsmasq"}, supervisor.calls)
+
+	// The lease is released for the next leader
+	lease, err := clientset.CoordinationV1().Leases("default").Get(context.Background(), "dnsmasq-k8s-leader", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, *lease.Spec.HolderIdentity)
+}
+
+func TestFollowerLoadsSyncedFiles(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "cluster")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	customFile := filepath.Join(tmpDir, "custom.conf")
+	leaseFile := filepath.Join(tmpDir, "dnsmasq.leases")
+	os.Setenv("DNSMASQ_CUSTOM_DNS_FILE", customFile)
+	defer os.Unsetenv("DNSMASQ_CUSTOM_DNS_FILE")
+	os.Setenv("DHCP_LEASE_FILE", leaseFile)
+	defer os.Unsetenv("DHCP_LEASE_FILE")
+	defer func(delay time.Duration) { followerRestartDelay = delay }(followerRestartDelay)
+	followerRestartDelay = 10 * time.Millisecond
+
+	clientset := fake.NewSimpleClientset()
+	watching := make(chan struct{})
+	clientset.PrependWatchReactor("configmaps", func(k8stesting.Action) (bool, watch.Interface, error) {
+		close(watching)
+		return false, nil, nil
+	})
+	configService := NewConfigService(clientset, "default")
+	supervisor := &fakeSupervisor{}
+	configService.SetSupervisor(supervisor)
+	cluster := NewClusterService(clientset, "default", configService, nil)
+	assert.True(t, cluster.Follower())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go configService.StartConfigMapWatch(ctx)
+	<-watching
+
+	// A copy of the leases is kept without disturbing dnsmasq
+	_, err = clientset.CoreV1().ConfigMaps("default").Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "dnsmasq-leases", Namespace: "default"},
+		Data:       map[string]string{"dnsmasq.leases": "1700000000 aa:bb:cc:dd:ee:ff 192.168.1.150 laptop *\n"},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(leaseFile)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// dnsmasq is restarted once the DNS entries of the leader are synced
+	_, err = clientset.CoreV1().ConfigMaps("default").Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "dnsmasq-custom-dns", Namespace: "default"},
+		Data:       map[string]string{"custom.conf": "address=/web.lan/10.0.0.5\n"},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(supervisor.called()) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"stop dnsmasq", "start dnsmasq"}, supervisor.called())
+	content, err := os.ReadFile(customFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "address=/web.lan/10.0.0.5\n", string(content))
+}
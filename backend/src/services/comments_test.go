@@ -49,7 +49,7 @@ dhcp-host=AA:BB:CC:DD:EE:00,192.168.1.13,host4
 	assert.Equal(t, "", reservations[3].Comment)
 
 	// Test AddReservation with comment
-	err = service.AddReservation(context.Background(), "AA:BB:CC:DD:EE:FF", "192.168.1.100", "test-host", "", "Initial comment")
+	_, err = service.AddReservation(context.Background(), DHCPReservation{MACAddress: "AA:BB:CC:DD:EE:01", IPAddress: "192.168.1.100", Hostname: "test-host", Comment: "Initial comment"})
 	assert.NoError(t, err)
 
 	reservations, err = service.GetReservations(context.Background())
@@ -60,7 +60,7 @@ dhcp-host=AA:BB:CC:DD:EE:00,192.168.1.13,host4
 	// Verify file content
 	newContent, err := os.ReadFile(reservationsFile)
 	assert.NoError(t, err)
-	assert.Contains(t, string(newContent), "dhcp-host=AA:BB:CC:DD:EE:FF,192.168.1.100,test-host # Initial comment")
+	assert.Contains(t, string(newContent), "dhcp-host=AA:BB:CC:DD:EE:01,192.168.1.100,test-host # Initial comment")
 }
 
 func TestDNSEntryComments(t *testing.T) {
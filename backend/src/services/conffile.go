@@ -0,0 +1,271 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ConfLine is one line of a dnsmasq configuration file. Lines that are not
+// changed are written back verbatim from Raw, so parsing and writing a file
+// is lossless.
+type ConfLine struct {
+	Raw string
+	// Key is the option name, empty for blank and comment-only lines
+	Key string
+	// Value is the text after '=', HasValue is false for flags such as
+	// domain-needed
+	Value    string
+	HasValue bool
+	Comment  string
+	dirty    bool
+}
+
+// ConfFile is a parsed dnsmasq configuration file.
+type ConfFile struct {
+	Lines []ConfLine
+}
+
+// ConfOption is an option or flag set in a configuration file.
+type ConfOption struct {
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Flag    bool   `json:"flag,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	// Line is the 1-based line number in the file
+	Line int `json:"line"`
+}
+
+// ConfInclude is a conf-file or conf-dir directive.
+type ConfInclude struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// Filters are the conf-dir suffix filters, "*.conf" to only include
+	// matching files or ".bak" to exclude them
+	Filters []string `json:"filters,omitempty"`
+	Line    int      `json:"line"`
+	// Files lists the included files, see ListFiles
+	Files []string `json:"files,omitempty"`
+}
+
+// OptionChange describes the new state of an option for SetOption. Values
+// replaces every occurrence of a key, one line per value.
+type OptionChange struct {
+	Values []string
+	Flag   bool
+	Remove bool
+}
+
+// ParseConf parses dnsmasq configuration syntax: one key[=value] per line,
+// with '#' comments.
+func ParseConf(content string) *ConfFile {
+	f := &ConfFile{}
+	for _, raw := range strings.Split(content, "\n") {
+		line := ConfLine{Raw: raw}
+		directive, comment := splitComment(strings.TrimSuffix(raw, "\r"))
+		line.Comment = comment
+		if directive != "" {
+			key, value, hasValue := strings.Cut(directive, "=")
+			line.Key = strings.TrimSpace(key)
+			line.Value = strings.TrimSpace(value)
+			line.HasValue = hasValue
+		}
+		f.Lines = append(f.Lines, line)
+	}
+	return f
+}
+
+// String renders the file. Unchanged lines keep their original text.
+func (f *ConfFile) String() string {
+	lines := make([]string, len(f.Lines))
+	for i, line := range f.Lines {
+		if !line.dirty {
+			lines[i] = line.Raw
+			continue
+		}
+		text := line.Key
+		if line.HasValue {
+			text += "=" + line.Value
+		}
+		if line.Comment != "" {
+			text += " # " + line.Comment
+		}
+		lines[i] = text
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Options returns the options and flags in file order. Repeated keys are
+// returned once per occurrence.
+func (f *ConfFile) Options() []ConfOption {
+	options := []ConfOption{}
+	for i, line := range f.Lines {
+		if line.Key == "" {
+			continue
+		}
+		options = append(options, ConfOption{
+			Key:     line.Key,
+			Value:   line.Value,
+			Flag:    !line.HasValue,
+			Comment: line.Comment,
+			Line:    i + 1,
+		})
+	}
+	return options
+}
+
+// Get returns the values of every occurrence of key.
+func (f *ConfFile) Get(key string) []string {
+	var values []string
+	for _, line := range f.Lines {
+		if line.Key == key {
+			values = append(values, line.Value)
+		}
+	}
+	return values
+}
+
+// Includes returns the conf-file and conf-dir directives.
+func (f *ConfFile) Includes() []ConfInclude {
+	includes := []ConfInclude{}
+	for i, line := range f.Lines {
+		switch line.Key {
+		case "conf-file":
+			includes = append(includes, ConfInclude{Type: line.Key, Path: line.Value, Line: i + 1})
+		case "conf-dir":
+			parts := strings.Split(line.Value, ",")
+			include := ConfInclude{Type: line.Key, Path: strings.TrimSpace(parts[0]), Line: i + 1}
+			for _, filter := range parts[1:] {
+				if filter = strings.TrimSpace(filter); filter != "" {
+					include.Filters = append(include.Filters, filter)
+				}
+			}
+			includes = append(includes, include)
+		}
+	}
+	return includes
+}
+
+// ListFiles returns the files an include pulls in, following dnsmasq rules for
+// conf-dir: dotfiles and editor backups are skipped, "*.ext" filters select
+// files and other filters exclude a suffix.
+func (inc ConfInclude) ListFiles() ([]string, error) {
+	if inc.Type == "conf-file" {
+		return []string{inc.Path}, nil
+	}
+
+	entries, err := os.ReadDir(inc.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var include, exclude []string
+	for _, filter := range inc.Filters {
+		if strings.HasPrefix(filter, "*") {
+			include = append(include, strings.TrimPrefix(filter, "*"))
+		} else {
+			exclude = append(exclude, filter)
+		}
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") ||
+			(strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#")) {
+			continue
+		}
+		if len(include) > 0 && !hasAnySuffix(name, include) {
+			continue
+		}
+		if hasAnySuffix(name, exclude) {
+			continue
+		}
+		files = append(files, filepath.Join(inc.Path, name))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func hasAnySuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetOption applies a change to every occurrence of key. Existing lines are
+// updated in place, keeping their comments, surplus occurrences are removed
+// and new ones are added after the last occurrence or at the end of the file.
+func (f *ConfFile) SetOption(key string, change OptionChange) error {
+	if err := validateOptionKey(key); err != nil {
+		return err
+	}
+
+	var wanted []ConfLine
+	switch {
+	case change.Remove:
+	case change.Flag:
+		wanted = []ConfLine{{Key: key}}
+	default:
+		for _, value := range change.Values {
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("invalid value for %s: must be a single line", key)
+			}
+			wanted = append(wanted, ConfLine{Key: key, Value: strings.TrimSpace(value), HasValue: true})
+		}
+	}
+
+	var lines []ConfLine
+	insertAt := -1
+	for _, line := range f.Lines {
+		if line.Key != key {
+			lines = append(lines, line)
+			continue
+		}
+		if len(wanted) > 0 {
+			next := wanted[0]
+			wanted = wanted[1:]
+			if next.HasValue != line.HasValue || next.Value != line.Value {
+				line.Value = next.Value
+				line.HasValue = next.HasValue
+				line.dirty = true
+			}
+			lines = append(lines, line)
+		}
+		insertAt = len(lines)
+	}
+
+	if len(wanted) > 0 {
+		for i := range wanted {
+			wanted[i].dirty = true
+		}
+		if insertAt == -1 {
+			// Append before the trailing empty line of a newline-terminated file
+			insertAt = len(lines)
+			if insertAt > 0 && lines[insertAt-1].Raw == "" && lines[insertAt-1].Key == "" {
+				insertAt--
+			}
+		}
+		lines = append(lines[:insertAt], append(wanted, lines[insertAt:]...)...)
+	}
+
+	f.Lines = lines
+	return nil
+}
+
+func validateOptionKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("option name cannot be empty")
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return fmt.Errorf("invalid option name: %q", key)
+		}
+	}
+	return nil
+}
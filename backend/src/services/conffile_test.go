@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const sampleConf = `# Main configuration
+domain-needed
+bogus-priv
+  cache-size=150   # tuned later
+server=10.0.0.1#5353
+server=/corp.lan/10.0.0.53
+txt-record=example.lan,"v=spf1 #all"
+
+conf-dir=/etc/dnsmasq.d/,*.conf
+conf-file=/etc/dnsmasq.more.conf
+`
+
+func TestParseConf_RoundTrip(t *testing.T) {
+	for _, content := range []string{sampleConf, "", "no-newline", "a=1\r\nb\r\n", "\n\n# only comments\n"} {
+		assert.Equal(t, content, ParseConf(content).String())
+	}
+}
+
+func TestParseConf(t *testing.T) {
+	conf := ParseConf(sampleConf)
+
+	options := conf.Options()
+	assert.Len(t, options, 8)
+	assert.Equal(t, ConfOption{Key: "domain-needed", Flag: true, Line: 2}, options[0])
+	assert.Equal(t, ConfOption{Key: "cache-size", Value: "150", Comment: "tuned later", Line: 4}, options[2])
+	// '#' without leading whitespace or inside quotes is not a comment
+	assert.Equal(t, "10.0.0.1#5353", options[3].Value)
+	assert.Equal(t, `example.lan,"v=spf1 #all"`, options[5].Value)
+
+	assert.Equal(t, []string{"10.0.0.1#5353", "/corp.lan/10.0.0.53"}, conf.Get("server"))
+
+	includes := conf.Includes()
+	assert.Equal(t, []ConfInclude{
+		{Type: "conf-dir", Path: "/etc/dnsmasq.d/", Filters: []string{"*.conf"}, Line: 9},
+		{Type: "conf-file", Path: "/etc/dnsmasq.more.conf", Line: 10},
+	}, includes)
+}
+
+func TestConfFile_SetOption(t *testing.T) {
+	conf := ParseConf(sampleConf)
+
+	assert.NoError(t, conf.SetOption("cache-size", OptionChange{Values: []string{"1000"}}))
+	assert.NoError(t, conf.SetOption("server", OptionChange{Values: []string{"1.1.1.1"}}))
+	assert.NoError(t, conf.SetOption("bogus-priv", OptionChange{Remove: true}))
+	assert.NoError(t, conf.SetOption("domain", OptionChange{Values: []string{"lan"}}))
+	assert.NoError(t, conf.SetOption("log-queries", OptionChange{Flag: true}))
+	assert.Error(t, conf.SetOption("bad key", OptionChange{Flag: true}))
+	assert.Error(t, conf.SetOption("domain", OptionChange{Values: []string{"lan\nno-resolv"}}))
+
+	assert.Equal(t, `# Main configuration
+domain-needed
+cache-size=1000 # tuned later
+server=1.1.1.1
+txt-record=example.lan,"v=spf1 #all"
+
+conf-dir=/etc/dnsmasq.d/,*.conf
+conf-file=/etc/dnsmasq.more.conf
+domain=lan
+log-queries
+`, conf.String())
+
+	// Repeated keys grow after their last occurrence
+	assert.NoError(t, conf.SetOption("server", OptionChange{Values: []string{"1.1.1.1", "9.9.9.9"}}))
+	assert.Equal(t, []string{"1.1.1.1", "9.9.9.9"}, conf.Get("server"))
+	assert.Equal(t, "server", conf.Lines[4].Key)
+}
+
+func TestConfInclude_ListFiles(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "conf-dir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, name := range []string{"a.conf", "b.conf", "c.bak", ".hidden.conf", "d.conf~"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(tmpDir, name), nil, 0644))
+	}
+
+	files, err := ConfInclude{Type: "conf-dir", Path: tmpDir}.ListFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmpDir, "a.conf"), filepath.Join(tmpDir, "b.conf"), filepath.Join(tmpDir, "c.bak")}, files)
+
+	files, err = ConfInclude{Type: "conf-dir", Path: tmpDir, Filters: []string{"*.conf"}}.ListFiles()
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	files, err = ConfInclude{Type: "conf-dir", Path: tmpDir, Filters: []string{".bak"}}.ListFiles()
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestConfigService_UpdateConfigOptions(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "dnsmasq.conf")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.WriteString("domain-needed\ncache-size=150\ndhcp-option=tag:lab,option:router,10.0.0.1\n")
+	assert.NoError(t, err)
+	tmpFile.Close()
+
+	os.Setenv("DNSMASQ_CONFIG_FILE", tmpFile.Name())
+	defer os.Unsetenv("DNSMASQ_CONFIG_FILE")
+
+	configService := NewConfigService(fake.NewSimpleClientset(), "default")
+	ctx := context.Background()
+
+	err = configService.UpdateConfigOptions(ctx, map[string]OptionChange{
+		"cache-size": {Values: []string{"1000"}},
+		"domain":     {Values: []string{"home.lan"}},
+	})
+	assert.NoError(t, err)
+
+	options, err := configService.GetConfigOptions(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, options.Options, 4)
+	assert.Equal(t, "1000", options.Options[1].Value)
+	assert.Equal(t, "home.lan", options.Options[3].Value)
+
+	err = configService.UpdateConfigOptions(ctx, map[string]OptionChange{"domain": {Values: []string{"a\nb"}}})
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	tags, err := configService.GetTags(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lab"}, tags)
+}
@@ -4,14 +4,15 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
-
-	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -19,10 +20,23 @@ import (
 )
 
 type ConfigService struct {
-	clientset     kubernetes.Interface
-	namespace     string
-	configFile    string
-	customDNSFile string
+	clientset      kubernetes.Interface
+	namespace      string
+	configFile     string
+	customDNSFile  string
+	forwardersFile string
+	// externalDNSFile holds the A and AAAA records of ExternalDNS, see
+	// ApplyExternalDNSChanges
+	externalDNSFile string
+	history         *HistoryService
+	// cluster is the leader election of this replica, see NewClusterService
+	cluster *ClusterService
+	// supervisor reloads dnsmasq after ExternalDNS changes and, on
+	// followers, after files are synced from ConfigMaps, see SetSupervisor
+	supervisor ServiceSupervisor
+	// blocklists re-renders the blocklist when its ConfigMaps change, see
+	// SetBlocklistService
+	blocklists *BlocklistService
 }
 
 func NewConfigService(clientset kubernetes.Interface, namespace string) *ConfigService {
@@ -34,11 +48,23 @@ func NewConfigService(clientset kubernetes.Interface, namespace string) *ConfigS
 	if customDNSFile == "" {
 		customDNSFile = "/etc/dnsmasq.d/custom.conf"
 	}
+	forwardersFile := os.Getenv("DNSMASQ_FORWARDERS_FILE")
+	if forwardersFile == "" {
+		forwardersFile = "/etc/dnsmasq.d/forwarders.conf"
+	}
+	// dnsmasq reads the hosts files of /etc/dnsmasq-hosts, see
+	// supervisord.conf
+	externalDNSFile := os.Getenv("DNSMASQ_EXTERNAL_DNS_FILE")
+	if externalDNSFile == "" {
+		externalDNSFile = "/etc/dnsmasq-hosts/external-dns.hosts"
+	}
 	return &ConfigService{
-		clientset:     clientset,
-		namespace:     namespace,
-		configFile:    configFile,
-		customDNSFile: customDNSFile,
+		clientset:       clientset,
+		namespace:       namespace,
+		configFile:      configFile,
+		customDNSFile:   customDNSFile,
+		forwardersFile:  forwardersFile,
+		externalDNSFile: externalDNSFile,
 	}
 }
 
@@ -50,6 +76,16 @@ func (s *ConfigService) GetConfig(ctx context.Context) (string, error) {
 	return string(content), nil
 }
 
+// ConfigETag returns the ETag of dnsmasq.conf.
+func (s *ConfigService) ConfigETag(ctx context.Context) (string, error) {
+	return fileETag(s.configFile)
+}
+
+// DNSEntriesETag returns the ETag of custom.conf.
+func (s *ConfigService) DNSEntriesETag(ctx context.Context) (string, error) {
+	return fileETag(s.customDNSFile)
+}
+
 func (s *ConfigService) GetTags(ctx context.Context) ([]string, error) {
 	content, err := ioutil.ReadFile(s.configFile)
 	if err != nil {
@@ -57,18 +93,13 @@ func (s *ConfigService) GetTags(ctx context.Context) ([]string, error) {
 	}
 
 	tags := make(map[string]bool)
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// dhcp-option=tag:specialhosts,option:dns-server,8.8.8.8,8.8.4.4
-		if strings.HasPrefix(line, "dhcp-option=") {
-			parts := strings.Split(strings.TrimPrefix(line, "dhcp-option="), ",")
-			for _, part := range parts {
-				if strings.HasPrefix(part, "tag:") {
-					tag := strings.TrimPrefix(part, "tag:")
-					if tag != "" {
-						tags[tag] = true
-					}
+	// dhcp-option=tag:specialhosts,option:dns-server,8.8.8.8,8.8.4.4
+	for _, value := range ParseConf(string(content)).Get("dhcp-option") {
+		for _, part := range strings.Split(value, ",") {
+			if strings.HasPrefix(part, "tag:") {
+				tag := strings.TrimPrefix(part, "tag:")
+				if tag != "" {
+					tags[tag] = true
 				}
 			}
 		}
@@ -81,15 +112,80 @@ func (s *ConfigService) GetTags(ctx context.Context) ([]string, error) {
 	return tagList, nil
 }
 
+// ConfigOptions is the structured view of dnsmasq.conf.
+type ConfigOptions struct {
+	Options  []ConfOption  `json:"options"`
+	Includes []ConfInclude `json:"includes"`
+}
+
+// GetConfigOptions parses dnsmasq.conf into its options and includes.
+func (s *ConfigService) GetConfigOptions(ctx context.Context) (*ConfigOptions, error) {
+	content, err := ioutil.ReadFile(s.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := ParseConf(string(content))
+	includes := conf.Includes()
+	for i, include := range includes {
+		// A missing include is reported by dnsmasq itself, just list nothing
+		if files, err := include.ListFiles(); err == nil {
+			includes[i].Files = files
+		}
+	}
+	return &ConfigOptions{Options: conf.Options(), Includes: includes}, nil
+}
+
+// UpdateConfigOptions applies changes to dnsmasq.conf, leaving the rest of
+// the file untouched.
+func (s *ConfigService) UpdateConfigOptions(ctx context.Context, changes map[string]OptionChange) error {
+	unlock := lockFile(s.configFile)
+	defer unlock()
+
+	content, err := ioutil.ReadFile(s.configFile)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	conf := ParseConf(string(content))
+	for _, key := range keys {
+		if err := conf.SetOption(key, changes[key]); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+
+	return s.writeConfig(ctx, conf.String())
+}
+
 func (s *ConfigService) UpdateConfig(ctx context.Context, config string) error {
+	unlock := lockFile(s.configFile)
+	defer unlock()
+	return s.writeConfig(ctx, config)
+}
+
+// writeConfig validates and writes dnsmasq.conf. The caller must hold
+// lockFile(s.configFile).
+func (s *ConfigService) writeConfig(ctx context.Context, config string) error {
 	if err := s.validateDnsmasqConfig(config); err != nil {
-		return fmt.Errorf("dnsmasq configuration validation failed: %v", err)
+		return fmt.Errorf("%w: dnsmasq configuration validation failed: %v", ErrInvalid, err)
+	}
+
+	old, err := readFile(s.configFile)
+	if err != nil {
+		return err
 	}
 
-	if err := ioutil.WriteFile(s.configFile, []byte(config), 0644); err != nil {
+	if err := writeFileAtomic(s.configFile, []byte(config)); err != nil {
 		return err
 	}
 
+	s.history.record(ctx, s.configFile, string(old), config)
 	return nil
 }
 
@@ -98,62 +194,65 @@ func (s *ConfigService) GetConfigMap(ctx context.Context) (*v1.ConfigMap, error)
 }
 
 func (s *ConfigService) AddDNSEntry(ctx context.Context, recordType, domain, value, comment string) error {
-	// Ensure custom DNS file exists
-	if _, err := os.Stat(s.customDNSFile); os.IsNotExist(err) {
-		// Ensure directory exists
-		dir := filepath.Dir(s.customDNSFile)
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return fmt.Errorf("failed to create custom DNS directory: %v", err)
-			}
-		}
+	return s.CreateDNSEntry(ctx, DNSEntry{Type: recordType, Domain: domain, Value: value, Comment: comment})
+}
 
-		if err := ioutil.WriteFile(s.customDNSFile, []byte(""), 0644); err != nil {
-			return fmt.Errorf("failed to create custom DNS file: %v", err)
-		}
+// CreateDNSEntry appends an entry to the custom DNS file. For A and AAAA
+// entries with PTR set, a matching ptr-record is written alongside it.
+func (s *ConfigService) CreateDNSEntry(ctx context.Context, entry DNSEntry) error {
+	entry = normalizeDNSEntry(entry)
+	if err := ValidateDNSEntry(entry); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
 	}
 
-	content, err := ioutil.ReadFile(s.customDNSFile)
+	unlock := lockFile(s.customDNSFile)
+	defer unlock()
+
+	content, err := readFile(s.customDNSFile)
 	if err != nil {
 		return err
 	}
 	dnsmasqConf := string(content)
 
-	var newEntry string
-	switch recordType {
-	case "address":
-		newEntry = fmt.Sprintf("\naddress=/%s/%s", domain, value)
-	case "cname":
-		newEntry = fmt.Sprintf("\ncname=%s,%s", domain, value)
-	case "txt":
-		newEntry = fmt.Sprintf("\ntxt-record=%s,\"%s\"", domain, value)
-	default:
-		return fmt.Errorf("unsupported DNS record type: %s. Only 'address', 'cname', and 'txt' are supported", recordType)
+	newEntry := "\n" + formatDNSEntry(entry)
+	if entry.Comment != "" {
+		newEntry += fmt.Sprintf(" # %s", entry.Comment)
 	}
-
-	if comment != "" {
-		newEntry += fmt.Sprintf(" # %s", comment)
+	if ptr, ok := pairedPTR(entry); ok && entry.PTR && !containsDNSLine(dnsmasqConf, formatDNSEntry(ptr)) {
+		newEntry += "\n" + formatDNSEntry(ptr) + " # " + pairedPTRComment
 	}
 
 	dnsmasqConf += newEntry
 
 	// Validate the configuration before writing
 	if err := s.validateDnsmasqConfig(dnsmasqConf); err != nil {
-		return fmt.Errorf("dnsmasq configuration validation failed: %v", err)
+		return fmt.Errorf("%w: dnsmasq configuration validation failed: %v", ErrInvalid, err)
 	}
 
-	if err := ioutil.WriteFile(s.customDNSFile, []byte(dnsmasqConf), 0644); err != nil {
+	if err := writeFileAtomic(s.customDNSFile, []byte(dnsmasqConf)); err != nil {
 		return err
 	}
 
+	s.history.record(ctx, s.customDNSFile, string(content), dnsmasqConf)
 	return nil
 }
 
 type DNSEntry struct {
+	// ID identifies the entry's line in custom.conf, see entryID
+	ID      string `json:"id"`
 	Type    string `json:"type"`
 	Domain  string `json:"domain"`
 	Value   string `json:"value"`
 	Comment string `json:"comment"`
+	// PTR is only meaningful for A and AAAA entries: when set, a matching
+	// ptr-record is kept in sync with the entry.
+	PTR bool `json:"ptr,omitempty"`
+	// Structured fields for SRV and MX entries. Priority holds the MX
+	// preference. Value mirrors Target for display.
+	Priority int    `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Target   string `json:"target,omitempty"`
 }
 
 func (s *ConfigService) GetDNSEntries(ctx context.Context) ([]DNSEntry, error) {
@@ -168,39 +267,51 @@ func (s *ConfigService) GetDNSEntries(ctx context.Context) ([]DNSEntry, error) {
 
 	var entries []DNSEntry
 	lines := strings.Split(string(content), "\n")
-
-	// Regex for parsing
-	// address=/domain/ip
-	reAddress := regexp.MustCompile(`^address=/(.+)/(.+)$`)
-	// cname=domain,target
-	reCname := regexp.MustCompile(`^cname=(.+),(.+)$`)
-	// txt-record=domain,"value"
-	reTxt := regexp.MustCompile(`^txt-record=(.+),"(.+)"$`)
+	ids := idAssigner{}
 
 	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
+		directive, comment := splitComment(line)
+		if directive == "" {
 			continue
 		}
 
-		comment := ""
-		if idx := strings.Index(line, "#"); idx != -1 {
-			comment = strings.TrimSpace(line[idx+1:])
-			line = strings.TrimSpace(line[:idx])
+		if entry, ok := parseDNSEntry(directive); ok {
+			entry.Comment = comment
+			entry.ID = ids.next(formatDNSEntry(entry))
+			entries = append(entries, entry)
 		}
+	}
 
-		if matches := reAddress.FindStringSubmatch(line); matches != nil {
-			entries = append(entries, DNSEntry{Type: "address", Domain: matches[1], Value: matches[2], Comment: comment})
-		} else if matches := reCname.FindStringSubmatch(line); matches != nil {
-			entries = append(entries, DNSEntry{Type: "cname", Domain: matches[1], Value: matches[2], Comment: comment})
-		} else if matches := reTxt.FindStringSubmatch(line); matches != nil {
-			entries = append(entries, DNSEntry{Type: "txt", Domain: matches[1], Value: matches[2], Comment: comment})
+	// Flag A/AAAA entries that have a paired PTR record
+	ptrs := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Type == "ptr" && entry.Comment == pairedPTRComment {
+			ptrs[formatDNSEntry(entry)] = true
+		}
+	}
+	for i, entry := range entries {
+		if ptr, ok := pairedPTR(entry); ok && ptrs[formatDNSEntry(ptr)] {
+			entries[i].PTR = true
 		}
 	}
 
 	return entries, nil
 }
 
+// GetDNSEntry returns the entry with the given ID.
+func (s *ConfigService) GetDNSEntry(ctx context.Context, id string) (*DNSEntry, error) {
+	entries, err := s.GetDNSEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.ID == id {
+			return &entry, nil
+		}
+	}
+	return nil, fmt.Errorf("entry %w", ErrNotFound)
+}
+
 func (s *ConfigService) DeleteDNSEntry(ctx context.Context, entry DNSEntry) error {
 	return s.modifyDNSEntry(ctx, entry, DNSEntry{}, true)
 }
@@ -209,73 +320,327 @@ func (s *ConfigService) UpdateDNSEntry(ctx context.Context, oldEntry, newEntry D
 	return s.modifyDNSEntry(ctx, oldEntry, newEntry, false)
 }
 
+// UpdateDNSEntryByID replaces the entry with the given ID and returns the ID
+// of the updated entry.
+func (s *ConfigService) UpdateDNSEntryByID(ctx context.Context, id string, newEntry DNSEntry) (string, error) {
+	return s.modifyDNSEntryByID(ctx, id, newEntry, false)
+}
+
+func (s *ConfigService) DeleteDNSEntryByID(ctx context.Context, id string) error {
+	_, err := s.modifyDNSEntryByID(ctx, id, DNSEntry{}, true)
+	return err
+}
+
+// modifyDNSEntry replaces or removes the first entry matching targetEntry.
 func (s *ConfigService) modifyDNSEntry(ctx context.Context, targetEntry, newEntry DNSEntry, isDelete bool) error {
+	id := entryID(formatDNSEntry(normalizeDNSEntry(targetEntry)), 1)
+	_, err := s.modifyDNSEntryByID(ctx, id, newEntry, isDelete)
+	return err
+}
+
+// modifyDNSEntryByID replaces or removes the entry with the given ID. The PTR
+// record paired with an A/AAAA target is removed as well, and re-created for
+// the new entry when newEntry.PTR is set. Only PTR lines marked with
+// pairedPTRComment belong to an entry, others are never removed.
+func (s *ConfigService) modifyDNSEntryByID(ctx context.Context, id string, newEntry DNSEntry, isDelete bool) (string, error) {
+	if !isDelete {
+		newEntry = normalizeDNSEntry(newEntry)
+		if err := ValidateDNSEntry(newEntry); err != nil {
+			return "", err
+		}
+	}
+
+	unlock := lockFile(s.customDNSFile)
+	defer unlock()
+
 	content, err := ioutil.ReadFile(s.customDNSFile)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	lines := strings.Split(string(content), "\n")
-	var newLines []string
-	found := false
 
-	targetLine := ""
-	switch targetEntry.Type {
-	case "address":
-		targetLine = fmt.Sprintf("address=/%s/%s", targetEntry.Domain, targetEntry.Value)
-	case "cname":
-		targetLine = fmt.Sprintf("cname=%s,%s", targetEntry.Domain, targetEntry.Value)
-	case "txt-record":
-		targetLine = fmt.Sprintf("txt-record=%s,\"%s\"", targetEntry.Domain, targetEntry.Value)
+	targetIdx := -1
+	var targetEntry DNSEntry
+	ids := idAssigner{}
+	for i, line := range lines {
+		directive, _ := splitComment(line)
+		if entry, ok := parseDNSEntry(directive); ok && ids.next(formatDNSEntry(entry)) == id {
+			targetIdx = i
+			targetEntry = entry
+			break
+		}
+	}
+	if targetIdx == -1 {
+		return "", fmt.Errorf("entry %w", ErrNotFound)
+	}
+	managed := controllerManaged(lines)
+	if managed[targetIdx] {
+		return "", fmt.Errorf("%w: entry is managed by a DNSRecord resource, change the resource instead", ErrConflict)
 	}
 
-	for _, line := range lines {
-		trimmedLine := strings.TrimSpace(line)
-
-		// Strip comment if present
-		if idx := strings.Index(trimmedLine, "#"); idx != -1 {
-			trimmedLine = strings.TrimSpace(trimmedLine[:idx])
+	targetPTRLine := ""
+	if ptr, ok := pairedPTR(targetEntry); ok {
+		targetPTRLine = formatDNSEntry(ptr)
+	}
+	newPTRLine := ""
+	if ptr, ok := pairedPTR(newEntry); ok && !isDelete && newEntry.PTR {
+		newPTRLine = formatDNSEntry(ptr)
+	}
+	// A PTR written by hand is kept, and not duplicated for the new entry
+	for i, line := range lines {
+		if _, comment := splitComment(line); i != targetIdx && comment != pairedPTRComment && canonicalDNSLine(line) == newPTRLine {
+			newPTRLine = ""
 		}
+	}
 
-		if !found && trimmedLine == targetLine {
-			found = true
+	var newLines []string
+	newIdx := -1
+	for i, line := range lines {
+		if i == targetIdx {
 			if !isDelete {
 				// Replace with new entry
-				var newLine string
-				switch newEntry.Type {
-				case "address":
-					newLine = fmt.Sprintf("address=/%s/%s", newEntry.Domain, newEntry.Value)
-				case "cname":
-					newLine = fmt.Sprintf("cname=%s,%s", newEntry.Domain, newEntry.Value)
-				case "txt-record":
-					newLine = fmt.Sprintf("txt-record=%s,\"%s\"", newEntry.Domain, newEntry.Value)
-				}
+				newLine := formatDNSEntry(newEntry)
 				if newEntry.Comment != "" {
 					newLine += fmt.Sprintf(" # %s", newEntry.Comment)
 				}
+				newIdx = len(newLines)
 				newLines = append(newLines, newLine)
+				if newPTRLine != "" {
+					newLines = append(newLines, newPTRLine+" # "+pairedPTRComment)
+				}
 			}
 			continue
 		}
+		// Drop the PTR paired with the old entry, and any paired copy of the
+		// new one so it is not duplicated. The controller's PTRs are its own.
+		if _, comment := splitComment(line); comment == pairedPTRComment && !managed[i] {
+			if canonical := canonicalDNSLine(line); canonical != "" && (canonical == targetPTRLine || canonical == newPTRLine) {
+				continue
+			}
+		}
 		newLines = append(newLines, line)
 	}
 
-	if !found {
-		return fmt.Errorf("entry not found")
-	}
-
 	newContent := strings.Join(newLines, "\n")
 
 	// Validate if it's an update (deletion should be safe usually, but good to check if we want to be strict)
 	// For now, let's just save it.
 
-	if err := ioutil.WriteFile(s.customDNSFile, []byte(newContent), 0644); err != nil {
-		return err
+	if err := writeFileAtomic(s.customDNSFile, []byte(newContent)); err != nil {
+		return "", err
+	}
+	s.history.record(ctx, s.customDNSFile, string(content), newContent)
+
+	if isDelete {
+		return "", nil
+	}
+	ids = idAssigner{}
+	newID := ""
+	for _, line := range newLines[:newIdx+1] {
+		if canonical := canonicalDNSLine(line); canonical != "" {
+			newID = ids.next(canonical)
+		}
 	}
+	return newID, nil
+}
 
+// ValidateDNSEntry checks that the entry type is supported and that its value
+// matches the record type (IPv4 for A records, IPv6 for AAAA records).
+func ValidateDNSEntry(entry DNSEntry) error {
+	entry = normalizeDNSEntry(entry)
+	switch entry.Type {
+	case "address":
+		if ip := net.ParseIP(entry.Value); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address for A record: %s", entry.Value)
+		}
+	case "aaaa":
+		if !isIPv6(entry.Value) {
+			return fmt.Errorf("invalid IPv6 address for AAAA record: %s", entry.Value)
+		}
+	case "cname":
+		if entry.Value == "" || len(entry.Value) > 253 {
+			return fmt.Errorf("invalid domain name for CNAME record: %s", entry.Value)
+		}
+	case "txt", "txt-record":
+	case "srv":
+		if !strings.HasPrefix(entry.Domain, "_") || !strings.Contains(entry.Domain, "._") {
+			return fmt.Errorf("invalid SRV name, expected _service._proto.domain: %s", entry.Domain)
+		}
+		if entry.Target == "" || len(entry.Target) > 253 {
+			return fmt.Errorf("invalid target domain name for SRV record: %s", entry.Target)
+		}
+		if entry.Port < 1 || entry.Port > 65535 {
+			return fmt.Errorf("invalid port for SRV record: %d", entry.Port)
+		}
+		if entry.Priority < 0 || entry.Priority > 65535 || entry.Weight < 0 || entry.Weight > 65535 {
+			return fmt.Errorf("SRV priority and weight must be between 0 and 65535")
+		}
+	case "mx":
+		if entry.Domain == "" {
+			return fmt.Errorf("MX record requires a domain")
+		}
+		if entry.Target == "" || len(entry.Target) > 253 {
+			return fmt.Errorf("invalid mail server name for MX record: %s", entry.Target)
+		}
+		if entry.Priority < 0 || entry.Priority > 65535 {
+			return fmt.Errorf("MX preference must be between 0 and 65535")
+		}
+	case "ptr":
+		if entry.Domain == "" {
+			return fmt.Errorf("PTR record requires a name or IP address")
+		}
+		if entry.Value == "" || len(entry.Value) > 253 {
+			return fmt.Errorf("invalid target domain name for PTR record: %s", entry.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported DNS record type: %s. Only 'address', 'aaaa', 'cname', 'txt', 'ptr', 'srv', and 'mx' are supported", entry.Type)
+	}
 	return nil
 }
 
+// formatDNSEntry renders an entry as a dnsmasq directive, without comment.
+// A and AAAA records share the address= directive; dnsmasq picks the record
+// type from the address family.
+func formatDNSEntry(entry DNSEntry) string {
+	switch entry.Type {
+	case "address", "aaaa":
+		return fmt.Sprintf("address=/%s/%s", entry.Domain, entry.Value)
+	case "cname":
+		return fmt.Sprintf("cname=%s,%s", entry.Domain, entry.Value)
+	case "txt", "txt-record":
+		return fmt.Sprintf("txt-record=%s,\"%s\"", entry.Domain, entry.Value)
+	case "ptr":
+		return fmt.Sprintf("ptr-record=%s,%s", entry.Domain, entry.Value)
+	case "srv":
+		return fmt.Sprintf("srv-host=%s,%s,%d,%d,%d", entry.Domain, entry.Target, entry.Port, entry.Priority, entry.Weight)
+	case "mx":
+		return fmt.Sprintf("mx-host=%s,%s,%d", entry.Domain, entry.Target, entry.Priority)
+	}
+	return ""
+}
+
+var (
+	// address=/domain/ip
+	reAddress = regexp.MustCompile(`^address=/(.+)/(.+)$`)
+	// cname=domain,target
+	reCname = regexp.MustCompile(`^cname=(.+),(.+)$`)
+	// txt-record=domain,"value"
+	reTxt = regexp.MustCompile(`^txt-record=(.+),"(.+)"$`)
+	// ptr-record=name,target
+	rePtr = regexp.MustCompile(`^ptr-record=([^,]+),(.+)$`)
+	// srv-host=_service._proto.domain,target,port,priority,weight
+	reSrv = regexp.MustCompile(`^srv-host=([^,]+)(?:,([^,]*))?(?:,(\d+))?(?:,(\d+))?(?:,(\d+))?$`)
+	// mx-host=domain,target,preference
+	reMx = regexp.MustCompile(`^mx-host=([^,]+)(?:,([^,]*))?(?:,(\d+))?$`)
+)
+
+// parseDNSEntry parses a single directive (comment already stripped).
+func parseDNSEntry(line string) (DNSEntry, bool) {
+	if matches := reAddress.FindStringSubmatch(line); matches != nil {
+		recordType := "address"
+		if isIPv6(matches[2]) {
+			recordType = "aaaa"
+		}
+		return DNSEntry{Type: recordType, Domain: matches[1], Value: matches[2]}, true
+	} else if matches := reCname.FindStringSubmatch(line); matches != nil {
+		return DNSEntry{Type: "cname", Domain: matches[1], Value: matches[2]}, true
+	} else if matches := reTxt.FindStringSubmatch(line); matches != nil {
+		return DNSEntry{Type: "txt", Domain: matches[1], Value: matches[2]}, true
+	} else if matches := rePtr.FindStringSubmatch(line); matches != nil {
+		return DNSEntry{Type: "ptr", Domain: matches[1], Value: matches[2]}, true
+	} else if matches := reSrv.FindStringSubmatch(line); matches != nil {
+		entry := DNSEntry{Type: "srv", Domain: matches[1], Value: matches[2], Target: matches[2]}
+		entry.Port, _ = strconv.Atoi(matches[3])
+		entry.Priority, _ = strconv.Atoi(matches[4])
+		entry.Weight, _ = strconv.Atoi(matches[5])
+		return entry, true
+	} else if matches := reMx.FindStringSubmatch(line); matches != nil {
+		// dnsmasq defaults the MX preference to 1
+		entry := DNSEntry{Type: "mx", Domain: matches[1], Value: matches[2], Target: matches[2], Priority: 1}
+		if matches[3] != "" {
+			entry.Priority, _ = strconv.Atoi(matches[3])
+		}
+		return entry, true
+	}
+	return DNSEntry{}, false
+}
+
+// normalizeDNSEntry rewrites a PTR entry given by IP address into its
+// in-addr.arpa / ip6.arpa name, and fills in Target from Value for SRV and
+// MX entries (or the reverse) so either field can be used by clients.
+func normalizeDNSEntry(entry DNSEntry) DNSEntry {
+	switch entry.Type {
+	case "ptr":
+		if ip := net.ParseIP(entry.Domain); ip != nil {
+			entry.Domain = reverseDNSName(ip)
+		}
+	case "srv", "mx":
+		if entry.Target == "" {
+			entry.Target = entry.Value
+		}
+		entry.Value = entry.Target
+	}
+	return entry
+}
+
+// pairedPTRComment marks the ptr-record lines written for an A/AAAA entry
+// with PTR set, which are updated and removed along with the entry.
+const pairedPTRComment = "paired"
+
+// pairedPTR returns the PTR record matching an A or AAAA entry.
+func pairedPTR(entry DNSEntry) (DNSEntry, bool) {
+	if entry.Type != "address" && entry.Type != "aaaa" {
+		return DNSEntry{}, false
+	}
+	ip := net.ParseIP(entry.Value)
+	if ip == nil || entry.Domain == "" {
+		return DNSEntry{}, false
+	}
+	return DNSEntry{Type: "ptr", Domain: reverseDNSName(ip), Value: entry.Domain}, true
+}
+
+// reverseDNSName returns the reverse lookup name of an IP address, e.g.
+// 10.1.168.192.in-addr.arpa for 192.168.1.10.
+func reverseDNSName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	ip = ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hexDigits[ip[i]&0x0f]), string(hexDigits[ip[i]>>4]))
+	}
+	return strings.Join(nibbles, ".") + ".ip6.arpa"
+}
+
+// containsDNSLine reports whether content has a directive equal to line,
+// ignoring surrounding whitespace and trailing comments.
+func containsDNSLine(content, line string) bool {
+	for _, l := range strings.Split(content, "\n") {
+		if canonicalDNSLine(l) == line {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalDNSLine returns the normalized directive of a custom.conf line, or
+// "" when the line is not a DNS entry.
+func canonicalDNSLine(line string) string {
+	directive, _ := splitComment(line)
+	if entry, ok := parseDNSEntry(directive); ok {
+		return formatDNSEntry(entry)
+	}
+	return ""
+}
+
+func isIPv6(value string) bool {
+	ip := net.ParseIP(value)
+	return ip != nil && ip.To4() == nil
+}
+
 func (s *ConfigService) validateDnsmasqConfig(config string) error {
 	tmpfile, err := ioutil.TempFile("", "dnsmasq-config-")
 	if err != nil {
@@ -304,85 +669,7 @@ func (s *ConfigService) validateDnsmasqConfig(config string) error {
 }
 
 func (s *ConfigService) StartConfigSync(ctx context.Context) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		fmt.Printf("ERROR: failed to create watcher: %v\n", err)
-		return
-	}
-	defer watcher.Close()
-
-	err = watcher.Add(s.configFile)
-	if err != nil {
-		// If file doesn't exist, try to create it empty or wait?
-		// RestoreConfigFromConfigMap should have created it if it existed in ConfigMap.
-		// If not, maybe create empty?
-		if os.IsNotExist(err) {
-			// Create empty file if it doesn't exist so we can watch it
-			if err := ioutil.WriteFile(s.configFile, []byte(""), 0644); err != nil {
-				fmt.Printf("ERROR: failed to create config file: %v\n", err)
-				return
-			}
-			err = watcher.Add(s.configFile)
-			if err != nil {
-				fmt.Printf("ERROR: failed to watch config file: %v\n", err)
-				return
-			}
-		} else {
-			fmt.Printf("ERROR: failed to watch config file: %v\n", err)
-			return
-		}
-	}
-
-	fmt.Printf("INFO: Starting config sync for %s\n", s.configFile)
-
-	// Restore config from ConfigMap if it exists
-	if err := s.RestoreConfigFromConfigMap(ctx); err != nil {
-		fmt.Printf("WARN: failed to restore config from ConfigMap: %v\n", err)
-	} else {
-		// If restored, we might need to re-add watch if the file was recreated?
-		// RestoreConfigFromConfigMap uses ioutil.WriteFile which might truncate/create.
-		// fsnotify usually handles writes fine.
-	}
-
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-				fmt.Println("INFO: Config file modified, syncing to ConfigMap")
-				if err := s.SyncConfigToConfigMap(ctx); err != nil {
-					fmt.Printf("ERROR: failed to sync config to ConfigMap: %v\n", err)
-				}
-			}
-			if event.Op&fsnotify.Rename == fsnotify.Rename || event.Op&fsnotify.Remove == fsnotify.Remove {
-				fmt.Println("INFO: Config file renamed or removed, re-watching")
-				watcher.Remove(event.Name)
-				// Wait for file to be recreated?
-				// In our case, we might be the ones recreating it via Restore or Update?
-				// Or user might have done it.
-				// Let's try to re-add watch.
-				for {
-					err := watcher.Add(s.configFile)
-					if err == nil {
-						break
-					}
-					// Sleep a bit?
-				}
-				if err := s.SyncConfigToConfigMap(ctx); err != nil {
-					fmt.Printf("ERROR: failed to sync config to ConfigMap: %v\n", err)
-				}
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			fmt.Printf("ERROR: watcher error: %v\n", err)
-		case <-ctx.Done():
-			return
-		}
-	}
+	startFileSync(ctx, s.configFile, "config", s.RestoreConfigFromConfigMap, s.SyncConfigToConfigMap)
 }
 
 func (s *ConfigService) SyncConfigToConfigMap(ctx context.Context) error {
@@ -404,83 +691,13 @@ func (s *ConfigService) RestoreConfigFromConfigMap(ctx context.Context) error {
 	}
 
 	if content, ok := configMap.Data["dnsmasq.conf"]; ok {
-		return ioutil.WriteFile(s.configFile, []byte(content), 0644)
+		return writeFile(s.configFile, []byte(content))
 	}
 	return nil
 }
 
 func (s *ConfigService) StartCustomDNSSync(ctx context.Context) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		fmt.Printf("ERROR: failed to create watcher: %v\n", err)
-		return
-	}
-	defer watcher.Close()
-
-	// Ensure file exists
-	if _, err := os.Stat(s.customDNSFile); os.IsNotExist(err) {
-		// Ensure directory exists
-		dir := filepath.Dir(s.customDNSFile)
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				fmt.Printf("ERROR: failed to create custom DNS directory: %v\n", err)
-				return
-			}
-		}
-
-		if err := ioutil.WriteFile(s.customDNSFile, []byte(""), 0644); err != nil {
-			fmt.Printf("ERROR: failed to create custom DNS file: %v\n", err)
-			return
-		}
-	}
-
-	err = watcher.Add(s.customDNSFile)
-	if err != nil {
-		fmt.Printf("ERROR: failed to watch custom DNS file: %v\n", err)
-		return
-	}
-
-	fmt.Printf("INFO: Starting custom DNS sync for %s\n", s.customDNSFile)
-
-	// Restore from ConfigMap
-	if err := s.RestoreCustomDNSFromConfigMap(ctx); err != nil {
-		fmt.Printf("WARN: failed to restore custom DNS from ConfigMap: %v\n", err)
-	}
-
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-				fmt.Println("INFO: Custom DNS file modified, syncing to ConfigMap")
-				if err := s.SyncCustomDNSToConfigMap(ctx); err != nil {
-					fmt.Printf("ERROR: failed to sync custom DNS to ConfigMap: %v\n", err)
-				}
-			}
-			if event.Op&fsnotify.Rename == fsnotify.Rename || event.Op&fsnotify.Remove == fsnotify.Remove {
-				fmt.Println("INFO: Custom DNS file renamed or removed, re-watching")
-				watcher.Remove(event.Name)
-				for {
-					err := watcher.Add(s.customDNSFile)
-					if err == nil {
-						break
-					}
-				}
-				if err := s.SyncCustomDNSToConfigMap(ctx); err != nil {
-					fmt.Printf("ERROR: failed to sync custom DNS to ConfigMap: %v\n", err)
-				}
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			fmt.Printf("ERROR: watcher error: %v\n", err)
-		case <-ctx.Done():
-			return
-		}
-	}
+	startFileSync(ctx, s.customDNSFile, "custom DNS", s.RestoreCustomDNSFromConfigMap, s.SyncCustomDNSToConfigMap)
 }
 
 func (s *ConfigService) SyncCustomDNSToConfigMap(ctx context.Context) error {
@@ -502,11 +719,21 @@ func (s *ConfigService) RestoreCustomDNSFromConfigMap(ctx context.Context) error
 	}
 
 	if content, ok := configMap.Data["custom.conf"]; ok {
-		return ioutil.WriteFile(s.customDNSFile, []byte(content), 0644)
+		return writeFile(s.customDNSFile, []byte(content))
 	}
 	return nil
 }
 
+// followerRestartDelay is how long followers wait for more ConfigMap changes
+// before restarting dnsmasq
+var followerRestartDelay = 2 * time.Second
+
+// SetBlocklistService makes the ConfigMap watch re-render the blocklist when
+// the lists are changed on another replica.
+func (s *ConfigService) SetBlocklistService(blocklists *BlocklistService) {
+	s.blocklists = blocklists
+}
+
 func (s *ConfigService) StartConfigMapWatch(ctx context.Context) {
 	watcher, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Watch(ctx, metav1.ListOptions{})
 	if err != nil {
@@ -517,7 +744,11 @@ func (s *ConfigService) StartConfigMapWatch(ctx context.Context) {
 
 	fmt.Println("INFO: Starting ConfigMap watch")
 
+	// Followers restart dnsmasq to load the files synced from the leader,
+	// once a burst of changes has settled
+	var restart <-chan time.Time
 	for {
+		reload := false
 		select {
 		case event, ok := <-watcher.ResultChan():
 			if !ok {
@@ -539,14 +770,37 @@ func (s *ConfigService) StartConfigMapWatch(ctx context.Context) {
 
 				if cm.Name == "dnsmasq-config" {
 					if content, ok := cm.Data["dnsmasq.conf"]; ok {
-						if err := s.syncFileIfChanged(s.configFile, content); err != nil {
+						if changed, err := s.syncFileIfChanged(ctx, s.configFile, content); err != nil {
 							fmt.Printf("ERROR: failed to sync dnsmasq-config to file: %v\n", err)
+						} else if changed {
+							reload = true
 						}
 					}
 				} else if cm.Name == "dnsmasq-custom-dns" {
 					if content, ok := cm.Data["custom.conf"]; ok {
-						if err := s.syncFileIfChanged(s.customDNSFile, content); err != nil {
+						if changed, err := s.syncFileIfChanged(ctx, s.customDNSFile, content); err != nil {
 							fmt.Printf("ERROR: failed to sync dnsmasq-custom-dns to file: %v\n", err)
+						} else if changed {
+							reload = true
+						}
+					}
+				} else if cm.Name == externalDNSConfigMap {
+					// A hosts file, which dnsmasq reloads on SIGHUP
+					if content, ok := cm.Data[externalDNSConfigMapKey]; ok {
+						if changed, err := s.syncFileIfChanged(ctx, s.externalDNSFile, content); err != nil {
+							fmt.Printf("ERROR: failed to sync %s to file: %v\n", externalDNSConfigMap, err)
+						} else if changed && s.cluster.Follower() && s.supervisor != nil {
+							if err := s.supervisor.SignalService(dnsmasqProgram, "HUP"); err != nil {
+								fmt.Printf("ERROR: failed to reload dnsmasq: %v\n", err)
+							}
+						}
+					}
+				} else if cm.Name == "dnsmasq-forwarders" {
+					if content, ok := cm.Data["forwarders.conf"]; ok {
+						if changed, err := s.syncFileIfChanged(ctx, s.forwardersFile, content); err != nil {
+							fmt.Printf("ERROR: failed to sync dnsmasq-forwarders to file: %v\n", err)
+						} else if changed {
+							reload = true
 						}
 					}
 				} else if cm.Name == "dnsmasq-reservations" {
@@ -558,35 +812,113 @@ func (s *ConfigService) StartConfigMapWatch(ctx context.Context) {
 						reservationsFile = "/etc/dnsmasq.d/reservations.conf"
 					}
 					if content, ok := cm.Data["reservations.conf"]; ok {
-						if err := s.syncFileIfChanged(reservationsFile, content); err != nil {
+						if changed, err := s.syncFileIfChanged(ctx, reservationsFile, content); err != nil {
 							fmt.Printf("ERROR: failed to sync dnsmasq-reservations to file: %v\n", err)
+						} else if changed {
+							reload = true
+						}
+					}
+				} else if cm.Name == "dnsmasq-ranges" && !s.cluster.Follower() {
+					// Followers serve no DHCP, see StandByDHCP
+					rangesFile := os.Getenv("DHCP_RANGES_FILE")
+					if rangesFile == "" {
+						rangesFile = "/etc/dnsmasq.d/ranges.conf"
+					}
+					if content, ok := cm.Data["ranges.conf"]; ok {
+						if changed, err := s.syncFileIfChanged(ctx, rangesFile, content); err != nil {
+							fmt.Printf("ERROR: failed to sync dnsmasq-ranges to file: %v\n", err)
+						} else if changed {
+							reload = true
+						}
+					}
+				} else if cm.Name == "dnsmasq-dhcp-options" {
+					optionsFile := os.Getenv("DHCP_OPTIONS_FILE")
+					if optionsFile == "" {
+						optionsFile = "/etc/dnsmasq.d/dhcp-options.conf"
+					}
+					if content, ok := cm.Data["dhcp-options.conf"]; ok {
+						if changed, err := s.syncFileIfChanged(ctx, optionsFile, content); err != nil {
+							fmt.Printf("ERROR: failed to sync dnsmasq-dhcp-options to file: %v\n", err)
+						} else if changed {
+							reload = true
 						}
 					}
+				} else if cm.Name == "dnsmasq-leases" && s.cluster.Follower() {
+					// The leader syncs its lease file to the ConfigMap, followers
+					// keep a copy to take over DHCP with
+					leaseFile := os.Getenv("DHCP_LEASE_FILE")
+					if leaseFile == "" {
+						leaseFile = "/var/lib/misc/dnsmasq.leases"
+					}
+					if content, ok := cm.Data["dnsmasq.leases"]; ok {
+						if _, err := s.syncFileIfChanged(ctx, leaseFile, content); err != nil {
+							fmt.Printf("ERROR: failed to sync dnsmasq-leases to file: %v\n", err)
+						}
+					}
+				} else if cm.Name == "dnsmasq-pxe" {
+					pxeFile := os.Getenv("DHCP_PXE_FILE")
+					if pxeFile == "" {
+						pxeFile = "/etc/dnsmasq.d/pxe.conf"
+					}
+					if content, ok := cm.Data["pxe.conf"]; ok {
+						if changed, err := s.syncFileIfChanged(ctx, pxeFile, content); err != nil {
+							fmt.Printf("ERROR: failed to sync dnsmasq-pxe to file: %v\n", err)
+						} else if changed {
+							reload = true
+						}
+					}
+				} else if cm.Name == blocklistConfigMap && s.blocklists != nil {
+					if err := s.blocklists.Resync(ctx); err != nil {
+						fmt.Printf("ERROR: failed to render blocklist: %v\n", err)
+					}
+				} else if strings.HasPrefix(cm.Name, BlocklistContentPrefix) && s.blocklists != nil {
+					// The content of an imported list
+					name := strings.TrimPrefix(cm.Name, BlocklistContentPrefix)
+					if err := s.blocklists.Refresh(ctx, name); err != nil {
+						fmt.Printf("ERROR: failed to render blocklist: %v\n", err)
+					}
 				}
 			}
+		case <-restart:
+			restart = nil
+			if err := restartDnsmasq(s.supervisor); err != nil {
+				fmt.Printf("ERROR: failed to load synced files: %v\n", err)
+			}
 		case <-ctx.Done():
 			return
 		}
+		if reload && restart == nil && s.cluster.Follower() && s.supervisor != nil {
+			restart = time.After(followerRestartDelay)
+		}
 	}
 }
 
-func (s *ConfigService) syncFileIfChanged(filePath, newContent string) error {
+// syncFileIfChanged writes newContent to filePath and reports whether the
+// file changed.
+func (s *ConfigService) syncFileIfChanged(ctx context.Context, filePath, newContent string) (bool, error) {
+	unlock := lockFile(filePath)
+	defer unlock()
+
 	// Read current content
 	currentContent, err := ioutil.ReadFile(filePath)
 	if err != nil && !os.IsNotExist(err) {
-		return err
+		return false, err
 	}
 
 	// If content matches, do nothing (prevents infinite loop)
 	if string(currentContent) == newContent {
-		return nil
+		return false, nil
 	}
 
 	fmt.Printf("INFO: Syncing ConfigMap change to %s\n", filePath)
 	// Write new content
-	if err := ioutil.WriteFile(filePath, []byte(newContent), 0644); err != nil {
-		return err
+	if err := writeFileAtomic(filePath, []byte(newContent)); err != nil {
+		return false, err
 	}
 
-	return nil
+	// The leader records the change in the history
+	if !s.cluster.Follower() {
+		s.history.record(WithAuthor(ctx, "configmap"), filePath, string(currentContent), newContent)
+	}
+	return true, nil
 }
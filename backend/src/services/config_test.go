@@ -3,7 +3,9 @@ package services
 import (
 	"context"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -103,3 +105,232 @@ func TestConfigService_RestoreConfigFromConfigMap(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "restored-config", string(content))
 }
+
+func TestConfigService_AAAAEntries(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dns-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	customDNSFile := filepath.Join(tmpDir, "custom.conf")
+	os.Setenv("DNSMASQ_CUSTOM_DNS_FILE", customDNSFile)
+	defer os.Unsetenv("DNSMASQ_CUSTOM_DNS_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+
+	assert.NoError(t, configService.AddDNSEntry(context.Background(), "address", "host.lan", "192.168.1.10", ""))
+	assert.NoError(t, configService.AddDNSEntry(context.Background(), "aaaa", "host.lan", "2001:db8::10", "v6"))
+
+	// Address families must match the record type
+	assert.Error(t, configService.AddDNSEntry(context.Background(), "aaaa", "bad.lan", "192.168.1.11", ""))
+	assert.Error(t, configService.AddDNSEntry(context.Background(), "address", "bad.lan", "2001:db8::11", ""))
+
+	entries, err := configService.GetDNSEntries(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "address", entries[0].Type)
+	assert.Equal(t, "aaaa", entries[1].Type)
+	assert.Equal(t, "2001:db8::10", entries[1].Value)
+	assert.Equal(t, "v6", entries[1].Comment)
+
+	content, err := ioutil.ReadFile(customDNSFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "address=/host.lan/2001:db8::10 # v6")
+
+	err = configService.UpdateDNSEntry(context.Background(), entries[1], DNSEntry{Type: "aaaa", Domain: "host.lan", Value: "2001:db8::20"})
+	assert.NoError(t, err)
+
+	err = configService.DeleteDNSEntry(context.Background(), DNSEntry{Type: "aaaa", Domain: "host.lan", Value: "2001:db8::20"})
+	assert.NoError(t, err)
+
+	entries, err = configService.GetDNSEntries(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "192.168.1.10", entries[0].Value)
+}
+
+func TestConfigService_UpdateTXTEntry(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dns-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	customDNSFile := filepath.Join(tmpDir, "custom.conf")
+	assert.NoError(t, os.WriteFile(customDNSFile, []byte("txt-record=example.lan,\"v=spf1 -all\"\n"), 0644))
+	os.Setenv("DNSMASQ_CUSTOM_DNS_FILE", customDNSFile)
+	defer os.Unsetenv("DNSMASQ_CUSTOM_DNS_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+
+	// GetDNSEntries reports TXT records as "txt", which must round-trip through updates
+	err = configService.UpdateDNSEntry(context.Background(),
+		DNSEntry{Type: "txt", Domain: "example.lan", Value: "v=spf1 -all"},
+		DNSEntry{Type: "txt", Domain: "example.lan", Value: "v=spf1 mx -all"})
+	assert.NoError(t, err)
+
+	content, err := ioutil.ReadFile(customDNSFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "txt-record=example.lan,\"v=spf1 mx -all\"")
+}
+
+func TestConfigService_PTREntries(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dns-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	customDNSFile := filepath.Join(tmpDir, "custom.conf")
+	os.Setenv("DNSMASQ_CUSTOM_DNS_FILE", customDNSFile)
+	defer os.Unsetenv("DNSMASQ_CUSTOM_DNS_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+	ctx := context.Background()
+
+	// Standalone PTR given by IP is stored under its reverse name
+	assert.NoError(t, configService.CreateDNSEntry(ctx, DNSEntry{Type: "ptr", Domain: "192.168.1.1", Value: "gw.lan"}))
+	// A record with a paired PTR
+	assert.NoError(t, configService.CreateDNSEntry(ctx, DNSEntry{Type: "address", Domain: "nas.lan", Value: "192.168.1.20", PTR: true}))
+
+	content, err := ioutil.ReadFile(customDNSFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "ptr-record=1.1.168.192.in-addr.arpa,gw.lan")
+	assert.Contains(t, string(content), "ptr-record=20.1.168.192.in-addr.arpa,nas.lan")
+
+	entries, err := configService.GetDNSEntries(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "address", entries[1].Type)
+	assert.True(t, entries[1].PTR)
+
+	// Updating the A record moves its PTR along
+	err = configService.UpdateDNSEntry(ctx, entries[1], DNSEntry{Type: "address", Domain: "nas.lan", Value: "192.168.1.21", PTR: true})
+	assert.NoError(t, err)
+	content, err = ioutil.ReadFile(customDNSFile)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "20.1.168.192.in-addr.arpa")
+	assert.Contains(t, string(content), "ptr-record=21.1.168.192.in-addr.arpa,nas.lan")
+
+	// Deleting the A record removes its PTR, but leaves unrelated ones
+	err = configService.DeleteDNSEntry(ctx, DNSEntry{Type: "address", Domain: "nas.lan", Value: "192.168.1.21"})
+	assert.NoError(t, err)
+	entries, err = configService.GetDNSEntries(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "ptr", entries[0].Type)
+	assert.Equal(t, "1.1.168.192.in-addr.arpa", entries[0].Domain)
+
+	// A PTR written by hand is not owned by the A record with the same address
+	assert.NoError(t, configService.CreateDNSEntry(ctx, DNSEntry{Type: "address", Domain: "gw.lan", Value: "192.168.1.1"}))
+	entries, err = configService.GetDNSEntries(ctx)
+	assert.NoError(t, err)
+	assert.False(t, entries[1].PTR)
+	_, err = configService.UpdateDNSEntryByID(ctx, entries[1].ID, DNSEntry{Type: "address", Domain: "gw.lan", Value: "192.168.1.254", PTR: true})
+	assert.NoError(t, err)
+	_, err = configService.UpdateDNSEntryByID(ctx, entries[1].ID, DNSEntry{Type: "address", Domain: "gw.lan", Value: "192.168.1.1", PTR: true})
+	assert.ErrorIs(t, err, ErrNotFound)
+	entries, err = configService.GetDNSEntries(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, configService.DeleteDNSEntryByID(ctx, entries[1].ID))
+	content, err = ioutil.ReadFile(customDNSFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "\nptr-record=1.1.168.192.in-addr.arpa,gw.lan", string(content))
+}
+
+func TestReverseDNSName(t *testing.T) {
+	assert.Equal(t, "10.1.168.192.in-addr.arpa", reverseDNSName(net.ParseIP("192.168.1.10")))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", reverseDNSName(net.ParseIP("2001:db8::1")))
+}
+
+func TestConfigService_SRVAndMXEntries(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dns-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	customDNSFile := filepath.Join(tmpDir, "custom.conf")
+	content := `srv-host=_ldap._tcp.example.lan,dc1.example.lan,389,0,100 # LDAP
+mx-host=example.lan,mail.example.lan
+`
+	assert.NoError(t, os.WriteFile(customDNSFile, []byte(content), 0644))
+	os.Setenv("DNSMASQ_CUSTOM_DNS_FILE", customDNSFile)
+	defer os.Unsetenv("DNSMASQ_CUSTOM_DNS_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+	ctx := context.Background()
+
+	entries, err := configService.GetDNSEntries(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, DNSEntry{ID: entries[0].ID, Type: "srv", Domain: "_ldap._tcp.example.lan", Value: "dc1.example.lan", Comment: "LDAP", Port: 389, Priority: 0, Weight: 100, Target: "dc1.example.lan"}, entries[0])
+	// Preference defaults to 1 when omitted
+	assert.Equal(t, "mx", entries[1].Type)
+	assert.Equal(t, 1, entries[1].Priority)
+	assert.Equal(t, "mail.example.lan", entries[1].Target)
+
+	// Validation
+	assert.Error(t, configService.CreateDNSEntry(ctx, DNSEntry{Type: "srv", Domain: "ldap.example.lan", Target: "dc1.example.lan", Port: 389}))
+	assert.Error(t, configService.CreateDNSEntry(ctx, DNSEntry{Type: "srv", Domain: "_kerberos._udp.example.lan", Target: "dc1.example.lan"}))
+	assert.Error(t, configService.CreateDNSEntry(ctx, DNSEntry{Type: "mx", Domain: "example.lan"}))
+
+	assert.NoError(t, configService.CreateDNSEntry(ctx, DNSEntry{Type: "srv", Domain: "_kerberos._udp.example.lan", Target: "dc1.example.lan", Port: 88, Priority: 10}))
+
+	// Abbreviated directives in the file still match on update
+	err = configService.UpdateDNSEntry(ctx, entries[1], DNSEntry{Type: "mx", Domain: "example.lan", Target: "mail2.example.lan", Priority: 20})
+	assert.NoError(t, err)
+
+	err = configService.DeleteDNSEntry(ctx, entries[0])
+	assert.NoError(t, err)
+
+	newContent, err := ioutil.ReadFile(customDNSFile)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(newContent), "_ldap._tcp")
+	assert.Contains(t, string(newContent), "mx-host=example.lan,mail2.example.lan,20")
+	assert.Contains(t, string(newContent), "srv-host=_kerberos._udp.example.lan,dc1.example.lan,88,10,0")
+}
+
+func TestConfigService_DNSEntriesByID(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dns-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	customDNSFile := filepath.Join(tmpDir, "custom.conf")
+	content := `address=/a.lan/192.168.1.10
+address=/a.lan/192.168.1.10
+txt-record=b.lan,"v=spf1 #keep" # note
+`
+	assert.NoError(t, os.WriteFile(customDNSFile, []byte(content), 0644))
+	os.Setenv("DNSMASQ_CUSTOM_DNS_FILE", customDNSFile)
+	defer os.Unsetenv("DNSMASQ_CUSTOM_DNS_FILE")
+
+	configService := NewConfigService(fake.NewSimpleClientset(), "default")
+	ctx := context.Background()
+
+	entries, err := configService.GetDNSEntries(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	// Identical lines get distinct IDs
+	assert.Equal(t, entries[0].ID+"-2", entries[1].ID)
+	// '#' inside quotes is not a comment
+	assert.Equal(t, "v=spf1 #keep", entries[2].Value)
+	assert.Equal(t, "note", entries[2].Comment)
+
+	entry, err := configService.GetDNSEntry(ctx, entries[2].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "b.lan", entry.Domain)
+
+	newID, err := configService.UpdateDNSEntryByID(ctx, entries[1].ID, DNSEntry{Type: "address", Domain: "c.lan", Value: "192.168.1.11", PTR: true})
+	assert.NoError(t, err)
+	entry, err = configService.GetDNSEntry(ctx, newID)
+	assert.NoError(t, err)
+	assert.Equal(t, "c.lan", entry.Domain)
+	assert.True(t, entry.PTR)
+
+	assert.NoError(t, configService.DeleteDNSEntryByID(ctx, newID))
+	assert.ErrorIs(t, configService.DeleteDNSEntryByID(ctx, newID), ErrNotFound)
+
+	newContent, err := os.ReadFile(customDNSFile)
+	assert.NoError(t, err)
+	assert.Equal(t, `address=/a.lan/192.168.1.10
+txt-record=b.lan,"v=spf1 #keep" # note
+`, string(newContent))
+}
@@ -0,0 +1,528 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+var (
+	dnsRecordsResource       = schema.GroupVersionResource{Group: "dnsmasq-k8s.io", Version: "v1alpha1", Resource: "dnsrecords"}
+	dhcpReservationsResource = schema.GroupVersionResource{Group: "dnsmasq-k8s.io", Version: "v1alpha1", Resource: "dhcpreservations"}
+)
+
+// The Ready condition of the custom resources and its reasons
+const (
+	ConditionReady = "Ready"
+
+	ReasonReconciled  = "Reconciled"
+	ReasonInvalid     = "Invalid"
+	ReasonConflict    = "Conflict"
+	ReasonWriteFailed = "WriteFailed"
+)
+
+// Markers of the blocks the controller owns in custom.conf and
+// reservations.conf. Entries created through the API live outside of them.
+const (
+	dnsRecordsBegin       = "# BEGIN DNSRecord resources, managed by the dnsmasq-k8s controller"
+	dnsRecordsEnd         = "# END DNSRecord resources"
+	dhcpReservationsBegin = "# BEGIN DHCPReservation resources, managed by the dnsmasq-k8s controller"
+	dhcpReservationsEnd   = "# END DHCPReservation resources"
+)
+
+// controllerManaged reports for each of lines whether it belongs to a block
+// owned by the controller, markers included.
+func controllerManaged(lines []string) []bool {
+	managed := make([]bool, len(lines))
+	end := ""
+	for i, line := range lines {
+		switch {
+		case end != "":
+			managed[i] = true
+			if line == end {
+				end = ""
+			}
+		case line == dnsRecordsBegin:
+			managed[i], end = true, dnsRecordsEnd
+		case line == dhcpReservationsBegin:
+			managed[i], end = true, dhcpReservationsEnd
+		}
+	}
+	return managed
+}
+
+// controllerAuthor is the author of the revisions written by the controller
+const controllerAuthor = "crd-controller"
+
+// DNSRecord is a custom DNS entry managed as a Kubernetes resource.
+type DNSRecord struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              DNSRecordSpec  `json:"spec"`
+	Status            ResourceStatus `json:"status,omitempty"`
+}
+
+// DNSRecordSpec holds the fields of a DNSEntry.
+type DNSRecordSpec struct {
+	// Type is the record type, A, AAAA, CNAME, TXT, PTR, SRV or MX. The
+	// DNSEntry types are accepted as well.
+	Type     string `json:"type"`
+	Domain   string `json:"domain"`
+	Value    string `json:"value,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+	PTR      bool   `json:"ptr,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Target   string `json:"target,omitempty"`
+}
+
+func (s DNSRecordSpec) entry() DNSEntry {
+	recordType := strings.ToLower(s.Type)
+	if recordType == "a" {
+		recordType = "address"
+	}
+	return DNSEntry{
+		Type:     recordType,
+		Domain:   s.Domain,
+		Value:    s.Value,
+		Comment:  s.Comment,
+		PTR:      s.PTR,
+		Priority: s.Priority,
+		Weight:   s.Weight,
+		Port:     s.Port,
+		Target:   s.Target,
+	}
+}
+
+// DHCPReservationResource is a DHCP reservation managed as a Kubernetes
+// resource of kind DHCPReservation.
+type DHCPReservationResource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              DHCPReservationSpec `json:"spec"`
+	Status            ResourceStatus      `json:"status,omitempty"`
+}
+
+// DHCPReservationSpec holds the fields of a DHCPReservation.
+type DHCPReservationSpec struct {
+	MACAddresses []string `json:"macAddresses,omitempty"`
+	ClientID     string   `json:"clientID,omitempty"`
+	IPAddress    string   `json:"ipAddress,omitempty"`
+	IPv6Address  string   `json:"ipv6Address,omitempty"`
+	Hostname     string   `json:"hostname,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	MatchTags    []string `json:"matchTags,omitempty"`
+	LeaseTime    string   `json:"leaseTime,omitempty"`
+	Ignore       bool     `json:"ignore,omitempty"`
+	Comment      string   `json:"comment,omitempty"`
+}
+
+func (s DHCPReservationSpec) reservation() DHCPReservation {
+	return DHCPReservation{
+		MACAddresses: s.MACAddresses,
+		ClientID:     s.ClientID,
+		IPAddress:    s.IPAddress,
+		IPv6Address:  s.IPv6Address,
+		Hostname:     s.Hostname,
+		Tags:         s.Tags,
+		MatchTags:    s.MatchTags,
+		LeaseTime:    s.LeaseTime,
+		Ignore:       s.Ignore,
+		Comment:      s.Comment,
+	}
+}
+
+// ResourceStatus is the status of the custom resources. The Ready condition
+// reports whether the resource was written to its file.
+type ResourceStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// CRDController reconciles DNSRecord and DHCPReservation resources into
+// custom.conf and reservations.conf. Each file gets a block of lines owned by
+// the controller, rewritten on every change; the API refuses to edit it.
+type CRDController struct {
+	client        dynamic.Interface
+	namespace     string
+	configService *ConfigService
+	dhcpService   *DHCPService
+	supervisor    ServiceController
+	// restartPending is set while a written block has not been loaded by
+	// dnsmasq yet
+	restartPending bool
+	// resync is how often resources are reconciled without a change
+	resync time.Duration
+	// versions holds the resource versions of the last lists, watches
+	// start from them
+	versions map[schema.GroupVersionResource]string
+}
+
+func NewCRDController(client dynamic.Interface, namespace string, configService *ConfigService, dhcpService *DHCPService) *CRDController {
+	return &CRDController{
+		client:        client,
+		namespace:     namespace,
+		configService: configService,
+		dhcpService:   dhcpService,
+		resync:        5 * time.Minute,
+		versions:      map[schema.GroupVersionResource]string{},
+	}
+}
+
+// SetSupervisor makes the controller restart dnsmasq when it changes a
+// block, so the resources are served before they are reported ready.
+func (c *CRDController) SetSupervisor(supervisor ServiceController) {
+	c.supervisor = supervisor
+}
+
+// Start reconciles the resources, then again whenever one changes, until ctx
+// is done.
+func (c *CRDController) Start(ctx context.Context) {
+	fmt.Printf("INFO: Starting controller for DNSRecord and DHCPReservation resources in %s\n", c.namespace)
+	for {
+		if err := c.Reconcile(ctx); err != nil {
+			fmt.Printf("WARN: failed to reconcile custom resources: %v\n", err)
+		}
+		c.waitForChange(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// waitForChange returns when a resource changes, a watch ends or the resync
+// period passes.
+func (c *CRDController) waitForChange(ctx context.Context) {
+	var watches []func(context.Context) (watch.Interface, error)
+	for _, gvr := range []schema.GroupVersionResource{dnsRecordsResource, dhcpReservationsResource} {
+		watches = append(watches, func(ctx context.Context) (watch.Interface, error) {
+			return c.client.Resource(gvr).Namespace(c.namespace).Watch(ctx, metav1.ListOptions{ResourceVersion: c.versions[gvr]})
+		})
+	}
+	waitForWatches(ctx, c.resync, watches...)
+}
+
+// waitForWatches starts the watches and returns when one of them sees a
+// change or ends, or after timeout. Watches that fail to start are skipped.
+func waitForWatches(ctx context.Context, timeout time.Duration, watches ...func(context.Context) (watch.Interface, error)) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	for _, start := range watches {
+		w, err := start(ctx)
+		if err != nil {
+			fmt.Printf("WARN: failed to start watch: %v\n", err)
+			continue
+		}
+		defer w.Stop()
+		go func() {
+			for event := range w.ResultChan() {
+				if event.Type == watch.Bookmark {
+					continue
+				}
+				break
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}()
+	}
+
+	select {
+	case <-changed:
+		// Let changes applied together, as by kubectl apply -f, settle
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+}
+
+// Reconcile writes all resources to their files and updates their status.
+func (c *CRDController) Reconcile(ctx context.Context) error {
+	ctx = WithAuthor(ctx, controllerAuthor)
+	var errs []string
+	if c.configService != nil {
+		if err := c.reconcileDNSRecords(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("DNS records: %v", err))
+		}
+	}
+	if c.dhcpService != nil {
+		if err := c.reconcileDHCPReservations(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("DHCP reservations: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *CRDController) reconcileDNSRecords(ctx context.Context) error {
+	items, err := c.list(ctx, dnsRecordsResource)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	conditions := make([]metav1.Condition, len(items))
+	ptrs := map[string]bool{}
+	for i, item := range items {
+		var record DNSRecord
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &record); err != nil {
+			conditions[i] = notReady(ReasonInvalid, err.Error())
+			continue
+		}
+		entry := normalizeDNSEntry(record.Spec.entry())
+		if err := ValidateDNSEntry(entry); err != nil {
+			conditions[i] = notReady(ReasonInvalid, err.Error())
+			continue
+		}
+		if strings.ContainsAny(entry.Comment, "\r\n") {
+			conditions[i] = notReady(ReasonInvalid, "comment must be a single line")
+			continue
+		}
+
+		lines = append(lines, formatDNSEntry(entry)+" # "+resourceComment(record.Name, entry.Comment))
+		if ptr, ok := pairedPTR(entry); ok && entry.PTR && !ptrs[formatDNSEntry(ptr)] {
+			ptrs[formatDNSEntry(ptr)] = true
+			lines = append(lines, formatDNSEntry(ptr)+" # "+pairedPTRComment)
+		}
+		conditions[i] = ready("Written to " + c.configService.customDNSFile)
+	}
+
+	if err := c.writeBlock(ctx, c.configService.customDNSFile, dnsRecordsBegin, dnsRecordsEnd, lines, c.configService.history); err != nil {
+		failWrites(conditions, err)
+	} else if err := c.loadBlocks(); err != nil {
+		failWrites(conditions, err)
+	}
+	return c.updateStatus(ctx, dnsRecordsResource, items, conditions)
+}
+
+// reconcileDHCPReservations writes the reservations in name order. Each is
+// checked like an API write against the reservations outside the block and
+// the ones before it, and left out on validation errors.
+func (c *CRDController) reconcileDHCPReservations(ctx context.Context) error {
+	items, err := c.list(ctx, dhcpReservationsResource)
+	if err != nil {
+		return err
+	}
+
+	path := c.dhcpService.reservationsFile
+	content, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	base := replaceBlock(string(content), dhcpReservationsBegin, dhcpReservationsEnd, nil)
+	env, err := c.dhcpService.validationEnv(ctx)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	conditions := make([]metav1.Condition, len(items))
+	for i, item := range items {
+		var resource DHCPReservationResource
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &resource); err != nil {
+			conditions[i] = notReady(ReasonInvalid, err.Error())
+			continue
+		}
+		res := resource.Spec.reservation()
+		if err := ValidateReservation(res); err != nil {
+			conditions[i] = notReady(ReasonInvalid, err.Error())
+			continue
+		}
+		if strings.ContainsAny(res.Comment, "\r\n") {
+			conditions[i] = notReady(ReasonInvalid, "comment must be a single line")
+			continue
+		}
+
+		line := formatReservation(res) + " # " + resourceComment(resource.Name, res.Comment)
+		// The block goes last in the candidate, so the new reservation is the
+		// last one parsed
+		candidate := replaceBlock(base, dhcpReservationsBegin, dhcpReservationsEnd, append(append([]string{}, lines...), line))
+		reservations := parseReservations(candidate)
+		report := checkReservations(reservations, env).For(reservations[len(reservations)-1].ID)
+		if !report.Valid {
+			conditions[i] = notReady(ReasonConflict, (&ValidationError{Report: report}).Error())
+			continue
+		}
+
+		lines = append(lines, line)
+		message := "Written to " + path
+		for _, warning := range report.Warnings {
+			message += "; warning: " + warning.Message
+		}
+		conditions[i] = ready(message)
+	}
+
+	if err := c.writeBlock(ctx, path, dhcpReservationsBegin, dhcpReservationsEnd, lines, c.dhcpService.history); err != nil {
+		failWrites(conditions, err)
+	} else if err := c.loadBlocks(); err != nil {
+		failWrites(conditions, err)
+	}
+	return c.updateStatus(ctx, dhcpReservationsResource, items, conditions)
+}
+
+// list returns the resources of the controller's namespace sorted by name.
+func (c *CRDController) list(ctx context.Context, gvr schema.GroupVersionResource) ([]unstructured.Unstructured, error) {
+	list, err := c.client.Resource(gvr).Namespace(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", gvr.Resource, err)
+	}
+	c.versions[gvr] = list.GetResourceVersion()
+	items := list.Items
+	sort.Slice(items, func(i, j int) bool { return items[i].GetName() < items[j].GetName() })
+	return items, nil
+}
+
+// writeBlock replaces the controller's block in path with lines. The file is
+// only written when the block changes.
+func (c *CRDController) writeBlock(ctx context.Context, path, begin, end string, lines []string, history *HistoryService) error {
+	unlock := lockFile(path)
+	defer unlock()
+
+	content, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	newContent := replaceBlock(string(content), begin, end, lines)
+	if newContent == string(content) {
+		return nil
+	}
+	if c.configService != nil {
+		if err := c.configService.validateDnsmasqConfig(newContent); err != nil {
+			return fmt.Errorf("dnsmasq configuration validation failed: %v", err)
+		}
+	}
+	if err := writeFileAtomic(path, []byte(newContent)); err != nil {
+		return err
+	}
+	history.record(ctx, path, string(content), newContent)
+	fmt.Printf("INFO: Reconciled %d line(s) of custom resources into %s\n", len(lines), path)
+	c.restartPending = true
+	return nil
+}
+
+// loadBlocks restarts dnsmasq after a block was written, dnsmasq only reads
+// custom.conf and reservations.conf when it starts. A failed restart is
+// retried on the next reconcile.
+func (c *CRDController) loadBlocks() error {
+	if !c.restartPending || c.supervisor == nil {
+		return nil
+	}
+	if err := restartDnsmasq(c.supervisor); err != nil {
+		return err
+	}
+	c.restartPending = false
+	return nil
+}
+
+// updateStatus sets the Ready condition of each resource, skipping the ones
+// whose status is unchanged.
+func (c *CRDController) updateStatus(ctx context.Context, gvr schema.GroupVersionResource, items []unstructured.Unstructured, conditions []metav1.Condition) error {
+	var errs []string
+	for i, item := range items {
+		var status ResourceStatus
+		if raw, ok := item.Object["status"].(map[string]interface{}); ok {
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status); err != nil {
+				status = ResourceStatus{}
+			}
+		}
+		current := meta.FindStatusCondition(status.Conditions, ConditionReady)
+		condition := conditions[i]
+		condition.ObservedGeneration = item.GetGeneration()
+		if current != nil && status.ObservedGeneration == item.GetGeneration() &&
+			current.Status == condition.Status && current.Reason == condition.Reason && current.Message == condition.Message {
+			continue
+		}
+
+		meta.SetStatusCondition(&status.Conditions, condition)
+		status.ObservedGeneration = item.GetGeneration()
+		raw, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+		if err != nil {
+			return err
+		}
+		item.Object["status"] = raw
+		if _, err := c.client.Resource(gvr).Namespace(c.namespace).UpdateStatus(ctx, &item, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", item.GetName(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to update status of %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func ready(message string) metav1.Condition {
+	return metav1.Condition{Type: ConditionReady, Status: metav1.ConditionTrue, Reason: ReasonReconciled, Message: message}
+}
+
+func notReady(reason, message string) metav1.Condition {
+	return metav1.Condition{Type: ConditionReady, Status: metav1.ConditionFalse, Reason: reason, Message: message}
+}
+
+// failWrites marks the resources that would have been written as not ready.
+func failWrites(conditions []metav1.Condition, err error) {
+	for i, condition := range conditions {
+		if condition.Status == metav1.ConditionTrue {
+			conditions[i] = notReady(ReasonWriteFailed, err.Error())
+		}
+	}
+}
+
+// resourceComment is the comment of a line written for a resource, naming
+// the resource.
+func resourceComment(name, comment string) string {
+	if comment == "" {
+		return name
+	}
+	return name + ": " + comment
+}
+
+// replaceBlock replaces the lines between the begin and end markers, the
+// markers included, with a new block of lines. Without lines the block is
+// removed. A missing block is appended.
+func replaceBlock(content, begin, end string, lines []string) string {
+	var block []string
+	if len(lines) > 0 {
+		block = append(append([]string{begin}, lines...), end)
+	}
+
+	all := strings.Split(content, "\n")
+	start, stop := -1, -1
+	for i, line := range all {
+		if line == begin && start < 0 {
+			start = i
+		} else if line == end && start >= 0 {
+			stop = i
+			break
+		}
+	}
+	if start >= 0 && stop >= 0 {
+		result := append(append(append([]string{}, all[:start]...), block...), all[stop+1:]...)
+		return strings.Join(result, "\n")
+	}
+
+	if len(block) == 0 {
+		return content
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + strings.Join(block, "\n") + "\n"
+}
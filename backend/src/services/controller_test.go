@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReplaceBlock(t *testing.T) {
+	content := "address=/a.lan/10.0.0.1\n"
+	withBlock := replaceBlock(content, "# BEGIN", "# END", []string{"address=/b.lan/10.0.0.2"})
+	assert.Equal(t, "address=/a.lan/10.0.0.1\n# BEGIN\naddress=/b.lan/10.0.0.2\n# END\n", withBlock)
+
+	// The block keeps its place when replaced
+	withBlock += "address=/c.lan/10.0.0.3\n"
+	assert.Equal(t, "address=/a.lan/10.0.0.1\n# BEGIN\naddress=/b.lan/10.0.0.4\n# END\naddress=/c.lan/10.0.0.3\n",
+		replaceBlock(withBlock, "# BEGIN", "# END", []string{"address=/b.lan/10.0.0.4"}))
+	assert.Equal(t, "address=/a.lan/10.0.0.1\naddress=/c.lan/10.0.0.3\n", replaceBlock(withBlock, "# BEGIN", "# END", nil))
+	assert.Equal(t, content, replaceBlock(content, "# BEGIN", "# END", nil))
+}
+
+func newResource(gvr schema.GroupVersionResource, kind, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": gvr.GroupVersion().String(),
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default", "generation": int64(1)},
+		"spec":       spec,
+	}}
+}
+
+func readyCondition(t *testing.T, client *dynamicfake.FakeDynamicClient, gvr schema.GroupVersionResource, name string) *metav1.Condition {
+	item, err := client.Resource(gvr).Namespace("default").Get(context.Background(), name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	var status ResourceStatus
+	if raw, ok := item.Object["status"].(map[string]interface{}); ok {
+		assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status))
+	}
+	return meta.FindStatusCondition(status.Conditions, ConditionReady)
+}
+
+func TestCRDController(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "controller")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	customFile := filepath.Join(tmpDir, "custom.conf")
+	reservationsFile := filepath.Join(tmpDir, "reservations.conf")
+	assert.NoError(t, os.WriteFile(customFile, []byte("address=/api.lan/10.0.0.1 # from the API\n"), 0644))
+	assert.NoError(t, os.WriteFile(reservationsFile, []byte("dhcp-host=00:11:22:33:44:55,192.168.1.10,printer\n"), 0644))
+	os.Setenv("DNSMASQ_CUSTOM_DNS_FILE", customFile)
+	defer os.Unsetenv("DNSMASQ_CUSTOM_DNS_FILE")
+	os.Setenv("DHCP_RESERVATIONS_FILE", reservationsFile)
+	defer os.Unsetenv("DHCP_RESERVATIONS_FILE")
+	os.Setenv("DHCP_LEASE_FILE", filepath.Join(tmpDir, "dnsmasq.leases"))
+	defer os.Unsetenv("DHCP_LEASE_FILE")
+	os.Setenv("DHCP_RANGES_FILE", filepath.Join(tmpDir, "ranges.conf"))
+	defer os.Unsetenv("DHCP_RANGES_FILE")
+	os.Setenv("DNSMASQ_CONFIG_FILE", filepath.Join(tmpDir, "dnsmasq.conf"))
+	defer os.Unsetenv("DNSMASQ_CONFIG_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+	dhcpService := NewDHCPService(clientset, "default", configService)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			dnsRecordsResource:       "DNSRecordList",
+			dhcpReservationsResource: "DHCPReservationList",
+		},
+		newResource(dnsRecordsResource, "DNSRecord", "web", map[string]interface{}{
+			"type": "a", "domain": "web.lan", "value": "10.0.0.5", "ptr": true, "comment": "Web server",
+		}),
+		newResource(dnsRecordsResource, "DNSRecord", "broken", map[string]interface{}{
+			"type": "a", "domain": "broken.lan", "value": "not-an-ip",
+		}),
+		newResource(dhcpReservationsResource, "DHCPReservation", "laptop", map[string]interface{}{
+			"macAddresses": []interface{}{"aa:bb:cc:dd:ee:ff"}, "ipAddress": "192.168.1.20", "hostname": "laptop",
+		}),
+		// Clashes with the reservation made through the API
+		newResource(dhcpReservationsResource, "DHCPReservation", "printer-copy", map[string]interface{}{
+			"macAddresses": []interface{}{"00:11:22:33:44:66"}, "ipAddress": "192.168.1.10",
+		}),
+	)
+	controller := NewCRDController(client, "default", configService, dhcpService)
+	supervisor := &fakeSupervisor{}
+	controller.SetSupervisor(supervisor)
+	ctx := context.Background()
+
+	assert.NoError(t, controller.Reconcile(ctx))
+	// dnsmasq is restarted to load each changed block
+	assert.Equal(t, []string{"stop dnsmasq", "start dnsmasq", "stop dnsmasq", "start dnsmasq"}, supervisor.calls)
+
+	content, err := os.ReadFile(customFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "address=/api.lan/10.0.0.1 # from the API\n"+dnsRecordsBegin+"\n"+
+		"address=/web.lan/10.0.0.5 # web: Web server\n"+
+		"ptr-record=5.0.0.10.in-addr.arpa,web.lan # paired\n"+
+		dnsRecordsEnd+"\n", string(content))
+	content, err = os.ReadFile(reservationsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "dhcp-host=00:11:22:33:44:55,192.168.1.10,printer\n"+dhcpReservationsBegin+"\n"+
+		"dhcp-host=AA:BB:CC:DD:EE:FF,192.168.1.20,laptop # laptop\n"+
+		dhcpReservationsEnd+"\n", string(content))
+
+	// Entries from resources are listed with the ones from the API
+	entries, err := configService.GetDNSEntries(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	condition := readyCondition(t, client, dnsRecordsResource, "web")
+	assert.Equal(t, metav1.ConditionTrue, condition.Status)
+	assert.Equal(t, int64(1), condition.ObservedGeneration)
+	condition = readyCondition(t, client, dnsRecordsResource, "broken")
+	assert.Equal(t, metav1.ConditionFalse, condition.Status)
+	assert.Equal(t, ReasonInvalid, condition.Reason)
+	assert.Equal(t, metav1.ConditionTrue, readyCondition(t, client, dhcpReservationsResource, "laptop").Status)
+	condition = readyCondition(t, client, dhcpReservationsResource, "printer-copy")
+	assert.Equal(t, ReasonConflict, condition.Reason)
+	assert.Contains(t, condition.Message, "192.168.1.10")
+
+	// Nothing changed, dnsmasq keeps running
+	supervisor.calls = nil
+	assert.NoError(t, controller.Reconcile(ctx))
+	assert.Empty(t, supervisor.calls)
+
+	// Lines of the blocks can't be changed through the API
+	for _, entry := range entries {
+		if entry.Domain == "web.lan" || entry.Type == "ptr" {
+			_, err := configService.UpdateDNSEntryByID(ctx, entry.ID, DNSEntry{Type: "address", Domain: "web.lan", Value: "10.0.0.6"})
+			assert.ErrorIs(t, err, ErrConflict)
+			assert.ErrorIs(t, configService.DeleteDNSEntryByID(ctx, entry.ID), ErrConflict)
+		}
+	}
+	reservations, err := dhcpService.GetReservations(ctx)
+	assert.NoError(t, err)
+	for _, res := range reservations {
+		if res.Hostname == "laptop" {
+			assert.ErrorIs(t, dhcpService.DeleteReservationByID(ctx, res.ID), ErrConflict)
+			assert.ErrorIs(t, dhcpService.DeleteReservation(ctx, res), ErrConflict)
+		}
+	}
+	// Deleting an API copy of a resource's entry keeps the resource's PTR
+	before, err := os.ReadFile(customFile)
+	assert.NoError(t, err)
+	assert.NoError(t, configService.CreateDNSEntry(ctx, DNSEntry{Type: "address", Domain: "web.lan", Value: "10.0.0.5", PTR: true}))
+	entries, err = configService.GetDNSEntries(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "web.lan", entries[len(entries)-1].Domain)
+	assert.NoError(t, configService.DeleteDNSEntryByID(ctx, entries[len(entries)-1].ID))
+	content, err = os.ReadFile(customFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "ptr-record=5.0.0.10.in-addr.arpa,web.lan # paired\n"+dnsRecordsEnd)
+	assert.NoError(t, os.WriteFile(customFile, before, 0644))
+
+	// Deleted resources are removed from the files, API entries stay
+	assert.NoError(t, client.Resource(dnsRecordsResource).Namespace("default").Delete(ctx, "web", metav1.DeleteOptions{}))
+	assert.NoError(t, controller.Reconcile(ctx))
+	content, err = os.ReadFile(customFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "address=/api.lan/10.0.0.1 # from the API\n", string(content))
+	assert.Equal(t, []string{"stop dnsmasq", "start dnsmasq"}, supervisor.calls)
+}
@@ -0,0 +1,422 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	devicesConfigMap = "dnsmasq-devices"
+	devicesKey       = "devices.json"
+	// Stay well below the 1MiB ConfigMap limit
+	maxDevicesSize = 900 * 1024
+	// lastSeenResolution is how much a device's LastSeen must advance for
+	// the sighting alone to be saved
+	lastSeenResolution = time.Minute
+)
+
+// Device is a client seen in the DHCP leases, kept after its lease expires.
+type Device struct {
+	MACAddress string    `json:"mac_address"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	// IPAddresses and Hostnames hold every value observed, most recent last
+	IPAddresses []string `json:"ip_addresses"`
+	Hostnames   []string `json:"hostnames"`
+	// Vendor and RandomizedMAC are looked up from the MAC address, see
+	// LookupVendor
+	Vendor        string `json:"vendor,omitempty"`
+	RandomizedMAC bool   `json:"randomized_mac,omitempty"`
+	// VendorClass is the vendor class the client sent in its last DHCP
+	// request
+	VendorClass string `json:"vendor_class,omitempty"`
+	// Name and Notes are set by users
+	Name  string `json:"name,omitempty"`
+	Notes string `json:"notes,omitempty"`
+}
+
+// DeviceUpdate changes the user-editable fields of a device. Nil fields are
+// left unchanged.
+type DeviceUpdate struct {
+	Name  *string `json:"name"`
+	Notes *string `json:"notes"`
+}
+
+// DeviceService keeps an inventory of the clients seen in the DHCP leases in
+// the dnsmasq-devices ConfigMap.
+type DeviceService struct {
+	clientset    kubernetes.Interface
+	namespace    string
+	dhcpService  *DHCPService
+	eventService *EventService
+
+	mu      sync.Mutex
+	loaded  bool
+	devices map[string]*Device
+	// saveDelay batches the saves of sightings, see scheduleSave
+	saveDelay time.Duration
+	saveTimer *time.Timer
+}
+
+// NewDeviceService creates the inventory. Lease events of eventService, if
+// not nil, add the vendor class of clients.
+func NewDeviceService(clientset kubernetes.Interface, namespace string, dhcpService *DHCPService, eventService *EventService) *DeviceService {
+	return &DeviceService{
+		clientset:    clientset,
+		namespace:    namespace,
+		dhcpService:  dhcpService,
+		eventService: eventService,
+		devices:      make(map[string]*Device),
+		saveDelay:    10 * time.Second,
+	}
+}
+
+// StartDeviceSync records the leases whenever the lease file changes. The
+// inventory is loaded again first, another replica may have changed it while
+// this one was not leading.
+func (d *DeviceService) StartDeviceSync(ctx context.Context) {
+	d.mu.Lock()
+	if d.saveTimer != nil {
+		d.saveTimer.Stop()
+		d.saveTimer = nil
+	}
+	d.loaded = false
+	d.devices = make(map[string]*Device)
+	d.mu.Unlock()
+
+	if d.eventService != nil {
+		go d.followEvents(ctx)
+	}
+	startFileSync(ctx, d.dhcpService.leaseFile, "device inventory", d.observeLeaseFile, d.observeLeaseFile)
+}
+
+func (d *DeviceService) observeLeaseFile(ctx context.Context) error {
+	leases, err := d.dhcpService.GetLeases(ctx)
+	if err != nil {
+		return err
+	}
+	return d.Observe(ctx, leases, time.Now().UTC())
+}
+
+func (d *DeviceService) followEvents(ctx context.Context) {
+	events, cancel := d.eventService.Subscribe()
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if event.Action == LeaseEventDel || event.MACAddress == "" {
+				continue
+			}
+			lease := DHCPLease{MACAddress: event.MACAddress, IPAddress: event.IPAddress, Hostname: event.Hostname}
+			if err := d.observe(ctx, []DHCPLease{lease}, event.Time.UTC(), event.VendorClass); err != nil {
+				fmt.Printf("WARN: Failed to record device %s: %v\n", event.MACAddress, err)
+			}
+		}
+	}
+}
+
+// Observe records the clients of active leases as seen at now. DHCPv6
+// leases, which have no MAC address, are skipped.
+func (d *DeviceService) Observe(ctx context.Context, leases []DHCPLease, now time.Time) error {
+	return d.observe(ctx, leases, now, "")
+}
+
+func (d *DeviceService) observe(ctx context.Context, leases []DHCPLease, now time.Time, vendorClass string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.load(ctx); err != nil {
+		return err
+	}
+
+	changed := false
+	for _, lease := range leases {
+		mac, ok := deviceMAC(lease.MACAddress)
+		if !ok || (lease.ExpiryTime != 0 && lease.ExpiryTime < now.Unix()) {
+			continue
+		}
+		device, ok := d.devices[mac]
+		if !ok {
+			device = &Device{MACAddress: mac, FirstSeen: now, IPAddresses: []string{}, Hostnames: []string{}}
+			d.devices[mac] = device
+			changed = true
+		}
+		before := device.clone()
+		// Pick up updates of the vendor database
+		device.Vendor, device.RandomizedMAC = LookupVendor(mac)
+		if now.After(device.LastSeen) {
+			device.LastSeen = now
+		}
+		device.IPAddresses = observed(device.IPAddresses, lease.IPAddress)
+		// dnsmasq writes * for clients without a hostname
+		if lease.Hostname != "*" {
+			device.Hostnames = observed(device.Hostnames, lease.Hostname)
+		}
+		if vendorClass != "" {
+			device.VendorClass = vendorClass
+		}
+		if device.differs(before) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return d.scheduleSave(ctx)
+}
+
+// differs reports whether device has changed from before in a way worth
+// saving: a sighting alone counts once LastSeen advanced by
+// lastSeenResolution.
+func (device *Device) differs(before Device) bool {
+	if device.LastSeen.Sub(before.LastSeen) >= lastSeenResolution {
+		return true
+	}
+	return !slices.Equal(device.IPAddresses, before.IPAddresses) ||
+		!slices.Equal(device.Hostnames, before.Hostnames) ||
+		device.Vendor != before.Vendor ||
+		device.RandomizedMAC != before.RandomizedMAC ||
+		device.VendorClass != before.VendorClass
+}
+
+// scheduleSave saves the inventory saveDelay from now, so a burst of lease
+// changes is saved once. A save already scheduled covers this change too.
+// The caller must hold mu.
+func (d *DeviceService) scheduleSave(ctx context.Context) error {
+	if d.saveDelay <= 0 {
+		return d.save(ctx)
+	}
+	if d.saveTimer != nil {
+		return nil
+	}
+	d.saveTimer = time.AfterFunc(d.saveDelay, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.saveTimer = nil
+		if err := d.save(ctx); err != nil {
+			fmt.Printf("WARN: Failed to save device inventory: %v\n", err)
+		}
+	})
+	return nil
+}
+
+// observed moves value to the end of values, adding it if it is new.
+func observed(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	values = slices.DeleteFunc(values, func(v string) bool { return v == value })
+	return append(values, value)
+}
+
+// deviceMAC normalizes a MAC address to the key of its device.
+func deviceMAC(mac string) (string, bool) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", false
+	}
+	return strings.ToUpper(hw.String()), true
+}
+
+// GetDevices returns the devices matching query, most recently seen first.
+// The query is matched case-insensitively against the MAC address, IP
+// addresses, hostnames, vendor, name and notes of devices.
+func (d *DeviceService) GetDevices(ctx context.Context, query string) ([]Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.load(ctx); err != nil {
+		return nil, err
+	}
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	devices := []Device{}
+	for _, device := range d.devices {
+		if query == "" || device.matches(query) {
+			devices = append(devices, device.clone())
+		}
+	}
+	sortDevices(devices)
+	return devices, nil
+}
+
+func (device *Device) matches(query string) bool {
+	fields := append([]string{device.MACAddress, device.Vendor, device.VendorClass, device.Name, device.Notes}, device.IPAddresses...)
+	fields = append(fields, device.Hostnames...)
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of device that does not share its slices.
+func (device *Device) clone() Device {
+	result := *device
+	result.IPAddresses = slices.Clone(device.IPAddresses)
+	result.Hostnames = slices.Clone(device.Hostnames)
+	return result
+}
+
+func sortDevices(devices []Device) {
+	sort.Slice(devices, func(i, j int) bool {
+		if !devices[i].LastSeen.Equal(devices[j].LastSeen) {
+			return devices[i].LastSeen.After(devices[j].LastSeen)
+		}
+		return devices[i].MACAddress < devices[j].MACAddress
+	})
+}
+
+// GetDevice returns the device with the given MAC address.
+func (d *DeviceService) GetDevice(ctx context.Context, mac string) (*Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	device, err := d.find(ctx, mac)
+	if err != nil {
+		return nil, err
+	}
+	result := device.clone()
+	return &result, nil
+}
+
+// UpdateDevice sets the name and notes of a device.
+func (d *DeviceService) UpdateDevice(ctx context.Context, mac string, update DeviceUpdate) (*Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	device, err := d.find(ctx, mac)
+	if err != nil {
+		return nil, err
+	}
+	if update.Name != nil {
+		device.Name = strings.TrimSpace(*update.Name)
+	}
+	if update.Notes != nil {
+		device.Notes = *update.Notes
+	}
+	if err := d.save(ctx); err != nil {
+		return nil, err
+	}
+	result := device.clone()
+	return &result, nil
+}
+
+// DeleteDevice removes a device from the inventory. It is added again when it
+// shows up in the leases.
+func (d *DeviceService) DeleteDevice(ctx context.Context, mac string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	device, err := d.find(ctx, mac)
+	if err != nil {
+		return err
+	}
+	delete(d.devices, device.MACAddress)
+	return d.save(ctx)
+}
+
+// DeviceReservation returns a reservation for a device, to promote it to a
+// reserved client. Empty fields of res default to the last IP address and
+// hostname of the device, and its name as the comment.
+func (d *DeviceService) DeviceReservation(ctx context.Context, mac string, res DHCPReservation) (DHCPReservation, error) {
+	device, err := d.GetDevice(ctx, mac)
+	if err != nil {
+		return res, err
+	}
+	res.MACAddress = device.MACAddress
+	if res.IPAddress == "" && len(device.IPAddresses) > 0 {
+		res.IPAddress = device.IPAddresses[len(device.IPAddresses)-1]
+	}
+	if res.Hostname == "" && len(device.Hostnames) > 0 {
+		res.Hostname = device.Hostnames[len(device.Hostnames)-1]
+	}
+	if res.Comment == "" {
+		res.Comment = device.Name
+	}
+	return res, nil
+}
+
+func (d *DeviceService) find(ctx context.Context, mac string) (*Device, error) {
+	if err := d.load(ctx); err != nil {
+		return nil, err
+	}
+	key, ok := deviceMAC(mac)
+	if !ok {
+		return nil, fmt.Errorf("device %s %w", mac, ErrNotFound)
+	}
+	device, ok := d.devices[key]
+	if !ok {
+		return nil, fmt.Errorf("device %s %w", mac, ErrNotFound)
+	}
+	return device, nil
+}
+
+// save stores the inventory in its ConfigMap, including the changes of a
+// scheduled save. The devices seen least recently are dropped when it grows
+// too large.
+func (d *DeviceService) save(ctx context.Context) error {
+	if d.saveTimer != nil {
+		d.saveTimer.Stop()
+		d.saveTimer = nil
+	}
+
+	devices := make([]Device, 0, len(d.devices))
+	for _, device := range d.devices {
+		devices = append(devices, *device)
+	}
+	sortDevices(devices)
+
+	for {
+		data, err := json.Marshal(devices)
+		if err != nil {
+			return err
+		}
+		if len(data) <= maxDevicesSize || len(devices) <= 1 {
+			return UpdateConfigMapWithRetry(ctx, d.clientset, d.namespace, devicesConfigMap, devicesKey, string(data))
+		}
+		dropped := devices[len(devices)-1]
+		fmt.Printf("WARN: Device inventory is full, dropping %s\n", dropped.MACAddress)
+		delete(d.devices, dropped.MACAddress)
+		devices = devices[:len(devices)-1]
+	}
+}
+
+func (d *DeviceService) load(ctx context.Context) error {
+	if d.loaded {
+		return nil
+	}
+
+	configMap, err := d.clientset.CoreV1().ConfigMaps(d.namespace).Get(ctx, devicesConfigMap, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if data, ok := configMap.Data[devicesKey]; ok && data != "" {
+			var devices []Device
+			if err := json.Unmarshal([]byte(data), &devices); err != nil {
+				return fmt.Errorf("failed to parse device inventory: %v", err)
+			}
+			for i := range devices {
+				d.devices[devices[i].MACAddress] = &devices[i]
+			}
+		}
+	}
+
+	d.loaded = true
+	return nil
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDeviceService(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	deviceService := NewDeviceService(clientset, "default", nil, nil)
+	ctx := context.Background()
+	first := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	later := first.Add(24 * time.Hour)
+
+	assert.NoError(t, deviceService.Observe(ctx, []DHCPLease{
+		{MACAddress: "00:0c:29:1c:bf:3b", IPAddress: "192.168.1.100", Hostname: "laptop"},
+		{MACAddress: "00:0C:29:1C:BF:3C", IPAddress: "192.168.1.101", Hostname: "*"},
+		// No MAC address
+		{IPv6: true, DUID: "00:01:00:01:2b:3c:4d:5e:00:11:22:33:44:55", IPAddress: "fd00::10"},
+	}, first))
+	assert.NoError(t, deviceService.Observe(ctx, []DHCPLease{
+		{MACAddress: "00:0C:29:1C:BF:3B", IPAddress: "192.168.1.110", Hostname: "laptop"},
+		// Expired leases are not a sighting
+		{MACAddress: "00:0C:29:1C:BF:3C", IPAddress: "192.168.1.101", ExpiryTime: first.Unix()},
+	}, later))
+
+	devices, err := deviceService.GetDevices(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+	assert.Equal(t, Device{
+		MACAddress:  "00:0C:29:1C:BF:3B",
+		FirstSeen:   first,
+		LastSeen:    later,
+		IPAddresses: []string{"192.168.1.100", "192.168.1.110"},
+		Hostnames:   []string{"laptop"},
+		Vendor:      "VMware, Inc.",
+	}, devices[0])
+	assert.Equal(t, first, devices[1].LastSeen)
+	assert.Empty(t, devices[1].Hostnames)
+
+	name, notes := "Work laptop", "Asset 1234"
+	_, err = deviceService.UpdateDevice(ctx, "00-0c-29-1c-bf-3c", DeviceUpdate{Name: &name, Notes: &notes})
+	assert.NoError(t, err)
+	_, err = deviceService.UpdateDevice(ctx, "00:0C:29:1C:BF:FF", DeviceUpdate{Name: &name})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	devices, err = deviceService.GetDevices(ctx, "asset")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "Work laptop", devices[0].Name)
+	devices, err = deviceService.GetDevices(ctx, "192.168.1.11")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "00:0C:29:1C:BF:3B", devices[0].MACAddress)
+
+	// The inventory survives restarts in its ConfigMap
+	configMap, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, devicesConfigMap, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, configMap.Data[devicesKey], "Asset 1234")
+	restored, err := NewDeviceService(clientset, "default", nil, nil).GetDevice(ctx, "00:0C:29:1C:BF:3C")
+	assert.NoError(t, err)
+	assert.Equal(t, "Asset 1234", restored.Notes)
+
+	assert.NoError(t, deviceService.DeleteDevice(ctx, "00:0C:29:1C:BF:3C"))
+	_, err = deviceService.GetDevice(ctx, "00:0C:29:1C:BF:3C")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestDeviceService_DeviceReservation(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "devices")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	leaseFile := filepath.Join(tmpDir, "dnsmasq.leases")
+	assert.NoError(t, os.WriteFile(leaseFile, []byte("0 00:0c:29:1c:bf:3b 192.168.1.100 laptop *\n"), 0644))
+	os.Setenv("DHCP_LEASE_FILE", leaseFile)
+	defer os.Unsetenv("DHCP_LEASE_FILE")
+	os.Setenv("DHCP_RESERVATIONS_FILE", filepath.Join(tmpDir, "reservations.conf"))
+	defer os.Unsetenv("DHCP_RESERVATIONS_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	dhcpService := NewDHCPService(clientset, "default", nil)
+	deviceService := NewDeviceService(clientset, "default", dhcpService, nil)
+	ctx := context.Background()
+	assert.NoError(t, deviceService.observeLeaseFile(ctx))
+
+	name := "Work laptop"
+	_, err = deviceService.UpdateDevice(ctx, "00:0C:29:1C:BF:3B", DeviceUpdate{Name: &name})
+	assert.NoError(t, err)
+
+	res, err := deviceService.DeviceReservation(ctx, "00:0c:29:1c:bf:3b", DHCPReservation{IPAddress: "192.168.1.10"})
+	assert.NoError(t, err)
+	assert.Equal(t, DHCPReservation{MACAddress: "00:0C:29:1C:BF:3B", IPAddress: "192.168.1.10", Hostname: "laptop", Comment: "Work laptop"}, res)
+
+	_, err = deviceService.DeviceReservation(ctx, "00:0C:29:1C:BF:FF", DHCPReservation{})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestDeviceService_Saves(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "devices")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	leaseFile := filepath.Join(tmpDir, "dnsmasq.leases")
+	assert.NoError(t, os.WriteFile(leaseFile, []byte("0 00:0c:29:1c:bf:3b 192.168.1.100 laptop *\n"), 0644))
+	os.Setenv("DHCP_LEASE_FILE", leaseFile)
+	defer os.Unsetenv("DHCP_LEASE_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	deviceService := NewDeviceService(clientset, "default", NewDHCPService(clientset, "default", nil), nil)
+	deviceService.saveDelay = 50 * time.Millisecond
+	ctx := context.Background()
+	saves := func() int {
+		count := 0
+		for _, action := range clientset.Actions() {
+			if action.GetResource().Resource == "configmaps" && (action.GetVerb() == "create" || action.GetVerb() == "update") {
+				count++
+			}
+		}
+		return count
+	}
+	first := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	laptop := DHCPLease{MACAddress: "00:0C:29:1C:BF:3B", IPAddress: "192.168.1.100", Hostname: "laptop"}
+	phone := DHCPLease{MACAddress: "00:0C:29:1C:BF:3C", IPAddress: "192.168.1.101", Hostname: "phone"}
+
+	// A burst of sightings is saved once
+	assert.NoError(t, deviceService.Observe(ctx, []DHCPLease{laptop}, first))
+	assert.NoError(t, deviceService.Observe(ctx, []DHCPLease{phone}, first))
+	assert.Equal(t, 0, saves())
+	assert.Eventually(t, func() bool { return saves() == 1 }, time.Second, 10*time.Millisecond)
+
+	// Sightings that change nothing are not saved
+	deviceService.saveDelay = 0
+	assert.NoError(t, deviceService.Observe(ctx, []DHCPLease{laptop, phone}, first.Add(time.Second)))
+	assert.Equal(t, 1, saves())
+	assert.NoError(t, deviceService.Observe(ctx, []DHCPLease{laptop}, first.Add(time.Hour)))
+	assert.Equal(t, 2, saves())
+
+	// The inventory is loaded again when this replica starts leading
+	other := NewDeviceService(clientset, "default", nil, nil)
+	assert.NoError(t, other.DeleteDevice(ctx, "00:0C:29:1C:BF:3C"))
+	stopped, cancel := context.WithCancel(ctx)
+	cancel()
+	deviceService.StartDeviceSync(stopped)
+	_, err = deviceService.GetDevice(ctx, "00:0C:29:1C:BF:3C")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
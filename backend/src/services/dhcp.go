@@ -5,11 +5,10 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-
-	"github.com/fsnotify/fsnotify"
+	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -22,7 +21,21 @@ type DHCPService struct {
 	namespace        string
 	leaseFile        string
 	reservationsFile string
-	configService    *ConfigService
+	rangesFile       string
+	optionsFile      string
+	pxeFile          string
+	// tftpRoot is the TFTP root used when TFTP is enabled without one
+	tftpRoot      string
+	configService *ConfigService
+	history       *HistoryService
+	// supervisor stops dnsmasq while leases are changed, see SetSupervisor
+	supervisor ServiceController
+	// leaseSettle is how long to wait for dnsmasq to load the lease file
+	// before checking a lease change
+	leaseSettle time.Duration
+
+	// tagsMu serializes changes to tag definitions
+	tagsMu sync.Mutex
 }
 
 type DHCPLease struct {
@@ -30,14 +43,52 @@ type DHCPLease struct {
 	IPAddress  string `json:"ip_address"`
 	Hostname   string `json:"hostname"`
 	ExpiryTime int64  `json:"expiry_time"`
+	// ClientID is the DHCPv4 client identifier, if the client sent one
+	ClientID string `json:"client_id,omitempty"`
+	IPv6     bool   `json:"ipv6"`
+	// IAID and DUID identify the client of a DHCPv6 lease. DHCPv6 leases
+	// have no MAC address. IAID is prefixed with T for temporary addresses.
+	IAID string `json:"iaid,omitempty"`
+	DUID string `json:"duid,omitempty"`
+	// Vendor and RandomizedMAC are looked up from the MAC address, see
+	// LookupVendor
+	Vendor        string `json:"vendor,omitempty"`
+	RandomizedMAC bool   `json:"randomized_mac,omitempty"`
 }
 
 type DHCPReservation struct {
-	MACAddress string `json:"mac_address"`
-	IPAddress  string `json:"ip_address"`
-	Hostname   string `json:"hostname"`
-	Tag        string `json:"tag"`
-	Comment    string `json:"comment"`
+	// ID identifies the reservation's line in reservations.conf, see entryID
+	ID string `json:"id"`
+	// MACAddress is the first of MACAddresses. Addresses may contain *
+	// wildcards and a hardware type prefix (1-00:11:22:33:44:55).
+	MACAddress   string   `json:"mac_address"`
+	MACAddresses []string `json:"mac_addresses,omitempty"`
+	// ClientID is the client identifier (id:), a DUID for DHCPv6 clients,
+	// or * to ignore the client identifier and match on the MAC address.
+	// Reservations match on MACAddress, ClientID or both.
+	ClientID string `json:"client_id,omitempty"`
+	// IPAddress is the IPv4 address, or the IPv6 address of IPv6 only
+	// reservations. IPv6Address is the IPv6 address of dual-stack ones.
+	IPAddress   string `json:"ip_address"`
+	IPv6Address string `json:"ipv6_address,omitempty"`
+	Hostname    string `json:"hostname"`
+	// Tag is the first of Tags, the tags set (set:) on matching clients
+	Tag  string   `json:"tag"`
+	Tags []string `json:"tags,omitempty"`
+	// MatchTags are the tags (tag:) a client must have for the reservation
+	// to apply
+	MatchTags []string `json:"match_tags,omitempty"`
+	LeaseTime string   `json:"lease_time,omitempty"`
+	// Ignore makes dnsmasq ignore DHCP requests from matching clients
+	Ignore bool `json:"ignore,omitempty"`
+	// Extra holds fields of the directive that are not modeled above. They
+	// are written back unchanged.
+	Extra   []string `json:"extra,omitempty"`
+	Comment string   `json:"comment"`
+	// Vendor and RandomizedMAC are looked up from MACAddress, see
+	// LookupVendor. They are not written to reservations.conf.
+	Vendor        string `json:"vendor,omitempty"`
+	RandomizedMAC bool   `json:"randomized_mac,omitempty"`
 }
 
 func NewDHCPService(clientset kubernetes.Interface, namespace string, configService *ConfigService) *DHCPService {
@@ -49,12 +100,38 @@ func NewDHCPService(clientset kubernetes.Interface, namespace string, configServ
 	if reservationsFile == "" {
 		reservationsFile = "/etc/dnsmasq.d/reservations.conf"
 	}
+	rangesFile := os.Getenv("DHCP_RANGES_FILE")
+	if rangesFile == "" {
+		rangesFile = "/etc/dnsmasq.d/ranges.conf"
+	}
+	optionsFile := os.Getenv("DHCP_OPTIONS_FILE")
+	if optionsFile == "" {
+		optionsFile = "/etc/dnsmasq.d/dhcp-options.conf"
+	}
+	pxeFile := os.Getenv("DHCP_PXE_FILE")
+	if pxeFile == "" {
+		pxeFile = "/etc/dnsmasq.d/pxe.conf"
+	}
+	tftpRoot := os.Getenv("TFTP_ROOT")
+	if tftpRoot == "" {
+		tftpRoot = "/var/lib/tftpboot"
+	}
+	// supervisord starts dnsmasq after a 5 second delay, see supervisord.conf
+	leaseSettle := 8 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("DHCP_LEASE_SETTLE")); err == nil {
+		leaseSettle = v
+	}
 	return &DHCPService{
 		clientset:        clientset,
 		namespace:        namespace,
 		leaseFile:        leaseFile,
 		reservationsFile: reservationsFile,
+		rangesFile:       rangesFile,
+		optionsFile:      optionsFile,
+		pxeFile:          pxeFile,
+		tftpRoot:         tftpRoot,
 		configService:    configService,
+		leaseSettle:      leaseSettle,
 	}
 }
 
@@ -66,335 +143,271 @@ func (s *DHCPService) GetLeases(ctx context.Context) ([]DHCPLease, error) {
 	defer file.Close()
 
 	leases := []DHCPLease{}
+	ipv6 := false
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		parts := strings.Fields(line)
-		if len(parts) >= 4 {
-			expiry, _ := strconv.ParseInt(parts[0], 10, 64)
-			leases = append(leases, DHCPLease{
-				MACAddress: strings.ToUpper(parts[1]),
-				IPAddress:  parts[2],
-				Hostname:   parts[3],
-				ExpiryTime: expiry,
-			})
+		if isDUIDLine(line) {
+			ipv6 = true
+			continue
+		}
+		if lease, ok := parseLease(line, ipv6); ok {
+			lease.Vendor, lease.RandomizedMAC = LookupVendor(lease.MACAddress)
+			leases = append(leases, lease)
 		}
 	}
 
 	return leases, scanner.Err()
 }
 
-func (s *DHCPService) GetReservations(ctx context.Context) ([]DHCPReservation, error) {
-	if _, err := os.Stat(s.reservationsFile); os.IsNotExist(err) {
-		return []DHCPReservation{}, nil
+// isDUIDLine reports whether line is the "duid <server-duid>" line of the
+// lease file, after which all leases are DHCPv6 leases.
+func isDUIDLine(line string) bool {
+	parts := strings.Fields(line)
+	return len(parts) == 2 && parts[0] == "duid"
+}
+
+// parseLease parses a line of the dnsmasq lease file. DHCPv4 leases are
+//
+//	<expiry> <mac> <ip> <hostname> <client-id>
+//
+// and DHCPv6 leases, which follow the duid line, are
+//
+//	<expiry> [T]<iaid> <ip> <hostname> <client-duid>
+//
+// dnsmasq writes "*" for unknown client IDs.
+func parseLease(line string, ipv6 bool) (DHCPLease, bool) {
+	parts := strings.Fields(line)
+	if len(parts) < 4 {
+		return DHCPLease{}, false
+	}
+	expiry, _ := strconv.ParseInt(parts[0], 10, 64)
+	lease := DHCPLease{
+		IPAddress:  parts[2],
+		Hostname:   parts[3],
+		ExpiryTime: expiry,
+		IPv6:       ipv6,
+	}
+	clientID := ""
+	if len(parts) > 4 && parts[4] != "*" {
+		clientID = parts[4]
+	}
+	if ipv6 {
+		lease.IAID = parts[1]
+		lease.DUID = clientID
+	} else {
+		lease.MACAddress = strings.ToUpper(parts[1])
+		lease.ClientID = clientID
+	}
+	return lease, true
+}
+
+// sameLease reports whether lease is the lease identified by target.
+func sameLease(lease, target DHCPLease) bool {
+	if lease.IPAddress != target.IPAddress || lease.Hostname != target.Hostname {
+		return false
+	}
+	if lease.IPv6 {
+		return (target.DUID == "" || strings.EqualFold(lease.DUID, target.DUID)) &&
+			(target.IAID == "" || lease.IAID == target.IAID)
 	}
+	return strings.EqualFold(lease.MACAddress, target.MACAddress)
+}
 
-	content, err := os.ReadFile(s.reservationsFile)
+func (s *DHCPService) GetReservations(ctx context.Context) ([]DHCPReservation, error) {
+	content, err := readFile(s.reservationsFile)
 	if err != nil {
 		return nil, err
 	}
+	reservations := parseReservations(string(content))
+	for i := range reservations {
+		reservations[i].Vendor, reservations[i].RandomizedMAC = LookupVendor(reservations[i].MACAddress)
+	}
+	return reservations, nil
+}
 
+// parseReservations returns the reservations of a reservations file with
+// their IDs and comments.
+func parseReservations(content string) []DHCPReservation {
 	reservations := []DHCPReservation{}
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	ids := idAssigner{}
+	for _, line := range strings.Split(content, "\n") {
+		directive, comment := splitComment(line)
+		if res, ok := parseReservation(directive); ok {
+			res.Comment = comment
+			res.ID = ids.next(directive)
+			reservations = append(reservations, res)
 		}
+	}
+	return reservations
+}
 
-		comment := ""
-		if idx := strings.Index(line, "#"); idx != -1 {
-			comment = strings.TrimSpace(line[idx+1:])
-			line = strings.TrimSpace(line[:idx])
-		}
+// ReservationsETag returns the ETag of reservations.conf.
+func (s *DHCPService) ReservationsETag(ctx context.Context) (string, error) {
+	return fileETag(s.reservationsFile)
+}
 
-		// dhcp-host=mac,ip,hostname OR dhcp-host=hostname,mac,ip
-		// Also supports set:tag
-		if strings.HasPrefix(line, "dhcp-host=") {
-			parts := strings.Split(strings.TrimPrefix(line, "dhcp-host="), ",")
-			if len(parts) >= 3 {
-				res := DHCPReservation{
-					Comment: comment,
-				}
-				for _, part := range parts {
-					part = strings.TrimSpace(part)
-					if strings.Contains(part, ":") && !strings.HasPrefix(part, "set:") && !strings.HasPrefix(part, "tag:") && !strings.HasPrefix(part, "id:") {
-						res.MACAddress = strings.ToUpper(part)
-					} else if strings.Contains(part, ".") {
-						res.IPAddress = part
-					} else if strings.HasPrefix(part, "set:") {
-						res.Tag = strings.TrimPrefix(part, "set:")
-					} else if !strings.HasPrefix(part, "tag:") && !strings.HasPrefix(part, "id:") && !strings.HasPrefix(part, "ignore") {
-						res.Hostname = part
-					}
-				}
-				if res.MACAddress != "" && res.IPAddress != "" {
-					reservations = append(reservations, res)
-				}
-			}
+// GetReservation returns the reservation with the given ID.
+func (s *DHCPService) GetReservation(ctx context.Context, id string) (*DHCPReservation, error) {
+	reservations, err := s.GetReservations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range reservations {
+		if res.ID == id {
+			return &res, nil
 		}
 	}
-	return reservations, nil
+	return nil, fmt.Errorf("reservation %w", ErrNotFound)
 }
 
-func (s *DHCPService) AddReservation(ctx context.Context, macAddress, ipAddress, hostname, tag, comment string) error {
-	macAddress = strings.ToUpper(macAddress)
-	// Ensure directory exists
-	dir := filepath.Dir(s.reservationsFile)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create reservations directory: %v", err)
-		}
-	}
+// AddReservation appends a reservation and returns its ID. Reservations with
+// validation errors are rejected with a ValidationError.
+func (s *DHCPService) AddReservation(ctx context.Context, res DHCPReservation) (string, error) {
+	unlock := lockFile(s.reservationsFile)
+	defer unlock()
 
-	// Append to file
-	f, err := os.OpenFile(s.reservationsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	old, err := readFile(s.reservationsFile)
 	if err != nil {
-		return err
+		return "", err
 	}
-	// defer f.Close() // We close explicitly
 
-	// Format: dhcp-host=mac,[set:tag,]ip,hostname
-	line := fmt.Sprintf("\ndhcp-host=%s", macAddress)
-	if tag != "" && tag != "None" {
-		line += fmt.Sprintf(",set:%s", tag)
-	}
-	line += fmt.Sprintf(",%s,%s", ipAddress, hostname)
+	line := "\n" + formatReservation(res)
 
-	if comment != "" {
-		line += fmt.Sprintf(" # %s", comment)
+	if res.Comment != "" {
+		line += fmt.Sprintf(" # %s", res.Comment)
 	}
 
-	if _, err := f.WriteString(line); err != nil {
-		return err
+	newContent := string(old) + line
+	reservations := parseReservations(newContent)
+	if _, ok := parseReservation(formatReservation(res)); !ok {
+		return "", fmt.Errorf("%w: empty reservation", ErrInvalid)
+	}
+	id := reservations[len(reservations)-1].ID
+	if err := s.checkReservation(ctx, reservations, id); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(s.reservationsFile, []byte(newContent)); err != nil {
+		return "", err
 	}
 
-	f.Close()
-	return nil
+	s.history.record(ctx, s.reservationsFile, string(old), newContent)
+	return id, nil
 }
 
-func (s *DHCPService) UpdateReservation(ctx context.Context, oldRes, newRes DHCPReservation) error {
-	return s.modifyReservation(ctx, oldRes, newRes, false)
+// UpdateReservation replaces oldRes with newRes. Fields newRes leaves unset,
+// such as the lease time, are kept, see mergeReservation.
+func (s *DHCPService) UpdateReservation(ctx context.Context, oldRes DHCPReservation, newRes ReservationUpdate) error {
+	return s.modifyReservation(ctx, oldRes, func(current DHCPReservation) (DHCPReservation, error) {
+		res := mergeReservation(current, newRes)
+		if err := ValidateReservation(res); err != nil {
+			return res, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		return res, nil
+	})
 }
 
 func (s *DHCPService) DeleteReservation(ctx context.Context, res DHCPReservation) error {
-	return s.modifyReservation(ctx, res, DHCPReservation{}, true)
+	return s.modifyReservation(ctx, res, nil)
 }
 
-func (s *DHCPService) modifyReservation(ctx context.Context, target, newRes DHCPReservation, isDelete bool) error {
-	content, err := os.ReadFile(s.reservationsFile)
-	if err != nil {
-		return err
-	}
-
-	lines := strings.Split(string(content), "\n")
-	var newLines []string
-	found := false
-
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-
-		// Strip comment if present
-		if idx := strings.Index(trimmed, "#"); idx != -1 {
-			trimmed = strings.TrimSpace(trimmed[:idx])
-		}
-
-		if !found && strings.HasPrefix(trimmed, "dhcp-host=") {
-			parts := strings.Split(strings.TrimPrefix(trimmed, "dhcp-host="), ",")
-			if len(parts) >= 3 {
-				currentRes := DHCPReservation{}
-				for _, part := range parts {
-					part = strings.TrimSpace(part)
-					if strings.Contains(part, ":") && !strings.HasPrefix(part, "set:") && !strings.HasPrefix(part, "tag:") && !strings.HasPrefix(part, "id:") {
-						currentRes.MACAddress = part
-					} else if strings.Contains(part, ".") {
-						currentRes.IPAddress = part
-					} else if strings.HasPrefix(part, "set:") {
-						currentRes.Tag = strings.TrimPrefix(part, "set:")
-					} else if !strings.HasPrefix(part, "tag:") && !strings.HasPrefix(part, "id:") && !strings.HasPrefix(part, "ignore") {
-						currentRes.Hostname = part
-					}
-				}
-
-				// Compare MAC, IP, Hostname. Tag might change, so we don't use it for identification unless strictly needed.
-				// But user might want to change tag.
-				if strings.EqualFold(currentRes.MACAddress, target.MACAddress) && currentRes.IPAddress == target.IPAddress && currentRes.Hostname == target.Hostname {
-					found = true
-					if !isDelete {
-						newRes.MACAddress = strings.ToUpper(newRes.MACAddress)
-						// Write in format: dhcp-host=mac,[set:tag,]ip,hostname
-						newLine := fmt.Sprintf("dhcp-host=%s", newRes.MACAddress)
-						if newRes.Tag != "" && newRes.Tag != "None" {
-							newLine += fmt.Sprintf(",set:%s", newRes.Tag)
-						}
-						newLine += fmt.Sprintf(",%s,%s", newRes.IPAddress, newRes.Hostname)
-
-						if newRes.Comment != "" {
-							newLine += fmt.Sprintf(" # %s", newRes.Comment)
-						}
-						newLines = append(newLines, newLine)
-					}
-					continue
-				}
-			}
-		}
-		newLines = append(newLines, line)
-	}
-
-	if !found {
-		return fmt.Errorf("reservation not found")
-	}
+// UpdateReservationByID replaces the reservation with the given ID and
+// returns the ID of the updated reservation.
+func (s *DHCPService) UpdateReservationByID(ctx context.Context, id string, newRes DHCPReservation) (string, error) {
+	return s.modifyReservationWhere(ctx, func(resID string, _ DHCPReservation) bool { return resID == id }, func(DHCPReservation) (DHCPReservation, error) { return newRes, nil })
+}
 
-	if err := os.WriteFile(s.reservationsFile, []byte(strings.Join(newLines, "\n")), 0644); err != nil {
-		return err
-	}
+func (s *DHCPService) DeleteReservationByID(ctx context.Context, id string) error {
+	_, err := s.modifyReservationWhere(ctx, func(resID string, _ DHCPReservation) bool { return resID == id }, nil)
+	return err
+}
 
-	return nil
+func (s *DHCPService) modifyReservation(ctx context.Context, target DHCPReservation, edit func(DHCPReservation) (DHCPReservation, error)) error {
+	// Compare MAC, IP, Hostname. Tag might change, so we don't use it for identification.
+	_, err := s.modifyReservationWhere(ctx, func(_ string, res DHCPReservation) bool {
+		return strings.EqualFold(res.MACAddress, target.MACAddress) && res.IPAddress == target.IPAddress && res.Hostname == target.Hostname
+	}, edit)
+	return err
 }
 
-func (s *DHCPService) UpdateLease(ctx context.Context, oldLease, newLease DHCPLease) error {
-	// Leases file format: timestamp mac ip hostname clientid
-	// We only care about mac, ip, hostname for now. Timestamp is usually first.
-	// This is tricky because dnsmasq manages this file.
-	// Editing it while dnsmasq is running might be overwritten.
-	// However, for the sake of this UI, we will try to edit it.
-	// Ideally, we should use dhcp_release or similar tools, but we are editing the file directly.
+// modifyReservationWhere replaces the first reservation accepted by match with
+// the result of edit, or removes it when edit is nil, and returns the ID of the
+// replacement. An error from edit leaves the file unchanged.
+func (s *DHCPService) modifyReservationWhere(ctx context.Context, match func(id string, res DHCPReservation) bool, edit func(current DHCPReservation) (DHCPReservation, error)) (string, error) {
+	unlock := lockFile(s.reservationsFile)
+	defer unlock()
 
-	content, err := os.ReadFile(s.leaseFile)
+	content, err := os.ReadFile(s.reservationsFile)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	lines := strings.Split(string(content), "\n")
+	managed := controllerManaged(lines)
 	var newLines []string
 	found := false
+	newIdx := -1
+	ids := idAssigner{}
+
+	for i, line := range lines {
+		directive, _ := splitComment(line)
+		res, ok := parseReservation(directive)
+		if !ok {
+			newLines = append(newLines, line)
+			continue
+		}
 
-	for _, line := range lines {
-		parts := strings.Fields(line)
-		if len(parts) >= 4 {
-			// parts[1] is mac, parts[2] is ip, parts[3] is hostname
-			if strings.EqualFold(parts[1], oldLease.MACAddress) && parts[2] == oldLease.IPAddress && parts[3] == oldLease.Hostname {
-				found = true
-				newLease.MACAddress = strings.ToUpper(newLease.MACAddress)
-				// Preserve timestamp (parts[0]) and clientid (parts[4] if exists)
-				newLine := fmt.Sprintf("%s %s %s %s", parts[0], newLease.MACAddress, newLease.IPAddress, newLease.Hostname)
-				if len(parts) > 4 {
-					newLine += " " + strings.Join(parts[4:], " ")
+		if !found && match(ids.next(directive), res) {
+			if managed[i] {
+				return "", fmt.Errorf("%w: reservation is managed by a DHCPReservation resource, change the resource instead", ErrConflict)
+			}
+			found = true
+			if edit != nil {
+				newRes, err := edit(res)
+				if err != nil {
+					return "", err
+				}
+				newLine := formatReservation(newRes)
+				newIdx = len(newLines)
+				if newRes.Comment != "" {
+					newLine += fmt.Sprintf(" # %s", newRes.Comment)
 				}
 				newLines = append(newLines, newLine)
-				continue
 			}
+			continue
 		}
 		newLines = append(newLines, line)
 	}
 
 	if !found {
-		return fmt.Errorf("lease not found")
+		return "", fmt.Errorf("reservation %w", ErrNotFound)
 	}
 
-	if err := os.WriteFile(s.leaseFile, []byte(strings.Join(newLines, "\n")), 0644); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (s *DHCPService) DeleteLease(ctx context.Context, lease DHCPLease) error {
-	content, err := os.ReadFile(s.leaseFile)
-	if err != nil {
-		return err
-	}
-
-	lines := strings.Split(string(content), "\n")
-	var newLines []string
-	found := false
-
-	for _, line := range lines {
-		parts := strings.Fields(line)
-		if len(parts) >= 4 {
-			if strings.EqualFold(parts[1], lease.MACAddress) && parts[2] == lease.IPAddress && parts[3] == lease.Hostname {
-				found = true
-				continue // Skip adding this line
+	newContent := strings.Join(newLines, "\n")
+	newID := ""
+	if edit != nil {
+		ids = idAssigner{}
+		for _, line := range newLines[:newIdx+1] {
+			if directive, _ := splitComment(line); strings.HasPrefix(directive, "dhcp-host=") {
+				if _, ok := parseReservation(directive); ok {
+					newID = ids.next(directive)
+				}
 			}
 		}
-		newLines = append(newLines, line)
-	}
-
-	if !found {
-		return fmt.Errorf("lease not found")
+		if err := s.checkReservation(ctx, parseReservations(newContent), newID); err != nil {
+			return "", err
+		}
 	}
 
-	if err := os.WriteFile(s.leaseFile, []byte(strings.Join(newLines, "\n")), 0644); err != nil {
-		return err
+	if err := writeFileAtomic(s.reservationsFile, []byte(newContent)); err != nil {
+		return "", err
 	}
-
-	return nil
+	s.history.record(ctx, s.reservationsFile, string(content), newContent)
+	return newID, nil
 }
 
 func (s *DHCPService) StartLeaseSync(ctx context.Context) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		fmt.Printf("ERROR: failed to create watcher: %v\n", err)
-		return
-	}
-	defer watcher.Close()
-
-	// Ensure lease file exists
-	if _, err := os.Stat(s.leaseFile); os.IsNotExist(err) {
-		file, err := os.Create(s.leaseFile)
-		if err != nil {
-			fmt.Printf("ERROR: failed to create lease file: %v\n", err)
-			return
-		}
-		file.Close()
-	}
-
-	err = watcher.Add(s.leaseFile)
-	if err != nil {
-		fmt.Printf("ERROR: failed to watch lease file: %v\n", err)
-		return
-	}
-
-	fmt.Printf("INFO: Starting lease sync for %s\n", s.leaseFile)
-
-	// Restore leases from ConfigMap if they exist
-	if err := s.RestoreLeasesFromConfigMap(ctx); err != nil {
-		fmt.Printf("WARN: failed to restore leases from ConfigMap: %v\n", err)
-	}
-
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-				fmt.Println("INFO: lease file modified/created, syncing to ConfigMap")
-				if err := s.SyncLeasesToConfigMap(ctx); err != nil {
-					fmt.Printf("ERROR: failed to sync leases: %v\n", err)
-				}
-			}
-			// Handle atomic updates (Rename/Remove)
-			if event.Op&fsnotify.Rename == fsnotify.Rename || event.Op&fsnotify.Remove == fsnotify.Remove {
-				fmt.Println("INFO: lease file renamed/removed, re-watching")
-				// Wait a bit for the file to be recreated
-				// In a real scenario, we might want a retry loop here
-				watcher.Remove(s.leaseFile)
-				watcher.Add(s.leaseFile)
-				// Trigger sync just in case
-				if err := s.SyncLeasesToConfigMap(ctx); err != nil {
-					fmt.Printf("ERROR: failed to sync leases after recreate: %v\n", err)
-				}
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			fmt.Printf("ERROR: watcher error: %v\n", err)
-		case <-ctx.Done():
-			return
-		}
-	}
+	startFileSync(ctx, s.leaseFile, "lease", s.RestoreLeasesFromConfigMap, s.SyncLeasesToConfigMap)
 }
 
 func (s *DHCPService) SyncLeasesToConfigMap(ctx context.Context) error {
@@ -443,7 +456,9 @@ func (s *DHCPService) RestoreLeasesFromConfigMap(ctx context.Context) error {
 	}
 
 	if content, ok := configMap.Data["dnsmasq.leases"]; ok {
-		if err := os.WriteFile(s.leaseFile, []byte(content), 0644); err != nil {
+		unlock := lockFile(s.leaseFile)
+		defer unlock()
+		if err := writeFileInPlace(s.leaseFile, []byte(content)); err != nil {
 			return err
 		}
 	}
@@ -451,68 +466,7 @@ func (s *DHCPService) RestoreLeasesFromConfigMap(ctx context.Context) error {
 }
 
 func (s *DHCPService) StartReservationsSync(ctx context.Context) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		fmt.Printf("ERROR: failed to create watcher: %v\n", err)
-		return
-	}
-	defer watcher.Close()
-
-	// Ensure file exists
-	if _, err := os.Stat(s.reservationsFile); os.IsNotExist(err) {
-		dir := filepath.Dir(s.reservationsFile)
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			os.MkdirAll(dir, 0755)
-		}
-		os.WriteFile(s.reservationsFile, []byte(""), 0644)
-	}
-
-	err = watcher.Add(s.reservationsFile)
-	if err != nil {
-		fmt.Printf("ERROR: failed to watch reservations file: %v\n", err)
-		return
-	}
-
-	fmt.Printf("INFO: Starting reservations sync for %s\n", s.reservationsFile)
-
-	if err := s.RestoreReservationsFromConfigMap(ctx); err != nil {
-		fmt.Printf("WARN: failed to restore reservations from ConfigMap: %v\n", err)
-	}
-
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-				fmt.Println("INFO: Reservations file modified, syncing to ConfigMap")
-				if err := s.SyncReservationsToConfigMap(ctx); err != nil {
-					fmt.Printf("ERROR: failed to sync reservations to ConfigMap: %v\n", err)
-				}
-			}
-			if event.Op&fsnotify.Rename == fsnotify.Rename || event.Op&fsnotify.Remove == fsnotify.Remove {
-				fmt.Println("INFO: Reservations file renamed/removed, re-watching")
-				watcher.Remove(event.Name)
-				for {
-					err := watcher.Add(s.reservationsFile)
-					if err == nil {
-						break
-					}
-				}
-				if err := s.SyncReservationsToConfigMap(ctx); err != nil {
-					fmt.Printf("ERROR: failed to sync reservations to ConfigMap: %v\n", err)
-				}
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			fmt.Printf("ERROR: watcher error: %v\n", err)
-		case <-ctx.Done():
-			return
-		}
-	}
+	startFileSync(ctx, s.reservationsFile, "reservations", s.RestoreReservationsFromConfigMap, s.SyncReservationsToConfigMap)
 }
 
 func (s *DHCPService) SyncReservationsToConfigMap(ctx context.Context) error {
@@ -534,7 +488,7 @@ func (s *DHCPService) RestoreReservationsFromConfigMap(ctx context.Context) erro
 	}
 
 	if content, ok := configMap.Data["reservations.conf"]; ok {
-		if err := os.WriteFile(s.reservationsFile, []byte(content), 0644); err != nil {
+		if err := writeFile(s.reservationsFile, []byte(content)); err != nil {
 			return err
 		}
 	}
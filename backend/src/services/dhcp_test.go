@@ -74,7 +74,7 @@ func TestDHCPService_AddReservation_Uppercase(t *testing.T) {
 	dhcpService := NewDHCPService(clientset, "default", configService)
 
 	// Add with lowercase
-	err = dhcpService.AddReservation(context.Background(), "AA:BB:CC:DD:EE:FF", "192.168.1.100", "test-host", "", "test comment")
+	_, err = dhcpService.AddReservation(context.Background(), DHCPReservation{MACAddress: "AA:BB:CC:DD:EE:FF", IPAddress: "192.168.1.100", Hostname: "test-host", Comment: "test comment"})
 	// Ignore error from ReloadDnsmasq if any, or check if it's specific error
 	// assert.NoError(t, err)
 
@@ -134,7 +134,7 @@ func TestDHCPService_UpdateReservation_Uppercase(t *testing.T) {
 		Hostname:   "my-host-new",
 	}
 
-	err = dhcpService.UpdateReservation(context.Background(), oldRes, newRes)
+	err = dhcpService.UpdateReservation(context.Background(), oldRes, ReservationUpdate{DHCPReservation: newRes})
 	// assert.NoError(t, err)
 
 	content, err := ioutil.ReadFile(resFile.Name())
@@ -142,6 +142,85 @@ func TestDHCPService_UpdateReservation_Uppercase(t *testing.T) {
 	assert.Contains(t, string(content), "00:0C:29:1C:BF:3C")
 }
 
+func TestDHCPService_ReservationsByID(t *testing.T) {
+	resFile, err := ioutil.TempFile("", "reservations")
+	assert.NoError(t, err)
+	defer os.Remove(resFile.Name())
+
+	_, err = resFile.WriteString("dhcp-host=00:0C:29:1C:BF:3B,192.168.1.100,host-a # first\ndhcp-host=00:0C:29:1C:BF:3C,192.168.1.101,host-b\n")
+	assert.NoError(t, err)
+	resFile.Close()
+
+	os.Setenv("DHCP_RESERVATIONS_FILE", resFile.Name())
+	defer os.Unsetenv("DHCP_RESERVATIONS_FILE")
+
+	dhcpService := NewDHCPService(fake.NewSimpleClientset(), "default", nil)
+	ctx := context.Background()
+
+	res, err := dhcpService.GetReservations(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, res, 2)
+	assert.NotEqual(t, res[0].ID, res[1].ID)
+	idB := res[1].ID
+
+	// IDs don't move when other lines change
+	assert.NoError(t, dhcpService.DeleteReservationByID(ctx, res[0].ID))
+	got, err := dhcpService.GetReservation(ctx, idB)
+	assert.NoError(t, err)
+	assert.Equal(t, "host-b", got.Hostname)
+
+	newID, err := dhcpService.UpdateReservationByID(ctx, idB, DHCPReservation{MACAddress: "00:0c:29:1c:bf:3c", IPAddress: "192.168.1.102", Hostname: "host-b"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, idB, newID)
+	got, err = dhcpService.GetReservation(ctx, newID)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.102", got.IPAddress)
+
+	// Stale IDs are rejected
+	_, err = dhcpService.UpdateReservationByID(ctx, idB, DHCPReservation{MACAddress: "00:0C:29:1C:BF:3C", IPAddress: "192.168.1.103"})
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = dhcpService.GetReservation(ctx, idB)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestDHCPService_IPv6Leases(t *testing.T) {
+	leaseFile, err := ioutil.TempFile("", "leases")
+	assert.NoError(t, err)
+	defer os.Remove(leaseFile.Name())
+
+	_, err = leaseFile.WriteString("1677721600 00:0c:29:1c:bf:3b 192.168.1.100 my-host 01:00:0c:29:1c:bf:3b\n" +
+		"duid 00:01:00:01:2b:3c:4d:5e:52:54:00:12:34:56\n" +
+		"1677721700 1251993 2001:db8::10 host6 00:01:00:01:aa:bb:cc:dd:00:11:22:33:44:55\n" +
+		"1677721800 T5 2001:db8::99 * 00:01:00:01:aa:bb:cc:dd:00:11:22:33:44:66\n")
+	assert.NoError(t, err)
+	leaseFile.Close()
+
+	os.Setenv("DHCP_LEASE_FILE", leaseFile.Name())
+	defer os.Unsetenv("DHCP_LEASE_FILE")
+
+	dhcpService := NewDHCPService(fake.NewSimpleClientset(), "default", nil)
+	ctx := context.Background()
+
+	leases, err := dhcpService.GetLeases(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, leases, 3)
+	assert.False(t, leases[0].IPv6)
+	assert.Equal(t, "01:00:0c:29:1c:bf:3b", leases[0].ClientID)
+	assert.Equal(t, DHCPLease{IPAddress: "2001:db8::10", Hostname: "host6", ExpiryTime: 1677721700, IPv6: true, IAID: "1251993", DUID: "00:01:00:01:aa:bb:cc:dd:00:11:22:33:44:55"}, leases[1])
+	assert.Equal(t, "T5", leases[2].IAID)
+
+	change, err := dhcpService.DeleteLease(ctx, DHCPLease{IPAddress: "2001:db8::10", Hostname: "host6", DUID: "00:01:00:01:aa:bb:cc:dd:00:11:22:33:44:55"})
+	assert.NoError(t, err)
+	assert.Equal(t, LeaseChangeFile, change.Method)
+	content, err := ioutil.ReadFile(leaseFile.Name())
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "duid 00:01:00:01:2b:3c:4d:5e:52:54:00:12:34:56\n")
+	assert.NotContains(t, string(content), "host6")
+	leases, err = dhcpService.GetLeases(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, leases, 2)
+}
+
 func TestDHCPService_SyncLeasesToConfigMap(t *testing.T) {
 	leaseFile, err := ioutil.TempFile("", "leases")
 	assert.NoError(t, err)
@@ -0,0 +1,256 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// hwAddrRe matches the hardware addresses of dhcp-host: hex octets or *
+// wildcards, with an optional hardware type prefix.
+var hwAddrRe = regexp.MustCompile(`^([0-9]{1,2}-)?([0-9A-Fa-f]{1,2}|\*)([:-]([0-9A-Fa-f]{1,2}|\*))+$`)
+
+// parseReservation parses a dhcp-host directive. Its fields may appear in any
+// order and are told apart by their syntax:
+//
+//	dhcp-host=[<hwaddr>,...][id:<client-id>|*,][set:<tag>,...][tag:<tag>,...]
+//	          [<ipv4>,][[<ipv6>],][<hostname>,][<lease-time>,][ignore]
+//
+// Fields that don't fit the model, such as a second IPv6 address, are kept in
+// Extra so formatReservation can write them back.
+func parseReservation(directive string) (DHCPReservation, bool) {
+	if !strings.HasPrefix(directive, "dhcp-host=") {
+		return DHCPReservation{}, false
+	}
+	res := DHCPReservation{}
+	for _, field := range strings.Split(strings.TrimPrefix(directive, "dhcp-host="), ",") {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "":
+		case strings.HasPrefix(field, "id:"):
+			res.ClientID = strings.TrimPrefix(field, "id:")
+		case strings.HasPrefix(field, "set:"):
+			res.Tags = append(res.Tags, strings.TrimPrefix(field, "set:"))
+		case strings.HasPrefix(field, "net:"):
+			// net: is the pre-2.52 spelling of set:
+			res.Tags = append(res.Tags, strings.TrimPrefix(field, "net:"))
+		case strings.HasPrefix(field, "tag:"):
+			res.MatchTags = append(res.MatchTags, strings.TrimPrefix(field, "tag:"))
+		case field == "ignore":
+			res.Ignore = true
+		case strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]"):
+			// IPv6 addresses are bracketed so their colons are not taken for a MAC
+			addr := strings.Trim(field, "[]")
+			if res.IPAddress == "" {
+				res.IPAddress = addr
+			} else if res.IPv6Address == "" && !strings.Contains(res.IPAddress, ":") {
+				res.IPv6Address = addr
+			} else {
+				res.Extra = append(res.Extra, field)
+			}
+		case strings.Contains(field, ":"):
+			res.MACAddresses = append(res.MACAddresses, strings.ToUpper(field))
+		case net.ParseIP(field) != nil:
+			if strings.Contains(res.IPAddress, ":") && res.IPv6Address == "" {
+				// A dual-stack reservation listed the IPv6 address first
+				res.IPv6Address = res.IPAddress
+				res.IPAddress = field
+			} else if res.IPAddress == "" {
+				res.IPAddress = field
+			} else {
+				res.Extra = append(res.Extra, field)
+			}
+		case leaseTimeRe.MatchString(field) && res.LeaseTime == "":
+			res.LeaseTime = field
+		case res.Hostname == "":
+			res.Hostname = field
+		default:
+			res.Extra = append(res.Extra, field)
+		}
+	}
+	if len(res.MACAddresses) > 0 {
+		res.MACAddress = res.MACAddresses[0]
+	}
+	if len(res.Tags) > 0 {
+		res.Tag = res.Tags[0]
+	}
+	return res, res.MACAddress != "" || res.ClientID != "" || res.IPAddress != "" || res.Hostname != ""
+}
+
+// formatReservation renders a reservation as a dhcp-host directive, with its
+// fields in the order shown at parseReservation. MACAddress and Tag are
+// written first when they are missing from MACAddresses and Tags, so clients
+// that only know the single valued fields can still set them.
+func formatReservation(res DHCPReservation) string {
+	var fields []string
+	for _, mac := range withFirst(res.MACAddresses, res.MACAddress) {
+		fields = append(fields, strings.ToUpper(mac))
+	}
+	if res.ClientID != "" {
+		fields = append(fields, "id:"+res.ClientID)
+	}
+	for _, tag := range withFirst(res.Tags, reservationTag(res.Tag)) {
+		fields = append(fields, "set:"+tag)
+	}
+	for _, tag := range res.MatchTags {
+		fields = append(fields, "tag:"+tag)
+	}
+	for _, ip := range []string{res.IPAddress, res.IPv6Address} {
+		ip = strings.Trim(ip, "[]")
+		if ip == "" {
+			continue
+		}
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		fields = append(fields, ip)
+	}
+	if res.Hostname != "" {
+		fields = append(fields, res.Hostname)
+	}
+	if res.LeaseTime != "" {
+		fields = append(fields, res.LeaseTime)
+	}
+	fields = append(fields, res.Extra...)
+	if res.Ignore {
+		fields = append(fields, "ignore")
+	}
+	return "dhcp-host=" + strings.Join(fields, ",")
+}
+
+// reservationTag maps the "None" tag of the web UI to no tag.
+func reservationTag(tag string) string {
+	if tag == "None" {
+		return ""
+	}
+	return tag
+}
+
+// withFirst returns list with first prepended, unless first is empty or
+// already in list.
+func withFirst(list []string, first string) []string {
+	if first == "" {
+		return list
+	}
+	for _, item := range list {
+		if strings.EqualFold(item, first) {
+			return list
+		}
+	}
+	return append([]string{first}, list...)
+}
+
+// replaceFirst returns a copy of list with its first element replaced by
+// first, or removed when first is empty.
+func replaceFirst(list []string, first string) []string {
+	if len(list) == 0 {
+		if first == "" {
+			return nil
+		}
+		return []string{first}
+	}
+	if first == "" {
+		return append([]string(nil), list[1:]...)
+	}
+	return append([]string{first}, list[1:]...)
+}
+
+// ReservationUpdate is the new reservation of an update from a client that
+// may not know every field. ClientID, LeaseTime and Ignore are only changed
+// when the client sends them, so they can be cleared but aren't lost when
+// left out.
+type ReservationUpdate struct {
+	DHCPReservation
+	ClientID  *string `json:"client_id,omitempty"`
+	LeaseTime *string `json:"lease_time,omitempty"`
+	Ignore    *bool   `json:"ignore,omitempty"`
+}
+
+// mergeReservation applies an update from a client that only knows the MAC
+// address, IP address, hostname, tag and comment of a reservation. Fields the
+// update leaves unset are taken from current, and the single valued MAC
+// address and tag replace the first of current's MAC addresses and tags.
+func mergeReservation(current DHCPReservation, update ReservationUpdate) DHCPReservation {
+	res := update.DHCPReservation
+	if res.MACAddresses == nil {
+		res.MACAddresses = replaceFirst(current.MACAddresses, strings.ToUpper(res.MACAddress))
+	}
+	if res.Tags == nil {
+		res.Tags = replaceFirst(current.Tags, reservationTag(res.Tag))
+	}
+	if res.MatchTags == nil {
+		res.MatchTags = current.MatchTags
+	}
+	res.ClientID = current.ClientID
+	if update.ClientID != nil {
+		res.ClientID = *update.ClientID
+	}
+	if res.IPv6Address == "" && !strings.Contains(res.IPAddress, ":") {
+		res.IPv6Address = current.IPv6Address
+	}
+	res.LeaseTime = current.LeaseTime
+	if update.LeaseTime != nil {
+		res.LeaseTime = *update.LeaseTime
+	}
+	res.Ignore = current.Ignore
+	if update.Ignore != nil {
+		res.Ignore = *update.Ignore
+	}
+	if res.Extra == nil {
+		res.Extra = current.Extra
+	}
+	return res
+}
+
+// ValidateReservation checks a reservation before it is written.
+func ValidateReservation(res DHCPReservation) error {
+	macs := withFirst(res.MACAddresses, res.MACAddress)
+	if len(macs) == 0 && (res.ClientID == "" || res.ClientID == "*") {
+		return fmt.Errorf("a reservation needs a MAC address or a client ID")
+	}
+	for _, mac := range macs {
+		if !hwAddrRe.MatchString(mac) {
+			return fmt.Errorf("invalid MAC address: %s", mac)
+		}
+	}
+	if strings.ContainsAny(res.ClientID, ", #\r\n") {
+		return fmt.Errorf("invalid client ID: %s", res.ClientID)
+	}
+	if res.IPAddress != "" && net.ParseIP(strings.Trim(res.IPAddress, "[]")) == nil {
+		return fmt.Errorf("invalid IP address: %s", res.IPAddress)
+	}
+	if res.IPAddress == "" && res.IPv6Address != "" {
+		return fmt.Errorf("ip_address must be set when ipv6_address is")
+	}
+	if res.IPv6Address != "" {
+		if !isIPv6(strings.Trim(res.IPv6Address, "[]")) {
+			return fmt.Errorf("invalid IPv6 address: %s", res.IPv6Address)
+		}
+		if isIPv6(strings.Trim(res.IPAddress, "[]")) {
+			return fmt.Errorf("ip_address must be the IPv4 address of a dual-stack reservation")
+		}
+	}
+	if strings.ContainsAny(res.Hostname, ", #\r\n") || leaseTimeRe.MatchString(res.Hostname) || net.ParseIP(res.Hostname) != nil {
+		return fmt.Errorf("invalid hostname: %s", res.Hostname)
+	}
+	if res.LeaseTime != "" && !leaseTimeRe.MatchString(res.LeaseTime) {
+		return fmt.Errorf("invalid lease time: %s, expected a number with an optional s, m, h, d or w suffix, or infinite", res.LeaseTime)
+	}
+	for _, tag := range withFirst(res.Tags, reservationTag(res.Tag)) {
+		if !tagNameRe.MatchString(tag) {
+			return fmt.Errorf("invalid tag: %s", tag)
+		}
+	}
+	for _, tag := range res.MatchTags {
+		if !tagNameRe.MatchString(strings.TrimPrefix(tag, "!")) {
+			return fmt.Errorf("invalid tag: %s", tag)
+		}
+	}
+	for _, field := range res.Extra {
+		if field == "" || strings.ContainsAny(field, ",#\r\n") {
+			return fmt.Errorf("invalid field: %s", field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseReservation(t *testing.T) {
+	res, ok := parseReservation("dhcp-host=00:11:22:33:44:55,00:11:22:33:44:*,id:*,set:iot,set:cameras,tag:!guest,192.168.2.20,cam,infinite,ignore")
+	assert.True(t, ok)
+	assert.Equal(t, DHCPReservation{
+		MACAddress:   "00:11:22:33:44:55",
+		MACAddresses: []string{"00:11:22:33:44:55", "00:11:22:33:44:*"},
+		ClientID:     "*",
+		IPAddress:    "192.168.2.20",
+		Hostname:     "cam",
+		Tag:          "iot",
+		Tags:         []string{"iot", "cameras"},
+		MatchTags:    []string{"!guest"},
+		LeaseTime:    "infinite",
+		Ignore:       true,
+	}, res)
+	assert.Equal(t, "dhcp-host=00:11:22:33:44:55,00:11:22:33:44:*,id:*,set:iot,set:cameras,tag:!guest,192.168.2.20,cam,infinite,ignore", formatReservation(res))
+
+	// Fields are recognized in any order
+	res, ok = parseReservation("dhcp-host=laptop,12h,aa:bb:cc:dd:ee:ff,192.168.1.30")
+	assert.True(t, ok)
+	assert.Equal(t, "AA:BB:CC:DD:EE:FF", res.MACAddress)
+	assert.Equal(t, "laptop", res.Hostname)
+	assert.Equal(t, "12h", res.LeaseTime)
+	assert.Equal(t, "dhcp-host=AA:BB:CC:DD:EE:FF,192.168.1.30,laptop,12h", formatReservation(res))
+
+	// Reservations may match on the hostname alone
+	res, ok = parseReservation("dhcp-host=printer,192.168.1.40")
+	assert.True(t, ok)
+	assert.Equal(t, "printer", res.Hostname)
+
+	// Unmodeled fields are written back
+	res, ok = parseReservation("dhcp-host=00:11:22:33:44:55,192.168.1.50,host,alias")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"alias"}, res.Extra)
+	assert.Equal(t, "dhcp-host=00:11:22:33:44:55,192.168.1.50,host,alias", formatReservation(res))
+
+	_, ok = parseReservation("dhcp-range=192.168.1.10,192.168.1.20")
+	assert.False(t, ok)
+}
+
+func TestParseReservation_IPv6(t *testing.T) {
+	res, ok := parseReservation("dhcp-host=id:00:01:00:01:2b:3c:4d:5e:00:11:22:33:44:55,[2001:db8::10],host6")
+	assert.True(t, ok)
+	assert.Equal(t, DHCPReservation{ClientID: "00:01:00:01:2b:3c:4d:5e:00:11:22:33:44:55", IPAddress: "2001:db8::10", Hostname: "host6"}, res)
+	assert.Equal(t, "dhcp-host=id:00:01:00:01:2b:3c:4d:5e:00:11:22:33:44:55,[2001:db8::10],host6", formatReservation(res))
+
+	// Dual-stack reservations keep the IPv4 address in IPAddress
+	res, ok = parseReservation("dhcp-host=00:11:22:33:44:55,[2001:db8::20],192.168.1.20,dual")
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.1.20", res.IPAddress)
+	assert.Equal(t, "2001:db8::20", res.IPv6Address)
+	assert.Equal(t, "dhcp-host=00:11:22:33:44:55,192.168.1.20,[2001:db8::20],dual", formatReservation(res))
+
+	// Partial addresses are kept as written
+	res, ok = parseReservation("dhcp-host=id:00:01:00:01:aa:bb,[::10],host")
+	assert.True(t, ok)
+	assert.Equal(t, "dhcp-host=id:00:01:00:01:aa:bb,[::10],host", formatReservation(res))
+}
+
+func TestValidateReservation(t *testing.T) {
+	valid := []DHCPReservation{
+		{MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.1.10"},
+		{ClientID: "00:01:00:01:aa:bb", IPAddress: "2001:db8::10"},
+		{MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.1.10", IPv6Address: "[2001:db8::10]"},
+		{MACAddresses: []string{"00:11:22:33:44:*", "1-00:11:22:33:44:66"}, ClientID: "*", Ignore: true},
+		{MACAddress: "00:11:22:33:44:55", Hostname: "nas", LeaseTime: "infinite", Tags: []string{"iot", "lan"}, MatchTags: []string{"!guest"}},
+	}
+	for _, res := range valid {
+		assert.NoError(t, ValidateReservation(res), res)
+	}
+
+	invalid := []DHCPReservation{
+		{IPAddress: "192.168.1.10"},
+		{ClientID: "*", IPAddress: "192.168.1.10"},
+		{MACAddress: "not-a-mac", IPAddress: "192.168.1.10"},
+		{ClientID: "a,b", IPAddress: "192.168.1.10"},
+		{MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.1.10", IPv6Address: "192.168.1.11"},
+		{MACAddress: "00:11:22:33:44:55", IPAddress: "2001:db8::1", IPv6Address: "2001:db8::2"},
+		{MACAddress: "00:11:22:33:44:55", LeaseTime: "forever"},
+		{MACAddress: "00:11:22:33:44:55", Hostname: "12h"},
+		{MACAddress: "00:11:22:33:44:55", Tags: []string{"bad tag"}},
+	}
+	for _, res := range invalid {
+		assert.Error(t, ValidateReservation(res), res)
+	}
+}
+
+func TestDHCPService_UpdateReservation_PreservesFields(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dhcp-host")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	resFile := filepath.Join(tmpDir, "reservations.conf")
+	assert.NoError(t, os.WriteFile(resFile, []byte("dhcp-host=00:11:22:33:44:55,00:11:22:33:44:56,id:*,set:iot,set:cameras,tag:lan,192.168.2.20,cam,infinite # front door\n"), 0644))
+	os.Setenv("DHCP_RESERVATIONS_FILE", resFile)
+	defer os.Unsetenv("DHCP_RESERVATIONS_FILE")
+
+	dhcpService := NewDHCPService(fake.NewSimpleClientset(), "default", nil)
+	ctx := context.Background()
+
+	// The web UI only sends the MAC, IP, hostname, tag and comment
+	err = dhcpService.UpdateReservation(ctx,
+		DHCPReservation{MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.2.20", Hostname: "cam"},
+		ReservationUpdate{DHCPReservation: DHCPReservation{MACAddress: "00:11:22:33:44:57", IPAddress: "192.168.2.21", Hostname: "cam", Tag: "None", Comment: "front door"}})
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(resFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "dhcp-host=00:11:22:33:44:57,00:11:22:33:44:56,id:*,set:cameras,tag:lan,192.168.2.21,cam,infinite # front door\n", string(content))
+
+	// Updates by ID replace the whole reservation
+	reservations, err := dhcpService.GetReservations(ctx)
+	assert.NoError(t, err)
+	_, err = dhcpService.UpdateReservationByID(ctx, reservations[0].ID, DHCPReservation{MACAddress: "00:11:22:33:44:57", IPAddress: "192.168.2.21", Hostname: "cam"})
+	assert.NoError(t, err)
+	content, err = os.ReadFile(resFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "dhcp-host=00:11:22:33:44:57,192.168.2.21,cam\n", string(content))
+}
+
+func TestDHCPService_UpdateReservation_ClearsAndValidates(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dhcp-host")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	resFile := filepath.Join(tmpDir, "reservations.conf")
+	initial := "dhcp-host=00:11:22:33:44:55,id:01:02,192.168.2.20,cam,infinite,ignore\n"
+	assert.NoError(t, os.WriteFile(resFile, []byte(initial), 0644))
+	os.Setenv("DHCP_RESERVATIONS_FILE", resFile)
+	defer os.Unsetenv("DHCP_RESERVATIONS_FILE")
+
+	dhcpService := NewDHCPService(fake.NewSimpleClientset(), "default", nil)
+	ctx := context.Background()
+	oldRes := DHCPReservation{MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.2.20", Hostname: "cam"}
+
+	// Merged reservations are validated before they are written
+	err = dhcpService.UpdateReservation(ctx, oldRes,
+		ReservationUpdate{DHCPReservation: DHCPReservation{MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.2.20", Hostname: "cam,infinite"}})
+	assert.ErrorIs(t, err, ErrInvalid)
+	content, err := os.ReadFile(resFile)
+	assert.NoError(t, err)
+	assert.Equal(t, initial, string(content))
+
+	// Fields that are sent can be cleared
+	empty, off := "", false
+	err = dhcpService.UpdateReservation(ctx, oldRes, ReservationUpdate{
+		DHCPReservation: DHCPReservation{MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.2.20", Hostname: "cam"},
+		ClientID:        &empty,
+		LeaseTime:       &empty,
+		Ignore:          &off,
+	})
+	assert.NoError(t, err)
+	content, err = os.ReadFile(resFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "dhcp-host=00:11:22:33:44:55,192.168.2.20,cam\n", string(content))
+}
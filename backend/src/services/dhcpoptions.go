@@ -0,0 +1,512 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DHCP option value types
+const (
+	OptionTypeIPList = "ip-list"
+	OptionTypeString = "string"
+	OptionTypeUint   = "uint"
+	OptionTypeBool   = "bool"
+)
+
+// DHCP option scopes
+const (
+	OptionScopeGlobal = "global"
+	OptionScopeTag    = "tag"
+	OptionScopeRange  = "range"
+)
+
+// DHCPOptionDef describes an option of the built-in catalogue.
+type DHCPOptionDef struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+	IPv6   bool   `json:"ipv6"`
+	Type   string `json:"type"`
+	// Multiple is set when the option takes a list of values
+	Multiple    bool   `json:"multiple"`
+	Description string `json:"description"`
+}
+
+// dhcpOptionCatalogue lists the options that can be managed through the API,
+// named as in `dnsmasq --help dhcp` and `dnsmasq --help dhcp6` except for
+// unnamedDHCPOptions.
+var dhcpOptionCatalogue = []DHCPOptionDef{
+	{1, "netmask", false, OptionTypeIPList, false, "Subnet mask"},
+	{2, "time-offset", false, OptionTypeUint, false, "Offset from UTC in seconds"},
+	{3, "router", false, OptionTypeIPList, true, "Default gateways"},
+	{6, "dns-server", false, OptionTypeIPList, true, "DNS servers, 0.0.0.0 is the dnsmasq host"},
+	{12, "hostname", false, OptionTypeString, false, "Client hostname"},
+	{15, "domain-name", false, OptionTypeString, false, "Domain name"},
+	{19, "ip-forward-enable", false, OptionTypeBool, false, "Enable IP forwarding on the client"},
+	{23, "default-ttl", false, OptionTypeUint, false, "Default IP time-to-live"},
+	{26, "mtu", false, OptionTypeUint, false, "Interface MTU"},
+	{28, "broadcast", false, OptionTypeIPList, false, "Broadcast address"},
+	{40, "nis-domain", false, OptionTypeString, false, "NIS domain"},
+	{41, "nis-server", false, OptionTypeIPList, true, "NIS servers"},
+	{42, "ntp-server", false, OptionTypeIPList, true, "NTP servers"},
+	{44, "netbios-ns", false, OptionTypeIPList, true, "NetBIOS name servers"},
+	{46, "netbios-nodetype", false, OptionTypeUint, false, "NetBIOS node type"},
+	{58, "T1", false, OptionTypeUint, false, "Renewal time in seconds"},
+	{59, "T2", false, OptionTypeUint, false, "Rebinding time in seconds"},
+	{66, "tftp-server", false, OptionTypeString, false, "TFTP server name"},
+	{67, "bootfile-name", false, OptionTypeString, false, "Boot file name"},
+	{69, "smtp-server", false, OptionTypeIPList, true, "SMTP servers"},
+	{119, "domain-search", false, OptionTypeString, true, "Domain search list"},
+	{150, "tftp-server-address", false, OptionTypeIPList, true, "TFTP server addresses"},
+	{252, "wpad", false, OptionTypeString, false, "Proxy auto-config URL"},
+	{23, "dns-server", true, OptionTypeIPList, true, "DNS servers, [::] is the dnsmasq host"},
+	{24, "domain-search", true, OptionTypeString, true, "Domain search list"},
+	{31, "sntp-server", true, OptionTypeIPList, true, "SNTP servers"},
+	{32, "information-refresh-time", true, OptionTypeUint, false, "Refresh time for stateless clients in seconds"},
+	{56, "ntp-server", true, OptionTypeIPList, true, "NTP servers"},
+	{59, "bootfile-url", true, OptionTypeString, false, "Boot file URL"},
+}
+
+// unnamedDHCPOptions are the catalogue options dnsmasq has no name for. They
+// are written by number, and their string values are quoted since dnsmasq
+// does not know their type.
+var unnamedDHCPOptions = map[string]bool{"wpad": true}
+
+// DHCPOptionCatalogue returns the options that can be managed through the API.
+func DHCPOptionCatalogue() []DHCPOptionDef {
+	return append([]DHCPOptionDef{}, dhcpOptionCatalogue...)
+}
+
+func lookupDHCPOption(option string, ipv6 bool) (DHCPOptionDef, bool) {
+	number, err := strconv.Atoi(option)
+	for _, def := range dhcpOptionCatalogue {
+		if def.IPv6 == ipv6 && (def.Name == option || (err == nil && def.Number == number)) {
+			return def, true
+		}
+	}
+	return DHCPOptionDef{}, false
+}
+
+// DHCPOption is a dhcp-option directive managed in the DHCP options file.
+//
+//	dhcp-option=option:ntp-server,192.168.1.1           global
+//	dhcp-option=tag:iot,option:router,192.168.2.1       per tag
+//	dhcp-option=tag:lan,option6:dns-server,[fd00::1]    per range, lan is set by the range
+type DHCPOption struct {
+	// ID identifies the option's line in the DHCP options file, see entryID
+	ID string `json:"id"`
+	// Scope is global, tag or range. Range scoped options match the set_tag
+	// of the range, which must have one.
+	Scope string   `json:"scope"`
+	Tags  []string `json:"tags,omitempty"`
+	// Range is the ID of the range for the range scope
+	Range string `json:"range,omitempty"`
+	// Option is the name of a catalogue option, Number is filled in on read
+	Option string   `json:"option"`
+	Number int      `json:"number"`
+	IPv6   bool     `json:"ipv6"`
+	Values []string `json:"values"`
+	// Force sends the option even when the client did not request it
+	Force   bool   `json:"force"`
+	Comment string `json:"comment"`
+}
+
+func (s *DHCPService) GetDHCPOptions(ctx context.Context) ([]DHCPOption, error) {
+	content, err := readFile(s.optionsFile)
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := s.GetRanges(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []DHCPOption{}
+	ids := idAssigner{}
+	for _, line := range strings.Split(string(content), "\n") {
+		directive, comment := splitComment(line)
+		if opt, ok := parseDHCPOption(directive); ok {
+			opt.Comment = comment
+			opt.ID = ids.next(directive)
+			setOptionScope(&opt, ranges)
+			options = append(options, opt)
+		}
+	}
+	return options, nil
+}
+
+// DHCPOptionsETag returns the ETag of the DHCP options file.
+func (s *DHCPService) DHCPOptionsETag(ctx context.Context) (string, error) {
+	return fileETag(s.optionsFile)
+}
+
+// GetDHCPOption returns the option with the given ID.
+func (s *DHCPService) GetDHCPOption(ctx context.Context, id string) (*DHCPOption, error) {
+	options, err := s.GetDHCPOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range options {
+		if opt.ID == id {
+			return &opt, nil
+		}
+	}
+	return nil, fmt.Errorf("option %w", ErrNotFound)
+}
+
+// AddDHCPOption appends an option and returns its ID.
+func (s *DHCPService) AddDHCPOption(ctx context.Context, opt DHCPOption) (string, error) {
+	return s.modifyDHCPOption(ctx, "", opt, false)
+}
+
+// UpdateDHCPOption replaces the option with the given ID and returns the ID
+// of the updated option.
+func (s *DHCPService) UpdateDHCPOption(ctx context.Context, id string, opt DHCPOption) (string, error) {
+	return s.modifyDHCPOption(ctx, id, opt, false)
+}
+
+func (s *DHCPService) DeleteDHCPOption(ctx context.Context, id string) error {
+	_, err := s.modifyDHCPOption(ctx, id, DHCPOption{}, true)
+	return err
+}
+
+// modifyDHCPOption replaces or removes the option with the given ID, or
+// appends newOpt when id is empty.
+func (s *DHCPService) modifyDHCPOption(ctx context.Context, id string, newOpt DHCPOption, isDelete bool) (string, error) {
+	newLine := ""
+	if !isDelete {
+		if err := ValidateDHCPOption(newOpt); err != nil {
+			return "", err
+		}
+		if newOpt.Scope == OptionScopeRange {
+			tag, err := s.rangeTag(ctx, newOpt.Range)
+			if err != nil {
+				return "", err
+			}
+			newOpt.Tags = []string{tag}
+		}
+		newLine = formatDHCPOption(newOpt)
+		if newOpt.Comment != "" {
+			newLine += fmt.Sprintf(" # %s", newOpt.Comment)
+		}
+	}
+
+	unlock := lockFile(s.optionsFile)
+	defer unlock()
+
+	content, err := readFile(s.optionsFile)
+	if err != nil {
+		return "", err
+	}
+
+	var newLines []string
+	found := id == ""
+	newIdx := -1
+	ids := idAssigner{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		directive, _ := splitComment(line)
+		if _, ok := parseDHCPOption(directive); ok && !found && ids.next(directive) == id {
+			found = true
+			if !isDelete {
+				newIdx = len(newLines)
+				newLines = append(newLines, newLine)
+			}
+			continue
+		}
+		newLines = append(newLines, line)
+	}
+
+	if !found {
+		return "", fmt.Errorf("option %w", ErrNotFound)
+	}
+
+	if id == "" {
+		// Append before the trailing newline
+		newIdx = len(newLines)
+		if newIdx > 0 && newLines[newIdx-1] == "" {
+			newIdx--
+		}
+		newLines = append(newLines[:newIdx], append([]string{newLine}, newLines[newIdx:]...)...)
+	}
+
+	newContent := strings.Join(newLines, "\n")
+	if s.configService != nil {
+		if err := s.configService.validateDnsmasqConfig(newContent); err != nil {
+			return "", fmt.Errorf("dnsmasq configuration validation failed: %v", err)
+		}
+	}
+	if err := writeFileAtomic(s.optionsFile, []byte(newContent)); err != nil {
+		return "", err
+	}
+	s.history.record(ctx, s.optionsFile, string(content), newContent)
+
+	if isDelete {
+		return "", nil
+	}
+	ids = idAssigner{}
+	newID := ""
+	for _, line := range newLines[:newIdx+1] {
+		directive, _ := splitComment(line)
+		if _, ok := parseDHCPOption(directive); ok {
+			newID = ids.next(directive)
+		}
+	}
+	return newID, nil
+}
+
+// rangeTag returns the tag set by a range, which range scoped options match.
+func (s *DHCPService) rangeTag(ctx context.Context, id string) (string, error) {
+	r, err := s.GetRange(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if r.SetTag == "" {
+		return "", fmt.Errorf("range %s has no set_tag, options can only be scoped to ranges that set a tag", r.Start)
+	}
+	return r.SetTag, nil
+}
+
+// setOptionScope derives the scope of a parsed option. An option matching a
+// single tag that is set by a range belongs to that range.
+func setOptionScope(opt *DHCPOption, ranges []DHCPRange) {
+	switch len(opt.Tags) {
+	case 0:
+		opt.Scope = OptionScopeGlobal
+		return
+	case 1:
+		for _, r := range ranges {
+			if r.SetTag != "" && r.SetTag == opt.Tags[0] {
+				opt.Scope = OptionScopeRange
+				opt.Range = r.ID
+				return
+			}
+		}
+	}
+	opt.Scope = OptionScopeTag
+}
+
+// ValidateDHCPOption checks an option and its values against the catalogue.
+func ValidateDHCPOption(opt DHCPOption) error {
+	switch opt.Scope {
+	case OptionScopeGlobal, "":
+		if len(opt.Tags) > 0 {
+			return fmt.Errorf("global options cannot have tags")
+		}
+	case OptionScopeTag:
+		if len(opt.Tags) == 0 {
+			return fmt.Errorf("tag scoped options need at least one tag")
+		}
+		for _, tag := range opt.Tags {
+			if !tagNameRe.MatchString(strings.TrimPrefix(tag, "!")) {
+				return fmt.Errorf("invalid tag: %q", tag)
+			}
+		}
+	case OptionScopeRange:
+		if opt.Range == "" {
+			return fmt.Errorf("range scoped options need a range ID")
+		}
+	default:
+		return fmt.Errorf("unsupported scope: %s. Only 'global', 'tag' and 'range' are supported", opt.Scope)
+	}
+
+	def, ok := lookupDHCPOption(opt.Option, opt.IPv6)
+	if !ok {
+		return fmt.Errorf("unknown %s option: %s", optionFamily(opt.IPv6), opt.Option)
+	}
+	if len(opt.Values) == 0 {
+		return fmt.Errorf("option %s needs a value", def.Name)
+	}
+	if len(opt.Values) > 1 && !def.Multiple {
+		return fmt.Errorf("option %s takes a single value", def.Name)
+	}
+
+	for _, value := range opt.Values {
+		if err := validateOptionValue(def, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateOptionValue(def DHCPOptionDef, value string) error {
+	switch def.Type {
+	case OptionTypeIPList:
+		ip := net.ParseIP(strings.Trim(value, "[]"))
+		if ip == nil || (ip.To4() == nil) != def.IPv6 {
+			return fmt.Errorf("invalid value for %s %s: %q is not a valid address", optionFamily(def.IPv6), def.Name, value)
+		}
+	case OptionTypeUint:
+		if n, err := strconv.ParseUint(value, 10, 64); err != nil || n > math.MaxUint32 {
+			return fmt.Errorf("invalid value for %s: %q is not an unsigned integer", def.Name, value)
+		}
+	case OptionTypeBool:
+		if _, ok := optionBool(value); !ok {
+			return fmt.Errorf("invalid value for %s: %q is not a boolean", def.Name, value)
+		}
+	case OptionTypeString:
+		if value == "" || strings.ContainsAny(value, "\"\r\n") {
+			return fmt.Errorf("invalid value for %s: %q", def.Name, value)
+		}
+	}
+	return nil
+}
+
+func optionFamily(ipv6 bool) string {
+	if ipv6 {
+		return "DHCPv6"
+	}
+	return "DHCPv4"
+}
+
+func optionBool(value string) (string, bool) {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "on":
+		return "1", true
+	case "0", "false", "no", "off":
+		return "0", true
+	}
+	return "", false
+}
+
+// formatDHCPOption renders an option as
+// dhcp-option[-force]=[tag:..,]option[6]:name,value[,value]
+func formatDHCPOption(opt DHCPOption) string {
+	def, _ := lookupDHCPOption(opt.Option, opt.IPv6)
+
+	key := "dhcp-option"
+	if opt.Force {
+		key = "dhcp-option-force"
+	}
+	var parts []string
+	for _, tag := range opt.Tags {
+		parts = append(parts, "tag:"+tag)
+	}
+	switch {
+	case unnamedDHCPOptions[def.Name] && opt.IPv6:
+		parts = append(parts, "option6:"+strconv.Itoa(def.Number))
+	case unnamedDHCPOptions[def.Name]:
+		parts = append(parts, strconv.Itoa(def.Number))
+	case opt.IPv6:
+		parts = append(parts, "option6:"+def.Name)
+	default:
+		parts = append(parts, "option:"+def.Name)
+	}
+	for _, value := range opt.Values {
+		switch def.Type {
+		case OptionTypeIPList:
+			if def.IPv6 {
+				// DHCPv6 addresses are bracketed so their colons are not
+				// mistaken for separators
+				value = "[" + strings.Trim(value, "[]") + "]"
+			}
+		case OptionTypeBool:
+			value, _ = optionBool(value)
+		case OptionTypeString:
+			if strings.ContainsAny(value, ", ") || unnamedDHCPOptions[def.Name] {
+				value = `"` + value + `"`
+			}
+		}
+		parts = append(parts, value)
+	}
+	return key + "=" + strings.Join(parts, ",")
+}
+
+// parseDHCPOption parses a dhcp-option or dhcp-option-force directive. Vendor
+// and encapsulated options are not supported and are left untouched.
+func parseDHCPOption(directive string) (DHCPOption, bool) {
+	key, value, ok := strings.Cut(directive, "=")
+	key = strings.TrimSpace(key)
+	if !ok || (key != "dhcp-option" && key != "dhcp-option-force") {
+		return DHCPOption{}, false
+	}
+
+	opt := DHCPOption{Force: key == "dhcp-option-force", Values: []string{}}
+	parts := splitOptionValues(value)
+	i := 0
+	for ; i < len(parts) && strings.HasPrefix(parts[i], "tag:"); i++ {
+		opt.Tags = append(opt.Tags, strings.TrimPrefix(parts[i], "tag:"))
+	}
+	if i == len(parts) {
+		return DHCPOption{}, false
+	}
+
+	name := parts[i]
+	switch {
+	case strings.HasPrefix(name, "option6:"):
+		opt.IPv6 = true
+		name = strings.TrimPrefix(name, "option6:")
+	case strings.HasPrefix(name, "option:"):
+		name = strings.TrimPrefix(name, "option:")
+	case strings.Contains(name, ":"):
+		// encap:, vendor:, vi-encap:
+		return DHCPOption{}, false
+	}
+	if def, ok := lookupDHCPOption(name, opt.IPv6); ok {
+		opt.Option = def.Name
+		opt.Number = def.Number
+	} else {
+		opt.Option = name
+		opt.Number, _ = strconv.Atoi(name)
+	}
+
+	for _, v := range parts[i+1:] {
+		opt.Values = append(opt.Values, strings.Trim(strings.Trim(v, `"`), "[]"))
+	}
+	return opt, true
+}
+
+// splitOptionValues splits on commas outside of double quotes.
+func splitOptionValues(value string) []string {
+	var parts []string
+	var current strings.Builder
+	inQuote := false
+	for _, c := range value {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			current.WriteRune(c)
+		case c == ',' && !inQuote:
+			parts = append(parts, strings.TrimSpace(current.String()))
+			current.Reset()
+		default:
+			current.WriteRune(c)
+		}
+	}
+	return append(parts, strings.TrimSpace(current.String()))
+}
+
+func (s *DHCPService) StartDHCPOptionsSync(ctx context.Context) {
+	startFileSync(ctx, s.optionsFile, "DHCP options", s.RestoreDHCPOptionsFromConfigMap, s.SyncDHCPOptionsToConfigMap)
+}
+
+func (s *DHCPService) SyncDHCPOptionsToConfigMap(ctx context.Context) error {
+	content, err := os.ReadFile(s.optionsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read DHCP options file: %v", err)
+	}
+
+	return UpdateConfigMapWithRetry(ctx, s.clientset, s.namespace, "dnsmasq-dhcp-options", "dhcp-options.conf", string(content))
+}
+
+func (s *DHCPService) RestoreDHCPOptionsFromConfigMap(ctx context.Context) error {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, "dnsmasq-dhcp-options", metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil // Nothing to restore
+		}
+		return err
+	}
+
+	if content, ok := configMap.Data["dhcp-options.conf"]; ok {
+		return writeFile(s.optionsFile, []byte(content))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseDHCPOption(t *testing.T) {
+	opt, ok := parseDHCPOption("dhcp-option=tag:iot,option:router,192.168.2.1")
+	assert.True(t, ok)
+	assert.Equal(t, DHCPOption{Tags: []string{"iot"}, Option: "router", Number: 3, Values: []string{"192.168.2.1"}}, opt)
+
+	// Numeric options are resolved through the catalogue
+	opt, ok = parseDHCPOption("dhcp-option-force=42,10.0.0.1,10.0.0.2")
+	assert.True(t, ok)
+	assert.Equal(t, DHCPOption{Option: "ntp-server", Number: 42, Force: true, Values: []string{"10.0.0.1", "10.0.0.2"}}, opt)
+
+	opt, ok = parseDHCPOption(`dhcp-option=option6:dns-server,[fd00::1],[fd00::2]`)
+	assert.True(t, ok)
+	assert.True(t, opt.IPv6)
+	assert.Equal(t, 23, opt.Number)
+	assert.Equal(t, []string{"fd00::1", "fd00::2"}, opt.Values)
+	assert.Equal(t, "dhcp-option=option6:dns-server,[fd00::1],[fd00::2]", formatDHCPOption(opt))
+
+	opt, ok = parseDHCPOption(`dhcp-option=option:domain-search,"a.lan,b",c.lan`)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a.lan,b", "c.lan"}, opt.Values)
+
+	// dnsmasq has no name for some options, they are written by number
+	opt, ok = parseDHCPOption(`dhcp-option=252,"http://wpad.lan/wpad.dat"`)
+	assert.True(t, ok)
+	assert.Equal(t, DHCPOption{Option: "wpad", Number: 252, Values: []string{"http://wpad.lan/wpad.dat"}}, opt)
+	assert.Equal(t, `dhcp-option=252,"http://wpad.lan/wpad.dat"`, formatDHCPOption(opt))
+	opt.Tags = []string{"lan"}
+	assert.Equal(t, `dhcp-option=tag:lan,252,"http://wpad.lan/wpad.dat"`, formatDHCPOption(opt))
+
+	_, ok = parseDHCPOption("dhcp-option=vendor:MSFT,2,1i")
+	assert.False(t, ok)
+	_, ok = parseDHCPOption("dhcp-range=192.168.1.10,192.168.1.20")
+	assert.False(t, ok)
+}
+
+func TestValidateDHCPOption(t *testing.T) {
+	valid := []DHCPOption{
+		{Option: "router", Values: []string{"192.168.1.1"}},
+		{Scope: OptionScopeTag, Tags: []string{"iot", "!guest"}, Option: "ntp-server", Values: []string{"10.0.0.1", "10.0.0.2"}},
+		{Scope: OptionScopeRange, Range: "abc", Option: "mtu", Values: []string{"9000"}},
+		{Option: "ip-forward-enable", Values: []string{"false"}},
+		{Option: "dns-server", IPv6: true, Values: []string{"[fd00::1]"}},
+		{Option: "6", Values: []string{"0.0.0.0"}},
+	}
+	for _, opt := range valid {
+		assert.NoError(t, ValidateDHCPOption(opt), opt.Option)
+	}
+
+	invalid := []DHCPOption{
+		{Option: "router", Values: []string{"fd00::1"}},
+		{Option: "router"},
+		{Option: "mtu", Values: []string{"1500", "9000"}},
+		{Option: "mtu", Values: []string{"-1"}},
+		{Option: "ip-forward-enable", Values: []string{"maybe"}},
+		{Option: "domain-name", Values: []string{"a\nb"}},
+		{Option: "no-such-option", Values: []string{"x"}},
+		{Option: "sntp-server", Values: []string{"10.0.0.1"}},
+		{Scope: OptionScopeGlobal, Tags: []string{"iot"}, Option: "router", Values: []string{"192.168.1.1"}},
+		{Scope: OptionScopeTag, Option: "router", Values: []string{"192.168.1.1"}},
+		{Scope: OptionScopeRange, Option: "router", Values: []string{"192.168.1.1"}},
+		{Scope: "vlan", Option: "router", Values: []string{"192.168.1.1"}},
+	}
+	for _, opt := range invalid {
+		assert.Error(t, ValidateDHCPOption(opt), opt)
+	}
+}
+
+func TestDHCPService_DHCPOptions(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dhcp-options")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	rangesFile := filepath.Join(tmpDir, "ranges.conf")
+	optionsFile := filepath.Join(tmpDir, "dhcp-options.conf")
+	assert.NoError(t, os.WriteFile(rangesFile, []byte("dhcp-range=set:lan,192.168.1.100,192.168.1.200,12h\ndhcp-range=192.168.3.10,192.168.3.20\n"), 0644))
+	os.Setenv("DHCP_RANGES_FILE", rangesFile)
+	os.Setenv("DHCP_OPTIONS_FILE", optionsFile)
+	defer os.Unsetenv("DHCP_RANGES_FILE")
+	defer os.Unsetenv("DHCP_OPTIONS_FILE")
+
+	dhcpService := NewDHCPService(fake.NewSimpleClientset(), "default", nil)
+	ctx := context.Background()
+
+	ranges, err := dhcpService.GetRanges(ctx)
+	assert.NoError(t, err)
+
+	_, err = dhcpService.AddDHCPOption(ctx, DHCPOption{Option: "ntp-server", Values: []string{"192.168.1.1"}})
+	assert.NoError(t, err)
+	iotID, err := dhcpService.AddDHCPOption(ctx, DHCPOption{Scope: OptionScopeTag, Tags: []string{"iot"}, Option: "router", Values: []string{"192.168.2.1"}, Comment: "iot gateway"})
+	assert.NoError(t, err)
+	lanID, err := dhcpService.AddDHCPOption(ctx, DHCPOption{Scope: OptionScopeRange, Range: ranges[0].ID, Option: "domain-name", Values: []string{"lan"}})
+	assert.NoError(t, err)
+
+	// Only ranges that set a tag can scope options
+	_, err = dhcpService.AddDHCPOption(ctx, DHCPOption{Scope: OptionScopeRange, Range: ranges[1].ID, Option: "router", Values: []string{"192.168.3.1"}})
+	assert.Error(t, err)
+	_, err = dhcpService.AddDHCPOption(ctx, DHCPOption{Scope: OptionScopeRange, Range: "missing", Option: "router", Values: []string{"192.168.3.1"}})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	content, err := os.ReadFile(optionsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "dhcp-option=option:ntp-server,192.168.1.1\ndhcp-option=tag:iot,option:router,192.168.2.1 # iot gateway\ndhcp-option=tag:lan,option:domain-name,lan\n", string(content))
+
+	options, err := dhcpService.GetDHCPOptions(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, options, 3)
+	assert.Equal(t, OptionScopeGlobal, options[0].Scope)
+	assert.Equal(t, OptionScopeTag, options[1].Scope)
+	assert.Equal(t, "iot gateway", options[1].Comment)
+	assert.Equal(t, OptionScopeRange, options[2].Scope)
+	assert.Equal(t, ranges[0].ID, options[2].Range)
+
+	newID, err := dhcpService.UpdateDHCPOption(ctx, iotID, DHCPOption{Scope: OptionScopeTag, Tags: []string{"iot"}, Option: "router", Values: []string{"192.168.2.254"}})
+	assert.NoError(t, err)
+	opt, err := dhcpService.GetDHCPOption(ctx, newID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.168.2.254"}, opt.Values)
+
+	assert.NoError(t, dhcpService.DeleteDHCPOption(ctx, lanID))
+	assert.ErrorIs(t, dhcpService.DeleteDHCPOption(ctx, lanID), ErrNotFound)
+	options, err = dhcpService.GetDHCPOptions(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, options, 2)
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lease event actions, as passed by dnsmasq to its dhcp-script
+const (
+	LeaseEventAdd = "add"
+	LeaseEventOld = "old"
+	LeaseEventDel = "del"
+)
+
+// LeaseEvent is a lease change reported by dnsmasq through its dhcp-script.
+type LeaseEvent struct {
+	// ID orders events, it is assigned by the EventService
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	// Action is add for a new lease, old for a renewed or loaded lease and
+	// del for a released or expired lease
+	Action     string `json:"action"`
+	IPv6       bool   `json:"ipv6"`
+	MACAddress string `json:"mac_address,omitempty"`
+	IPAddress  string `json:"ip_address"`
+	Hostname   string `json:"hostname,omitempty"`
+	ClientID   string `json:"client_id,omitempty"`
+	// IAID and DUID identify the client of DHCPv6 leases
+	IAID        string   `json:"iaid,omitempty"`
+	DUID        string   `json:"duid,omitempty"`
+	Interface   string   `json:"interface,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	VendorClass string   `json:"vendor_class,omitempty"`
+	ExpiryTime  int64    `json:"expiry_time,omitempty"`
+}
+
+// DHCPScriptEnv is set in the environment of dnsmasq by supervisord.conf.
+// dnsmasq passes its environment on to its dhcp-script, so the variable tells
+// the binary it runs as the script rather than as the server.
+const DHCPScriptEnv = "DNSMASQ_K8S_DHCP_SCRIPT"
+
+// IsDHCPScript reports whether the binary runs as the dhcp-script of dnsmasq.
+func IsDHCPScript(getenv func(string) string) bool {
+	return getenv(DHCPScriptEnv) != ""
+}
+
+// LeaseEventFromScript builds the event of a dhcp-script invocation from its
+// arguments (action, MAC address or DUID, IP address and hostname) and the
+// DNSMASQ_* variables of its environment. The other actions of dnsmasq, such
+// as init, tftp, arp-add, arp-del and relay-snoop, have no event.
+func LeaseEventFromScript(args []string, getenv func(string) string) (LeaseEvent, bool) {
+	if len(args) < 3 || (args[0] != LeaseEventAdd && args[0] != LeaseEventOld && args[0] != LeaseEventDel) {
+		return LeaseEvent{}, false
+	}
+	event := LeaseEvent{
+		Action:      args[0],
+		IPAddress:   args[2],
+		Interface:   getenv("DNSMASQ_INTERFACE"),
+		VendorClass: getenv("DNSMASQ_VENDOR_CLASS"),
+	}
+	if len(args) > 3 {
+		event.Hostname = args[3]
+	}
+	if strings.Contains(event.IPAddress, ":") {
+		// DHCPv6 events pass the DUID instead of the MAC address
+		event.IPv6 = true
+		event.DUID = args[1]
+		event.IAID = getenv("DNSMASQ_IAID")
+		event.MACAddress = strings.ToUpper(getenv("DNSMASQ_MAC"))
+	} else {
+		event.MACAddress = strings.ToUpper(args[1])
+		event.ClientID = getenv("DNSMASQ_CLIENT_ID")
+	}
+	if tags := getenv("DNSMASQ_TAGS"); tags != "" {
+		event.Tags = strings.Fields(tags)
+	}
+	if expires, err := strconv.ParseInt(getenv("DNSMASQ_LEASE_EXPIRES"), 10, 64); err == nil {
+		event.ExpiryTime = expires
+	}
+	return event, true
+}
+
+// SendLeaseEvent sends an event to the EventService listening on socketPath.
+func SendLeaseEvent(socketPath string, event LeaseEvent) error {
+	conn, err := net.DialTimeout("unix", socketPath, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return json.NewEncoder(conn).Encode(event)
+}
+
+// EventService collects lease events sent by the dhcp-script helper over a
+// unix socket. It keeps the latest events, streams them to subscribers and
+// posts them to webhooks.
+type EventService struct {
+	socketPath string
+	webhooks   []string
+	maxEvents  int
+	client     *http.Client
+
+	mu          sync.Mutex
+	events      []LeaseEvent
+	nextID      uint64
+	subscribers map[chan LeaseEvent]struct{}
+}
+
+func NewEventService() *EventService {
+	socketPath := os.Getenv("DHCP_EVENTS_SOCKET")
+	if socketPath == "" {
+		socketPath = "/var/run/dnsmasq-k8s/events.sock"
+	}
+	maxEvents := 500
+	if v, err := strconv.Atoi(os.Getenv("DHCP_EVENTS_MAX")); err == nil && v > 0 {
+		maxEvents = v
+	}
+	var webhooks []string
+	for _, url := range strings.Split(os.Getenv("DHCP_EVENT_WEBHOOKS"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			webhooks = append(webhooks, url)
+		}
+	}
+	return &EventService{
+		socketPath:  socketPath,
+		webhooks:    webhooks,
+		maxEvents:   maxEvents,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		nextID:      1,
+		subscribers: make(map[chan LeaseEvent]struct{}),
+	}
+}
+
+// SocketPath returns the path of the unix socket events are sent to.
+func (s *EventService) SocketPath() string {
+	return s.socketPath
+}
+
+// StartListener accepts events on the unix socket until ctx is done.
+func (s *EventService) StartListener(ctx context.Context) {
+	if err := os.MkdirAll(filepath.Dir(s.socketPath), 0755); err != nil {
+		fmt.Printf("ERROR: Failed to create directory for %s: %v\n", s.socketPath, err)
+		return
+	}
+	// Remove the socket left by a previous run
+	os.Remove(s.socketPath)
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to listen for lease events on %s: %v\n", s.socketPath, err)
+		return
+	}
+	fmt.Printf("INFO: Listening for lease events on %s\n", s.socketPath)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Printf("ERROR: Failed to accept lease event connection: %v\n", err)
+			}
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *EventService) handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	decoder := json.NewDecoder(conn)
+	for {
+		var event LeaseEvent
+		if err := decoder.Decode(&event); err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Printf("WARN: Invalid lease event: %v\n", err)
+			}
+			return
+		}
+		s.Publish(event)
+	}
+}
+
+// Publish records an event, sends it to subscribers and webhooks and returns
+// it with its ID.
+func (s *EventService) Publish(event LeaseEvent) LeaseEvent {
+	s.mu.Lock()
+	event.ID = s.nextID
+	s.nextID++
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	s.events = append(s.events, event)
+	if len(s.events) > s.maxEvents {
+		s.events = s.events[len(s.events)-s.maxEvents:]
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscribers miss events rather than blocking dnsmasq
+		}
+	}
+	s.mu.Unlock()
+
+	fmt.Printf("INFO: Lease event %s %s %s %s\n", event.Action, event.IPAddress, event.MACAddress+event.DUID, event.Hostname)
+	for _, url := range s.webhooks {
+		go s.postWebhook(url, event)
+	}
+	return event
+}
+
+func (s *EventService) postWebhook(url string, event LeaseEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	resp, err := s.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("WARN: Failed to post lease event to %s: %v\n", url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Printf("WARN: Webhook %s answered %s to lease event %d\n", url, resp.Status, event.ID)
+	}
+}
+
+// GetEvents returns up to limit of the latest events with an ID greater than
+// since, oldest first. A limit of 0 returns all of them.
+func (s *EventService) GetEvents(since uint64, limit int) []LeaseEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := []LeaseEvent{}
+	for _, event := range s.events {
+		if event.ID > since {
+			events = append(events, event)
+		}
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events
+}
+
+// Subscribe returns a channel receiving new events and a function to cancel
+// the subscription.
+func (s *EventService) Subscribe() (<-chan LeaseEvent, func()) {
+	ch := make(chan LeaseEvent, 64)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaseEventFromScript(t *testing.T) {
+	env := map[string]string{
+		"DNSMASQ_CLIENT_ID":     "01:00:11:22:33:44:55",
+		"DNSMASQ_INTERFACE":     "eth0",
+		"DNSMASQ_TAGS":          "lan known",
+		"DNSMASQ_LEASE_EXPIRES": "1677721600",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	event, ok := LeaseEventFromScript([]string{"add", "00:11:22:33:44:55", "192.168.1.10", "nas"}, getenv)
+	assert.True(t, ok)
+	assert.Equal(t, LeaseEvent{
+		Action:     LeaseEventAdd,
+		MACAddress: "00:11:22:33:44:55",
+		IPAddress:  "192.168.1.10",
+		Hostname:   "nas",
+		ClientID:   "01:00:11:22:33:44:55",
+		Interface:  "eth0",
+		Tags:       []string{"lan", "known"},
+		ExpiryTime: 1677721600,
+	}, event)
+
+	env["DNSMASQ_IAID"] = "12345"
+	event, ok = LeaseEventFromScript([]string{"del", "00:01:00:01:2b:3c:4d:5e:00:11:22:33:44:55", "fd00::10"}, getenv)
+	assert.True(t, ok)
+	assert.True(t, event.IPv6)
+	assert.Equal(t, "00:01:00:01:2b:3c:4d:5e:00:11:22:33:44:55", event.DUID)
+	assert.Equal(t, "12345", event.IAID)
+	assert.Empty(t, event.ClientID)
+
+	_, ok = LeaseEventFromScript([]string{"init"}, getenv)
+	assert.False(t, ok)
+	_, ok = LeaseEventFromScript([]string{"tftp", "1024", "192.168.1.10", "/tftp/pxelinux.0"}, getenv)
+	assert.False(t, ok)
+	_, ok = LeaseEventFromScript([]string{"arp-add", "00:11:22:33:44:55", "192.168.1.10"}, getenv)
+	assert.False(t, ok)
+	_, ok = LeaseEventFromScript([]string{"relay-snoop", "fd00::/64", "eth0", "fd00::1"}, getenv)
+	assert.False(t, ok)
+
+	assert.True(t, IsDHCPScript(func(key string) string { return map[string]string{DHCPScriptEnv: "1"}[key] }))
+	assert.False(t, IsDHCPScript(getenv))
+}
+
+func TestEventService(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "events")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	received := make(chan LeaseEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event LeaseEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		received <- event
+	}))
+	defer webhook.Close()
+
+	os.Setenv("DHCP_EVENTS_SOCKET", filepath.Join(tmpDir, "run", "events.sock"))
+	defer os.Unsetenv("DHCP_EVENTS_SOCKET")
+	os.Setenv("DHCP_EVENTS_MAX", "2")
+	defer os.Unsetenv("DHCP_EVENTS_MAX")
+	os.Setenv("DHCP_EVENT_WEBHOOKS", webhook.URL)
+	defer os.Unsetenv("DHCP_EVENT_WEBHOOKS")
+
+	eventService := NewEventService()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go eventService.StartListener(ctx)
+
+	events, unsubscribe := eventService.Subscribe()
+	defer unsubscribe()
+
+	// The listener may not be up yet
+	event := LeaseEvent{Action: LeaseEventAdd, MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.1.10"}
+	assert.Eventually(t, func() bool {
+		return SendLeaseEvent(eventService.SocketPath(), event) == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	select {
+	case published := <-events:
+		assert.Equal(t, uint64(1), published.ID)
+		assert.Equal(t, "192.168.1.10", published.IPAddress)
+		assert.False(t, published.Time.IsZero())
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not published")
+	}
+	select {
+	case posted := <-received:
+		assert.Equal(t, uint64(1), posted.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not posted to webhook")
+	}
+
+	eventService.Publish(LeaseEvent{Action: LeaseEventOld, IPAddress: "192.168.1.10"})
+	eventService.Publish(LeaseEvent{Action: LeaseEventDel, IPAddress: "192.168.1.10"})
+	<-received
+	<-received
+
+	// Only the latest DHCP_EVENTS_MAX events are kept
+	history := eventService.GetEvents(0, 0)
+	assert.Len(t, history, 2)
+	assert.Equal(t, uint64(2), history[0].ID)
+	assert.Equal(t, []LeaseEvent{history[1]}, eventService.GetEvents(2, 0))
+	assert.Equal(t, []LeaseEvent{history[1]}, eventService.GetEvents(0, 1))
+}
@@ -0,0 +1,401 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExternalDNSMediaType is the content type of the ExternalDNS webhook
+// provider protocol.
+const ExternalDNSMediaType = "application/external.dns.webhook+json;version=1"
+
+// ExternalDNSOwner is the comment marking the custom.conf entries owned by
+// ExternalDNS. Entries without it are never returned to or changed by
+// ExternalDNS.
+const ExternalDNSOwner = "external-dns"
+
+// ExternalDNSEndpoint is the Endpoint of the ExternalDNS webhook protocol: a
+// DNS name with its record type and targets.
+type ExternalDNSEndpoint struct {
+	DNSName          string                        `json:"dnsName"`
+	Targets          []string                      `json:"targets"`
+	RecordType       string                        `json:"recordType"`
+	SetIdentifier    string                        `json:"setIdentifier,omitempty"`
+	RecordTTL        int64                         `json:"recordTTL,omitempty"`
+	Labels           map[string]string             `json:"labels,omitempty"`
+	ProviderSpecific []ExternalDNSProviderProperty `json:"providerSpecific,omitempty"`
+}
+
+type ExternalDNSProviderProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ExternalDNSChanges are the endpoints ExternalDNS creates, updates and
+// deletes in one apply.
+type ExternalDNSChanges struct {
+	Create    []ExternalDNSEndpoint `json:"create,omitempty"`
+	UpdateOld []ExternalDNSEndpoint `json:"updateOld,omitempty"`
+	UpdateNew []ExternalDNSEndpoint `json:"updateNew,omitempty"`
+	Delete    []ExternalDNSEndpoint `json:"delete,omitempty"`
+}
+
+// ExternalDNSDomainFilter limits the domains ExternalDNS manages through
+// dnsmasq-k8s.
+type ExternalDNSDomainFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// externalDNSTypes maps the supported ExternalDNS record types to DNSEntry
+// types.
+var externalDNSTypes = map[string]string{"A": "address", "AAAA": "aaaa", "CNAME": "cname", "TXT": "txt"}
+
+// ExternalDNSDomainFilter returns the domains in EXTERNAL_DNS_DOMAIN_FILTER
+// and EXTERNAL_DNS_EXCLUDE_DOMAINS, comma separated.
+func (s *ConfigService) ExternalDNSDomainFilter() ExternalDNSDomainFilter {
+	return ExternalDNSDomainFilter{
+		Include: splitAnnotation(os.Getenv("EXTERNAL_DNS_DOMAIN_FILTER")),
+		Exclude: splitAnnotation(os.Getenv("EXTERNAL_DNS_EXCLUDE_DOMAINS")),
+	}
+}
+
+// SetSupervisor makes changes applied by ExternalDNS reload dnsmasq. Nobody
+// is there to restart it by hand, unlike after edits through the API.
+func (s *ConfigService) SetSupervisor(supervisor ServiceSupervisor) {
+	s.supervisor = supervisor
+}
+
+// GetExternalDNSEndpoints returns the records owned by ExternalDNS as
+// endpoints, one per name and record type: the A and AAAA records of the
+// hosts file, then the entries of custom.conf.
+func (s *ConfigService) GetExternalDNSEndpoints(ctx context.Context) ([]ExternalDNSEndpoint, error) {
+	hosts, err := readFile(s.externalDNSFile)
+	if err != nil {
+		return nil, err
+	}
+	entries := parseExternalDNSHosts(string(hosts))
+	custom, err := s.GetDNSEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, custom...)
+
+	endpoints := []ExternalDNSEndpoint{}
+	index := map[string]int{}
+	for _, entry := range entries {
+		if entry.Comment != ExternalDNSOwner {
+			continue
+		}
+		recordType := ""
+		for t, entryType := range externalDNSTypes {
+			if entryType == entry.Type {
+				recordType = t
+			}
+		}
+		if recordType == "" {
+			continue
+		}
+		target := entry.Value
+		if recordType == "TXT" {
+			target = `"` + target + `"`
+		}
+		key := recordType + " " + entry.Domain
+		if i, ok := index[key]; ok {
+			endpoints[i].Targets = append(endpoints[i].Targets, target)
+			continue
+		}
+		index[key] = len(endpoints)
+		endpoints = append(endpoints, ExternalDNSEndpoint{DNSName: entry.Domain, RecordType: recordType, Targets: []string{target}})
+	}
+	return endpoints, nil
+}
+
+// AdjustExternalDNSEndpoints drops the endpoints dnsmasq-k8s cannot store and
+// clears the fields it does not keep, the TTL and provider specific
+// properties, so the records read back match the ones ExternalDNS plans.
+func AdjustExternalDNSEndpoints(endpoints []ExternalDNSEndpoint) []ExternalDNSEndpoint {
+	adjusted := []ExternalDNSEndpoint{}
+	for _, ep := range endpoints {
+		if _, err := externalDNSEntries(ep); err != nil {
+			fmt.Printf("WARN: ExternalDNS endpoint %s %s not supported: %v\n", ep.RecordType, ep.DNSName, err)
+			continue
+		}
+		ep.RecordTTL = 0
+		ep.ProviderSpecific = nil
+		adjusted = append(adjusted, ep)
+	}
+	return adjusted
+}
+
+// externalDNSEntries maps an endpoint to a DNS entry per target, marked with
+// ExternalDNSOwner.
+func externalDNSEntries(ep ExternalDNSEndpoint) ([]DNSEntry, error) {
+	entryType, ok := externalDNSTypes[ep.RecordType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported record type: %s", ep.RecordType)
+	}
+	if ep.SetIdentifier != "" {
+		return nil, fmt.Errorf("set identifiers are not supported")
+	}
+	name := strings.TrimSuffix(ep.DNSName, ".")
+	if !validHostname(name) {
+		return nil, fmt.Errorf("invalid DNS name: %q", ep.DNSName)
+	}
+	if len(ep.Targets) == 0 {
+		return nil, fmt.Errorf("%s has no targets", ep.DNSName)
+	}
+	if entryType == "cname" && len(ep.Targets) > 1 {
+		return nil, fmt.Errorf("a CNAME has a single target")
+	}
+
+	var entries []DNSEntry
+	for _, target := range ep.Targets {
+		entry := DNSEntry{Type: entryType, Domain: name, Value: target, Comment: ExternalDNSOwner}
+		switch entryType {
+		case "cname":
+			entry.Value = strings.TrimSuffix(target, ".")
+		case "txt":
+			entry.Value = strings.TrimSuffix(strings.TrimPrefix(target, `"`), `"`)
+			if entry.Value == "" || strings.ContainsAny(entry.Value, "\"\r\n") {
+				return nil, fmt.Errorf("invalid TXT target: %q", target)
+			}
+		}
+		if err := ValidateDNSEntry(entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// externalDNSHeader starts the hosts file of the ExternalDNS records.
+const externalDNSHeader = "# Written by dnsmasq-k8s for ExternalDNS, do not edit"
+
+const (
+	externalDNSConfigMap    = "dnsmasq-external-dns"
+	externalDNSConfigMapKey = "external-dns.hosts"
+)
+
+// isHostsEntry reports whether an entry goes to the hosts file rather than
+// custom.conf: dnsmasq reloads hosts files on SIGHUP, but only reads
+// custom.conf when it starts.
+func isHostsEntry(entry DNSEntry) bool {
+	return entry.Type == "address" || entry.Type == "aaaa"
+}
+
+// formatHostsEntry formats an A or AAAA entry as a hosts file line, without
+// its comment.
+func formatHostsEntry(entry DNSEntry) string {
+	return entry.Value + " " + entry.Domain
+}
+
+// parseExternalDNSHosts returns the A and AAAA entries of the ExternalDNS
+// hosts file.
+func parseExternalDNSHosts(content string) []DNSEntry {
+	var entries []DNSEntry
+	for _, line := range strings.Split(content, "\n") {
+		directive, comment := splitComment(line)
+		fields := strings.Fields(directive)
+		if len(fields) < 2 {
+			continue
+		}
+		entryType := "address"
+		if strings.Contains(fields[0], ":") {
+			entryType = "aaaa"
+		}
+		for _, name := range fields[1:] {
+			entries = append(entries, DNSEntry{Type: entryType, Domain: name, Value: fields[0], Comment: comment})
+		}
+	}
+	return entries
+}
+
+// ApplyExternalDNSChanges deletes the entries of the deleted and updated
+// endpoints, then adds the entries of the created and updated ones. A and
+// AAAA records are written to the ExternalDNS hosts file, which dnsmasq
+// reloads on SIGHUP. CNAME and TXT records are written to custom.conf, and
+// dnsmasq is restarted when it changed. Only entries owned by ExternalDNS
+// are deleted, including A and AAAA records written to custom.conf by
+// earlier versions.
+func (s *ConfigService) ApplyExternalDNSChanges(ctx context.Context, changes ExternalDNSChanges) error {
+	remove := map[string]bool{}
+	for _, ep := range append(append([]ExternalDNSEndpoint{}, changes.Delete...), changes.UpdateOld...) {
+		entries, err := externalDNSEntries(ep)
+		if err != nil {
+			// Nothing was written for endpoints that cannot be mapped
+			continue
+		}
+		for _, entry := range entries {
+			remove[formatDNSEntry(entry)] = true
+			if isHostsEntry(entry) {
+				remove[formatHostsEntry(entry)] = true
+			}
+		}
+	}
+	var addCustom, addHosts []string
+	for _, ep := range append(append([]ExternalDNSEndpoint{}, changes.Create...), changes.UpdateNew...) {
+		entries, err := externalDNSEntries(ep)
+		if err != nil {
+			return fmt.Errorf("%w: %s %s: %v", ErrInvalid, ep.RecordType, ep.DNSName, err)
+		}
+		for _, entry := range entries {
+			if isHostsEntry(entry) {
+				addHosts = append(addHosts, formatHostsEntry(entry))
+			} else {
+				addCustom = append(addCustom, formatDNSEntry(entry))
+			}
+		}
+	}
+
+	restart, err := s.applyExternalDNSCustom(ctx, remove, addCustom)
+	if err != nil {
+		return err
+	}
+	reload, err := s.applyExternalDNSHosts(remove, addHosts)
+	if err != nil {
+		return err
+	}
+
+	if s.supervisor == nil {
+		return nil
+	}
+	if restart {
+		return restartDnsmasq(s.supervisor)
+	}
+	if reload {
+		if err := s.supervisor.SignalService(dnsmasqProgram, "HUP"); err != nil {
+			return fmt.Errorf("failed to reload dnsmasq: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyExternalDNSCustom removes the owned entries of custom.conf in remove,
+// adds the ones in add and reports whether the file changed.
+func (s *ConfigService) applyExternalDNSCustom(ctx context.Context, remove map[string]bool, add []string) (bool, error) {
+	unlock := lockFile(s.customDNSFile)
+	defer unlock()
+
+	content, err := readFile(s.customDNSFile)
+	if err != nil {
+		return false, err
+	}
+
+	var lines []string
+	owned := map[string]bool{}
+	for _, line := range strings.Split(string(content), "\n") {
+		directive, comment := splitComment(line)
+		if comment == ExternalDNSOwner {
+			if canonical := canonicalDNSLine(directive); canonical != "" {
+				if remove[canonical] {
+					continue
+				}
+				owned[canonical] = true
+			}
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range add {
+		if !owned[line] {
+			owned[line] = true
+			lines = append(lines, line+" # "+ExternalDNSOwner)
+		}
+	}
+
+	newContent := strings.Join(lines, "\n") + "\n"
+	if newContent == string(content) {
+		return false, nil
+	}
+	if err := s.validateDnsmasqConfig(newContent); err != nil {
+		return false, fmt.Errorf("%w: dnsmasq configuration validation failed: %v", ErrInvalid, err)
+	}
+	if err := writeFileAtomic(s.customDNSFile, []byte(newContent)); err != nil {
+		return false, err
+	}
+	s.history.record(ctx, s.customDNSFile, string(content), newContent)
+	return true, nil
+}
+
+// applyExternalDNSHosts removes the lines of the ExternalDNS hosts file in
+// remove, adds the ones in add and reports whether the file changed.
+func (s *ConfigService) applyExternalDNSHosts(remove map[string]bool, add []string) (bool, error) {
+	unlock := lockFile(s.externalDNSFile)
+	defer unlock()
+
+	content, err := readFile(s.externalDNSFile)
+	if err != nil {
+		return false, err
+	}
+
+	lines := []string{externalDNSHeader}
+	present := map[string]bool{}
+	changed := false
+	for _, line := range strings.Split(string(content), "\n") {
+		directive, _ := splitComment(line)
+		record := strings.Join(strings.Fields(directive), " ")
+		if record == "" || present[record] {
+			continue
+		}
+		if remove[record] {
+			changed = true
+			continue
+		}
+		present[record] = true
+		lines = append(lines, record+" # "+ExternalDNSOwner)
+	}
+	for _, record := range add {
+		if !present[record] {
+			present[record] = true
+			changed = true
+			lines = append(lines, record+" # "+ExternalDNSOwner)
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	newContent := strings.Join(lines, "\n") + "\n"
+	if err := writeFileAtomic(s.externalDNSFile, []byte(newContent)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// StartExternalDNSSync keeps the dnsmasq-external-dns ConfigMap in sync with
+// the ExternalDNS hosts file, see startFileSync.
+func (s *ConfigService) StartExternalDNSSync(ctx context.Context) {
+	startFileSync(ctx, s.externalDNSFile, "ExternalDNS", s.RestoreExternalDNSFromConfigMap, s.SyncExternalDNSToConfigMap)
+}
+
+func (s *ConfigService) SyncExternalDNSToConfigMap(ctx context.Context) error {
+	content, err := os.ReadFile(s.externalDNSFile)
+	if err != nil {
+		return fmt.Errorf("failed to read ExternalDNS file: %v", err)
+	}
+
+	return UpdateConfigMapWithRetry(ctx, s.clientset, s.namespace, externalDNSConfigMap, externalDNSConfigMapKey, string(content))
+}
+
+func (s *ConfigService) RestoreExternalDNSFromConfigMap(ctx context.Context) error {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, externalDNSConfigMap, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil // Nothing to restore
+		}
+		return err
+	}
+
+	if content, ok := configMap.Data[externalDNSConfigMapKey]; ok {
+		return writeFile(s.externalDNSFile, []byte(content))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestExternalDNSEntries(t *testing.T) {
+	entries, err := externalDNSEntries(ExternalDNSEndpoint{DNSName: "web.home.lan.", RecordType: "A", Targets: []string{"10.0.0.1", "10.0.0.2"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []DNSEntry{
+		{Type: "address", Domain: "web.home.lan", Value: "10.0.0.1", Comment: ExternalDNSOwner},
+		{Type: "address", Domain: "web.home.lan", Value: "10.0.0.2", Comment: ExternalDNSOwner},
+	}, entries)
+
+	// TXT targets are quoted by ExternalDNS
+	entries, err = externalDNSEntries(ExternalDNSEndpoint{DNSName: "a-web.home.lan", RecordType: "TXT", Targets: []string{`"heritage=external-dns,external-dns/owner=default"`}})
+	assert.NoError(t, err)
+	assert.Equal(t, "heritage=external-dns,external-dns/owner=default", entries[0].Value)
+
+	for _, ep := range []ExternalDNSEndpoint{
+		{DNSName: "web.home.lan", RecordType: "SRV", Targets: []string{"0 0 80 web.home.lan"}},
+		{DNSName: "web.home.lan", RecordType: "A", Targets: []string{"fd00::1"}},
+		{DNSName: "web.home.lan", RecordType: "A"},
+		{DNSName: "web.home.lan", RecordType: "CNAME", Targets: []string{"a.lan", "b.lan"}},
+		{DNSName: "web.home.lan", RecordType: "TXT", Targets: []string{`"say "hi""`}},
+		{DNSName: "web.home.lan", RecordType: "A", Targets: []string{"10.0.0.1"}, SetIdentifier: "blue"},
+		{DNSName: "bad_name!", RecordType: "A", Targets: []string{"10.0.0.1"}},
+	} {
+		_, err := externalDNSEntries(ep)
+		assert.Error(t, err, ep)
+	}
+}
+
+func TestApplyExternalDNSChanges(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "externaldns")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	customFile := filepath.Join(tmpDir, "custom.conf")
+	assert.NoError(t, os.WriteFile(customFile, []byte("address=/web.home.lan/10.0.0.9 # manual\naddress=/old.home.lan/10.0.0.8 # external-dns\n"), 0644))
+	os.Setenv("DNSMASQ_CUSTOM_DNS_FILE", customFile)
+	defer os.Unsetenv("DNSMASQ_CUSTOM_DNS_FILE")
+	hostsFile := filepath.Join(tmpDir, "external-dns.hosts")
+	os.Setenv("DNSMASQ_EXTERNAL_DNS_FILE", hostsFile)
+	defer os.Unsetenv("DNSMASQ_EXTERNAL_DNS_FILE")
+
+	configService := NewConfigService(fake.NewSimpleClientset(), "default")
+	supervisor := &fakeSupervisor{}
+	configService.SetSupervisor(supervisor)
+	ctx := context.Background()
+
+	// A and AAAA records go to the hosts file, CNAME and TXT to custom.conf,
+	// which needs a restart
+	web := ExternalDNSEndpoint{DNSName: "web.home.lan", RecordType: "A", Targets: []string{"10.0.0.1"}}
+	owner := ExternalDNSEndpoint{DNSName: "a-web.home.lan", RecordType: "TXT", Targets: []string{`"heritage=external-dns"`}}
+	assert.NoError(t, configService.ApplyExternalDNSChanges(ctx, ExternalDNSChanges{Create: []ExternalDNSEndpoint{web, owner}}))
+	content, err := os.ReadFile(customFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "address=/web.home.lan/10.0.0.9 # manual\n"+
+		"address=/old.home.lan/10.0.0.8 # external-dns\n"+
+		"txt-record=a-web.home.lan,\"heritage=external-dns\" # external-dns\n", string(content))
+	content, err = os.ReadFile(hostsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, externalDNSHeader+"\n10.0.0.1 web.home.lan # external-dns\n", string(content))
+	assert.Equal(t, []string{"stop dnsmasq", "start dnsmasq"}, supervisor.called())
+
+	// dnsmasq is only reloaded when a file changes
+	assert.NoError(t, configService.ApplyExternalDNSChanges(ctx, ExternalDNSChanges{Create: []ExternalDNSEndpoint{web}}))
+	assert.Len(t, supervisor.called(), 2)
+
+	// Changes to the hosts file alone only send SIGHUP
+	v6 := ExternalDNSEndpoint{DNSName: "web.home.lan", RecordType: "AAAA", Targets: []string{"fd00::1"}}
+	assert.NoError(t, configService.ApplyExternalDNSChanges(ctx, ExternalDNSChanges{Create: []ExternalDNSEndpoint{v6}}))
+	assert.Equal(t, []string{"stop dnsmasq", "start dnsmasq", "signal HUP dnsmasq"}, supervisor.called())
+
+	// Manual entries are not returned, the ones written to custom.conf by
+	// earlier versions are
+	old := ExternalDNSEndpoint{DNSName: "old.home.lan", RecordType: "A", Targets: []string{"10.0.0.8"}}
+	endpoints, err := configService.GetExternalDNSEndpoints(ctx)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []ExternalDNSEndpoint{web, v6, old, owner}, endpoints)
+
+	// Updates only replace the owned entries, even when a manual entry matches
+	moved := web
+	moved.Targets = []string{"10.0.0.2", "10.0.0.3"}
+	manual := ExternalDNSEndpoint{DNSName: "web.home.lan", RecordType: "A", Targets: []string{"10.0.0.9"}}
+	assert.NoError(t, configService.ApplyExternalDNSChanges(ctx, ExternalDNSChanges{
+		UpdateOld: []ExternalDNSEndpoint{web},
+		UpdateNew: []ExternalDNSEndpoint{moved},
+		Delete:    []ExternalDNSEndpoint{owner, manual, old, v6},
+	}))
+	content, err = os.ReadFile(customFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "address=/web.home.lan/10.0.0.9 # manual\n", string(content))
+	content, err = os.ReadFile(hostsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, externalDNSHeader+"\n10.0.0.2 web.home.lan # external-dns\n10.0.0.3 web.home.lan # external-dns\n", string(content))
+	endpoints, err = configService.GetExternalDNSEndpoints(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []ExternalDNSEndpoint{moved}, endpoints)
+
+	// Unsupported endpoints reject the whole change
+	err = configService.ApplyExternalDNSChanges(ctx, ExternalDNSChanges{Create: []ExternalDNSEndpoint{
+		{DNSName: "mail.home.lan", RecordType: "MX", Targets: []string{"10 mail.home.lan"}},
+	}})
+	assert.ErrorIs(t, err, ErrInvalid)
+}
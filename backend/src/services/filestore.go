@@ -0,0 +1,120 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Managed files are read by dnsmasq and synced to ConfigMaps by watchers, so
+// they must never be observed half-written. Every write goes through
+// writeFile: the content is written to a temporary file in the same
+// directory, flushed to disk, then renamed over the target in a single
+// atomic step. Read-modify-write sequences hold lockFile for the whole
+// sequence so concurrent API calls cannot lose each other's changes.
+//
+// The lease file is the exception: dnsmasq keeps it open while it runs and
+// would go on writing to the replaced file, so it is rewritten in place with
+// writeFileInPlace.
+
+var fileLocks sync.Map // cleaned path -> *sync.Mutex
+
+// lockFile locks path for this process and returns the unlock function.
+func lockFile(path string) func() {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	mu, _ := fileLocks.LoadOrStore(filepath.Clean(path), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// writeFile locks path and atomically replaces its content.
+func writeFile(path string, data []byte) error {
+	unlock := lockFile(path)
+	defer unlock()
+	return writeFileAtomic(path, data)
+}
+
+// readFile returns the content of path, or nothing if it does not exist.
+func readFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return content, nil
+}
+
+// writeFileInPlace truncates and rewrites path, keeping its inode so a
+// process holding the file open sees the new content. The caller must hold
+// lockFile(path).
+func writeFileInPlace(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileAtomic replaces the content of path with data using a temporary
+// file, fsync and rename. The caller must hold lockFile(path). The file mode
+// of an existing file is kept.
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", path, err)
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// Dotfiles are skipped by dnsmasq's conf-dir, so a leftover temporary file
+	// is never loaded as configuration.
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "filestore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "sub", "custom.conf")
+	assert.NoError(t, writeFile(path, []byte("a\n")))
+	content, err := readFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "a\n", string(content))
+
+	// The mode of an existing file is kept
+	assert.NoError(t, os.Chmod(path, 0600))
+	assert.NoError(t, writeFile(path, []byte("b\n")))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// No temporary file is left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	content, err = readFile(filepath.Join(tmpDir, "missing.conf"))
+	assert.NoError(t, err)
+	assert.Empty(t, content)
+}
+
+func TestWriteFileInPlace(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "filestore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "dnsmasq.leases")
+	assert.NoError(t, os.WriteFile(path, []byte("1700000000 aa:bb:cc:dd:ee:ff 192.168.1.150 laptop *\n"), 0644))
+
+	// A process holding the file open, like dnsmasq, sees the new content
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, writeFileInPlace(path, []byte("b\n")))
+	content := make([]byte, 64)
+	n, err := f.ReadAt(content, 0)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, "b\n", string(content[:n]))
+}
+
+func TestLockFile_ConcurrentUpdates(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "filestore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "reservations.conf")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			unlock := lockFile(path)
+			defer unlock()
+			content, err := readFile(path)
+			assert.NoError(t, err)
+			assert.NoError(t, writeFileAtomic(path, append(content, fmt.Sprintf("line-%d\n", i)...)))
+		}(i)
+	}
+	wg.Wait()
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(content)), "\n"), 20)
+}
+
+func TestStartFileSync_AtomicReplace(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "filestore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "custom.conf")
+	synced := make(chan string, 10)
+	syncFile := func(ctx context.Context) error {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		synced <- string(content)
+		return nil
+	}
+	restore := func(ctx context.Context) error { return nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go startFileSync(ctx, path, "custom DNS", restore, syncFile)
+
+	// Every write replaces the file, keep writing until the watcher is up
+	// and each revision has been synced at least once
+	for i := 1; i <= 3; i++ {
+		want := fmt.Sprintf("rev %d\n", i)
+		timeout := time.After(2 * time.Second)
+	wait:
+		for {
+			assert.NoError(t, writeFile(path, []byte(want)))
+			select {
+			case content := <-synced:
+				if content == want {
+					break wait
+				}
+			case <-time.After(50 * time.Millisecond):
+			case <-timeout:
+				t.Fatalf("revision %d was not synced", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Forwarder is an upstream DNS directive managed in the forwarders file.
+//
+//	server=10.0.0.1                  global upstream
+//	server=/corp.example/10.0.0.53   conditional forwarder
+//	rev-server=10.0.0.0/8,10.0.0.53  reverse lookups for a subnet
+//	local=/home.lan/                 answered from local data only
+type Forwarder struct {
+	Type    string   `json:"type"`
+	Domains []string `json:"domains,omitempty"`
+	Subnet  string   `json:"subnet,omitempty"`
+	Server  string   `json:"server,omitempty"`
+	Port    int      `json:"port,omitempty"`
+	Comment string   `json:"comment"`
+}
+
+// ForwardersETag returns the ETag of the forwarders file.
+func (s *ConfigService) ForwardersETag(ctx context.Context) (string, error) {
+	return fileETag(s.forwardersFile)
+}
+
+func (s *ConfigService) GetForwarders(ctx context.Context) ([]Forwarder, error) {
+	if _, err := os.Stat(s.forwardersFile); os.IsNotExist(err) {
+		return []Forwarder{}, nil
+	}
+
+	content, err := os.ReadFile(s.forwardersFile)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarders := []Forwarder{}
+	for _, line := range strings.Split(string(content), "\n") {
+		// server=/domain/# and server=10.0.0.1#53 use '#' too, see splitComment
+		directive, comment := splitComment(line)
+		if fwd, ok := parseForwarder(directive); ok {
+			fwd.Comment = comment
+			forwarders = append(forwarders, fwd)
+		}
+	}
+	return forwarders, nil
+}
+
+func (s *ConfigService) AddForwarder(ctx context.Context, fwd Forwarder) error {
+	if err := ValidateForwarder(fwd); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	unlock := lockFile(s.forwardersFile)
+	defer unlock()
+
+	content, err := readFile(s.forwardersFile)
+	if err != nil {
+		return err
+	}
+
+	newLine := formatForwarder(fwd)
+	if fwd.Comment != "" {
+		newLine += fmt.Sprintf(" # %s", fwd.Comment)
+	}
+	newContent := string(content)
+	if newContent != "" && !strings.HasSuffix(newContent, "\n") {
+		newContent += "\n"
+	}
+	newContent += newLine + "\n"
+
+	if err := s.validateDnsmasqConfig(newContent); err != nil {
+		return fmt.Errorf("%w: dnsmasq configuration validation failed: %v", ErrInvalid, err)
+	}
+
+	if err := writeFileAtomic(s.forwardersFile, []byte(newContent)); err != nil {
+		return err
+	}
+	s.history.record(ctx, s.forwardersFile, string(content), newContent)
+	return nil
+}
+
+func (s *ConfigService) UpdateForwarder(ctx context.Context, oldFwd, newFwd Forwarder) error {
+	return s.modifyForwarder(ctx, oldFwd, newFwd, false)
+}
+
+func (s *ConfigService) DeleteForwarder(ctx context.Context, fwd Forwarder) error {
+	return s.modifyForwarder(ctx, fwd, Forwarder{}, true)
+}
+
+func (s *ConfigService) modifyForwarder(ctx context.Context, target, newFwd Forwarder, isDelete bool) error {
+	if !isDelete {
+		if err := ValidateForwarder(newFwd); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+
+	unlock := lockFile(s.forwardersFile)
+	defer unlock()
+
+	// A missing file has no forwarders, the target is reported not found
+	content, err := readFile(s.forwardersFile)
+	if err != nil {
+		return err
+	}
+
+	targetLine := formatForwarder(target)
+	lines := strings.Split(string(content), "\n")
+	var newLines []string
+	found := false
+
+	for _, line := range lines {
+		trimmed, _ := splitComment(line)
+		if fwd, ok := parseForwarder(trimmed); ok {
+			trimmed = formatForwarder(fwd)
+		}
+
+		if !found && trimmed == targetLine {
+			found = true
+			if !isDelete {
+				newLine := formatForwarder(newFwd)
+				if newFwd.Comment != "" {
+					newLine += fmt.Sprintf(" # %s", newFwd.Comment)
+				}
+				newLines = append(newLines, newLine)
+			}
+			continue
+		}
+		newLines = append(newLines, line)
+	}
+
+	if !found {
+		return fmt.Errorf("forwarder %w", ErrNotFound)
+	}
+
+	newContent := strings.Join(newLines, "\n")
+	if err := s.validateDnsmasqConfig(newContent); err != nil {
+		return fmt.Errorf("%w: dnsmasq configuration validation failed: %v", ErrInvalid, err)
+	}
+
+	if err := writeFileAtomic(s.forwardersFile, []byte(newContent)); err != nil {
+		return err
+	}
+	s.history.record(ctx, s.forwardersFile, string(content), newContent)
+	return nil
+}
+
+// ValidateForwarder checks a forwarder before it is written.
+func ValidateForwarder(fwd Forwarder) error {
+	for _, domain := range fwd.Domains {
+		if domain == "" || strings.ContainsAny(domain, "/# ") {
+			return fmt.Errorf("invalid domain: %q", domain)
+		}
+	}
+	if fwd.Port < 0 || fwd.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", fwd.Port)
+	}
+
+	switch fwd.Type {
+	case "server":
+		if len(fwd.Domains) == 0 {
+			if net.ParseIP(fwd.Server) == nil {
+				return fmt.Errorf("global upstream server requires a valid IP address: %s", fwd.Server)
+			}
+			return nil
+		}
+		// Conditional forwarders may leave the server empty (local only) or
+		// use '#' to send the domain to the standard upstreams.
+		if fwd.Server != "" && fwd.Server != "#" && net.ParseIP(fwd.Server) == nil {
+			return fmt.Errorf("invalid server IP address: %s", fwd.Server)
+		}
+	case "rev-server":
+		if _, _, err := net.ParseCIDR(fwd.Subnet); err != nil {
+			return fmt.Errorf("invalid subnet for rev-server, expected CIDR notation: %s", fwd.Subnet)
+		}
+		if fwd.Server != "" && net.ParseIP(fwd.Server) == nil {
+			return fmt.Errorf("invalid server IP address: %s", fwd.Server)
+		}
+	case "local":
+		if len(fwd.Domains) == 0 {
+			return fmt.Errorf("local requires at least one domain")
+		}
+		if fwd.Server != "" {
+			return fmt.Errorf("local entries do not take a server")
+		}
+	default:
+		return fmt.Errorf("unsupported forwarder type: %s. Only 'server', 'rev-server', and 'local' are supported", fwd.Type)
+	}
+	return nil
+}
+
+func formatForwarder(fwd Forwarder) string {
+	server := fwd.Server
+	if fwd.Port != 0 && server != "" && server != "#" {
+		server += "#" + strconv.Itoa(fwd.Port)
+	}
+
+	domains := ""
+	if len(fwd.Domains) > 0 {
+		domains = "/" + strings.Join(fwd.Domains, "/") + "/"
+	}
+
+	switch fwd.Type {
+	case "server":
+		return "server=" + domains + server
+	case "rev-server":
+		if server == "" {
+			return "rev-server=" + fwd.Subnet
+		}
+		return "rev-server=" + fwd.Subnet + "," + server
+	case "local":
+		return "local=" + domains
+	}
+	return ""
+}
+
+func parseForwarder(line string) (Forwarder, bool) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return Forwarder{}, false
+	}
+	fwd := Forwarder{Type: strings.TrimSpace(key)}
+	value = strings.TrimSpace(value)
+
+	switch fwd.Type {
+	case "server", "local":
+		if strings.HasPrefix(value, "/") {
+			idx := strings.LastIndex(value, "/")
+			if idx == 0 {
+				return Forwarder{}, false
+			}
+			fwd.Domains = strings.Split(value[1:idx], "/")
+			value = value[idx+1:]
+		}
+		if fwd.Type == "local" {
+			return fwd, len(fwd.Domains) > 0 && value == ""
+		}
+	case "rev-server":
+		subnet, server, _ := strings.Cut(value, ",")
+		fwd.Subnet = subnet
+		value = server
+	default:
+		return Forwarder{}, false
+	}
+
+	fwd.Server, fwd.Port = splitServerPort(value)
+	return fwd, true
+}
+
+// splitServerPort splits "10.0.0.1#5353" into its address and port.
+func splitServerPort(value string) (string, int) {
+	if value == "#" {
+		return value, 0
+	}
+	server, portStr, ok := strings.Cut(value, "#")
+	if !ok {
+		return value, 0
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return value, 0
+	}
+	return server, port
+}
+
+func (s *ConfigService) StartForwardersSync(ctx context.Context) {
+	startFileSync(ctx, s.forwardersFile, "forwarders", s.RestoreForwardersFromConfigMap, s.SyncForwardersToConfigMap)
+}
+
+func (s *ConfigService) SyncForwardersToConfigMap(ctx context.Context) error {
+	content, err := os.ReadFile(s.forwardersFile)
+	if err != nil {
+		return fmt.Errorf("failed to read forwarders file: %v", err)
+	}
+
+	return UpdateConfigMapWithRetry(ctx, s.clientset, s.namespace, "dnsmasq-forwarders", "forwarders.conf", string(content))
+}
+
+func (s *ConfigService) RestoreForwardersFromConfigMap(ctx context.Context) error {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, "dnsmasq-forwarders", metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil // Nothing to restore
+		}
+		return err
+	}
+
+	if content, ok := configMap.Data["forwarders.conf"]; ok {
+		return writeFile(s.forwardersFile, []byte(content))
+	}
+	return nil
+}
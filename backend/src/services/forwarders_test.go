@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigService_Forwarders(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "forwarders-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	forwardersFile := filepath.Join(tmpDir, "forwarders.conf")
+	content := `# Upstreams
+server=1.1.1.1 # Cloudflare
+server=/corp.example/10.0.0.53#5353
+rev-server=10.0.0.0/8,10.0.0.53
+local=/home.lan/
+`
+	assert.NoError(t, os.WriteFile(forwardersFile, []byte(content), 0644))
+	os.Setenv("DNSMASQ_FORWARDERS_FILE", forwardersFile)
+	defer os.Unsetenv("DNSMASQ_FORWARDERS_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+	history := NewHistoryService(clientset, "default", configService, nil)
+	ctx := context.Background()
+
+	forwarders, err := configService.GetForwarders(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []Forwarder{
+		{Type: "server", Server: "1.1.1.1", Comment: "Cloudflare"},
+		{Type: "server", Domains: []string{"corp.example"}, Server: "10.0.0.53", Port: 5353},
+		{Type: "rev-server", Subnet: "10.0.0.0/8", Server: "10.0.0.53"},
+		{Type: "local", Domains: []string{"home.lan"}},
+	}, forwarders)
+
+	// Validation
+	assert.ErrorIs(t, configService.AddForwarder(ctx, Forwarder{Type: "server", Server: "not-an-ip"}), ErrInvalid)
+	assert.Error(t, configService.AddForwarder(ctx, Forwarder{Type: "rev-server", Subnet: "10.0.0.1"}))
+	assert.Error(t, configService.AddForwarder(ctx, Forwarder{Type: "local"}))
+	assert.Error(t, configService.AddForwarder(ctx, Forwarder{Type: "address"}))
+
+	assert.NoError(t, configService.AddForwarder(ctx, Forwarder{Type: "server", Domains: []string{"lab.example", "test.example"}, Server: "192.168.10.1"}))
+
+	err = configService.UpdateForwarder(ctx, forwarders[0], Forwarder{Type: "server", Server: "9.9.9.9", Comment: "Quad9"})
+	assert.NoError(t, err)
+	err = configService.DeleteForwarder(ctx, forwarders[2])
+	assert.NoError(t, err)
+	assert.ErrorIs(t, configService.DeleteForwarder(ctx, forwarders[2]), ErrNotFound)
+
+	newContent, err := os.ReadFile(forwardersFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(newContent), "# Upstreams")
+	assert.Contains(t, string(newContent), "server=9.9.9.9 # Quad9")
+	assert.Contains(t, string(newContent), "server=/lab.example/test.example/192.168.10.1")
+	assert.NotContains(t, string(newContent), "rev-server")
+
+	// Changes are recorded in the history, after the initial state
+	revisions, err := history.GetHistory(ctx, "forwarders.conf")
+	assert.NoError(t, err)
+	assert.Len(t, revisions, 4)
+
+	// The file is mirrored to its own ConfigMap
+	assert.NoError(t, configService.SyncForwardersToConfigMap(ctx))
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, "dnsmasq-forwarders", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, string(newContent), cm.Data["forwarders.conf"])
+
+	// Without a forwarders file there is nothing to change
+	assert.NoError(t, os.Remove(forwardersFile))
+	assert.ErrorIs(t, configService.DeleteForwarder(ctx, forwarders[0]), ErrNotFound)
+}
@@ -0,0 +1,343 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	historyConfigMap = "dnsmasq-history"
+	historyKey       = "history.json"
+	// Stay well below the 1MiB ConfigMap limit
+	maxHistorySize = 900 * 1024
+)
+
+// Revision is a snapshot of a managed file taken after a write.
+type Revision struct {
+	Rev       int       `json:"rev"`
+	File      string    `json:"file"`
+	Author    string    `json:"author"`
+	Timestamp time.Time `json:"timestamp"`
+	Message   string    `json:"message,omitempty"`
+	Diff      string    `json:"diff"`
+	Content   string    `json:"content,omitempty"`
+}
+
+type authorKey struct{}
+
+// WithAuthor returns a context carrying the user making a change, recorded in
+// the revision history.
+func WithAuthor(ctx context.Context, author string) context.Context {
+	return context.WithValue(ctx, authorKey{}, author)
+}
+
+func authorFrom(ctx context.Context) string {
+	if author, ok := ctx.Value(authorKey{}).(string); ok && author != "" {
+		return author
+	}
+	return "anonymous"
+}
+
+// HistoryService keeps the revision history of dnsmasq.conf, custom.conf and
+// the DHCP reservations, ranges and options files in the dnsmasq-history
+// ConfigMap.
+type HistoryService struct {
+	clientset    kubernetes.Interface
+	namespace    string
+	maxRevisions int
+	// files maps the file names used in revisions to their path
+	files         map[string]string
+	configService *ConfigService
+
+	mu        sync.Mutex
+	loaded    bool
+	revisions []Revision
+
+	// queue holds the writes waiting to be recorded by drain, so writers
+	// don't wait for the ConfigMap update while holding their file lock
+	queueMu  sync.Mutex
+	queue    []pendingRevision
+	draining bool
+	drained  *sync.Cond
+}
+
+type pendingRevision struct {
+	ctx            context.Context
+	path, old, new string
+}
+
+// NewHistoryService creates the history store and registers it with the
+// config and DHCP services so their writes are recorded.
+func NewHistoryService(clientset kubernetes.Interface, namespace string, configService *ConfigService, dhcpService *DHCPService) *HistoryService {
+	maxRevisions := 50
+	if v, err := strconv.Atoi(os.Getenv("HISTORY_MAX_REVISIONS")); err == nil && v > 0 {
+		maxRevisions = v
+	}
+	h := &HistoryService{
+		clientset:    clientset,
+		namespace:    namespace,
+		maxRevisions: maxRevisions,
+		files:        make(map[string]string),
+	}
+	h.drained = sync.NewCond(&h.queueMu)
+	if configService != nil {
+		h.configService = configService
+		configService.history = h
+		h.files[filepath.Base(configService.configFile)] = configService.configFile
+		h.files[filepath.Base(configService.customDNSFile)] = configService.customDNSFile
+		h.files[filepath.Base(configService.forwardersFile)] = configService.forwardersFile
+	}
+	if dhcpService != nil {
+		dhcpService.history = h
+		h.files[filepath.Base(dhcpService.reservationsFile)] = dhcpService.reservationsFile
+		h.files[filepath.Base(dhcpService.rangesFile)] = dhcpService.rangesFile
+		h.files[filepath.Base(dhcpService.optionsFile)] = dhcpService.optionsFile
+		h.files[filepath.Base(dhcpService.pxeFile)] = dhcpService.pxeFile
+	}
+	return h
+}
+
+// GetHistory returns revisions newest first, without their content. An empty
+// file returns revisions of all files.
+func (h *HistoryService) GetHistory(ctx context.Context, file string) ([]Revision, error) {
+	h.wait()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.load(ctx); err != nil {
+		return nil, err
+	}
+
+	revisions := []Revision{}
+	for i := len(h.revisions) - 1; i >= 0; i-- {
+		rev := h.revisions[i]
+		if file != "" && rev.File != file {
+			continue
+		}
+		rev.Content = ""
+		revisions = append(revisions, rev)
+	}
+	return revisions, nil
+}
+
+// GetRevision returns a single revision including its content.
+func (h *HistoryService) GetRevision(ctx context.Context, rev int) (*Revision, error) {
+	h.wait()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.load(ctx); err != nil {
+		return nil, err
+	}
+	for _, r := range h.revisions {
+		if r.Rev == rev {
+			return &r, nil
+		}
+	}
+	return nil, fmt.Errorf("revision %d %w", rev, ErrNotFound)
+}
+
+// Restore writes the content of a revision back to its file. The restore is
+// itself recorded as a new revision.
+func (h *HistoryService) Restore(ctx context.Context, rev int) (*Revision, error) {
+	target, err := h.GetRevision(ctx, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	path, ok := h.files[target.File]
+	if !ok {
+		return nil, fmt.Errorf("file %s is not tracked", target.File)
+	}
+
+	if h.configService != nil {
+		if err := h.configService.validateDnsmasqConfig(target.Content); err != nil {
+			return nil, fmt.Errorf("dnsmasq configuration validation failed: %v", err)
+		}
+	}
+
+	old, err := h.restoreFile(path, target.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record after the writes queued before the restore
+	h.wait()
+	return h.recordRevision(ctx, path, old, target.Content, fmt.Sprintf("Restore revision %d", rev))
+}
+
+func (h *HistoryService) restoreFile(path, content string) (string, error) {
+	unlock := lockFile(path)
+	defer unlock()
+
+	old, err := readFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(old), writeFileAtomic(path, []byte(content))
+}
+
+// record queues a revision for a write to path. Revisions are recorded in
+// the order of the writes, in the background: failures are logged rather
+// than returned so that history problems never block configuration changes.
+func (h *HistoryService) record(ctx context.Context, path, old, new string) {
+	if h == nil || old == new {
+		return
+	}
+	if tracked, ok := h.files[filepath.Base(path)]; !ok || tracked != path {
+		return
+	}
+
+	h.queueMu.Lock()
+	defer h.queueMu.Unlock()
+	// The revision outlives the request making the change
+	h.queue = append(h.queue, pendingRevision{ctx: context.WithoutCancel(ctx), path: path, old: old, new: new})
+	if !h.draining {
+		h.draining = true
+		go h.drain()
+	}
+}
+
+// drain records the queued revisions until the queue is empty.
+func (h *HistoryService) drain() {
+	for {
+		h.queueMu.Lock()
+		if len(h.queue) == 0 {
+			h.draining = false
+			h.drained.Broadcast()
+			h.queueMu.Unlock()
+			return
+		}
+		p := h.queue[0]
+		h.queue = h.queue[1:]
+		h.queueMu.Unlock()
+
+		if _, err := h.recordRevision(p.ctx, p.path, p.old, p.new, ""); err != nil {
+			fmt.Printf("WARN: failed to record history for %s: %v\n", p.path, err)
+		}
+	}
+}
+
+// wait returns once the queued revisions are recorded.
+func (h *HistoryService) wait() {
+	h.queueMu.Lock()
+	defer h.queueMu.Unlock()
+	for h.draining {
+		h.drained.Wait()
+	}
+}
+
+func (h *HistoryService) recordRevision(ctx context.Context, path, old, new, message string) (*Revision, error) {
+	if old == new {
+		return nil, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.load(ctx); err != nil {
+		return nil, err
+	}
+
+	file := filepath.Base(path)
+	now := time.Now().UTC()
+
+	// Keep the state before the first recorded change so it can be restored
+	hasBaseline := false
+	for _, r := range h.revisions {
+		if r.File == file {
+			hasBaseline = true
+			break
+		}
+	}
+	if !hasBaseline {
+		h.append(Revision{File: file, Author: "system", Timestamp: now, Message: "Initial state", Content: old})
+	}
+
+	rev := h.append(Revision{
+		File:      file,
+		Author:    authorFrom(ctx),
+		Timestamp: now,
+		Message:   message,
+		Diff:      unifiedDiff(file, old, new),
+		Content:   new,
+	})
+
+	if err := h.save(ctx); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+func (h *HistoryService) append(rev Revision) Revision {
+	rev.Rev = 1
+	if n := len(h.revisions); n > 0 {
+		rev.Rev = h.revisions[n-1].Rev + 1
+	}
+	h.revisions = append(h.revisions, rev)
+	return rev
+}
+
+// save prunes the oldest revisions and stores the history in its ConfigMap.
+func (h *HistoryService) save(ctx context.Context) error {
+	if len(h.revisions) > h.maxRevisions {
+		h.revisions = h.revisions[len(h.revisions)-h.maxRevisions:]
+	}
+
+	for {
+		data, err := json.Marshal(h.revisions)
+		if err != nil {
+			return err
+		}
+		if len(data) <= maxHistorySize || len(h.revisions) <= 1 {
+			return UpdateConfigMapWithRetry(ctx, h.clientset, h.namespace, historyConfigMap, historyKey, string(data))
+		}
+		h.revisions = h.revisions[1:]
+	}
+}
+
+func (h *HistoryService) load(ctx context.Context) error {
+	if h.loaded {
+		return nil
+	}
+
+	configMap, err := h.clientset.CoreV1().ConfigMaps(h.namespace).Get(ctx, historyConfigMap, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if data, ok := configMap.Data[historyKey]; ok && data != "" {
+			if err := json.Unmarshal([]byte(data), &h.revisions); err != nil {
+				return fmt.Errorf("failed to parse history: %v", err)
+			}
+		}
+	}
+
+	h.loaded = true
+	return nil
+}
+
+func unifiedDiff(file, old, new string) string {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(old),
+		B:        difflib.SplitLines(new),
+		FromFile: "a/" + file,
+		ToFile:   "b/" + file,
+		Context:  3,
+	})
+	if err != nil {
+		return ""
+	}
+	return diff
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHistoryService(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "history-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	customDNSFile := filepath.Join(tmpDir, "custom.conf")
+	reservationsFile := filepath.Join(tmpDir, "reservations.conf")
+	assert.NoError(t, os.WriteFile(customDNSFile, []byte("address=/a.lan/192.168.1.10\n"), 0644))
+
+	os.Setenv("DNSMASQ_CONFIG_FILE", filepath.Join(tmpDir, "dnsmasq.conf"))
+	os.Setenv("DNSMASQ_CUSTOM_DNS_FILE", customDNSFile)
+	os.Setenv("DHCP_RESERVATIONS_FILE", reservationsFile)
+	defer os.Unsetenv("DNSMASQ_CONFIG_FILE")
+	defer os.Unsetenv("DNSMASQ_CUSTOM_DNS_FILE")
+	defer os.Unsetenv("DHCP_RESERVATIONS_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+	dhcpService := NewDHCPService(clientset, "default", configService)
+	historyService := NewHistoryService(clientset, "default", configService, dhcpService)
+	ctx := WithAuthor(context.Background(), "alice")
+
+	assert.NoError(t, configService.CreateDNSEntry(ctx, DNSEntry{Type: "address", Domain: "b.lan", Value: "192.168.1.11"}))
+	_, err = dhcpService.AddReservation(ctx, DHCPReservation{MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.1.50", Hostname: "nas"})
+	assert.NoError(t, err)
+
+	revisions, err := historyService.GetHistory(ctx, "custom.conf")
+	assert.NoError(t, err)
+	assert.Len(t, revisions, 2)
+	// Newest first, the initial state is kept so it can be restored
+	assert.Equal(t, "alice", revisions[0].Author)
+	assert.Contains(t, revisions[0].Diff, "+address=/b.lan/192.168.1.11")
+	assert.Empty(t, revisions[0].Content)
+	assert.Equal(t, "Initial state", revisions[1].Message)
+
+	all, err := historyService.GetHistory(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, all, 4)
+
+	// Roll custom.conf back to its initial state
+	restored, err := historyService.Restore(WithAuthor(context.Background(), "bob"), revisions[1].Rev)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", restored.Author)
+	content, err := os.ReadFile(customDNSFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "address=/a.lan/192.168.1.10\n", string(content))
+
+	_, err = historyService.Restore(ctx, 999)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// History survives restarts through its ConfigMap
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, historyConfigMap, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, cm.Data[historyKey], "bob")
+
+	reloaded := NewHistoryService(clientset, "default", nil, nil)
+	all, err = reloaded.GetHistory(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, all, 5)
+	rev, err := reloaded.GetRevision(ctx, restored.Rev)
+	assert.NoError(t, err)
+	assert.Equal(t, "address=/a.lan/192.168.1.10\n", rev.Content)
+}
+
+func TestHistoryService_Prune(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "dnsmasq.conf")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	os.Setenv("DNSMASQ_CONFIG_FILE", tmpFile.Name())
+	os.Setenv("HISTORY_MAX_REVISIONS", "3")
+	defer os.Unsetenv("DNSMASQ_CONFIG_FILE")
+	defer os.Unsetenv("HISTORY_MAX_REVISIONS")
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+	historyService := NewHistoryService(clientset, "default", configService, nil)
+	ctx := context.Background()
+
+	for _, config := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		assert.NoError(t, configService.UpdateConfig(ctx, config))
+	}
+	// Unchanged content is not recorded
+	assert.NoError(t, configService.UpdateConfig(ctx, "d\n"))
+
+	revisions, err := historyService.GetHistory(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, revisions, 3)
+	assert.Equal(t, 5, revisions[0].Rev)
+	assert.Equal(t, "anonymous", revisions[0].Author)
+}
+
+func TestHistoryService_RecordInBackground(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "dnsmasq.conf")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	os.Setenv("DNSMASQ_CONFIG_FILE", tmpFile.Name())
+	defer os.Unsetenv("DNSMASQ_CONFIG_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+	historyService := NewHistoryService(clientset, "default", configService, nil)
+	ctx, cancel := context.WithCancel(WithAuthor(context.Background(), "alice"))
+
+	// Writes don't wait for the history, even when it is busy saving
+	historyService.mu.Lock()
+	assert.NoError(t, configService.UpdateConfig(ctx, "a\n"))
+	assert.NoError(t, configService.UpdateConfig(ctx, "b\n"))
+	cancel()
+	historyService.mu.Unlock()
+
+	// Revisions are recorded in order once the request is done
+	revisions, err := historyService.GetHistory(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Len(t, revisions, 3)
+	assert.Contains(t, revisions[0].Diff, "+b")
+	assert.Equal(t, "alice", revisions[0].Author)
+	assert.Contains(t, revisions[1].Diff, "+a")
+}
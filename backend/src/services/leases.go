@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// dnsmasqProgram is the supervisor program running dnsmasq, see supervisord.conf
+const dnsmasqProgram = "dnsmasq"
+
+// Methods of applying lease changes
+const (
+	// LeaseChangeSupervisor edits the lease file while dnsmasq is stopped
+	LeaseChangeSupervisor = "supervisor"
+	// LeaseChangeFile edits the lease file in place. dnsmasq keeps its
+	// leases in memory and may write the old lease back.
+	LeaseChangeFile = "file"
+)
+
+// ServiceController starts and stops supervisor programs.
+type ServiceController interface {
+	StartService(serviceName string) error
+	StopService(serviceName string) error
+}
+
+// ServiceSignaler sends signals to supervisor programs.
+type ServiceSignaler interface {
+	SignalService(serviceName, signal string) error
+}
+
+// ServiceSupervisor starts, stops and signals supervisor programs.
+type ServiceSupervisor interface {
+	ServiceController
+	ServiceSignaler
+}
+
+// restartDnsmasq restarts dnsmasq so it loads its configuration again, which
+// it only reads when it starts.
+func restartDnsmasq(supervisor ServiceController) error {
+	if err := supervisor.StopService(dnsmasqProgram); err != nil {
+		return fmt.Errorf("failed to stop dnsmasq: %v", err)
+	}
+	if err := supervisor.StartService(dnsmasqProgram); err != nil {
+		return fmt.Errorf("failed to start dnsmasq: %v", err)
+	}
+	return nil
+}
+
+// SetSupervisor makes lease changes stop dnsmasq while the lease file is
+// edited, so dnsmasq loads the edited file when it starts again instead of
+// overwriting it with the leases it holds in memory.
+func (s *DHCPService) SetSupervisor(supervisor ServiceController) {
+	s.supervisor = supervisor
+}
+
+// LeaseChange reports how a lease change was applied.
+type LeaseChange struct {
+	Method string `json:"method"`
+	// Verified is set when the lease file, re-read after the change, shows
+	// the change. A client renewing its lease right away can undo a release.
+	// Changes made in place (LeaseChangeFile) are never verified.
+	Verified bool `json:"verified"`
+}
+
+// UpdateLease changes the MAC address, IP address and hostname of a lease.
+// The expiry time, the client ID and the IAID of DHCPv6 leases are kept.
+func (s *DHCPService) UpdateLease(ctx context.Context, oldLease, newLease DHCPLease) (LeaseChange, error) {
+	edit := func(content string) (string, error) {
+		lines := strings.Split(content, "\n")
+		var newLines []string
+		found := false
+		ipv6 := false
+
+		for _, line := range lines {
+			if isDUIDLine(line) {
+				ipv6 = true
+			}
+			if lease, ok := parseLease(line, ipv6); ok && sameLease(lease, oldLease) {
+				found = true
+				parts := strings.Fields(line)
+				// parts[1] is the MAC address, or the IAID of DHCPv6 leases
+				client := parts[1]
+				if !ipv6 {
+					client = strings.ToUpper(newLease.MACAddress)
+				}
+				// Preserve timestamp (parts[0]) and clientid (parts[4] if exists)
+				newLine := fmt.Sprintf("%s %s %s %s", parts[0], client, newLease.IPAddress, newLease.Hostname)
+				if len(parts) > 4 {
+					newLine += " " + strings.Join(parts[4:], " ")
+				}
+				newLines = append(newLines, newLine)
+				continue
+			}
+			newLines = append(newLines, line)
+		}
+
+		if !found {
+			return "", fmt.Errorf("lease %w", ErrNotFound)
+		}
+		return strings.Join(newLines, "\n"), nil
+	}
+	verify := func(leases []DHCPLease) bool {
+		for _, lease := range leases {
+			if lease.IPAddress == newLease.IPAddress && lease.Hostname == newLease.Hostname &&
+				(lease.IPv6 || strings.EqualFold(lease.MACAddress, newLease.MACAddress)) {
+				return true
+			}
+		}
+		return false
+	}
+	return s.changeLeases(ctx, edit, verify)
+}
+
+// DeleteLease releases a lease so its address can be handed out again.
+func (s *DHCPService) DeleteLease(ctx context.Context, lease DHCPLease) (LeaseChange, error) {
+	edit := func(content string) (string, error) {
+		lines := strings.Split(content, "\n")
+		var newLines []string
+		found := false
+
+		ipv6 := false
+		for _, line := range lines {
+			if isDUIDLine(line) {
+				ipv6 = true
+			}
+			if l, ok := parseLease(line, ipv6); ok && sameLease(l, lease) {
+				found = true
+				continue // Skip adding this line
+			}
+			newLines = append(newLines, line)
+		}
+
+		if !found {
+			return "", fmt.Errorf("lease %w", ErrNotFound)
+		}
+		return strings.Join(newLines, "\n"), nil
+	}
+	verify := func(leases []DHCPLease) bool {
+		for _, l := range leases {
+			if sameLease(l, lease) {
+				return false
+			}
+		}
+		return true
+	}
+	return s.changeLeases(ctx, edit, verify)
+}
+
+// changeLeases applies edit to the lease file. With a supervisor, dnsmasq is
+// stopped for the edit and started again. The lease file is then re-read,
+// once dnsmasq had time to load it, and passed to verify to check that the
+// change took effect. Without a supervisor dnsmasq keeps the old leases in
+// memory, and the change is left unverified.
+func (s *DHCPService) changeLeases(ctx context.Context, edit func(content string) (string, error), verify func([]DHCPLease) bool) (LeaseChange, error) {
+	change, err := s.writeLeases(edit)
+	if err != nil || change.Method != LeaseChangeSupervisor {
+		return change, err
+	}
+
+	// The lease file is not locked while dnsmasq loads it, so other changes
+	// and the lease sync don't wait for the settle time
+	if s.leaseSettle > 0 {
+		select {
+		case <-ctx.Done():
+			return change, nil
+		case <-time.After(s.leaseSettle):
+		}
+	}
+	leases, err := s.GetLeases(ctx)
+	if err != nil {
+		fmt.Printf("WARN: Failed to re-read lease file: %v\n", err)
+		return change, nil
+	}
+	change.Verified = verify(leases)
+	if !change.Verified {
+		fmt.Printf("WARN: Lease change did not take effect in %s\n", s.leaseFile)
+	}
+	return change, nil
+}
+
+// writeLeases applies edit to the lease file under its lock, stopping dnsmasq
+// for the write when there is a supervisor.
+func (s *DHCPService) writeLeases(edit func(content string) (string, error)) (LeaseChange, error) {
+	unlock := lockFile(s.leaseFile)
+	defer unlock()
+
+	// Check the lease exists before stopping dnsmasq
+	content, err := os.ReadFile(s.leaseFile)
+	if err != nil {
+		return LeaseChange{}, err
+	}
+	newContent, err := edit(string(content))
+	if err != nil {
+		return LeaseChange{}, err
+	}
+
+	change := LeaseChange{Method: LeaseChangeFile}
+	if s.supervisor == nil {
+		// dnsmasq is running and holds the lease file open
+		return change, writeFileInPlace(s.leaseFile, []byte(newContent))
+	}
+
+	change.Method = LeaseChangeSupervisor
+	if err := s.supervisor.StopService(dnsmasqProgram); err != nil {
+		return change, fmt.Errorf("failed to stop dnsmasq: %v", err)
+	}
+	// dnsmasq may have changed the file before it stopped
+	content, err = os.ReadFile(s.leaseFile)
+	if err == nil {
+		newContent, err = edit(string(content))
+	}
+	if err == nil {
+		err = writeFileAtomic(s.leaseFile, []byte(newContent))
+	}
+	if startErr := s.supervisor.StartService(dnsmasqProgram); startErr != nil {
+		return change, fmt.Errorf("failed to start dnsmasq: %v", startErr)
+	}
+	return change, err
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeSupervisor records the calls made to it and runs onStart when dnsmasq
+// is started.
+type fakeSupervisor struct {
+	mu      sync.Mutex
+	calls   []string
+	onStart func()
+}
+
+func (f *fakeSupervisor) StartService(name string) error {
+	f.record("start " + name)
+	if f.onStart != nil {
+		f.onStart()
+	}
+	return nil
+}
+
+func (f *fakeSupervisor) StopService(name string) error {
+	f.record("stop " + name)
+	return nil
+}
+
+func (f *fakeSupervisor) SignalService(name, signal string) error {
+	f.record("signal " + signal + " " + name)
+	return nil
+}
+
+func (f *fakeSupervisor) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+// called returns the calls made so far, for tests calling from goroutines
+func (f *fakeSupervisor) called() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+func TestDHCPService_DeleteLease_Supervisor(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "leases")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	leaseFile := filepath.Join(tmpDir, "dnsmasq.leases")
+	leases := "1677721600 00:0c:29:1c:bf:3b 192.168.1.100 laptop *\n1677721600 00:0c:29:1c:bf:3c 192.168.1.101 phone *\n"
+	assert.NoError(t, os.WriteFile(leaseFile, []byte(leases), 0644))
+	os.Setenv("DHCP_LEASE_FILE", leaseFile)
+	defer os.Unsetenv("DHCP_LEASE_FILE")
+
+	dhcpService := NewDHCPService(fake.NewSimpleClientset(), "default", nil)
+	dhcpService.leaseSettle = 0
+	supervisor := &fakeSupervisor{}
+	dhcpService.SetSupervisor(supervisor)
+	ctx := context.Background()
+
+	laptop := DHCPLease{MACAddress: "00:0C:29:1C:BF:3B", IPAddress: "192.168.1.100", Hostname: "laptop"}
+	change, err := dhcpService.DeleteLease(ctx, laptop)
+	assert.NoError(t, err)
+	assert.Equal(t, LeaseChange{Method: LeaseChangeSupervisor, Verified: true}, change)
+	assert.Equal(t, []string{"stop dnsmasq", "start dnsmasq"}, supervisor.calls)
+
+	content, err := os.ReadFile(leaseFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "1677721600 00:0c:29:1c:bf:3c 192.168.1.101 phone *\n", string(content))
+
+	// dnsmasq isn't touched for unknown leases
+	supervisor.calls = nil
+	_, err = dhcpService.DeleteLease(ctx, laptop)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Nil(t, supervisor.calls)
+
+	// A lease that is back after dnsmasq started is reported
+	supervisor.onStart = func() {
+		assert.NoError(t, os.WriteFile(leaseFile, []byte(leases), 0644))
+	}
+	assert.NoError(t, os.WriteFile(leaseFile, []byte(leases), 0644))
+	change, err = dhcpService.DeleteLease(ctx, laptop)
+	assert.NoError(t, err)
+	assert.False(t, change.Verified)
+
+	// The lease file is unlocked while dnsmasq loads it
+	supervisor.onStart = nil
+	dhcpService.leaseSettle = time.Minute
+	assert.NoError(t, os.WriteFile(leaseFile, []byte(leases), 0644))
+	settling, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := dhcpService.DeleteLease(settling, laptop)
+		assert.NoError(t, err)
+	}()
+	assert.Eventually(t, func() bool {
+		return len(supervisor.called()) == 4
+	}, time.Second, 10*time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		unlock := lockFile(leaseFile)
+		unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("lease file still locked while dnsmasq settles")
+	}
+	cancel()
+	<-done
+}
+
+func TestDHCPService_UpdateLease(t *testing.T) {
+	leaseFile, err := os.CreateTemp("", "leases")
+	assert.NoError(t, err)
+	defer os.Remove(leaseFile.Name())
+	_, err = leaseFile.WriteString("1677721600 00:0c:29:1c:bf:3b 192.168.1.100 laptop 01:00:0c:29:1c:bf:3b\n")
+	assert.NoError(t, err)
+	leaseFile.Close()
+	os.Setenv("DHCP_LEASE_FILE", leaseFile.Name())
+	defer os.Unsetenv("DHCP_LEASE_FILE")
+
+	dhcpService := NewDHCPService(fake.NewSimpleClientset(), "default", nil)
+	change, err := dhcpService.UpdateLease(context.Background(),
+		DHCPLease{MACAddress: "00:0C:29:1C:BF:3B", IPAddress: "192.168.1.100", Hostname: "laptop"},
+		DHCPLease{MACAddress: "00:0c:29:1c:bf:3b", IPAddress: "192.168.1.100", Hostname: "work-laptop"})
+	assert.NoError(t, err)
+	// dnsmasq keeps the old lease in memory, so the change is not verified
+	assert.Equal(t, LeaseChange{Method: LeaseChangeFile}, change)
+
+	content, err := os.ReadFile(leaseFile.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "1677721600 00:0C:29:1C:BF:3B 192.168.1.100 work-laptop 01:00:0c:29:1c:bf:3b\n", string(content))
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// embeddedOUI is the vendor database built into the binary, in the format
+// written by FormatOUI.
+//
+//go:embed oui.txt
+var embeddedOUI string
+
+var (
+	ouiOnce sync.Once
+	ouiDB   map[string]string
+
+	// ouiTxtRe matches the assignment lines of the IEEE oui.txt file
+	ouiTxtRe = regexp.MustCompile(`^([0-9A-Fa-f]{2})-([0-9A-Fa-f]{2})-([0-9A-Fa-f]{2})\s+\(hex\)\s+(.+)$`)
+	// ouiLineRe matches the lines of FormatOUI
+	ouiLineRe = regexp.MustCompile(`^([0-9A-F]{6,9})\t(.+)$`)
+)
+
+// ieeeRegistrationAuthority holds the MA-L blocks split into MA-M and MA-S
+// assignments. It is no vendor, the assignments are in mam.csv and oui36.csv.
+const ieeeRegistrationAuthority = "IEEE Registration Authority"
+
+// ouiDatabase returns the embedded vendor database, extended or overridden by
+// the file in OUI_FILE.
+func ouiDatabase() map[string]string {
+	ouiOnce.Do(func() {
+		db, err := ParseOUI(strings.NewReader(embeddedOUI))
+		if err != nil {
+			fmt.Printf("ERROR: Failed to parse embedded OUI database: %v\n", err)
+			db = map[string]string{}
+		}
+		if path := os.Getenv("OUI_FILE"); path != "" {
+			if extra, err := loadOUIFile(path); err != nil {
+				fmt.Printf("WARN: Failed to load OUI database %s: %v\n", path, err)
+			} else {
+				for prefix, vendor := range extra {
+					db[prefix] = vendor
+				}
+				fmt.Printf("INFO: Loaded %d OUI assignments from %s\n", len(extra), path)
+			}
+		}
+		ouiDB = db
+	})
+	return ouiDB
+}
+
+func loadOUIFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseOUI(file)
+}
+
+// ParseOUI reads a vendor database, mapping hex prefixes of 6 (MA-L), 7
+// (MA-M) or 9 (MA-S) digits to vendors. It reads the IEEE oui.txt and CSV
+// registry files (oui.csv, mam.csv, oui36.csv) as well as FormatOUI output.
+func ParseOUI(r io.Reader) (map[string]string, error) {
+	reader := bufio.NewReader(r)
+	head, _ := reader.Peek(len("Registry,"))
+	if string(head) == "Registry," {
+		return parseOUICSV(reader)
+	}
+
+	db := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := ouiTxtRe.FindStringSubmatch(line); m != nil {
+			addOUI(db, strings.ToUpper(m[1]+m[2]+m[3]), m[4])
+		} else if m := ouiLineRe.FindStringSubmatch(scanner.Text()); m != nil {
+			addOUI(db, m[1], m[2])
+		}
+	}
+	return db, scanner.Err()
+}
+
+func parseOUICSV(r io.Reader) (map[string]string, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	db := make(map[string]string)
+	for _, record := range records[1:] {
+		if len(record) < 3 {
+			continue
+		}
+		prefix := strings.ToUpper(strings.TrimSpace(record[1]))
+		if _, err := strconv.ParseUint(prefix, 16, 64); err != nil || len(prefix) < 6 || len(prefix) > 9 {
+			continue
+		}
+		addOUI(db, prefix, record[2])
+	}
+	return db, nil
+}
+
+func addOUI(db map[string]string, prefix, vendor string) {
+	if vendor = cleanVendor(vendor); vendor != ieeeRegistrationAuthority {
+		db[prefix] = vendor
+	}
+}
+
+func cleanVendor(vendor string) string {
+	return strings.Join(strings.Fields(vendor), " ")
+}
+
+// FormatOUI writes a vendor database as sorted "<prefix>\t<vendor>" lines,
+// the format of the embedded database.
+func FormatOUI(db map[string]string) string {
+	lines := make([]string, 0, len(db))
+	for prefix, vendor := range db {
+		lines = append(lines, prefix+"\t"+vendor)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// LookupVendor returns the vendor of a MAC address and whether the address is
+// locally administered. Clients use locally administered, usually random,
+// addresses for privacy. They have no vendor.
+func LookupVendor(mac string) (vendor string, randomized bool) {
+	// Reservations may prefix the hardware type, as in 1-00:11:22:33:44:55
+	if i := strings.Index(mac, "-"); i > 0 && i <= 2 && strings.Contains(mac, ":") {
+		mac = mac[i+1:]
+	}
+	hex := strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+	if len(hex) < 6 {
+		return "", false
+	}
+	first, err := strconv.ParseUint(hex[:2], 16, 8)
+	if err != nil {
+		return "", false
+	}
+	if first&0x02 != 0 {
+		return "", true
+	}
+	db := ouiDatabase()
+	for _, n := range []int{9, 7, 6} {
+		if len(hex) >= n {
+			if vendor, ok := db[hex[:n]]; ok {
+				return vendor, false
+			}
+		}
+	}
+	return "", false
+}
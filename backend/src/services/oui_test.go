@@ -0,0 +1,73 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOUI(t *testing.T) {
+	txt := `OUI/MA-L                                                    Organization
+company_id                                                  Organization
+                                                            Address
+
+A4-83-E7   (hex)		Apple, Inc.
+A483E7     (base 16)		Apple, Inc.
+				1 Infinite Loop
+
+70-B3-D5   (hex)		IEEE Registration Authority
+`
+	db, err := ParseOUI(strings.NewReader(txt))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"A483E7": "Apple, Inc."}, db)
+
+	csv := `Registry,Assignment,Organization Name,Organization Address
+MA-L,A483E7,"Apple, Inc.",1 Infinite Loop Cupertino CA US 95014
+MA-M,70B3D51,Example  Devices,Somewhere
+`
+	db, err = ParseOUI(strings.NewReader(csv))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"A483E7": "Apple, Inc.", "70B3D51": "Example Devices"}, db)
+
+	// FormatOUI output reads back
+	db, err = ParseOUI(strings.NewReader(FormatOUI(db)))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"A483E7": "Apple, Inc.", "70B3D51": "Example Devices"}, db)
+}
+
+func TestLookupVendor(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "oui")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ouiFile := filepath.Join(tmpDir, "oui.txt")
+	assert.NoError(t, os.WriteFile(ouiFile, []byte("70B3D51\tExample Devices\n"), 0644))
+	os.Setenv("OUI_FILE", ouiFile)
+	defer os.Unsetenv("OUI_FILE")
+	ouiOnce = sync.Once{}
+	defer func() { ouiOnce = sync.Once{} }()
+
+	vendor, randomized := LookupVendor("a4:83:e7:12:34:56")
+	assert.Equal(t, "Apple, Inc.", vendor)
+	assert.False(t, randomized)
+
+	vendor, _ = LookupVendor("1-00:0C:29:1C:BF:3B")
+	assert.Equal(t, "VMware, Inc.", vendor)
+	vendor, _ = LookupVendor("70:B3:D5:1A:BC:DE")
+	assert.Equal(t, "Example Devices", vendor)
+	vendor, _ = LookupVendor("70:B3:D5:2A:BC:DE")
+	assert.Empty(t, vendor)
+
+	// The locally administered bit is set
+	vendor, randomized = LookupVendor("DA:A1:19:00:00:01")
+	assert.Empty(t, vendor)
+	assert.True(t, randomized)
+
+	vendor, randomized = LookupVendor("00:11:*:*:*:*")
+	assert.Empty(t, vendor)
+	assert.False(t, randomized)
+}
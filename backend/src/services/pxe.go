@@ -0,0 +1,495 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pxeHeader is the first line of the managed PXE file
+const pxeHeader = "# Managed by dnsmasq-k8s through /api/v1/pxe"
+
+// PXEArch is a client architecture PXE profiles can target. Clients are
+// matched on the client-arch option (RFC 4578).
+type PXEArch struct {
+	// Name is the tag set on matching clients
+	Name       string `json:"name"`
+	ClientArch []int  `json:"client_arch"`
+	// CSA is the client system architecture of pxe-service menu entries
+	CSA         string `json:"csa"`
+	Description string `json:"description"`
+}
+
+var pxeArchitectures = []PXEArch{
+	{"bios", []int{0}, "x86PC", "x86 BIOS"},
+	{"efi-ia32", []int{6}, "IA32_EFI", "32-bit x86 UEFI"},
+	{"efi-x86_64", []int{7, 9}, "X86-64_EFI", "64-bit x86 UEFI"},
+	{"efi-arm32", []int{10}, "ARM32_EFI", "32-bit ARM UEFI"},
+	{"efi-arm64", []int{11}, "ARM64_EFI", "64-bit ARM UEFI"},
+}
+
+// PXEArchitectures returns the architectures PXE profiles can target.
+func PXEArchitectures() []PXEArch {
+	return append([]PXEArch{}, pxeArchitectures...)
+}
+
+func lookupPXEArch(match func(PXEArch) bool) (PXEArch, bool) {
+	for _, arch := range pxeArchitectures {
+		if match(arch) {
+			return arch, true
+		}
+	}
+	return PXEArch{}, false
+}
+
+// PXEConfig is the network boot configuration of the managed PXE file.
+type PXEConfig struct {
+	PXESettings
+	Profiles []PXEProfile `json:"profiles"`
+	// Extra holds lines of the file that are not modeled. They are written
+	// back unchanged.
+	Extra []string `json:"extra,omitempty"`
+}
+
+// PXESettings configures the built-in TFTP server.
+type PXESettings struct {
+	TFTPEnabled bool `json:"tftp_enabled"`
+	// TFTPRoot is the directory served over TFTP. Boot files of profiles
+	// served by the built-in server must exist in it.
+	TFTPRoot string `json:"tftp_root"`
+}
+
+// PXEProfile is the boot file sent to the clients of an architecture, of a
+// set of tags or both.
+//
+//	dhcp-match=set:efi-x86_64,option:client-arch,7
+//	dhcp-boot=tag:efi-x86_64,tag:lab,grubx64.efi           boot file
+//	pxe-service=tag:lab,x86PC,"Install Linux",pxelinux     PXE menu entry
+type PXEProfile struct {
+	// ID identifies the profile's line in the PXE file, see entryID
+	ID string `json:"id"`
+	// Arch is the name of the architecture, see PXEArchitectures. Empty
+	// matches all architectures.
+	Arch string   `json:"arch,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+	// BootFile is relative to the TFTP root. The .0 suffix of BIOS menu
+	// entries is added by dnsmasq and left out.
+	BootFile string `json:"boot_file"`
+	// ServerName and ServerAddress make clients load the boot file from
+	// another TFTP server
+	ServerName    string `json:"server_name,omitempty"`
+	ServerAddress string `json:"server_address,omitempty"`
+	// MenuText makes the profile an entry of the PXE boot menu (pxe-service)
+	// rather than the boot file of the DHCP reply (dhcp-boot). Menu entries
+	// need an architecture.
+	MenuText string `json:"menu_text,omitempty"`
+	Comment  string `json:"comment"`
+}
+
+// local reports whether the profile's boot file is served by the built-in
+// TFTP server.
+func (p PXEProfile) local() bool {
+	return p.ServerName == "" && p.ServerAddress == ""
+}
+
+// GetPXE returns the network boot configuration.
+func (s *DHCPService) GetPXE(ctx context.Context) (*PXEConfig, error) {
+	content, err := readFile(s.pxeFile)
+	if err != nil {
+		return nil, err
+	}
+	return parsePXE(string(content)), nil
+}
+
+// PXEETag returns the ETag of the PXE file.
+func (s *DHCPService) PXEETag(ctx context.Context) (string, error) {
+	return fileETag(s.pxeFile)
+}
+
+// GetPXEProfile returns the profile with the given ID.
+func (s *DHCPService) GetPXEProfile(ctx context.Context, id string) (*PXEProfile, error) {
+	config, err := s.GetPXE(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range config.Profiles {
+		if p.ID == id {
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("PXE profile %w", ErrNotFound)
+}
+
+// UpdatePXESettings enables or disables the TFTP server and sets its root.
+// The boot files of all profiles served by it must exist in the new root.
+func (s *DHCPService) UpdatePXESettings(ctx context.Context, settings PXESettings) error {
+	if settings.TFTPEnabled && settings.TFTPRoot == "" {
+		settings.TFTPRoot = s.tftpRoot
+	}
+	if err := ValidatePXESettings(settings); err != nil {
+		return err
+	}
+	_, err := s.modifyPXE(ctx, func(config *PXEConfig) (int, error) {
+		config.PXESettings = settings
+		for _, p := range config.Profiles {
+			if err := checkBootFile(config.PXESettings, p); err != nil {
+				return -1, err
+			}
+		}
+		return -1, nil
+	})
+	return err
+}
+
+// AddPXEProfile appends a profile and returns its ID.
+func (s *DHCPService) AddPXEProfile(ctx context.Context, profile PXEProfile) (string, error) {
+	if err := ValidatePXEProfile(profile); err != nil {
+		return "", err
+	}
+	return s.modifyPXE(ctx, func(config *PXEConfig) (int, error) {
+		if err := checkBootFile(config.PXESettings, profile); err != nil {
+			return -1, err
+		}
+		config.Profiles = append(config.Profiles, profile)
+		return len(config.Profiles) - 1, nil
+	})
+}
+
+// UpdatePXEProfile replaces the profile with the given ID and returns the ID
+// of the updated profile.
+func (s *DHCPService) UpdatePXEProfile(ctx context.Context, id string, profile PXEProfile) (string, error) {
+	if err := ValidatePXEProfile(profile); err != nil {
+		return "", err
+	}
+	return s.modifyPXE(ctx, func(config *PXEConfig) (int, error) {
+		i := slices.IndexFunc(config.Profiles, func(p PXEProfile) bool { return p.ID == id })
+		if i < 0 {
+			return -1, fmt.Errorf("PXE profile %w", ErrNotFound)
+		}
+		if err := checkBootFile(config.PXESettings, profile); err != nil {
+			return -1, err
+		}
+		config.Profiles[i] = profile
+		return i, nil
+	})
+}
+
+func (s *DHCPService) DeletePXEProfile(ctx context.Context, id string) error {
+	_, err := s.modifyPXE(ctx, func(config *PXEConfig) (int, error) {
+		i := slices.IndexFunc(config.Profiles, func(p PXEProfile) bool { return p.ID == id })
+		if i < 0 {
+			return -1, fmt.Errorf("PXE profile %w", ErrNotFound)
+		}
+		config.Profiles = slices.Delete(config.Profiles, i, i+1)
+		return -1, nil
+	})
+	return err
+}
+
+// modifyPXE applies edit to the PXE configuration and renders it to the PXE
+// file. edit returns the index of the changed profile, whose new ID is
+// returned, or -1.
+func (s *DHCPService) modifyPXE(ctx context.Context, edit func(config *PXEConfig) (int, error)) (string, error) {
+	unlock := lockFile(s.pxeFile)
+	defer unlock()
+
+	content, err := readFile(s.pxeFile)
+	if err != nil {
+		return "", err
+	}
+	config := parsePXE(string(content))
+	changed, err := edit(config)
+	if err != nil {
+		return "", err
+	}
+
+	newContent := formatPXE(config)
+	if s.configService != nil {
+		if err := s.configService.validateDnsmasqConfig(newContent); err != nil {
+			return "", fmt.Errorf("%w: dnsmasq configuration validation failed: %v", ErrInvalid, err)
+		}
+	}
+	if err := writeFileAtomic(s.pxeFile, []byte(newContent)); err != nil {
+		return "", err
+	}
+	s.history.record(ctx, s.pxeFile, string(content), newContent)
+
+	if changed < 0 {
+		return "", nil
+	}
+	return parsePXE(newContent).Profiles[changed].ID, nil
+}
+
+// ValidatePXESettings checks the TFTP settings.
+func ValidatePXESettings(settings PXESettings) error {
+	if settings.TFTPRoot != "" && (!filepath.IsAbs(settings.TFTPRoot) || strings.ContainsAny(settings.TFTPRoot, ",\"\r\n")) {
+		return fmt.Errorf("invalid tftp_root: %q must be an absolute path", settings.TFTPRoot)
+	}
+	if settings.TFTPEnabled && settings.TFTPRoot == "" {
+		return fmt.Errorf("tftp_root is required to enable TFTP")
+	}
+	return nil
+}
+
+// ValidatePXEProfile checks the fields of a profile. Whether its boot file
+// exists is checked when it is written.
+func ValidatePXEProfile(p PXEProfile) error {
+	if p.Arch != "" {
+		if _, ok := lookupPXEArch(func(a PXEArch) bool { return a.Name == p.Arch }); !ok {
+			return fmt.Errorf("unknown architecture: %s", p.Arch)
+		}
+	}
+	for _, tag := range p.Tags {
+		if !tagNameRe.MatchString(strings.TrimPrefix(tag, "!")) {
+			return fmt.Errorf("invalid tag: %q", tag)
+		}
+	}
+	if p.BootFile == "" {
+		return fmt.Errorf("boot_file is required")
+	}
+	if strings.ContainsAny(p.BootFile, ",\"\r\n ") || filepath.IsAbs(p.BootFile) ||
+		slices.Contains(strings.Split(filepath.ToSlash(p.BootFile), "/"), "..") {
+		return fmt.Errorf("invalid boot_file: %q must be a path relative to the TFTP root", p.BootFile)
+	}
+	if strings.ContainsAny(p.ServerName, ",\"\r\n ") {
+		return fmt.Errorf("invalid server_name: %q", p.ServerName)
+	}
+	if p.ServerAddress != "" {
+		if ip := net.ParseIP(p.ServerAddress); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid server_address: %q is not an IPv4 address", p.ServerAddress)
+		}
+	}
+	if p.MenuText != "" {
+		if p.Arch == "" {
+			return fmt.Errorf("menu entries need an architecture")
+		}
+		if p.ServerName != "" {
+			return fmt.Errorf("menu entries take a server_address, not a server_name")
+		}
+		if strings.ContainsAny(p.MenuText, "\"\r\n") {
+			return fmt.Errorf("invalid menu_text: %q", p.MenuText)
+		}
+	}
+	return nil
+}
+
+// checkBootFile checks that the boot file of a profile served by the
+// built-in TFTP server exists under the TFTP root.
+func checkBootFile(settings PXESettings, p PXEProfile) error {
+	if !settings.TFTPEnabled || !p.local() {
+		return nil
+	}
+	file := p.BootFile
+	if p.MenuText != "" && p.Arch == "bios" {
+		file += ".0"
+	}
+	info, err := os.Stat(filepath.Join(settings.TFTPRoot, file))
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: boot file %s does not exist in %s", ErrInvalid, file, settings.TFTPRoot)
+	}
+	return nil
+}
+
+// formatPXE renders the PXE file: the TFTP settings, the dhcp-match lines of
+// the architectures used by boot files, the profiles and the extra lines.
+func formatPXE(config *PXEConfig) string {
+	lines := []string{pxeHeader}
+	if config.TFTPEnabled {
+		lines = append(lines, "enable-tftp")
+	}
+	if config.TFTPRoot != "" {
+		lines = append(lines, "tftp-root="+config.TFTPRoot)
+	}
+	for _, arch := range pxeArchitectures {
+		used := slices.ContainsFunc(config.Profiles, func(p PXEProfile) bool {
+			return p.Arch == arch.Name && p.MenuText == ""
+		})
+		if used {
+			for _, n := range arch.ClientArch {
+				lines = append(lines, fmt.Sprintf("dhcp-match=set:%s,option:client-arch,%d", arch.Name, n))
+			}
+		}
+	}
+	for _, p := range config.Profiles {
+		line := formatPXEProfile(p)
+		if p.Comment != "" {
+			line += " # " + p.Comment
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, config.Extra...)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// formatPXEProfile renders a profile as
+// dhcp-boot=[tag:<arch>,][tag:..,]<file>[,<server name>[,<server address>]]
+// or pxe-service=[tag:..,]<csa>,"<menu text>",<file>[,<server address>]
+func formatPXEProfile(p PXEProfile) string {
+	var parts []string
+	if p.MenuText != "" {
+		for _, tag := range p.Tags {
+			parts = append(parts, "tag:"+tag)
+		}
+		arch, _ := lookupPXEArch(func(a PXEArch) bool { return a.Name == p.Arch })
+		parts = append(parts, arch.CSA, `"`+p.MenuText+`"`, p.BootFile)
+		if p.ServerAddress != "" {
+			parts = append(parts, p.ServerAddress)
+		}
+		return "pxe-service=" + strings.Join(parts, ",")
+	}
+
+	if p.Arch != "" {
+		parts = append(parts, "tag:"+p.Arch)
+	}
+	for _, tag := range p.Tags {
+		parts = append(parts, "tag:"+tag)
+	}
+	parts = append(parts, p.BootFile)
+	if p.ServerName != "" || p.ServerAddress != "" {
+		parts = append(parts, p.ServerName)
+	}
+	if p.ServerAddress != "" {
+		parts = append(parts, p.ServerAddress)
+	}
+	return "dhcp-boot=" + strings.Join(parts, ",")
+}
+
+// parsePXE parses the PXE file. The dhcp-match lines of known architectures
+// are dropped as formatPXE generates them.
+func parsePXE(content string) *PXEConfig {
+	config := &PXEConfig{Profiles: []PXEProfile{}}
+	ids := idAssigner{}
+	for _, line := range strings.Split(content, "\n") {
+		directive, comment := splitComment(line)
+		key, value, _ := strings.Cut(directive, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch {
+		case directive == "" && (comment == "" || line == pxeHeader):
+			continue
+		case key == "enable-tftp" && value == "":
+			config.TFTPEnabled = true
+			continue
+		case key == "tftp-root":
+			config.TFTPRoot = value
+			continue
+		case key == "dhcp-match" && isArchMatch(value):
+			continue
+		}
+		if p, ok := parsePXEProfile(directive); ok {
+			p.ID = ids.next(directive)
+			p.Comment = comment
+			config.Profiles = append(config.Profiles, p)
+			continue
+		}
+		config.Extra = append(config.Extra, line)
+	}
+	return config
+}
+
+// isArchMatch reports whether a dhcp-match value is one formatPXE generates.
+func isArchMatch(value string) bool {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 || parts[1] != "option:client-arch" {
+		return false
+	}
+	n, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return false
+	}
+	_, ok := lookupPXEArch(func(a PXEArch) bool {
+		return "set:"+a.Name == parts[0] && slices.Contains(a.ClientArch, n)
+	})
+	return ok
+}
+
+// parsePXEProfile parses a dhcp-boot or pxe-service directive. Menu entries
+// with a boot service type instead of a file are not supported.
+func parsePXEProfile(directive string) (PXEProfile, bool) {
+	key, value, ok := strings.Cut(directive, "=")
+	key = strings.TrimSpace(key)
+	if !ok || (key != "dhcp-boot" && key != "pxe-service") {
+		return PXEProfile{}, false
+	}
+
+	var p PXEProfile
+	parts := splitOptionValues(value)
+	i := 0
+	for ; i < len(parts) && strings.HasPrefix(parts[i], "tag:"); i++ {
+		tag := strings.TrimPrefix(parts[i], "tag:")
+		if _, known := lookupPXEArch(func(a PXEArch) bool { return a.Name == tag }); known && p.Arch == "" && key == "dhcp-boot" {
+			p.Arch = tag
+			continue
+		}
+		p.Tags = append(p.Tags, tag)
+	}
+	rest := parts[i:]
+
+	if key == "pxe-service" {
+		if len(rest) < 3 || len(rest) > 4 {
+			return PXEProfile{}, false
+		}
+		arch, ok := lookupPXEArch(func(a PXEArch) bool { return strings.EqualFold(a.CSA, rest[0]) })
+		if !ok {
+			return PXEProfile{}, false
+		}
+		if _, err := strconv.Atoi(rest[2]); err == nil {
+			return PXEProfile{}, false
+		}
+		p.Arch = arch.Name
+		p.MenuText = strings.Trim(rest[1], `"`)
+		p.BootFile = rest[2]
+		if len(rest) == 4 {
+			p.ServerAddress = rest[3]
+		}
+		return p, p.MenuText != ""
+	}
+
+	if len(rest) == 0 || len(rest) > 3 || rest[0] == "" {
+		return PXEProfile{}, false
+	}
+	p.BootFile = rest[0]
+	if len(rest) > 1 {
+		p.ServerName = rest[1]
+	}
+	if len(rest) > 2 {
+		p.ServerAddress = rest[2]
+	}
+	return p, true
+}
+
+func (s *DHCPService) StartPXESync(ctx context.Context) {
+	startFileSync(ctx, s.pxeFile, "PXE", s.RestorePXEFromConfigMap, s.SyncPXEToConfigMap)
+}
+
+func (s *DHCPService) SyncPXEToConfigMap(ctx context.Context) error {
+	content, err := os.ReadFile(s.pxeFile)
+	if err != nil {
+		return fmt.Errorf("failed to read PXE file: %v", err)
+	}
+
+	return UpdateConfigMapWithRetry(ctx, s.clientset, s.namespace, "dnsmasq-pxe", "pxe.conf", string(content))
+}
+
+func (s *DHCPService) RestorePXEFromConfigMap(ctx context.Context) error {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, "dnsmasq-pxe", metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil // Nothing to restore
+		}
+		return err
+	}
+
+	if content, ok := configMap.Data["pxe.conf"]; ok {
+		return writeFile(s.pxeFile, []byte(content))
+	}
+	return nil
+}
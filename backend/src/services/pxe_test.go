@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParsePXE(t *testing.T) {
+	content := pxeHeader + `
+enable-tftp
+tftp-root=/srv/tftp
+dhcp-match=set:bios,option:client-arch,0
+dhcp-match=set:efi-x86_64,option:client-arch,7
+dhcp-match=set:efi-x86_64,option:client-arch,9
+dhcp-boot=tag:bios,pxelinux.0
+dhcp-boot=tag:efi-x86_64,tag:!lab,efi/grubx64.efi,boot,192.168.1.5 # UEFI
+pxe-service=tag:lab,x86PC,"Install Linux",pxelinux
+pxe-service=x86PC,"Boot from disk",0
+dhcp-match=set:ipxe,175
+`
+	config := parsePXE(content)
+	assert.True(t, config.TFTPEnabled)
+	assert.Equal(t, "/srv/tftp", config.TFTPRoot)
+	assert.Len(t, config.Profiles, 3)
+	assert.Equal(t, "bios", config.Profiles[0].Arch)
+	assert.Equal(t, "pxelinux.0", config.Profiles[0].BootFile)
+	assert.Equal(t, PXEProfile{
+		ID:            config.Profiles[1].ID,
+		Arch:          "efi-x86_64",
+		Tags:          []string{"!lab"},
+		BootFile:      "efi/grubx64.efi",
+		ServerName:    "boot",
+		ServerAddress: "192.168.1.5",
+		Comment:       "UEFI",
+	}, config.Profiles[1])
+	assert.Equal(t, "bios", config.Profiles[2].Arch)
+	assert.Equal(t, []string{"lab"}, config.Profiles[2].Tags)
+	assert.Equal(t, "Install Linux", config.Profiles[2].MenuText)
+	// Menu entries booting a service type and unknown matches are kept as is
+	assert.Equal(t, []string{`pxe-service=x86PC,"Boot from disk",0`, "dhcp-match=set:ipxe,175"}, config.Extra)
+
+	// Rendering drops matches no boot file uses and keeps the IDs
+	config.Profiles = config.Profiles[1:]
+	formatted := formatPXE(config)
+	assert.NotContains(t, formatted, "set:bios")
+	assert.Contains(t, formatted, "dhcp-match=set:efi-x86_64,option:client-arch,9\n")
+	reparsed := parsePXE(formatted)
+	assert.Equal(t, config.Profiles, reparsed.Profiles)
+	assert.Equal(t, config.Extra, reparsed.Extra)
+}
+
+func TestValidatePXEProfile(t *testing.T) {
+	valid := []PXEProfile{
+		{BootFile: "pxelinux.0"},
+		{Arch: "efi-arm64", Tags: []string{"lab", "!guest"}, BootFile: "arm64/grubaa64.efi"},
+		{Arch: "bios", BootFile: "pxelinux.0", ServerName: "boot", ServerAddress: "192.168.1.5"},
+		{Arch: "bios", MenuText: "Install Linux", BootFile: "pxelinux"},
+	}
+	for _, p := range valid {
+		assert.NoError(t, ValidatePXEProfile(p), p)
+	}
+
+	invalid := []PXEProfile{
+		{},
+		{Arch: "sparc", BootFile: "boot.img"},
+		{Tags: []string{"a,b"}, BootFile: "pxelinux.0"},
+		{BootFile: "../etc/passwd"},
+		{BootFile: "/pxelinux.0"},
+		{BootFile: "pxelinux.0", ServerAddress: "fd00::1"},
+		{MenuText: "Install Linux", BootFile: "pxelinux"},
+		{Arch: "bios", MenuText: "Install Linux", BootFile: "pxelinux", ServerName: "boot"},
+		{Arch: "bios", MenuText: `Say "hi"`, BootFile: "pxelinux"},
+	}
+	for _, p := range invalid {
+		assert.Error(t, ValidatePXEProfile(p), p)
+	}
+}
+
+func TestDHCPService_PXE(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pxe")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	tftpRoot := filepath.Join(tmpDir, "tftp")
+	assert.NoError(t, os.MkdirAll(filepath.Join(tftpRoot, "efi"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(tftpRoot, "efi", "grubx64.efi"), []byte("grub"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(tftpRoot, "pxelinux.0"), []byte("pxelinux"), 0644))
+	pxeFile := filepath.Join(tmpDir, "pxe.conf")
+	os.Setenv("DHCP_PXE_FILE", pxeFile)
+	defer os.Unsetenv("DHCP_PXE_FILE")
+	os.Setenv("TFTP_ROOT", tftpRoot)
+	defer os.Unsetenv("TFTP_ROOT")
+
+	dhcpService := NewDHCPService(fake.NewSimpleClientset(), "default", nil)
+	ctx := context.Background()
+
+	// TFTP is enabled with the default root
+	assert.NoError(t, dhcpService.UpdatePXESettings(ctx, PXESettings{TFTPEnabled: true}))
+
+	uefiID, err := dhcpService.AddPXEProfile(ctx, PXEProfile{Arch: "efi-x86_64", BootFile: "efi/grubx64.efi", Comment: "UEFI"})
+	assert.NoError(t, err)
+	_, err = dhcpService.AddPXEProfile(ctx, PXEProfile{Arch: "bios", Tags: []string{"lab"}, MenuText: "Install Linux", BootFile: "pxelinux"})
+	assert.NoError(t, err)
+
+	// Boot files served by the built-in server must exist
+	_, err = dhcpService.AddPXEProfile(ctx, PXEProfile{Arch: "efi-arm64", BootFile: "grubaa64.efi"})
+	assert.ErrorIs(t, err, ErrInvalid)
+	_, err = dhcpService.AddPXEProfile(ctx, PXEProfile{Arch: "efi-arm64", BootFile: "grubaa64.efi", ServerAddress: "192.168.1.5"})
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(pxeFile)
+	assert.NoError(t, err)
+	assert.Equal(t, pxeHeader+"\nenable-tftp\ntftp-root="+tftpRoot+"\n"+
+		"dhcp-match=set:efi-x86_64,option:client-arch,7\n"+
+		"dhcp-match=set:efi-x86_64,option:client-arch,9\n"+
+		"dhcp-match=set:efi-arm64,option:client-arch,11\n"+
+		"dhcp-boot=tag:efi-x86_64,efi/grubx64.efi # UEFI\n"+
+		`pxe-service=tag:lab,x86PC,"Install Linux",pxelinux`+"\n"+
+		"dhcp-boot=tag:efi-arm64,grubaa64.efi,,192.168.1.5\n", string(content))
+
+	// The profiles must still find their boot files in a new root
+	assert.ErrorIs(t, dhcpService.UpdatePXESettings(ctx, PXESettings{TFTPEnabled: true, TFTPRoot: tmpDir}), ErrInvalid)
+
+	newID, err := dhcpService.UpdatePXEProfile(ctx, uefiID, PXEProfile{Arch: "efi-x86_64", Tags: []string{"lab"}, BootFile: "efi/grubx64.efi"})
+	assert.NoError(t, err)
+	profile, err := dhcpService.GetPXEProfile(ctx, newID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lab"}, profile.Tags)
+	_, err = dhcpService.GetPXEProfile(ctx, uefiID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, dhcpService.DeletePXEProfile(ctx, newID))
+	assert.ErrorIs(t, dhcpService.DeletePXEProfile(ctx, newID), ErrNotFound)
+
+	// Disabling TFTP keeps the profiles
+	assert.NoError(t, dhcpService.UpdatePXESettings(ctx, PXESettings{TFTPRoot: tftpRoot}))
+	config, err := dhcpService.GetPXE(ctx)
+	assert.NoError(t, err)
+	assert.False(t, config.TFTPEnabled)
+	assert.Len(t, config.Profiles, 2)
+}
@@ -0,0 +1,432 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DHCPRange is a dhcp-range directive managed in the ranges file.
+//
+//	dhcp-range=set:lan,192.168.1.100,192.168.1.200,255.255.255.0,12h
+//	dhcp-range=tag:iot,192.168.2.0,static,255.255.255.0,infinite
+//	dhcp-range=::100,::1ff,constructor:eth0,slaac,64,1h
+type DHCPRange struct {
+	// ID identifies the range's line in the ranges file, see entryID
+	ID string `json:"id"`
+	// IPv6 is derived from Start
+	IPv6  bool   `json:"ipv6"`
+	Start string `json:"start"`
+	// End is empty for static and proxy ranges, which cover the subnet of Start
+	End string `json:"end,omitempty"`
+	// Netmask and Broadcast only apply to IPv4, PrefixLength to IPv6
+	Netmask      string `json:"netmask,omitempty"`
+	Broadcast    string `json:"broadcast,omitempty"`
+	PrefixLength int    `json:"prefix_length,omitempty"`
+	// LeaseTime is a duration such as 45m, 12h, 1w or infinite
+	LeaseTime string `json:"lease_time,omitempty"`
+	// Tags must all be set on a request for the range to be used, a leading
+	// '!' matches requests without the tag
+	Tags []string `json:"tags,omitempty"`
+	// SetTag is set on requests served from this range
+	SetTag string `json:"set_tag,omitempty"`
+	// Mode is static, proxy (IPv4), or a comma separated list of ra-only,
+	// slaac, ra-names, ra-stateless, ra-advrouter and off-link (IPv6)
+	Mode string `json:"mode,omitempty"`
+	// Interface builds the range from the addresses of an interface
+	// (constructor:<interface>), Start and End then only hold the host part
+	Interface string `json:"interface,omitempty"`
+	Comment   string `json:"comment"`
+}
+
+var (
+	ipv4RangeModes = map[string]bool{"static": true, "proxy": true}
+	ipv6RangeModes = map[string]bool{"static": true, "ra-only": true, "slaac": true, "ra-names": true, "ra-stateless": true, "ra-advrouter": true, "off-link": true}
+
+	leaseTimeRe = regexp.MustCompile(`^([0-9]+[smhdw]?|infinite|deprecated)$`)
+	tagNameRe   = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+func (s *DHCPService) GetRanges(ctx context.Context) ([]DHCPRange, error) {
+	content, err := readFile(s.rangesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := []DHCPRange{}
+	ids := idAssigner{}
+	for _, line := range strings.Split(string(content), "\n") {
+		directive, comment := splitComment(line)
+		if r, ok := parseRange(directive); ok {
+			r.Comment = comment
+			r.ID = ids.next(directive)
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges, nil
+}
+
+// RangesETag returns the ETag of the ranges file.
+func (s *DHCPService) RangesETag(ctx context.Context) (string, error) {
+	return fileETag(s.rangesFile)
+}
+
+// GetRange returns the range with the given ID.
+func (s *DHCPService) GetRange(ctx context.Context, id string) (*DHCPRange, error) {
+	ranges, err := s.GetRanges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ranges {
+		if r.ID == id {
+			return &r, nil
+		}
+	}
+	return nil, fmt.Errorf("range %w", ErrNotFound)
+}
+
+// AddRange appends a range and returns its ID.
+func (s *DHCPService) AddRange(ctx context.Context, r DHCPRange) (string, error) {
+	return s.modifyRange(ctx, "", r, false)
+}
+
+// UpdateRange replaces the range with the given ID and returns the ID of the
+// updated range.
+func (s *DHCPService) UpdateRange(ctx context.Context, id string, r DHCPRange) (string, error) {
+	return s.modifyRange(ctx, id, r, false)
+}
+
+func (s *DHCPService) DeleteRange(ctx context.Context, id string) error {
+	_, err := s.modifyRange(ctx, id, DHCPRange{}, true)
+	return err
+}
+
+// modifyRange replaces or removes the range with the given ID, or appends
+// newRange when id is empty. The result is checked for overlapping ranges
+// and validated by dnsmasq before it is written.
+func (s *DHCPService) modifyRange(ctx context.Context, id string, newRange DHCPRange, isDelete bool) (string, error) {
+	if !isDelete {
+		if err := ValidateRange(newRange); err != nil {
+			return "", err
+		}
+	}
+
+	unlock := lockFile(s.rangesFile)
+	defer unlock()
+
+	content, err := readFile(s.rangesFile)
+	if err != nil {
+		return "", err
+	}
+
+	newLine := formatRange(newRange)
+	if newRange.Comment != "" {
+		newLine += fmt.Sprintf(" # %s", newRange.Comment)
+	}
+
+	var newLines, others []string
+	var kept []DHCPRange
+	found := id == ""
+	newIdx := -1
+	ids := idAssigner{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		directive, _ := splitComment(line)
+		r, ok := parseRange(directive)
+		if ok && !found && ids.next(directive) == id {
+			found = true
+			if !isDelete {
+				newIdx = len(newLines)
+				newLines = append(newLines, newLine)
+			}
+			continue
+		}
+		if ok {
+			kept = append(kept, r)
+			others = append(others, directive)
+		}
+		newLines = append(newLines, line)
+	}
+
+	if !found {
+		return "", fmt.Errorf("range %w", ErrNotFound)
+	}
+
+	if id == "" {
+		// Append before the trailing newline
+		newIdx = len(newLines)
+		if newIdx > 0 && newLines[newIdx-1] == "" {
+			newIdx--
+		}
+		newLines = append(newLines[:newIdx], append([]string{newLine}, newLines[newIdx:]...)...)
+	}
+
+	if !isDelete {
+		for i, r := range kept {
+			if rangesOverlap(newRange, r) {
+				return "", fmt.Errorf("%w: range overlaps with %s", ErrConflict, others[i])
+			}
+		}
+	}
+
+	newContent := strings.Join(newLines, "\n")
+	if s.configService != nil {
+		if err := s.configService.validateDnsmasqConfig(newContent); err != nil {
+			return "", fmt.Errorf("dnsmasq configuration validation failed: %v", err)
+		}
+	}
+	if err := writeFileAtomic(s.rangesFile, []byte(newContent)); err != nil {
+		return "", err
+	}
+	s.history.record(ctx, s.rangesFile, string(content), newContent)
+
+	if isDelete {
+		return "", nil
+	}
+	ids = idAssigner{}
+	newID := ""
+	for _, line := range newLines[:newIdx+1] {
+		directive, _ := splitComment(line)
+		if _, ok := parseRange(directive); ok {
+			newID = ids.next(directive)
+		}
+	}
+	return newID, nil
+}
+
+// ValidateRange checks a range before it is written. Overlaps with other
+// ranges are checked when the ranges file is modified.
+func ValidateRange(r DHCPRange) error {
+	start := net.ParseIP(r.Start)
+	if start == nil {
+		return fmt.Errorf("invalid start address: %s", r.Start)
+	}
+	ipv6 := start.To4() == nil
+
+	if r.End != "" {
+		end := net.ParseIP(r.End)
+		if end == nil {
+			return fmt.Errorf("invalid end address: %s", r.End)
+		}
+		if (end.To4() == nil) != ipv6 {
+			return fmt.Errorf("start and end addresses must be of the same family")
+		}
+		if bytes.Compare(start.To16(), end.To16()) > 0 {
+			return fmt.Errorf("start address %s is after end address %s", r.Start, r.End)
+		}
+	}
+
+	modes, family := ipv4RangeModes, "IPv4"
+	if ipv6 {
+		modes, family = ipv6RangeModes, "IPv6"
+	}
+	if r.Mode != "" {
+		for _, mode := range strings.Split(r.Mode, ",") {
+			if !modes[strings.TrimSpace(mode)] {
+				return fmt.Errorf("unsupported mode for an %s range: %s", family, mode)
+			}
+		}
+	}
+	if r.End == "" && r.Mode == "" {
+		return fmt.Errorf("a range needs an end address or a mode")
+	}
+
+	if ipv6 {
+		if r.Netmask != "" || r.Broadcast != "" {
+			return fmt.Errorf("netmask and broadcast only apply to IPv4 ranges, use prefix_length")
+		}
+		if r.PrefixLength != 0 && (r.PrefixLength < 64 || r.PrefixLength > 128) {
+			return fmt.Errorf("invalid prefix length: %d, must be between 64 and 128", r.PrefixLength)
+		}
+	} else {
+		if r.PrefixLength != 0 {
+			return fmt.Errorf("prefix_length only applies to IPv6 ranges, use netmask")
+		}
+		if r.Netmask != "" {
+			mask := net.ParseIP(r.Netmask).To4()
+			if mask == nil {
+				return fmt.Errorf("invalid netmask: %s", r.Netmask)
+			}
+			if ones, bits := net.IPMask(mask).Size(); ones == 0 && bits == 0 {
+				return fmt.Errorf("invalid netmask: %s", r.Netmask)
+			}
+		}
+		if r.Broadcast != "" {
+			if r.Netmask == "" {
+				return fmt.Errorf("broadcast requires a netmask")
+			}
+			if ip := net.ParseIP(r.Broadcast); ip == nil || ip.To4() == nil {
+				return fmt.Errorf("invalid broadcast address: %s", r.Broadcast)
+			}
+		}
+	}
+
+	if r.LeaseTime != "" && !leaseTimeRe.MatchString(r.LeaseTime) {
+		return fmt.Errorf("invalid lease time: %s, expected a number with an optional s, m, h, d or w suffix, or infinite", r.LeaseTime)
+	}
+	for _, tag := range r.Tags {
+		// tag:!name matches requests without the tag
+		if !tagNameRe.MatchString(strings.TrimPrefix(tag, "!")) {
+			return fmt.Errorf("invalid tag: %q", tag)
+		}
+	}
+	if r.SetTag != "" && !tagNameRe.MatchString(r.SetTag) {
+		return fmt.Errorf("invalid tag: %q", r.SetTag)
+	}
+	if r.Interface != "" && !tagNameRe.MatchString(strings.TrimSuffix(r.Interface, "*")) {
+		return fmt.Errorf("invalid interface: %q", r.Interface)
+	}
+	return nil
+}
+
+// rangesOverlap reports whether two dynamic pools share addresses. Ranges
+// without an end address only reserve the subnet for static or proxy use and
+// never conflict with pools, and ranges built for different interfaces are
+// independent.
+func rangesOverlap(a, b DHCPRange) bool {
+	if a.Interface != b.Interface {
+		return false
+	}
+	aStart, bStart := net.ParseIP(a.Start), net.ParseIP(b.Start)
+	if aStart == nil || bStart == nil || (aStart.To4() == nil) != (bStart.To4() == nil) {
+		return false
+	}
+	if a.End == "" || b.End == "" {
+		return a.End == "" && b.End == "" && aStart.Equal(bStart)
+	}
+	aEnd, bEnd := net.ParseIP(a.End), net.ParseIP(b.End)
+	if aEnd == nil || bEnd == nil {
+		return false
+	}
+	return bytes.Compare(aStart.To16(), bEnd.To16()) <= 0 && bytes.Compare(bStart.To16(), aEnd.To16()) <= 0
+}
+
+// formatRange renders a range in dnsmasq order:
+// dhcp-range=[tag:..,][set:..,]start[,end][,constructor:..][,mode][,netmask[,broadcast]|,prefix][,lease]
+func formatRange(r DHCPRange) string {
+	var parts []string
+	for _, tag := range r.Tags {
+		parts = append(parts, "tag:"+tag)
+	}
+	if r.SetTag != "" {
+		parts = append(parts, "set:"+r.SetTag)
+	}
+	parts = append(parts, r.Start)
+	if r.End != "" {
+		parts = append(parts, r.End)
+	}
+	if r.Interface != "" {
+		parts = append(parts, "constructor:"+r.Interface)
+	}
+	if r.Mode != "" {
+		parts = append(parts, r.Mode)
+	}
+	if r.Netmask != "" {
+		parts = append(parts, r.Netmask)
+		if r.Broadcast != "" {
+			parts = append(parts, r.Broadcast)
+		}
+	}
+	prefix := r.PrefixLength
+	if prefix == 0 && r.LeaseTime != "" && net.ParseIP(r.Start) != nil && net.ParseIP(r.Start).To4() == nil {
+		// A bare lease time would be read as the prefix length, 64 is the default
+		prefix = 64
+	}
+	if prefix != 0 {
+		parts = append(parts, strconv.Itoa(prefix))
+	}
+	if r.LeaseTime != "" {
+		parts = append(parts, r.LeaseTime)
+	}
+	return "dhcp-range=" + strings.Join(parts, ",")
+}
+
+func parseRange(directive string) (DHCPRange, bool) {
+	key, value, ok := strings.Cut(directive, "=")
+	if !ok || strings.TrimSpace(key) != "dhcp-range" {
+		return DHCPRange{}, false
+	}
+
+	r := DHCPRange{}
+	var modes []string
+	addrs := 0
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		ip := net.ParseIP(part)
+		switch {
+		case strings.HasPrefix(part, "tag:"):
+			r.Tags = append(r.Tags, strings.TrimPrefix(part, "tag:"))
+		case strings.HasPrefix(part, "set:"):
+			r.SetTag = strings.TrimPrefix(part, "set:")
+		case strings.HasPrefix(part, "constructor:"):
+			r.Interface = strings.TrimPrefix(part, "constructor:")
+		case ip != nil && addrs == 0:
+			r.Start = part
+			r.IPv6 = ip.To4() == nil
+			addrs++
+		case ip != nil && addrs == 1 && len(modes) == 0 && r.Interface == "":
+			r.End = part
+			addrs++
+		case ip != nil && r.Netmask == "":
+			r.Netmask = part
+		case ip != nil:
+			r.Broadcast = part
+		case (r.IPv6 && ipv6RangeModes[part]) || (!r.IPv6 && ipv4RangeModes[part]):
+			modes = append(modes, part)
+		case r.IPv6 && r.PrefixLength == 0 && isDigits(part):
+			r.PrefixLength, _ = strconv.Atoi(part)
+		default:
+			r.LeaseTime = part
+		}
+	}
+	r.Mode = strings.Join(modes, ",")
+	return r, r.Start != ""
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *DHCPService) StartRangesSync(ctx context.Context) {
+	startFileSync(ctx, s.rangesFile, "ranges", s.RestoreRangesFromConfigMap, s.SyncRangesToConfigMap)
+}
+
+func (s *DHCPService) SyncRangesToConfigMap(ctx context.Context) error {
+	content, err := os.ReadFile(s.rangesFile)
+	if err != nil {
+		return fmt.Errorf("failed to read ranges file: %v", err)
+	}
+
+	return UpdateConfigMapWithRetry(ctx, s.clientset, s.namespace, "dnsmasq-ranges", "ranges.conf", string(content))
+}
+
+func (s *DHCPService) RestoreRangesFromConfigMap(ctx context.Context) error {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, "dnsmasq-ranges", metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil // Nothing to restore
+		}
+		return err
+	}
+
+	if content, ok := configMap.Data["ranges.conf"]; ok {
+		return writeFile(s.rangesFile, []byte(content))
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected DHCPRange
+	}{
+		{
+			"dhcp-range=set:lan,192.168.1.100,192.168.1.200,255.255.255.0,12h",
+			DHCPRange{Start: "192.168.1.100", End: "192.168.1.200", Netmask: "255.255.255.0", LeaseTime: "12h", SetTag: "lan"},
+		},
+		{
+			"dhcp-range=tag:iot,tag:!guest,192.168.2.0,static,255.255.255.0,192.168.2.255,infinite",
+			DHCPRange{Start: "192.168.2.0", Mode: "static", Netmask: "255.255.255.0", Broadcast: "192.168.2.255", LeaseTime: "infinite", Tags: []string{"iot", "!guest"}},
+		},
+		{
+			"dhcp-range=::100,::1ff,constructor:eth0,slaac,ra-names,64,1h",
+			DHCPRange{IPv6: true, Start: "::100", End: "::1ff", Interface: "eth0", Mode: "slaac,ra-names", PrefixLength: 64, LeaseTime: "1h"},
+		},
+		{
+			"dhcp-range=2001:db8::,ra-only",
+			DHCPRange{IPv6: true, Start: "2001:db8::", Mode: "ra-only"},
+		},
+	}
+	for _, tt := range tests {
+		r, ok := parseRange(tt.line)
+		assert.True(t, ok, tt.line)
+		assert.Equal(t, tt.expected, r)
+		assert.Equal(t, tt.line, formatRange(r))
+	}
+
+	_, ok := parseRange("dhcp-host=00:11:22:33:44:55,192.168.1.10")
+	assert.False(t, ok)
+
+	// A bare IPv6 lease time would be read back as the prefix length
+	assert.Equal(t, "dhcp-range=2001:db8::10,2001:db8::ff,64,3600", formatRange(DHCPRange{Start: "2001:db8::10", End: "2001:db8::ff", LeaseTime: "3600"}))
+}
+
+func TestValidateRange(t *testing.T) {
+	valid := []DHCPRange{
+		{Start: "192.168.1.100", End: "192.168.1.200", LeaseTime: "12h"},
+		{Start: "192.168.1.0", Mode: "proxy"},
+		{Start: "2001:db8::", Mode: "ra-only"},
+		{Start: "::1", End: "::400", Interface: "eth*", Mode: "slaac", PrefixLength: 64},
+	}
+	for _, r := range valid {
+		assert.NoError(t, ValidateRange(r), r.Start)
+	}
+
+	invalid := []DHCPRange{
+		{Start: "192.168.1.300", End: "192.168.1.200"},
+		{Start: "192.168.1.200", End: "192.168.1.100"},
+		{Start: "192.168.1.100", End: "2001:db8::1"},
+		{Start: "192.168.1.100"},
+		{Start: "192.168.1.0", Mode: "slaac"},
+		{Start: "2001:db8::", Mode: "proxy"},
+		{Start: "192.168.1.100", End: "192.168.1.200", Netmask: "255.0.255.0"},
+		{Start: "192.168.1.100", End: "192.168.1.200", PrefixLength: 64},
+		{Start: "2001:db8::1", End: "2001:db8::ff", Netmask: "255.255.255.0"},
+		{Start: "2001:db8::1", End: "2001:db8::ff", PrefixLength: 48},
+		{Start: "192.168.1.100", End: "192.168.1.200", LeaseTime: "12 hours"},
+		{Start: "192.168.1.100", End: "192.168.1.200", SetTag: "bad,tag"},
+	}
+	for _, r := range invalid {
+		assert.Error(t, ValidateRange(r), r)
+	}
+}
+
+func TestDHCPService_Ranges(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "ranges")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	rangesFile := filepath.Join(tmpDir, "ranges.conf")
+	assert.NoError(t, os.WriteFile(rangesFile, []byte("# Managed by dnsmasq-k8s\ndhcp-range=192.168.1.100,192.168.1.200,12h # lan\n"), 0644))
+	os.Setenv("DHCP_RANGES_FILE", rangesFile)
+	defer os.Unsetenv("DHCP_RANGES_FILE")
+
+	clientset := fake.NewSimpleClientset()
+	dhcpService := NewDHCPService(clientset, "default", nil)
+	ctx := context.Background()
+
+	ranges, err := dhcpService.GetRanges(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, ranges, 1)
+	assert.Equal(t, "lan", ranges[0].Comment)
+	lanID := ranges[0].ID
+
+	// Overlapping pools are rejected
+	_, err = dhcpService.AddRange(ctx, DHCPRange{Start: "192.168.1.150", End: "192.168.1.250"})
+	assert.ErrorIs(t, err, ErrConflict)
+
+	// Pools bound to another interface or of the other family do not overlap
+	iotID, err := dhcpService.AddRange(ctx, DHCPRange{Start: "192.168.2.10", End: "192.168.2.50", SetTag: "iot", Comment: "iot"})
+	assert.NoError(t, err)
+	_, err = dhcpService.AddRange(ctx, DHCPRange{Start: "::100", End: "::1ff", Interface: "eth0", Mode: "slaac"})
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(rangesFile)
+	assert.NoError(t, err)
+	assert.Equal(t, `# Managed by dnsmasq-k8s
+dhcp-range=192.168.1.100,192.168.1.200,12h # lan
+dhcp-range=set:iot,192.168.2.10,192.168.2.50 # iot
+dhcp-range=::100,::1ff,constructor:eth0,slaac
+`, string(content))
+
+	r, err := dhcpService.GetRange(ctx, iotID)
+	assert.NoError(t, err)
+	assert.Equal(t, "iot", r.SetTag)
+
+	// An update may overlap with the range it replaces
+	newID, err := dhcpService.UpdateRange(ctx, lanID, DHCPRange{Start: "192.168.1.50", End: "192.168.1.150", LeaseTime: "24h", Comment: "lan"})
+	assert.NoError(t, err)
+	r, err = dhcpService.GetRange(ctx, newID)
+	assert.NoError(t, err)
+	assert.Equal(t, "24h", r.LeaseTime)
+
+	_, err = dhcpService.UpdateRange(ctx, iotID, DHCPRange{Start: "192.168.1.140", End: "192.168.1.160"})
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = dhcpService.UpdateRange(ctx, "missing", DHCPRange{Start: "10.0.0.1", End: "10.0.0.10"})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, dhcpService.DeleteRange(ctx, iotID))
+	ranges, err = dhcpService.GetRanges(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, ranges, 2)
+	assert.ErrorIs(t, dhcpService.DeleteRange(ctx, iotID), ErrNotFound)
+
+	// The ranges file follows the ConfigMap like the reservations file
+	assert.NoError(t, dhcpService.SyncRangesToConfigMap(ctx))
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, "dnsmasq-ranges", metav1.GetOptions{})
+	assert.NoError(t, err)
+	content, err = os.ReadFile(rangesFile)
+	assert.NoError(t, err)
+	assert.Equal(t, string(content), cm.Data["ranges.conf"])
+}
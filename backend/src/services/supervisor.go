@@ -46,3 +46,22 @@ func (s *SupervisorService) RestartService(serviceName string) error {
 	fmt.Printf("INFO: Service %s restarted successfully\n", serviceName)
 	return nil
 }
+
+// SignalService sends a signal, such as HUP, to a program.
+func (s *SupervisorService) SignalService(serviceName, signal string) error {
+	fmt.Printf("INFO: Sending SIG%s to supervisor service: %s\n", signal, serviceName)
+	cmd := exec.Command("supervisorctl", "signal", signal, serviceName)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Printf("ERROR: Failed to signal service %s: %v, output: %s\n", serviceName, err, string(output))
+		return fmt.Errorf("failed to signal service: %v, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// Available reports whether supervisorctl can be run, which is the case in
+// the container image but usually not during development.
+func (s *SupervisorService) Available() bool {
+	_, err := exec.LookPath("supervisorctl")
+	return err == nil
+}
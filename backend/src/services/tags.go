@@ -0,0 +1,438 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	tagsConfigMap = "dnsmasq-tags"
+	tagsKey       = "tags.json"
+)
+
+// Tag is a DHCP tag. Tags are set by reservations (set:) and ranges, and
+// matched by ranges and options (tag:). Tags created through the API are
+// stored in the dnsmasq-tags ConfigMap, tags only found in the configuration
+// are listed with Defined set to false.
+type Tag struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Defined     bool     `json:"defined"`
+	Usage       TagUsage `json:"usage"`
+}
+
+// TagUsage lists the IDs of the reservations, ranges, DHCP options and PXE
+// profiles using a tag, and the 1-based lines of dnsmasq.conf that reference
+// it.
+type TagUsage struct {
+	Reservations []string `json:"reservations"`
+	Ranges       []string `json:"ranges"`
+	Options      []string `json:"options"`
+	PXE          []string `json:"pxe"`
+	Config       []int    `json:"config"`
+}
+
+// InUse reports whether anything references the tag.
+func (u TagUsage) InUse() bool {
+	return len(u.Reservations)+len(u.Ranges)+len(u.Options)+len(u.PXE)+len(u.Config) > 0
+}
+
+type tagDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// GetTags returns defined and used tags sorted by name.
+func (s *DHCPService) GetTags(ctx context.Context) ([]Tag, error) {
+	defs, err := s.loadTagDefinitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := s.tagUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]*Tag{}
+	for _, def := range defs {
+		tags[def.Name] = &Tag{Name: def.Name, Description: def.Description, Defined: true}
+	}
+	for name, u := range usage {
+		if _, ok := tags[name]; !ok {
+			tags[name] = &Tag{Name: name}
+		}
+		tags[name].Usage = *u
+	}
+
+	list := []Tag{}
+	for _, tag := range tags {
+		if tag.Usage.Reservations == nil {
+			tag.Usage = TagUsage{Reservations: []string{}, Ranges: []string{}, Options: []string{}, PXE: []string{}, Config: []int{}}
+		}
+		list = append(list, *tag)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// GetTag returns a single tag with its usage.
+func (s *DHCPService) GetTag(ctx context.Context, name string) (*Tag, error) {
+	tags, err := s.GetTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		if tag.Name == name {
+			return &tag, nil
+		}
+	}
+	return nil, fmt.Errorf("tag %w", ErrNotFound)
+}
+
+// CreateTag defines a new tag. A tag that is only used in the configuration
+// can be defined to give it a description.
+func (s *DHCPService) CreateTag(ctx context.Context, tag Tag) error {
+	if err := ValidateTagName(tag.Name); err != nil {
+		return err
+	}
+
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+
+	defs, err := s.loadTagDefinitions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, def := range defs {
+		if def.Name == tag.Name {
+			return fmt.Errorf("%w: tag %s already exists", ErrConflict, tag.Name)
+		}
+	}
+	defs = append(defs, tagDefinition{Name: tag.Name, Description: tag.Description})
+	return s.saveTagDefinitions(ctx, defs)
+}
+
+// UpdateTag updates the description of a tag and renames it when tag.Name
+// differs from name. Renames are applied to every reservation, range, option
+// and dnsmasq.conf line using the tag. Tags used by DHCPReservation resources
+// are renamed in the resources, the controller would revert the rename.
+func (s *DHCPService) UpdateTag(ctx context.Context, name string, tag Tag) error {
+	if err := ValidateTagName(tag.Name); err != nil {
+		return err
+	}
+
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+
+	defs, err := s.loadTagDefinitions(ctx)
+	if err != nil {
+		return err
+	}
+	usage, err := s.tagUsage()
+	if err != nil {
+		return err
+	}
+
+	idx := -1
+	for i, def := range defs {
+		if def.Name == name {
+			idx = i
+		}
+		if def.Name == tag.Name && tag.Name != name {
+			return fmt.Errorf("%w: tag %s already exists", ErrConflict, tag.Name)
+		}
+	}
+	if idx == -1 && usage[name] == nil {
+		return fmt.Errorf("tag %w", ErrNotFound)
+	}
+	if tag.Name != name && usage[tag.Name] != nil {
+		return fmt.Errorf("%w: tag %s is already used", ErrConflict, tag.Name)
+	}
+
+	if tag.Name != name {
+		if err := s.renameTag(ctx, name, tag.Name); err != nil {
+			return err
+		}
+	}
+
+	def := tagDefinition{Name: tag.Name, Description: tag.Description}
+	if idx == -1 {
+		defs = append(defs, def)
+	} else {
+		defs[idx] = def
+	}
+	return s.saveTagDefinitions(ctx, defs)
+}
+
+// DeleteTag removes a tag definition. Tags that are still in use cannot be
+// deleted.
+func (s *DHCPService) DeleteTag(ctx context.Context, name string) error {
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+
+	defs, err := s.loadTagDefinitions(ctx)
+	if err != nil {
+		return err
+	}
+	usage, err := s.tagUsage()
+	if err != nil {
+		return err
+	}
+	if u := usage[name]; u != nil {
+		return fmt.Errorf("%w: tag %s is used by %d reservation(s), %d range(s), %d option(s), %d PXE profile(s) and %d dnsmasq.conf line(s)",
+			ErrConflict, name, len(u.Reservations), len(u.Ranges), len(u.Options), len(u.PXE), len(u.Config))
+	}
+
+	kept := []tagDefinition{}
+	for _, def := range defs {
+		if def.Name != name {
+			kept = append(kept, def)
+		}
+	}
+	if len(kept) == len(defs) {
+		return fmt.Errorf("tag %w", ErrNotFound)
+	}
+	return s.saveTagDefinitions(ctx, kept)
+}
+
+// ValidateTagName checks that name can be used in set: and tag: prefixes.
+func ValidateTagName(name string) error {
+	if !tagNameRe.MatchString(name) {
+		return fmt.Errorf("invalid tag name: %q, only letters, digits, '-', '_' and '.' are allowed", name)
+	}
+	return nil
+}
+
+// tagFiles returns the files whose tags are managed, the configuration last.
+func (s *DHCPService) tagFiles() []string {
+	files := []string{s.reservationsFile, s.rangesFile, s.optionsFile, s.pxeFile}
+	if s.configService != nil {
+		files = append(files, s.configService.configFile)
+	}
+	return files
+}
+
+// tagUsage scans the managed files for tag references.
+func (s *DHCPService) tagUsage() (map[string]*TagUsage, error) {
+	usage := map[string]*TagUsage{}
+	get := func(tag string) *TagUsage {
+		if usage[tag] == nil {
+			usage[tag] = &TagUsage{Reservations: []string{}, Ranges: []string{}, Options: []string{}, PXE: []string{}, Config: []int{}}
+		}
+		return usage[tag]
+	}
+
+	scan := func(path string, parse func(directive string) bool, add func(u *TagUsage, id string)) error {
+		content, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		ids := idAssigner{}
+		for _, line := range strings.Split(string(content), "\n") {
+			directive, _ := splitComment(line)
+			if !parse(directive) {
+				continue
+			}
+			id := ids.next(directive)
+			for _, tag := range directiveTags(directive) {
+				add(get(tag), id)
+			}
+		}
+		return nil
+	}
+
+	if err := scan(s.reservationsFile, func(d string) bool { _, ok := parseReservation(d); return ok },
+		func(u *TagUsage, id string) { u.Reservations = appendUnique(u.Reservations, id) }); err != nil {
+		return nil, err
+	}
+	if err := scan(s.rangesFile, func(d string) bool { _, ok := parseRange(d); return ok },
+		func(u *TagUsage, id string) { u.Ranges = appendUnique(u.Ranges, id) }); err != nil {
+		return nil, err
+	}
+	if err := scan(s.optionsFile, func(d string) bool { _, ok := parseDHCPOption(d); return ok },
+		func(u *TagUsage, id string) { u.Options = appendUnique(u.Options, id) }); err != nil {
+		return nil, err
+	}
+	pxe, err := readFile(s.pxeFile)
+	if err != nil {
+		return nil, err
+	}
+	// Architecture tags are set by the PXE file itself
+	for _, p := range parsePXE(string(pxe)).Profiles {
+		for _, tag := range p.Tags {
+			u := get(strings.TrimPrefix(tag, "!"))
+			u.PXE = appendUnique(u.PXE, p.ID)
+		}
+	}
+
+	if s.configService != nil {
+		content, err := readFile(s.configService.configFile)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			directive, _ := splitComment(line)
+			for _, tag := range directiveTags(directive) {
+				u := get(tag)
+				if len(u.Config) == 0 || u.Config[len(u.Config)-1] != i+1 {
+					u.Config = append(u.Config, i+1)
+				}
+			}
+		}
+	}
+	return usage, nil
+}
+
+func appendUnique(ids []string, id string) []string {
+	if len(ids) > 0 && ids[len(ids)-1] == id {
+		return ids
+	}
+	return append(ids, id)
+}
+
+// tagPrefixes are the prefixes of tag references, net: is the deprecated
+// spelling of tag:
+var tagPrefixes = []string{"set:", "tag:!", "tag:", "net:!", "net:"}
+
+// isTagDirective reports whether key is a DHCP directive that takes tags.
+func isTagDirective(key string) bool {
+	return strings.HasPrefix(key, "dhcp-") || key == "tag-if" || key == "pxe-service"
+}
+
+// directiveTags returns the tags set or matched by a directive.
+func directiveTags(directive string) []string {
+	key, value, ok := strings.Cut(directive, "=")
+	if !ok || !isTagDirective(strings.TrimSpace(key)) {
+		return nil
+	}
+	var tags []string
+	for _, part := range splitOptionValues(value) {
+		for _, prefix := range tagPrefixes {
+			if strings.HasPrefix(part, prefix) {
+				if tag := strings.TrimPrefix(part, prefix); tag != "" {
+					tags = append(tags, tag)
+				}
+				break
+			}
+		}
+	}
+	return tags
+}
+
+// renameTagInDirective replaces references to oldName in a directive.
+func renameTagInDirective(directive, oldName, newName string) string {
+	key, value, ok := strings.Cut(directive, "=")
+	if !ok || !isTagDirective(strings.TrimSpace(key)) {
+		return directive
+	}
+	parts := splitOptionValues(value)
+	changed := false
+	for i, part := range parts {
+		for _, prefix := range tagPrefixes {
+			if part == prefix+oldName {
+				parts[i] = prefix + newName
+				changed = true
+				break
+			}
+		}
+	}
+	if !changed {
+		return directive
+	}
+	return key + "=" + strings.Join(parts, ",")
+}
+
+// renameTag rewrites the lines of the tag files that reference oldName,
+// keeping comments and unrelated lines as they are. Every file is rewritten
+// and validated before the first one is written, so a rename that is
+// rejected changes nothing.
+func (s *DHCPService) renameTag(ctx context.Context, oldName, newName string) error {
+	type rename struct {
+		path, old, new string
+	}
+	var renames []rename
+	for _, path := range s.tagFiles() {
+		unlock := lockFile(path)
+		defer unlock()
+
+		content, err := readFile(path)
+		if err != nil {
+			return err
+		}
+
+		lines := strings.Split(string(content), "\n")
+		managed := controllerManaged(lines)
+		changed := false
+		for i, line := range lines {
+			directive, _ := splitComment(line)
+			renamed := renameTagInDirective(directive, oldName, newName)
+			if renamed == directive {
+				continue
+			}
+			if managed[i] {
+				return fmt.Errorf("%w: tag %s is used by DHCPReservation resources, rename it in the resources first", ErrConflict, oldName)
+			}
+			lines[i] = strings.Replace(line, directive, renamed, 1)
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+
+		newContent := strings.Join(lines, "\n")
+		if s.configService != nil {
+			if err := s.configService.validateDnsmasqConfig(newContent); err != nil {
+				return fmt.Errorf("%w: dnsmasq configuration validation failed for %s: %v", ErrInvalid, path, err)
+			}
+		}
+		renames = append(renames, rename{path: path, old: string(content), new: newContent})
+	}
+
+	for i, r := range renames {
+		if err := writeFileAtomic(r.path, []byte(r.new)); err != nil {
+			// Put back the files already renamed
+			for _, done := range renames[:i] {
+				if err := writeFileAtomic(done.path, []byte(done.old)); err != nil {
+					fmt.Printf("ERROR: failed to restore %s: %v\n", done.path, err)
+				}
+			}
+			return fmt.Errorf("failed to rename tag in %s: %v", r.path, err)
+		}
+	}
+	for _, r := range renames {
+		s.history.record(ctx, r.path, r.old, r.new)
+	}
+	return nil
+}
+
+func (s *DHCPService) loadTagDefinitions(ctx context.Context) ([]tagDefinition, error) {
+	defs := []tagDefinition{}
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, tagsConfigMap, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return defs, nil
+		}
+		return nil, err
+	}
+	if content, ok := configMap.Data[tagsKey]; ok && content != "" {
+		if err := json.Unmarshal([]byte(content), &defs); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", tagsKey, err)
+		}
+	}
+	return defs, nil
+}
+
+func (s *DHCPService) saveTagDefinitions(ctx context.Context, defs []tagDefinition) error {
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	content, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return UpdateConfigMapWithRetry(ctx, s.clientset, s.namespace, tagsConfigMap, tagsKey, string(content))
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDirectiveTags(t *testing.T) {
+	assert.Equal(t, []string{"iot", "guest"}, directiveTags("dhcp-range=tag:iot,tag:!guest,192.168.2.10,192.168.2.50"))
+	assert.Equal(t, []string{"lab", "pxe"}, directiveTags("tag-if=set:lab,tag:pxe"))
+	assert.Equal(t, []string{"old"}, directiveTags("dhcp-option=net:old,3,10.0.0.1"))
+	assert.Nil(t, directiveTags("address=/tag:iot/10.0.0.1"))
+
+	assert.Equal(t, "dhcp-host=00:11:22:33:44:55,set:cameras,192.168.2.20,cam",
+		renameTagInDirective("dhcp-host=00:11:22:33:44:55,set:iot,192.168.2.20,cam", "iot", "cameras"))
+	assert.Equal(t, "dhcp-range=tag:!cameras,192.168.1.10,192.168.1.20",
+		renameTagInDirective("dhcp-range=tag:!iot,192.168.1.10,192.168.1.20", "iot", "cameras"))
+	// Only whole tag names are renamed
+	assert.Equal(t, "dhcp-option=tag:iot2,option:router,10.0.0.1",
+		renameTagInDirective("dhcp-option=tag:iot2,option:router,10.0.0.1", "iot", "cameras"))
+}
+
+func TestDHCPService_Tags(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tags")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	files := map[string]string{
+		"DNSMASQ_CONFIG_FILE":    "dhcp-option=tag:iot,option:dns-server,10.0.0.53\ndhcp-boot=tag:pxe,pxelinux.0 # netboot\n",
+		"DHCP_RESERVATIONS_FILE": "dhcp-host=00:11:22:33:44:55,set:iot,192.168.2.20,cam # front door\n",
+		"DHCP_RANGES_FILE":       "dhcp-range=set:iot,192.168.2.100,192.168.2.200,12h\n",
+		"DHCP_OPTIONS_FILE":      "dhcp-option=tag:iot,option:router,192.168.2.1\n",
+	}
+	for env, content := range files {
+		path := filepath.Join(tmpDir, env)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		os.Setenv(env, path)
+		defer os.Unsetenv(env)
+	}
+
+	clientset := fake.NewSimpleClientset()
+	configService := NewConfigService(clientset, "default")
+	dhcpService := NewDHCPService(clientset, "default", configService)
+	ctx := context.Background()
+
+	assert.NoError(t, dhcpService.CreateTag(ctx, Tag{Name: "printers", Description: "Office printers"}))
+	assert.ErrorIs(t, dhcpService.CreateTag(ctx, Tag{Name: "printers"}), ErrConflict)
+	assert.Error(t, dhcpService.CreateTag(ctx, Tag{Name: "bad tag"}))
+
+	tags, err := dhcpService.GetTags(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, tags, 3)
+	assert.Equal(t, "iot", tags[0].Name)
+	assert.False(t, tags[0].Defined)
+	assert.Len(t, tags[0].Usage.Reservations, 1)
+	assert.Len(t, tags[0].Usage.Ranges, 1)
+	assert.Len(t, tags[0].Usage.Options, 1)
+	assert.Equal(t, []int{1}, tags[0].Usage.Config)
+	assert.Equal(t, "printers", tags[1].Name)
+	assert.True(t, tags[1].Defined)
+	assert.False(t, tags[1].Usage.InUse())
+	assert.Equal(t, "pxe", tags[2].Name)
+
+	// Tags in use cannot be deleted or renamed onto another tag
+	assert.ErrorIs(t, dhcpService.DeleteTag(ctx, "iot"), ErrConflict)
+	assert.ErrorIs(t, dhcpService.UpdateTag(ctx, "iot", Tag{Name: "pxe"}), ErrConflict)
+	assert.ErrorIs(t, dhcpService.UpdateTag(ctx, "iot", Tag{Name: "printers"}), ErrConflict)
+	assert.ErrorIs(t, dhcpService.UpdateTag(ctx, "missing", Tag{Name: "other"}), ErrNotFound)
+
+	// Renames cascade through every file
+	assert.NoError(t, dhcpService.UpdateTag(ctx, "iot", Tag{Name: "cameras", Description: "IP cameras"}))
+	expected := map[string]string{
+		"DNSMASQ_CONFIG_FILE":    "dhcp-option=tag:cameras,option:dns-server,10.0.0.53\ndhcp-boot=tag:pxe,pxelinux.0 # netboot\n",
+		"DHCP_RESERVATIONS_FILE": "dhcp-host=00:11:22:33:44:55,set:cameras,192.168.2.20,cam # front door\n",
+		"DHCP_RANGES_FILE":       "dhcp-range=set:cameras,192.168.2.100,192.168.2.200,12h\n",
+		"DHCP_OPTIONS_FILE":      "dhcp-option=tag:cameras,option:router,192.168.2.1\n",
+	}
+	for env, content := range expected {
+		actual, err := os.ReadFile(os.Getenv(env))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(actual), env)
+	}
+
+	tag, err := dhcpService.GetTag(ctx, "cameras")
+	assert.NoError(t, err)
+	assert.True(t, tag.Defined)
+	assert.Equal(t, "IP cameras", tag.Description)
+	_, err = dhcpService.GetTag(ctx, "iot")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, dhcpService.DeleteTag(ctx, "printers"))
+	assert.ErrorIs(t, dhcpService.DeleteTag(ctx, "printers"), ErrNotFound)
+
+	// Tags of DHCPReservation resources are renamed in the resources, and a
+	// rejected rename changes no file
+	reservations := "dhcp-host=00:11:22:33:44:55,set:cameras,192.168.2.20,cam # front door\n" +
+		dhcpReservationsBegin + "\ndhcp-host=00:11:22:33:44:66,set:cameras,192.168.2.21,cam2\n" + dhcpReservationsEnd + "\n"
+	assert.NoError(t, os.WriteFile(os.Getenv("DHCP_RESERVATIONS_FILE"), []byte(reservations), 0644))
+	assert.ErrorIs(t, dhcpService.UpdateTag(ctx, "cameras", Tag{Name: "iot"}), ErrConflict)
+	for env, content := range expected {
+		if env == "DHCP_RESERVATIONS_FILE" {
+			content = reservations
+		}
+		actual, err := os.ReadFile(os.Getenv(env))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(actual), env)
+	}
+}
@@ -2,16 +2,37 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	stderrors "errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
+
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
+// ErrNotFound is wrapped by errors returned when an entry, reservation or
+// other managed item does not exist.
+var ErrNotFound = stderrors.New("not found")
+
+// ErrConflict is wrapped by errors returned when a change clashes with the
+// existing configuration, such as overlapping DHCP ranges.
+var ErrConflict = stderrors.New("conflict")
+
+// ErrInvalid is wrapped by errors returned when a change is rejected, such as
+// an invalid value, a configuration dnsmasq refuses or a PXE boot file missing
+// from the TFTP root.
+var ErrInvalid = stderrors.New("invalid")
+
 // UpdateConfigMapWithRetry updates a ConfigMap with a retry mechanism for handling conflicts.
 // It attempts to update the ConfigMap up to 10 times with a random backoff between 500ms and 5s.
 // On each retry, it re-fetches the ConfigMap to ensure the latest version is used.
@@ -98,3 +119,131 @@ func UpdateConfigMapWithRetry(ctx context.Context, clientset kubernetes.Interfac
 
 	return fmt.Errorf("failed to update ConfigMap %s after %d retries", name, maxRetries)
 }
+
+// ensureFile creates path, and its parent directory, if it does not exist yet.
+func ensureFile(path string) error {
+	unlock := lockFile(path)
+	defer unlock()
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := writeFileAtomic(path, []byte("")); err != nil {
+			return fmt.Errorf("failed to create %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// startFileSync restores path from its ConfigMap, unless restore is nil,
+// then watches it and calls sync on every change so the ConfigMap follows the
+// file. It blocks until ctx is done.
+//
+// The parent directory is watched rather than the file: writeFile replaces
+// the file with a rename, which ends any watch held on the old inode. The
+// rename shows up as a Create event for path, and the temporary file's own
+// events are ignored, so sync only ever sees complete files.
+func startFileSync(ctx context.Context, path, label string, restore, sync func(context.Context) error) {
+	if err := ensureFile(path); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Printf("ERROR: failed to create watcher: %v\n", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		fmt.Printf("ERROR: failed to watch %s file: %v\n", label, err)
+		return
+	}
+
+	fmt.Printf("INFO: Starting %s sync for %s\n", label, path)
+
+	if restore != nil {
+		if err := restore(ctx); err != nil {
+			fmt.Printf("WARN: failed to restore %s from ConfigMap: %v\n", label, err)
+		}
+	}
+
+	target := filepath.Clean(path)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != target {
+				continue
+			}
+			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
+				fmt.Printf("INFO: %s file modified, syncing to ConfigMap\n", label)
+				if err := sync(ctx); err != nil {
+					fmt.Printf("ERROR: failed to sync %s to ConfigMap: %v\n", label, err)
+				}
+			}
+			if event.Op&fsnotify.Rename == fsnotify.Rename || event.Op&fsnotify.Remove == fsnotify.Remove {
+				// Keep the ConfigMap as is, it is synced again when the file is recreated
+				fmt.Printf("INFO: %s file removed, waiting for it to be recreated\n", label)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("ERROR: watcher error: %v\n", err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fileETag returns a strong ETag for the content of path. A missing file has
+// the ETag of empty content. Files are synced both ways with their ConfigMap,
+// so edits made with kubectl change the ETag as soon as they reach the file.
+func fileETag(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// splitComment separates a config line into its directive and trailing
+// comment. Like dnsmasq, '#' only starts a comment at the beginning of the
+// line or after whitespace, and never inside double quotes.
+func splitComment(line string) (string, string) {
+	inQuotes := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '"':
+			inQuotes = !inQuotes
+		case line[i] == '#' && !inQuotes && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+	}
+	return strings.TrimSpace(line), ""
+}
+
+// entryID derives a stable identifier for a managed line from a hash of its
+// canonical directive and its occurrence among identical directives. IDs do
+// not move when unrelated lines are added or removed, and change when the
+// entry itself is edited, so stale clients get a not found error instead of
+// modifying another line.
+func entryID(directive string, occurrence int) string {
+	sum := sha256.Sum256([]byte(directive))
+	id := hex.EncodeToString(sum[:6])
+	if occurrence > 1 {
+		id += fmt.Sprintf("-%d", occurrence)
+	}
+	return id
+}
+
+// idAssigner hands out entryIDs while scanning a file top to bottom.
+type idAssigner map[string]int
+
+func (a idAssigner) next(directive string) string {
+	a[directive]++
+	return entryID(directive, a[directive])
+}
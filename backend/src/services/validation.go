@@ -0,0 +1,428 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Severities of validation issues. Errors block writing a reservation,
+// warnings are reported only.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Codes of validation issues
+const (
+	IssueDuplicateIP       = "duplicate_ip"
+	IssueDuplicateMAC      = "duplicate_mac"
+	IssueDuplicateHostname = "duplicate_hostname"
+	IssueOutsideRange      = "outside_range"
+	IssueLeaseConflict     = "lease_conflict"
+	IssueDNSConflict       = "dns_conflict"
+	IssueUndefinedTag      = "undefined_tag"
+)
+
+// ValidationIssue is a problem found with a reservation.
+type ValidationIssue struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	// Reservation is the ID of the reservation with the issue
+	Reservation string `json:"reservation"`
+	// Field is the JSON name of the offending reservation field
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	// Conflicts identifies what the reservation conflicts with: the IDs of
+	// other reservations or DNS entries, or the client holding a lease
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// ValidationReport lists the issues found with the reservations.
+type ValidationReport struct {
+	Valid    bool              `json:"valid"`
+	Errors   []ValidationIssue `json:"errors"`
+	Warnings []ValidationIssue `json:"warnings"`
+}
+
+// For returns the part of the report about the reservation with the given ID.
+func (r ValidationReport) For(id string) ValidationReport {
+	report := ValidationReport{Errors: []ValidationIssue{}, Warnings: []ValidationIssue{}}
+	for _, issue := range r.Errors {
+		if issue.Reservation == id {
+			report.Errors = append(report.Errors, issue)
+		}
+	}
+	for _, issue := range r.Warnings {
+		if issue.Reservation == id {
+			report.Warnings = append(report.Warnings, issue)
+		}
+	}
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// ValidationError is returned when a reservation is rejected because of
+// validation errors. It wraps ErrConflict.
+type ValidationError struct {
+	Report ValidationReport
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Report.Errors))
+	for i, issue := range e.Report.Errors {
+		messages[i] = issue.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrConflict
+}
+
+// validationEnv is what reservations are checked against.
+type validationEnv struct {
+	ranges []DHCPRange
+	leases []DHCPLease
+	dns    []DNSEntry
+	// tags are the tags defined through the tags API, nil skips the check
+	tags map[string]bool
+	now  time.Time
+}
+
+// ValidateReservations checks all reservations against each other, the DHCP
+// ranges, the active leases, the A and AAAA records of custom.conf and the
+// defined tags.
+func (s *DHCPService) ValidateReservations(ctx context.Context) (ValidationReport, error) {
+	reservations, err := s.GetReservations(ctx)
+	if err != nil {
+		return ValidationReport{}, err
+	}
+	env, err := s.validationEnv(ctx)
+	if err != nil {
+		return ValidationReport{}, err
+	}
+	return checkReservations(reservations, env), nil
+}
+
+// checkReservation validates the reservation with the given ID among
+// reservations, the content about to be written, and returns a
+// ValidationError if it has errors.
+func (s *DHCPService) checkReservation(ctx context.Context, reservations []DHCPReservation, id string) error {
+	env, err := s.validationEnv(ctx)
+	if err != nil {
+		return err
+	}
+	report := checkReservations(reservations, env).For(id)
+	if !report.Valid {
+		return &ValidationError{Report: report}
+	}
+	return nil
+}
+
+func (s *DHCPService) validationEnv(ctx context.Context) (validationEnv, error) {
+	env := validationEnv{now: time.Now()}
+	ranges, err := s.GetRanges(ctx)
+	if err != nil {
+		return env, err
+	}
+	env.ranges = ranges
+	env.leases, err = s.GetLeases(ctx)
+	if err != nil && !os.IsNotExist(err) {
+		return env, err
+	}
+	defs, err := s.loadTagDefinitions(ctx)
+	if err != nil {
+		return env, err
+	}
+	env.tags = map[string]bool{}
+	for _, def := range defs {
+		env.tags[def.Name] = true
+	}
+	if s.configService != nil {
+		// Ranges may also be configured in dnsmasq.conf
+		config, err := s.configService.GetConfig(ctx)
+		if err != nil && !os.IsNotExist(err) {
+			return env, err
+		}
+		for _, line := range strings.Split(config, "\n") {
+			directive, _ := splitComment(line)
+			if r, ok := parseRange(directive); ok {
+				env.ranges = append(env.ranges, r)
+			}
+		}
+		env.dns, err = s.configService.GetDNSEntries(ctx)
+		if err != nil {
+			return env, err
+		}
+	}
+	return env, nil
+}
+
+// checkReservations runs every check on reservations. Duplicate IP and MAC
+// addresses are errors, everything else is a warning.
+func checkReservations(reservations []DHCPReservation, env validationEnv) ValidationReport {
+	var issues []ValidationIssue
+	add := func(severity, code string, res DHCPReservation, field string, conflicts []string, format string, args ...interface{}) {
+		issues = append(issues, ValidationIssue{
+			Severity:    severity,
+			Code:        code,
+			Reservation: res.ID,
+			Field:       field,
+			Message:     fmt.Sprintf(format, args...),
+			Conflicts:   conflicts,
+		})
+	}
+
+	for i, res := range reservations {
+		var sameIP, sameMAC, sameHost []string
+		for j, other := range reservations {
+			if i == j {
+				continue
+			}
+			if shareAddress(res, other) {
+				sameIP = append(sameIP, other.ID)
+			}
+			if shareMAC(res, other) {
+				sameMAC = append(sameMAC, other.ID)
+			}
+			if res.Hostname != "" && strings.EqualFold(res.Hostname, other.Hostname) {
+				sameHost = append(sameHost, other.ID)
+			}
+		}
+		if sameIP != nil {
+			add(SeverityError, IssueDuplicateIP, res, "ip_address", sameIP, "%s is reserved more than once", res.IPAddress)
+		}
+		if sameMAC != nil {
+			add(SeverityError, IssueDuplicateMAC, res, "mac_address", sameMAC, "%s is reserved more than once", strings.Join(withFirst(res.MACAddresses, res.MACAddress), ", "))
+		}
+		if sameHost != nil {
+			add(SeverityWarning, IssueDuplicateHostname, res, "hostname", sameHost, "hostname %s is used by another reservation", res.Hostname)
+		}
+
+		for _, field := range []struct{ name, ip string }{{"ip_address", res.IPAddress}, {"ipv6_address", res.IPv6Address}} {
+			ip := net.ParseIP(strings.Trim(field.ip, "[]"))
+			if ip == nil {
+				continue
+			}
+			if !inRanges(ip, env.ranges) {
+				add(SeverityWarning, IssueOutsideRange, res, field.name, nil, "%s is not in the subnet of any DHCP range, dnsmasq will not hand it out", field.ip)
+			}
+			if holders := leaseHolders(ip, res, env); holders != nil {
+				add(SeverityWarning, IssueLeaseConflict, res, field.name, holders, "%s is leased to another client", field.ip)
+			}
+		}
+
+		if entries := dnsConflicts(res, env.dns); entries != nil {
+			add(SeverityWarning, IssueDNSConflict, res, "hostname", entries, "hostname %s has a DNS record in custom.conf with another address", res.Hostname)
+		}
+
+		if env.tags != nil {
+			for _, field := range []struct {
+				name string
+				tags []string
+			}{{"tags", res.Tags}, {"match_tags", res.MatchTags}} {
+				for _, tag := range field.tags {
+					if !env.tags[strings.TrimPrefix(tag, "!")] {
+						add(SeverityWarning, IssueUndefinedTag, res, field.name, nil, "tag %s is not defined, create it under /api/v1/dhcp/tags", strings.TrimPrefix(tag, "!"))
+					}
+				}
+			}
+		}
+	}
+
+	report := ValidationReport{Errors: []ValidationIssue{}, Warnings: []ValidationIssue{}}
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			report.Errors = append(report.Errors, issue)
+		} else {
+			report.Warnings = append(report.Warnings, issue)
+		}
+	}
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// reservationIPs returns the addresses of a reservation in canonical form.
+func reservationIPs(res DHCPReservation) []string {
+	var ips []string
+	for _, value := range []string{res.IPAddress, res.IPv6Address} {
+		if ip := net.ParseIP(strings.Trim(value, "[]")); ip != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips
+}
+
+// shareAddress reports whether two reservations hand out the same address.
+// Reservations for different tag: conditions apply to different requests.
+func shareAddress(a, b DHCPReservation) bool {
+	if !sameMatchTags(a, b) {
+		return false
+	}
+	for _, ipA := range reservationIPs(a) {
+		for _, ipB := range reservationIPs(b) {
+			if ipA == ipB {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shareMAC reports whether two reservations match the same MAC address.
+func shareMAC(a, b DHCPReservation) bool {
+	if !sameMatchTags(a, b) {
+		return false
+	}
+	for _, macA := range withFirst(a.MACAddresses, a.MACAddress) {
+		for _, macB := range withFirst(b.MACAddresses, b.MACAddress) {
+			if strings.EqualFold(macA, macB) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameMatchTags(a, b DHCPReservation) bool {
+	tagsA := append([]string(nil), a.MatchTags...)
+	tagsB := append([]string(nil), b.MatchTags...)
+	sort.Strings(tagsA)
+	sort.Strings(tagsB)
+	return strings.Join(tagsA, ",") == strings.Join(tagsB, ",")
+}
+
+// inRanges reports whether ip is in the subnet of one of the ranges of its
+// family, which dnsmasq requires to serve a reservation. IPv4 ranges without
+// a netmask are assumed to be /24 and IPv6 ranges without a prefix length
+// /64. When no range of the family is known, or a range is built from an
+// interface, ip is assumed to be covered.
+func inRanges(ip net.IP, ranges []DHCPRange) bool {
+	ipv6 := ip.To4() == nil
+	known := false
+	for _, r := range ranges {
+		start := net.ParseIP(r.Start)
+		if start == nil || (start.To4() == nil) != ipv6 {
+			continue
+		}
+		known = true
+		if r.Interface != "" {
+			return true
+		}
+		var mask net.IPMask
+		if ipv6 {
+			prefix := r.PrefixLength
+			if prefix == 0 {
+				prefix = 64
+			}
+			mask = net.CIDRMask(prefix, 128)
+		} else if m := net.ParseIP(r.Netmask); m != nil && m.To4() != nil {
+			mask = net.IPMask(m.To4())
+		} else {
+			mask = net.CIDRMask(24, 32)
+		}
+		subnet := net.IPNet{IP: start.Mask(mask), Mask: mask}
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return !known
+}
+
+// leaseHolders returns the clients holding an active lease on ip other than
+// the client of res.
+func leaseHolders(ip net.IP, res DHCPReservation, env validationEnv) []string {
+	var holders []string
+	for _, lease := range env.leases {
+		leaseIP := net.ParseIP(lease.IPAddress)
+		if leaseIP == nil || !leaseIP.Equal(ip) {
+			continue
+		}
+		// An expiry time of 0 means the lease never expires
+		if lease.ExpiryTime != 0 && time.Unix(lease.ExpiryTime, 0).Before(env.now) {
+			continue
+		}
+		if lease.IPv6 {
+			if res.ClientID == "" || !strings.EqualFold(res.ClientID, lease.DUID) {
+				holders = append(holders, lease.DUID)
+			}
+			continue
+		}
+		if lease.ClientID != "" && res.ClientID != "" && res.ClientID != "*" && strings.EqualFold(lease.ClientID, res.ClientID) {
+			continue
+		}
+		matched := false
+		for _, mac := range withFirst(res.MACAddresses, res.MACAddress) {
+			if macMatches(mac, lease.MACAddress) {
+				matched = true
+			}
+		}
+		if !matched {
+			holders = append(holders, lease.MACAddress)
+		}
+	}
+	return holders
+}
+
+// macMatches reports whether a MAC address matches a dhcp-host hardware
+// address, which may contain * wildcards and a hardware type prefix.
+func macMatches(pattern, mac string) bool {
+	if i := strings.Index(pattern, "-"); i >= 0 && i <= 2 && strings.Count(pattern, "-") == 1 {
+		pattern = pattern[i+1:]
+	}
+	split := func(s string) []string {
+		return strings.FieldsFunc(strings.ToUpper(s), func(r rune) bool { return r == ':' || r == '-' })
+	}
+	p, m := split(pattern), split(mac)
+	if len(p) != len(m) {
+		return false
+	}
+	for i := range p {
+		if p[i] != "*" && strings.TrimLeft(p[i], "0") != strings.TrimLeft(m[i], "0") {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsConflicts returns the IDs of the A and AAAA records of custom.conf for
+// the reservation's hostname, bare or qualified, that point to another address
+// of the same family.
+func dnsConflicts(res DHCPReservation, entries []DNSEntry) []string {
+	if res.Hostname == "" {
+		return nil
+	}
+	ips := reservationIPs(res)
+	hostname := strings.ToLower(res.Hostname)
+	var conflicts []string
+	for _, entry := range entries {
+		if entry.Type != "address" && entry.Type != "aaaa" {
+			continue
+		}
+		domain := strings.ToLower(entry.Domain)
+		if domain != hostname && !strings.HasPrefix(domain, hostname+".") {
+			continue
+		}
+		ip := net.ParseIP(entry.Value)
+		if ip == nil {
+			continue
+		}
+		// Records of the other address family don't clash
+		sameFamily, same := false, false
+		for _, resIP := range ips {
+			if (net.ParseIP(resIP).To4() == nil) == (ip.To4() == nil) {
+				sameFamily = true
+				same = same || resIP == ip.String()
+			}
+		}
+		if sameFamily && !same {
+			conflicts = append(conflicts, entry.ID)
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckReservations(t *testing.T) {
+	reservations := parseReservations(`dhcp-host=00:11:22:33:44:55,192.168.1.10,nas
+dhcp-host=00:11:22:33:44:66,192.168.1.10,printer
+dhcp-host=00:11:22:33:44:55,tag:pxe,192.168.1.11,nas
+dhcp-host=00:11:22:33:44:77,10.0.0.5,camera
+dhcp-host=00:11:22:33:44:88,192.168.1.20,router
+dhcp-host=00:11:22:33:44:*,192.168.1.30,tv
+dhcp-host=00:11:22:33:55:aa,set:iot,192.168.1.40,doorbell
+`)
+	env := validationEnv{
+		ranges: []DHCPRange{{Start: "192.168.1.100", End: "192.168.1.200"}},
+		leases: []DHCPLease{
+			{MACAddress: "AA:AA:AA:AA:AA:AA", IPAddress: "192.168.1.20", ExpiryTime: time.Now().Add(time.Hour).Unix()},
+			{MACAddress: "BB:BB:BB:BB:BB:BB", IPAddress: "192.168.1.11", ExpiryTime: time.Now().Add(-time.Hour).Unix()},
+			{MACAddress: "00:11:22:33:44:99", IPAddress: "192.168.1.30"},
+		},
+		dns: []DNSEntry{
+			{ID: "dns1", Type: "address", Domain: "router.lan", Value: "192.168.1.1"},
+			{ID: "dns2", Type: "aaaa", Domain: "router", Value: "fd00::1"},
+			{ID: "dns3", Type: "address", Domain: "nas.lan", Value: "192.168.1.10"},
+		},
+		tags: map[string]bool{"pxe": true},
+		now:  time.Now(),
+	}
+
+	report := checkReservations(reservations, env)
+	assert.False(t, report.Valid)
+
+	codes := func(issues []ValidationIssue, id string) []string {
+		var result []string
+		for _, issue := range issues {
+			if issue.Reservation == id {
+				result = append(result, issue.Code)
+			}
+		}
+		return result
+	}
+
+	// The first two share an IP, the first and third a MAC under different
+	// tag: conditions
+	assert.Equal(t, []string{IssueDuplicateIP}, codes(report.Errors, reservations[0].ID))
+	assert.Equal(t, []string{reservations[1].ID}, report.Errors[0].Conflicts)
+	assert.Equal(t, []string{IssueDuplicateIP}, codes(report.Errors, reservations[1].ID))
+	assert.Nil(t, codes(report.Errors, reservations[2].ID))
+	// nas.lan points to the address of the first nas reservation
+	assert.Equal(t, []string{IssueDuplicateHostname, IssueDNSConflict}, codes(report.Warnings, reservations[2].ID))
+
+	assert.Equal(t, []string{IssueOutsideRange}, codes(report.Warnings, reservations[3].ID))
+
+	// Only the A record for another address clashes, and only active leases
+	// of other clients count
+	router := report.For(reservations[4].ID)
+	assert.True(t, router.Valid)
+	assert.Len(t, router.Warnings, 2)
+	assert.Equal(t, IssueLeaseConflict, router.Warnings[0].Code)
+	assert.Equal(t, []string{"AA:AA:AA:AA:AA:AA"}, router.Warnings[0].Conflicts)
+	assert.Equal(t, IssueDNSConflict, router.Warnings[1].Code)
+	assert.Equal(t, []string{"dns1"}, router.Warnings[1].Conflicts)
+
+	// Wildcard MACs match the lease holder
+	assert.Empty(t, report.For(reservations[5].ID).Warnings)
+
+	// Reservations may only use tags defined through the API
+	doorbell := report.For(reservations[6].ID)
+	assert.Len(t, doorbell.Warnings, 1)
+	assert.Equal(t, IssueUndefinedTag, doorbell.Warnings[0].Code)
+	assert.Equal(t, "tags", doorbell.Warnings[0].Field)
+}
+
+func TestInRanges(t *testing.T) {
+	ranges := []DHCPRange{
+		{Start: "192.168.1.100", End: "192.168.1.200"},
+		{Start: "10.0.0.0", Mode: "static", Netmask: "255.255.0.0"},
+	}
+	assert.True(t, inRanges(net.ParseIP("192.168.1.5"), ranges))
+	assert.True(t, inRanges(net.ParseIP("10.0.200.1"), ranges))
+	assert.False(t, inRanges(net.ParseIP("192.168.2.5"), ranges))
+	// Without IPv6 ranges any IPv6 address is accepted
+	assert.True(t, inRanges(net.ParseIP("fd00::5"), ranges))
+	assert.False(t, inRanges(net.ParseIP("fd01::5"), append(ranges, DHCPRange{Start: "fd00::100", End: "fd00::1ff"})))
+}
+
+func TestDHCPService_AddReservation_Validation(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "validation")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	resFile := filepath.Join(tmpDir, "reservations.conf")
+	assert.NoError(t, os.WriteFile(resFile, []byte("dhcp-host=00:11:22:33:44:55,192.168.1.10,nas\n"), 0644))
+	os.Setenv("DHCP_RESERVATIONS_FILE", resFile)
+	defer os.Unsetenv("DHCP_RESERVATIONS_FILE")
+	os.Setenv("DHCP_RANGES_FILE", filepath.Join(tmpDir, "ranges.conf"))
+	defer os.Unsetenv("DHCP_RANGES_FILE")
+	os.Setenv("DHCP_LEASE_FILE", filepath.Join(tmpDir, "dnsmasq.leases"))
+	defer os.Unsetenv("DHCP_LEASE_FILE")
+
+	dhcpService := NewDHCPService(fake.NewSimpleClientset(), "default", nil)
+	ctx := context.Background()
+
+	_, err = dhcpService.AddReservation(ctx, DHCPReservation{MACAddress: "00:11:22:33:44:66", IPAddress: "192.168.1.10", Hostname: "printer"})
+	assert.ErrorIs(t, err, ErrConflict)
+	var validationErr *ValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, IssueDuplicateIP, validationErr.Report.Errors[0].Code)
+
+	id, err := dhcpService.AddReservation(ctx, DHCPReservation{MACAddress: "00:11:22:33:44:66", IPAddress: "192.168.1.11", Hostname: "nas"})
+	assert.NoError(t, err)
+	report, err := dhcpService.ValidateReservations(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, IssueDuplicateHostname, report.For(id).Warnings[0].Code)
+
+	// Updates are checked against the other reservations only
+	_, err = dhcpService.UpdateReservationByID(ctx, id, DHCPReservation{MACAddress: "00:11:22:33:44:55", IPAddress: "192.168.1.11", Hostname: "printer"})
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = dhcpService.UpdateReservationByID(ctx, id, DHCPReservation{MACAddress: "00:11:22:33:44:66", IPAddress: "192.168.1.12", Hostname: "printer"})
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(resFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "dhcp-host=00:11:22:33:44:55,192.168.1.10,nas\n\ndhcp-host=00:11:22:33:44:66,192.168.1.12,printer", string(content))
+}
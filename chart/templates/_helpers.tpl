@@ -65,7 +65,7 @@ Create the name of the service account to use
 Validate values
 */}}
 {{- define "dnsmasq-k8s.validateValues" -}}
-{{- if and (gt (int .Values.replicaCount) 1) .Values.dhcp.enabled }}
-{{- fail "Can't support multiple replicas because of dnsmasq implementation with concurrency issue on a single configmap and no possible diff between 2 versions" }}
+{{- if and (gt (int .Values.replicaCount) 1) .Values.dhcp.enabled (not .Values.cluster.enabled) }}
+{{- fail "Multiple replicas with DHCP enabled require cluster.enabled, so only the elected leader serves DHCP and writes the ConfigMaps" }}
 {{- end }}
 {{- end }}
@@ -61,13 +61,35 @@ const Auth = {
 // Global Fetch Interceptor to inject headers
 (function() {
     const originalFetch = window.fetch;
+
+    // Resources using optimistic concurrency: the ETag from the last GET is
+    // sent back as If-Match on writes, the API answers 412 if it is stale.
+    const ETAG_RESOURCES = ['/api/v1/config', '/api/v1/dns/entries', '/api/v1/dns/forwarders', '/api/v1/dhcp/reservations'];
+    const etags = {};
+
+    function etagResource(url) {
+        const path = new URL(url, window.location.origin).pathname;
+        return ETAG_RESOURCES.find(r => path === r || path.startsWith(r + '/'));
+    }
+
     window.fetch = async function(url, options = {}) {
         options.headers = options.headers || {};
         
         // Inject auth header if available
         Auth.getOrCreateHeaders(options.headers);
+
+        const method = (options.method || 'GET').toUpperCase();
+        const resource = etagResource(url);
+        if (resource && method !== 'GET' && etags[resource] && !options.headers['If-Match']) {
+            options.headers['If-Match'] = etags[resource];
+        }
         
         const response = await originalFetch(url, options);
+
+        const etag = response.headers.get('ETag');
+        if (resource && etag && new URL(url, window.location.origin).pathname === resource) {
+            etags[resource] = etag;
+        }
         
         if (response.status === 401) {
             // If we got a 401, it means creds are invalid or missing
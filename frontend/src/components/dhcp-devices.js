@@ -0,0 +1,150 @@
+// Device inventory: every client seen in the leases, kept after its lease expires
+
+let deviceSearchTimer = null;
+
+async function getDevices(query) {
+    const params = query ? `?q=${encodeURIComponent(query)}` : '';
+    const response = await fetch(`${window.env.API_URL}/api/v1/dhcp/devices${params}`);
+    const data = await response.json();
+    return data.devices;
+}
+
+function formatSeen(timestamp) {
+    return new Date(timestamp).toLocaleString('en-GB', {
+        year: 'numeric',
+        month: '2-digit',
+        day: '2-digit',
+        hour: '2-digit',
+        minute: '2-digit',
+        hour12: false
+    });
+}
+
+async function displayDevices() {
+    const searchInput = document.getElementById('device-search');
+    const [devices, reservations] = await Promise.all([
+        getDevices(searchInput ? searchInput.value.trim() : ''),
+        window.getReservations ? window.getReservations() : Promise.resolve([])
+    ]);
+    const tbody = document.getElementById('devices-table-body');
+    tbody.innerHTML = '';
+
+    const header = document.getElementById('dhcp-devices-header');
+    if (header) {
+        header.innerHTML = `Devices <span class="badge rounded-pill bg-success ms-2">${devices ? devices.length : 0}</span>`;
+    }
+
+    if (!devices || devices.length === 0) {
+        tbody.innerHTML = '<tr><td colspan="7" class="text-center">No devices found</td></tr>';
+        return;
+    }
+
+    devices.forEach((device, index) => {
+        const row = document.createElement('tr');
+        const isReserved = reservations && reservations.some(r => (r.mac_address || '').toUpperCase() === device.mac_address);
+        const promoteClass = isReserved ? 'text-secondary' : 'text-primary';
+        const promoteStyle = isReserved ? 'cursor: not-allowed; opacity: 0.5;' : 'cursor: pointer;';
+        const promoteOnClick = isReserved ? '' : `onclick="promoteDevice('${device.mac_address}')"`;
+
+        row.innerHTML = `
+            <td data-label="MAC Address">${device.mac_address}${macVendor(device)}</td>
+            <td data-label="Name">${device.name || ''}${device.notes ? `<br><small class="text-muted">${device.notes}</small>` : ''}</td>
+            <td data-label="IP Addresses">${device.ip_addresses.join('<br>')}</td>
+            <td data-label="Hostnames">${device.hostnames.join('<br>')}</td>
+            <td data-label="First Seen"><small>${formatSeen(device.first_seen)}</small></td>
+            <td data-label="Last Seen"><small>${formatSeen(device.last_seen)}</small></td>
+            <td data-label="Actions">
+                <i class="bi bi-plus-circle-fill ${promoteClass} me-3" style="${promoteStyle}" ${promoteOnClick} title="${isReserved ? 'Already reserved' : 'Promote to reservation'}"></i>
+                <i class="bi bi-pencil text-success me-3" style="cursor: pointer;" onclick="editDevice(${index}, '${device.mac_address}')"></i>
+                <i class="bi bi-x-lg text-danger" style="cursor: pointer;" onclick="deleteDevice('${device.mac_address}')"></i>
+            </td>
+        `;
+        row.dataset.name = device.name || '';
+        row.dataset.notes = device.notes || '';
+        tbody.appendChild(row);
+    });
+}
+
+window.editDevice = function(index, mac) {
+    const row = document.getElementById('devices-table-body').children[index];
+    const name = document.createElement('input');
+    name.type = 'text';
+    name.className = 'form-control form-control-sm mb-1';
+    name.id = `edit-device-name-${index}`;
+    name.placeholder = 'Name';
+    name.value = row.dataset.name;
+    const notes = document.createElement('input');
+    notes.type = 'text';
+    notes.className = 'form-control form-control-sm';
+    notes.id = `edit-device-notes-${index}`;
+    notes.placeholder = 'Notes';
+    notes.value = row.dataset.notes;
+
+    const nameCell = row.querySelector('td[data-label="Name"]');
+    nameCell.innerHTML = '';
+    nameCell.append(name, notes);
+    row.querySelector('td[data-label="Actions"]').innerHTML = `
+        <i class="bi bi-check-lg text-success me-3" style="cursor: pointer;" onclick="saveDevice(${index}, '${mac}')"></i>
+        <i class="bi bi-x-circle text-secondary" style="cursor: pointer;" onclick="displayDevices()"></i>
+    `;
+}
+
+window.saveDevice = async function(index, mac) {
+    const response = await fetch(`${window.env.API_URL}/api/v1/dhcp/devices/${mac}`, {
+        method: 'PATCH',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({
+            name: document.getElementById(`edit-device-name-${index}`).value,
+            notes: document.getElementById(`edit-device-notes-${index}`).value,
+        }),
+    });
+    if (!response.ok) {
+        const data = await response.json();
+        alert(`Error: ${data.error}`);
+    }
+    displayDevices();
+}
+
+window.deleteDevice = async function(mac) {
+    if (!confirm(`Forget device ${mac}? It is added again when it requests a lease.`)) {
+        return;
+    }
+    const response = await fetch(`${window.env.API_URL}/api/v1/dhcp/devices/${mac}`, {
+        method: 'DELETE',
+    });
+    if (!response.ok) {
+        const data = await response.json();
+        alert(`Error: ${data.error}`);
+    }
+    displayDevices();
+}
+
+window.promoteDevice = async function(mac) {
+    const response = await fetch(`${window.env.API_URL}/api/v1/dhcp/devices/${mac}/reservation`, {
+        method: 'POST',
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        alert(`Error: ${data.error}`);
+        return;
+    }
+    if (data.warnings && data.warnings.length > 0) {
+        alert(`Warning: ${data.warnings.map(w => w.message).join('\n')}`);
+    }
+    displayDevices();
+    if (window.displayReservations) {
+        window.displayReservations();
+    }
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+    const searchInput = document.getElementById('device-search');
+    if (searchInput) {
+        searchInput.addEventListener('input', () => {
+            clearTimeout(deviceSearchTimer);
+            deviceSearchTimer = setTimeout(displayDevices, 300);
+        });
+    }
+});
+
+displayDevices();
@@ -101,7 +101,7 @@ async function displayLeases() {
         const addBtnOnClick = isReserved ? '' : `onclick="openAddReservationModal('${lease.mac_address}', '${lease.ip_address}', '${lease.hostname}')"`;
 
         row.innerHTML = `
-            <td data-label="MAC Address">${lease.mac_address}</td>
+            <td data-label="MAC Address">${lease.mac_address || lease.duid || ''}${macVendor(lease)}</td>
             <td data-label="IP Address">${lease.ip_address}</td>
             <td data-label="Hostname">${lease.hostname}</td>
             <td data-label="Expires"><small>${expiryStr}</small></td>
@@ -171,7 +171,7 @@ window.saveLease = async function(index, oldMac, oldIp, oldHostname) {
         return;
     }
 
-    await fetch(window.env.API_URL + '/api/v1/dhcp/leases', {
+    const response = await fetch(window.env.API_URL + '/api/v1/dhcp/leases', {
         method: 'PUT',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({
@@ -181,21 +181,33 @@ window.saveLease = async function(index, oldMac, oldIp, oldHostname) {
     });
 
     currentlyEditingLease = null;
-    displayLeases();
-    showRestartBanner();
+    await reportLeaseChange(response);
 }
 
 window.deleteLease = async function(mac, ip, hostname) {
     if (!confirm(`Are you sure you want to delete lease for ${mac} (${ip})?`)) return;
 
-    await fetch(`${window.env.API_URL}/api/v1/dhcp/leases`, {
+    const response = await fetch(`${window.env.API_URL}/api/v1/dhcp/leases`, {
         method: 'DELETE',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({ mac_address: mac, ip_address: ip, hostname: hostname }),
     });
+    await reportLeaseChange(response);
+}
 
+// dnsmasq is restarted by the API for lease changes, so no restart banner is
+// needed unless the lease file was edited in place.
+async function reportLeaseChange(response) {
+    const data = await response.json();
+    if (!response.ok) {
+        alert(`Error: ${data.error}`);
+    } else if (data.method !== 'file' && !data.verified) {
+        alert('The change did not take effect yet, dnsmasq may have restored the lease.');
+    }
     displayLeases();
-    showRestartBanner();
+    if (data.method === 'file') {
+        showRestartBanner();
+    }
 }
 
 window.openAddReservationModal = function(mac, ip, hostname) {
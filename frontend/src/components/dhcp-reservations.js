@@ -72,10 +72,21 @@ window.addReservation = async function(macAddress, ipAddress, hostname, tag, com
             comment: comment,
         }),
     });
+    const data = await response.json();
     if (!response.ok) {
-        const data = await response.json();
         alert(`Error: ${data.error}`);
+    } else if (data.warnings && data.warnings.length > 0) {
+        alert(`Warning: ${data.warnings.map(w => w.message).join('\n')}`);
+    }
+}
+
+// Vendor of a lease, reservation or device, and a badge for private
+// (randomized) MAC addresses
+window.macVendor = function(item) {
+    if (item.randomized_mac) {
+        return '<br><span class="badge bg-warning text-dark" title="Locally administered address, the device may change it">Private MAC</span>';
     }
+    return item.vendor ? `<br><small class="text-muted">${item.vendor}</small>` : '';
 }
 
 window.getReservations = async function() {
@@ -85,9 +96,9 @@ window.getReservations = async function() {
 }
 
 window.getTags = async function() {
-    const response = await fetch(`${window.env.API_URL}/api/v1/config/tags`);
+    const response = await fetch(`${window.env.API_URL}/api/v1/dhcp/tags`);
     const data = await response.json();
-    return data.tags || [];
+    return (data.tags || []).map(tag => tag.name);
 }
 
 async function populateTagSelectors() {
@@ -134,8 +145,8 @@ async function displayReservations() {
             : `<span class="badge bg-secondary">None</span>`;
             
         row.innerHTML = `
-            <td data-label="MAC Address">${res.mac_address}</td>
-            <td data-label="IP Address">${res.ip_address}</td>
+            <td data-label="MAC Address">${res.mac_address || (res.client_id ? `id:${res.client_id}` : '')}${macVendor(res)}</td>
+            <td data-label="IP Address">${res.ip_address}${res.ipv6_address ? `<br>${res.ipv6_address}` : ''}</td>
             <td data-label="Hostname">${res.hostname}</td>
             <td data-label="Tag">${tagBadge}</td>
             <td data-label="Comment">${res.comment || ''}</td>
@@ -210,7 +221,7 @@ window.saveReservation = async function(index, oldMac, oldIp, oldHostname, oldTa
         return;
     }
 
-    await fetch(`${window.env.API_URL}/api/v1/dhcp/reservations`, {
+    const response = await fetch(`${window.env.API_URL}/api/v1/dhcp/reservations`, {
         method: 'PUT',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({
@@ -218,6 +229,11 @@ window.saveReservation = async function(index, oldMac, oldIp, oldHostname, oldTa
             new: { mac_address: newMac, ip_address: newIp, hostname: newHostname, tag: newTag, comment: newComment }
         }),
     });
+    if (!response.ok) {
+        const data = await response.json();
+        alert(`Error: ${data.error}`);
+        return;
+    }
 
     displayReservations();
     showRestartBanner();
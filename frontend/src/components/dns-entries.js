@@ -50,6 +50,11 @@ const VALIDATION_PATTERNS = {
         placeholder: 'IP Address',
         title: 'Please enter a valid IPv4 address'
     },
+    aaaa: {
+        pattern: /^[0-9a-fA-F:.]*:[0-9a-fA-F:.]*$/,
+        placeholder: 'IPv6 Address',
+        title: 'Please enter a valid IPv6 address'
+    },
     cname: {
         pattern: /^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$/,
         placeholder: 'Target Domain',
@@ -59,6 +64,21 @@ const VALIDATION_PATTERNS = {
         pattern: null,
         placeholder: 'Text Value',
         title: 'Enter any text value'
+    },
+    srv: {
+        pattern: /^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$/,
+        placeholder: 'Target Host',
+        title: 'Please enter a valid target host name'
+    },
+    mx: {
+        pattern: /^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$/,
+        placeholder: 'Mail Server',
+        title: 'Please enter a valid mail server name'
+    },
+    ptr: {
+        pattern: /^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$/,
+        placeholder: 'Target Hostname',
+        title: 'Please enter a valid host name (domain may be an IP address)'
     }
 };
 
@@ -77,6 +97,17 @@ function updateFormValidation(type) {
         }
         valueInput.placeholder = validation.placeholder;
     }
+
+    // Priority/weight/port only apply to SRV and MX entries
+    document.getElementById('dns-record-fields').classList.toggle('d-none', !(type === 'srv' || type === 'mx'));
+    document.querySelectorAll('.dns-srv-only').forEach(el => el.classList.toggle('d-none', type !== 'srv'));
+
+    // Paired PTR records only apply to A and AAAA entries
+    const ptrInput = document.getElementById('dns-ptr');
+    ptrInput.disabled = !(type === 'address' || type === 'aaaa');
+    if (ptrInput.disabled) {
+        ptrInput.checked = false;
+    }
 }
 
 // Type select change listener
@@ -93,6 +124,12 @@ document.getElementById('add-dns-form').addEventListener('submit', async (event)
     const domain = document.getElementById('dns-domain').value.trim();
     const value = document.getElementById('dns-value').value.trim();
     const comment = document.getElementById('dns-comment').value.trim();
+    const ptr = document.getElementById('dns-ptr').checked;
+    const record = {
+        priority: parseInt(document.getElementById('dns-priority').value, 10) || 0,
+        weight: parseInt(document.getElementById('dns-weight').value, 10) || 0,
+        port: parseInt(document.getElementById('dns-port').value, 10) || 0,
+    };
 
     // Client-side validation
     const validation = VALIDATION_PATTERNS[dnsType];
@@ -102,7 +139,7 @@ document.getElementById('add-dns-form').addEventListener('submit', async (event)
     }
 
     try {
-        await addDNSEntry(dnsType, domain, value, comment);
+        await addDNSEntry(dnsType, domain, value, comment, ptr, record);
         document.getElementById('add-dns-form').reset();
         // Reset to default validation (A record)
         updateFormValidation('address');
@@ -114,7 +151,7 @@ document.getElementById('add-dns-form').addEventListener('submit', async (event)
     }
 });
 
-async function addDNSEntry(dnsType, domain, value, comment) {
+async function addDNSEntry(dnsType, domain, value, comment, ptr, record) {
     const response = await fetch(`${window.env.API_URL}/api/v1/dns/entries`, {
         method: 'POST',
         headers: {
@@ -125,6 +162,10 @@ async function addDNSEntry(dnsType, domain, value, comment) {
             domain: domain,
             value: value,
             comment: comment,
+            ptr: ptr,
+            priority: record.priority,
+            weight: record.weight,
+            port: record.port,
         }),
     });
 
@@ -158,6 +199,7 @@ async function displayDNSEntries() {
 
     // Sort entries
     const sortedEntries = sortData(entries, dnsSortState.column, dnsSortState.direction);
+    displayedDNSEntries = sortedEntries;
 
     sortedEntries.forEach((entry, index) => {
         const row = document.createElement('tr');
@@ -168,13 +210,13 @@ async function displayDNSEntries() {
         const escapedValue = entry.value.replace(/'/g, '&#39;');
         
         row.innerHTML = `
-            <td data-label="Type">${displayType}</td>
+            <td data-label="Type">${displayType}${entry.ptr ? ' <span class="badge bg-secondary">PTR</span>' : ''}</td>
             <td data-label="Domain">${entry.domain}</td>
-            <td data-label="Value">${entry.value}</td>
+            <td data-label="Value">${entry.value}${formatRecordDetails(entry)}</td>
             <td data-label="Comment">${entry.comment || ''}</td>
             <td data-label="Actions">
-                <i class="bi bi-pencil text-success me-3" style="cursor: pointer;" onclick="editEntry(${index}, '${entry.type}', '${escapedDomain}', '${escapedValue}', '${entry.comment || ''}')"></i>
-                <i class="bi bi-x-lg text-danger" style="cursor: pointer;" onclick="deleteEntry('${entry.type}', '${escapedDomain}', '${escapedValue}')"></i>
+                <i class="bi bi-pencil text-success me-3" style="cursor: pointer;" onclick="editEntry(${index}, '${entry.type}', '${escapedDomain}', '${escapedValue}', '${entry.comment || ''}', ${entry.ptr ? 'true' : 'false'})"></i>
+                <i class="bi bi-x-lg text-danger" style="cursor: pointer;" onclick="deleteEntry('${entry.type}', '${escapedDomain}', '${escapedValue}', ${index})"></i>
             </td>
         `;
         tbody.appendChild(row);
@@ -184,14 +226,31 @@ async function displayDNSEntries() {
     updateSortIcons(dnsSortState.column, dnsSortState.direction);
 }
 
+// Entries as currently shown in the table, used to keep SRV/MX fields on edit
+let displayedDNSEntries = [];
+
+function formatRecordDetails(entry) {
+    if (entry.type === 'srv') {
+        return ` <small class="text-muted">port ${entry.port || 0}, priority ${entry.priority || 0}, weight ${entry.weight || 0}</small>`;
+    }
+    if (entry.type === 'mx') {
+        return ` <small class="text-muted">preference ${entry.priority || 0}</small>`;
+    }
+    return '';
+}
+
 function formatDnsType(type) {
     if (type === 'address') return 'A';
+    if (type === 'aaaa') return 'AAAA';
     if (type === 'cname') return 'CNAME';
     if (type === 'txt') return 'TXT';
+    if (type === 'ptr') return 'PTR';
+    if (type === 'srv') return 'SRV';
+    if (type === 'mx') return 'MX';
     return type.toUpperCase();
 }
 
-window.editEntry = function(index, type, domain, value, comment) {
+window.editEntry = function(index, type, domain, value, comment, ptr) {
     const tbody = document.getElementById('dns-entries-table-body');
     const row = tbody.children[index];
     const displayType = formatDnsType(type);
@@ -208,7 +267,7 @@ window.editEntry = function(index, type, domain, value, comment) {
         <td data-label="Value"><input type="text" class="form-control form-control-sm" id="edit-value-${index}" value="${unescapedValue}"></td>
         <td data-label="Comment"><input type="text" class="form-control form-control-sm" id="edit-comment-${index}" value="${comment}"></td>
         <td data-label="Actions">
-            <i class="bi bi-check-lg text-success me-3" style="cursor: pointer;" onclick="saveEntry(${index}, '${type}', '${domain}', '${value}', '${comment}')"></i>
+            <i class="bi bi-check-lg text-success me-3" style="cursor: pointer;" onclick="saveEntry(${index}, '${type}', '${domain}', '${value}', '${comment}', ${ptr})"></i>
             <i class="bi bi-x-circle text-secondary" style="cursor: pointer;" onclick="cancelEdit()"></i>
         </td>
     `;
@@ -218,7 +277,7 @@ window.cancelEdit = function() {
     displayDNSEntries();
 }
 
-window.saveEntry = async function(index, oldType, oldDomain, oldValue, oldComment) {
+window.saveEntry = async function(index, oldType, oldDomain, oldValue, oldComment, ptr) {
     const newType = oldType; // Type cannot be changed
     const newDomain = document.getElementById(`edit-domain-${index}`).value.trim();
     const newValue = document.getElementById(`edit-value-${index}`).value.trim();
@@ -231,21 +290,22 @@ window.saveEntry = async function(index, oldType, oldDomain, oldValue, oldCommen
         return;
     }
 
-    // Unescape HTML entities from old values
-    const unescapedOldDomain = oldDomain.replace(/&#39;/g, "'");
-    const unescapedOldValue = oldValue.replace(/&#39;/g, "'");
+    // SRV/MX fields are not editable inline, carry them over unchanged
+    const current = displayedDNSEntries[index] || {};
+    const record = { priority: current.priority || 0, weight: current.weight || 0, port: current.port || 0 };
 
     try {
-        await fetch(`${window.env.API_URL}/api/v1/dns/entries`, {
+        const response = await fetch(`${window.env.API_URL}/api/v1/dns/entries/${encodeURIComponent(current.id)}`, {
             method: 'PUT',
             headers: {
                 'Content-Type': 'application/json',
             },
-            body: JSON.stringify({
-                old: { type: oldType, domain: unescapedOldDomain, value: unescapedOldValue, comment: oldComment },
-                new: { type: newType, domain: newDomain, value: newValue, comment: newComment }
-            }),
+            body: JSON.stringify({ type: newType, domain: newDomain, value: newValue, comment: newComment, ptr: ptr, ...record }),
         });
+        if (!response.ok) {
+            const error = await response.json();
+            alert('Error updating DNS entry: ' + error.error);
+        }
 
         displayDNSEntries();
         showRestartBanner();
@@ -254,25 +314,19 @@ window.saveEntry = async function(index, oldType, oldDomain, oldValue, oldCommen
     }
 }
 
-window.deleteEntry = async function(type, domain, value) {
+window.deleteEntry = async function(type, domain, value, index) {
     // Unescape HTML entities
     const unescapedDomain = domain.replace(/&#39;/g, "'");
     const unescapedValue = value.replace(/&#39;/g, "'");
     
+    const current = displayedDNSEntries[index] || {};
+
     if (!confirm(`Are you sure you want to delete this entry?\n${formatDnsType(type)} ${unescapedDomain} ${unescapedValue}`)) {
         return;
     }
 
-    await fetch(`${window.env.API_URL}/api/v1/dns/entries`, {
+    await fetch(`${window.env.API_URL}/api/v1/dns/entries/${encodeURIComponent(current.id)}`, {
         method: 'DELETE',
-        headers: {
-            'Content-Type': 'application/json',
-        },
-        body: JSON.stringify({
-            type: type,
-            domain: unescapedDomain,
-            value: unescapedValue,
-        }),
     });
 
     displayDNSEntries();